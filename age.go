@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// age decryption, with the private key in AUTOPG_AGE_KEY (or AUTOPG_AGE_KEY_FILE), for encrypted config
+// files and age: label values. It runs the age CLI, which the image ships.
+
+func isAgeCiphertext(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("age-encryption.org/")) || bytes.HasPrefix(b, []byte("-----BEGIN AGE ENCRYPTED FILE-----"))
+}
+
+// ageDecrypt decrypts an age file, binary or armored.
+func ageDecrypt(ciphertext []byte) ([]byte, error) {
+	key := os.Getenv("AUTOPG_AGE_KEY")
+	if key == "" {
+		return nil, errors.New("age decryption needs AUTOPG_AGE_KEY or AUTOPG_AGE_KEY_FILE")
+	}
+	identity, err := os.CreateTemp("", "autopg-age-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(identity.Name())
+	_, err = identity.WriteString(key + "\n")
+	if cerr := identity.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("age", "--decrypt", "-i", identity.Name())
+	cmd.Stdin = bytes.NewReader(ciphertext)
+	return runDecrypt(cmd)
+}
+
+var (
+	ageValuesMu sync.Mutex
+	ageValues   = map[[sha256.Size]byte]string{}
+)
+
+// decryptAgeValue decrypts a label value "age:<ciphertext>", the ciphertext being base64 of an age file
+// (e.g. `age -r <recipient> | base64 -w0`) or an armored one. Values are cached by ciphertext so
+// periodic resyncs don't run age again.
+func decryptAgeValue(v string) (string, error) {
+	enc := strings.TrimSpace(strings.TrimPrefix(v, "age:"))
+	sum := sha256.Sum256([]byte(enc))
+	ageValuesMu.Lock()
+	defer ageValuesMu.Unlock()
+	if plain, ok := ageValues[sum]; ok {
+		return plain, nil
+	}
+	ciphertext := []byte(enc)
+	if !isAgeCiphertext(ciphertext) {
+		var err error
+		if ciphertext, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(enc), "")); err != nil {
+			return "", fmt.Errorf("age value is neither armored nor base64: %w", err)
+		}
+	}
+	plain, err := ageDecrypt(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimRight(string(plain), "\r\n")
+	ageValues[sum] = s
+	return s, nil
+}
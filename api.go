@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Control API: with AUTOPG_API_LISTEN (e.g. ":8443") set, autopg serves its status and the pause,
+// resume and retrigger commands over HTTPS. Mutual TLS is mandatory: AUTOPG_API_TLS_CERT and
+// AUTOPG_API_TLS_KEY are the server's certificate and key, and only clients presenting a certificate
+// issued by AUTOPG_API_CLIENT_CA are served, optionally further limited to the common or DNS names in
+// AUTOPG_API_ALLOWED_CLIENTS. There is no plaintext mode.
+
+// apiStatus is the "api-status" document of GET /v1/status.
+type apiStatus struct {
+	SchemaVersion int    `json:"schema_version"`
+	Time          string `json:"time"`
+	Paused        bool   `json:"paused"`
+}
+
+// apiRetrigger is the "api-retrigger" document answered by POST /v1/retrigger.
+type apiRetrigger struct {
+	SchemaVersion int      `json:"schema_version"`
+	Containers    []string `json:"containers"`
+	RequestIDs    []string `json:"request_ids"`
+}
+
+// apiTLSConfig builds the server TLS configuration, refusing to run without client verification. listen
+// names the variable that enabled the server, for errors.
+func apiTLSConfig(listen string) (*tls.Config, error) {
+	certFile, keyFile, caFile := os.Getenv("AUTOPG_API_TLS_CERT"), os.Getenv("AUTOPG_API_TLS_KEY"), os.Getenv("AUTOPG_API_CLIENT_CA")
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New(listen + " needs AUTOPG_API_TLS_CERT, AUTOPG_API_TLS_KEY and AUTOPG_API_CLIENT_CA")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("API certificate: %w", err)
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("API client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("API client CA %s has no certificates", caFile)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}, nil
+}
+
+// apiClientAllowed reports whether the verified client certificate of r is in AUTOPG_API_ALLOWED_CLIENTS,
+// when set.
+func apiClientAllowed(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	names := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	allowed := splitList(os.Getenv("AUTOPG_API_ALLOWED_CLIENTS"))
+	if len(allowed) == 0 {
+		return names[0], true
+	}
+	for _, n := range names {
+		if n != "" && contains(allowed, n) {
+			return n, true
+		}
+	}
+	return names[0], false
+}
+
+// startAPI serves the control API in the background when AUTOPG_API_LISTEN is set.
+func startAPI(hosts []dockerHost, ctx context.Context) error {
+	addr := os.Getenv("AUTOPG_API_LISTEN")
+	if addr == "" {
+		return nil
+	}
+	config, err := apiTLSConfig("AUTOPG_API_LISTEN")
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiStatus{SchemaVersion: schemaVersion, Time: time.Now().UTC().Format(time.RFC3339), Paused: provisioningPaused()})
+	})
+	for path, paused := range map[string]bool{"/v1/pause": true, "/v1/resume": false} {
+		paused := paused
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := setPaused(paused); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, apiStatus{SchemaVersion: schemaVersion, Time: time.Now().UTC().Format(time.RFC3339), Paused: paused})
+		})
+	}
+	mux.HandleFunc("/v1/retrigger", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		names := r.URL.Query()["container"]
+		if len(names) == 0 {
+			http.Error(w, "container parameter required", http.StatusBadRequest)
+			return
+		}
+		resp := apiRetrigger{SchemaVersion: schemaVersion, Containers: []string{}, RequestIDs: []string{}}
+		for _, h := range hosts {
+			containers, err := listClients(h.context(r.Context()), h.cli)
+			if err != nil {
+				http.Error(w, "container list: "+err.Error(), http.StatusBadGateway)
+				return
+			}
+			for _, c := range containers {
+				if !matchesContainer(names, c) {
+					continue
+				}
+				id := newRequestID()
+				resp.Containers = append(resp.Containers, displayName(c))
+				resp.RequestIDs = append(resp.RequestIDs, id)
+				go processContainer(h.cli, withForce(withRequestID(h.context(ctx), id)), c, nil)
+			}
+		}
+		if len(resp.Containers) == 0 {
+			http.Error(w, fmt.Sprintf("no container matches %v", names), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, resp)
+	})
+	srv := &http.Server{
+		Addr:              addr,
+		TLSConfig:         config,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, ok := apiClientAllowed(r)
+			if !ok {
+				log.Printf("API: client %q refused: %s %s", name, r.Method, r.URL.Path)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			log.Printf("API: %s %s by %s", r.Method, r.URL.RequestURI(), name)
+			mux.ServeHTTP(w, r)
+		}),
+	}
+	go func() {
+		log.Printf("control API listening on %s (mutual TLS)", addr)
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			log.Fatalf("control API: %v", err)
+		}
+	}()
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// In-database audit trail. With AUTOPG_<TARGET>_AUDIT_DB set, every provisioning run on the target is
+// recorded in autopg.audit_log of that database (created if missing): who ran it, for which container,
+// the outcome, and every statement executed, with passwords redacted.
+
+// auditDB returns the metadata database audit records of target go to, or "" when auditing is off.
+func auditDB(target string) string {
+	return targetSetting(target, "AUDIT_DB")
+}
+
+// auditRecorder collects the statements executed on connections opened with its context.
+type auditRecorder struct {
+	mu         sync.Mutex
+	statements []string
+}
+
+func (r *auditRecorder) add(q string) {
+	r.mu.Lock()
+	r.statements = append(r.statements, redact(q))
+	r.mu.Unlock()
+}
+
+type auditKey struct{}
+
+// withAudit returns a context whose connections record their statements in the returned recorder.
+func withAudit(ctx context.Context) (context.Context, *auditRecorder) {
+	rec := &auditRecorder{}
+	return context.WithValue(ctx, auditKey{}, rec), rec
+}
+
+func auditFrom(ctx context.Context) *auditRecorder {
+	rec, _ := ctx.Value(auditKey{}).(*auditRecorder)
+	return rec
+}
+
+// auditConnector wraps the pq connector so that statements run through Exec are recorded; queries
+// are not.
+type auditConnector struct {
+	*pq.Connector
+	rec *auditRecorder
+}
+
+func (c auditConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &auditConn{Conn: conn, rec: c.rec}, nil
+}
+
+// auditConn passes everything on to the pq connection, which implements all the optional interfaces.
+type auditConn struct {
+	driver.Conn
+	rec *auditRecorder
+}
+
+func (c *auditConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.rec.add(query)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *auditConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *auditConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *auditConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *auditConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *auditConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *auditConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+var (
+	auditReadyMu sync.Mutex
+	auditReady   = map[string]bool{}
+)
+
+// ensureAuditTable creates the audit database and table of target once per process.
+func ensureAuditTable(ctx context.Context, target, host, port, admin, adminPass, dbname string) error {
+	auditReadyMu.Lock()
+	defer auditReadyMu.Unlock()
+	if auditReady[target] {
+		return nil
+	}
+	db, err := openAdmin(ctx, host, port, admin, adminPass, "")
+	if err != nil {
+		return err
+	}
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_catalog.pg_database WHERE datname = $1);", dbname).Scan(&exists)
+	if err == nil && !exists {
+		_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s;", pqQuoteIdent(dbname)))
+	}
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("create audit database failed: %w", err)
+	}
+	adb, err := openAdmin(ctx, host, port, admin, adminPass, dbname)
+	if err != nil {
+		return err
+	}
+	defer adb.Close()
+	_, err = adb.Exec(`CREATE SCHEMA IF NOT EXISTS autopg;
+CREATE TABLE IF NOT EXISTS autopg.audit_log (
+	id bigserial PRIMARY KEY,
+	at timestamptz NOT NULL DEFAULT now(),
+	actor text NOT NULL DEFAULT session_user,
+	autopg_host text,
+	request_id text,
+	container text,
+	container_name text,
+	db text,
+	role text,
+	status text NOT NULL,
+	error text,
+	features text[],
+	statements text[]
+);`)
+	if err != nil {
+		return fmt.Errorf("create audit table failed: %w", err)
+	}
+	auditReady[target] = true
+	return nil
+}
+
+// writeAudit records the provisioning run described by h, with the statements it executed, on target.
+func writeAudit(ctx context.Context, target, host, port, admin, adminPass string, h historyRecord, statements []string) error {
+	dbname := auditDB(target)
+	if dbname == "" {
+		return errors.New("no audit database configured")
+	}
+	ctx = withTarget(ctx, target)
+	if err := ensureAuditTable(ctx, target, host, port, admin, adminPass, dbname); err != nil {
+		return err
+	}
+	db, err := openAdmin(ctx, host, port, admin, adminPass, dbname)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	hostname, _ := os.Hostname()
+	_, err = db.Exec(`INSERT INTO autopg.audit_log (at, autopg_host, request_id, container, container_name, db, role, status, error, features, statements)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11);`,
+		h.Time, hostname, h.RequestID, h.Container, h.ContainerName, h.DB, h.User, h.Status, redact(h.Error),
+		pq.Array(h.Features), pq.Array(statements))
+	if err != nil {
+		return fmt.Errorf("write audit record failed: %w", err)
+	}
+	return nil
+}
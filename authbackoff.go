@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backoff on rejected admin logins: once the target rejects the admin's credentials (and re-reading
+// them didn't help), autopg stops logging in to that target for 30 seconds, doubling with every further
+// rejection up to AUTOPG_<TARGET>_AUTH_BACKOFF_MAX (default 1h), so fail2ban or an account lockout
+// policy on the server isn't tripped by repeated attempts. After AUTOPG_<TARGET>_AUTH_ALERT_AFTER
+// consecutive rejections (default 3) an alert is logged and AUTOPG_<TARGET>_ALERT_COMMAND, if set, is
+// run with the message on stdin.
+
+const authBackoffBase = 30 * time.Second
+
+type authState struct {
+	failures int
+	until    time.Time
+	alerted  bool
+}
+
+var (
+	authStatesMu sync.Mutex
+	authStates   = map[string]*authState{}
+)
+
+// authSuspended returns an error while admin logins to target are suspended after rejections.
+func authSuspended(target string) error {
+	authStatesMu.Lock()
+	defer authStatesMu.Unlock()
+	s := authStates[target]
+	if s == nil || !time.Now().Before(s.until) {
+		return nil
+	}
+	return fmt.Errorf("admin login to target %s suspended until %s after %d rejected attempts",
+		target, s.until.Format(time.RFC3339), s.failures)
+}
+
+// recordAuthFailure notes a rejected admin login to target and suspends further ones.
+func recordAuthFailure(ctx context.Context, target string, err error) {
+	authStatesMu.Lock()
+	s := authStates[target]
+	if s == nil {
+		s = &authState{}
+		authStates[target] = s
+	}
+	s.failures++
+	backoff := authBackoffBase << min(s.failures-1, 16)
+	if limit := authBackoffMax(target); backoff > limit {
+		backoff = limit
+	}
+	s.until = time.Now().Add(backoff)
+	failures := s.failures
+	alert := !s.alerted && failures >= authAlertAfter(target)
+	if alert {
+		s.alerted = true
+	}
+	authStatesMu.Unlock()
+	logf(ctx, "admin login to target %s rejected (%d in a row), next attempt in %s: %v", target, failures, backoff, err)
+	if alert {
+		sendAlert(ctx, target, fmt.Sprintf("admin login to target %s rejected %d times in a row: %v", target, failures, err))
+	}
+}
+
+// recordAuthSuccess clears the rejections of target.
+func recordAuthSuccess(ctx context.Context, target string) {
+	authStatesMu.Lock()
+	s := authStates[target]
+	delete(authStates, target)
+	authStatesMu.Unlock()
+	if s != nil && s.alerted {
+		sendAlert(ctx, target, fmt.Sprintf("admin login to target %s succeeded again after %d rejections", target, s.failures))
+	}
+}
+
+func authBackoffMax(target string) time.Duration {
+	if v := targetSetting(target, "AUTH_BACKOFF_MAX"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		logf(context.Background(), "warning: invalid %s %q, using 1h", toEnvKey(target, "AUTH_BACKOFF_MAX"), v)
+	}
+	return time.Hour
+}
+
+func authAlertAfter(target string) int {
+	if v := targetSetting(target, "AUTH_ALERT_AFTER"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+		logf(context.Background(), "warning: invalid %s %q, using 3", toEnvKey(target, "AUTH_ALERT_AFTER"), v)
+	}
+	return 3
+}
+
+// sendAlert logs msg as an alert and hands it to the alert command of target. The command gets the
+// target in AUTOPG_ALERT_TARGET.
+func sendAlert(ctx context.Context, target, msg string) {
+	logf(ctx, "ALERT: %s", msg)
+	command := targetSetting(target, "ALERT_COMMAND")
+	if command == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = strings.NewReader(redact(msg) + "\n")
+	cmd.Env = append(os.Environ(), "AUTOPG_ALERT_TARGET="+target)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logf(ctx, "warning: alert command for target %s failed: %v: %s", target, err, strings.TrimSpace(string(out)))
+	}
+}
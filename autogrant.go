@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// autoGrant gives Role access to every table, view and sequence created later in the provisioned
+// database, whoever creates it. Unlike default privileges, which only cover objects created by the role
+// they were set for, an event trigger catches migrations run under any role.
+type autoGrant struct {
+	Role       string
+	Privileges string // SQL privilege list for tables, e.g. "SELECT"
+}
+
+var autoGrantLevels = map[string]string{
+	"read":  "SELECT",
+	"write": "SELECT, INSERT, UPDATE, DELETE",
+	"all":   "ALL",
+}
+
+// parseAutoGrants parses "role[:read|write|all],..."; the level defaults to read.
+func parseAutoGrants(v string) ([]autoGrant, error) {
+	var grants []autoGrant
+	for _, item := range splitList(v) {
+		role, level, _ := strings.Cut(item, ":")
+		if level == "" {
+			level = "read"
+		}
+		privs, ok := autoGrantLevels[level]
+		if role == "" || !ok {
+			return nil, fmt.Errorf("invalid auto_grant %q; expected role[:read|write|all]", item)
+		}
+		grants = append(grants, autoGrant{Role: role, Privileges: privs})
+	}
+	return grants, nil
+}
+
+const autoGrantFunction = `CREATE OR REPLACE FUNCTION autopg.auto_grant() RETURNS event_trigger
+LANGUAGE plpgsql SECURITY DEFINER SET search_path = pg_catalog AS $$
+DECLARE
+	obj record;
+	g record;
+BEGIN
+	FOR obj IN SELECT * FROM pg_event_trigger_ddl_commands() WHERE NOT in_extension LOOP
+		FOR g IN SELECT role, privileges FROM autopg.auto_grants LOOP
+			IF obj.object_type = 'schema' THEN
+				EXECUTE format('GRANT USAGE ON SCHEMA %s TO %I', obj.object_identity, g.role);
+			ELSIF obj.object_type = 'sequence' THEN
+				EXECUTE format('GRANT %s ON SEQUENCE %s TO %I',
+					CASE WHEN g.privileges = 'SELECT' THEN 'SELECT' ELSE 'USAGE, SELECT' END, obj.object_identity, g.role);
+			ELSIF obj.object_type IN ('table', 'view', 'materialized view', 'foreign table') THEN
+				EXECUTE format('GRANT %s ON TABLE %s TO %I', g.privileges, obj.object_identity, g.role);
+			END IF;
+		END LOOP;
+	END LOOP;
+END $$;`
+
+// installAutoGrants installs the event trigger in the provisioned database and replaces its grant list.
+// Event triggers can only be created by a superuser admin.
+func installAutoGrants(ctx context.Context, dbHost, dbPort, admin, adminPass string, spec provisionSpec) error {
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, spec.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmts := []string{
+		"CREATE SCHEMA IF NOT EXISTS autopg;",
+		"CREATE TABLE IF NOT EXISTS autopg.auto_grants (role name PRIMARY KEY, privileges text NOT NULL);",
+		"REVOKE ALL ON SCHEMA autopg FROM PUBLIC;",
+		autoGrantFunction,
+		"DROP EVENT TRIGGER IF EXISTS autopg_auto_grant;",
+		`CREATE EVENT TRIGGER autopg_auto_grant ON ddl_command_end
+			WHEN TAG IN ('CREATE SCHEMA', 'CREATE TABLE', 'CREATE TABLE AS', 'SELECT INTO', 'CREATE VIEW',
+				'CREATE MATERIALIZED VIEW', 'CREATE FOREIGN TABLE', 'CREATE SEQUENCE')
+			EXECUTE FUNCTION autopg.auto_grant();`,
+		"DELETE FROM autopg.auto_grants;",
+	}
+	for _, q := range stmts {
+		if _, err := tx.Exec(q); err != nil {
+			return fmt.Errorf("install auto_grant trigger failed: %w", err)
+		}
+	}
+	for _, g := range spec.AutoGrants {
+		if _, err := tx.Exec("INSERT INTO autopg.auto_grants (role, privileges) VALUES ($1, $2);", g.Role, g.Privileges); err != nil {
+			return fmt.Errorf("auto_grant %s failed: %w", g.Role, err)
+		}
+	}
+	return tx.Commit()
+}
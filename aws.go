@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal AWS client: credentials from the environment (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN), the ECS task role or the EC2 instance role (IMDSv2), Signature V4 signing and
+// JSON-protocol calls. The region comes from AWS_REGION or AWS_DEFAULT_REGION.
+//
+// The AWS SDK for Go is not used: an RDS IAM token and the Secrets Manager calls only need Signature V4,
+// which is checked against the AWS test suite (aws_test.go), and the SDK would add a dozen modules and
+// its own credential chain next to the one above.
+
+type awsCreds struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      time.Time
+}
+
+var (
+	awsCredsMu     sync.Mutex
+	awsCachedCreds *awsCreds
+	awsHTTP        = &http.Client{Timeout: 20 * time.Second}
+)
+
+func awsRegion() string {
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// awsCredentials returns the current credentials, refreshing role credentials before they expire.
+func awsCredentials(ctx context.Context) (*awsCreds, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCreds{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	awsCredsMu.Lock()
+	defer awsCredsMu.Unlock()
+	if c := awsCachedCreds; c != nil && time.Until(c.Expiration) > 5*time.Minute {
+		return c, nil
+	}
+	var c awsCreds
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		if err := awsMetadataJSON(ctx, "http://169.254.170.2"+uri, nil, &c); err != nil {
+			return nil, fmt.Errorf("ECS task credentials: %w", err)
+		}
+	} else {
+		token, err := awsMetadata(ctx, http.MethodPut, "http://169.254.169.254/latest/api/token",
+			map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "21600"})
+		if err != nil {
+			return nil, fmt.Errorf("no AWS credentials in the environment and no instance metadata: %w", err)
+		}
+		hdr := map[string]string{"X-aws-ec2-metadata-token": token}
+		role, err := awsMetadata(ctx, http.MethodGet, "http://169.254.169.254/latest/meta-data/iam/security-credentials/", hdr)
+		if err != nil {
+			return nil, fmt.Errorf("instance role: %w", err)
+		}
+		role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+		if err := awsMetadataJSON(ctx, "http://169.254.169.254/latest/meta-data/iam/security-credentials/"+role, hdr, &c); err != nil {
+			return nil, fmt.Errorf("instance role credentials: %w", err)
+		}
+	}
+	awsCachedCreds = &c
+	return &c, nil
+}
+
+func awsMetadata(ctx context.Context, method, url string, hdr map[string]string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := awsHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return string(b), nil
+}
+
+func awsMetadataJSON(ctx context.Context, url string, hdr map[string]string, out any) error {
+	body, err := awsMetadata(ctx, http.MethodGet, url, hdr)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(body), out)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsSigningKey derives the Signature V4 key for a day, region and service.
+func awsSigningKey(secret, day, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), day)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+// signAWSRequest adds Signature V4 headers to req, whose body is body. Only headers already set on req
+// (plus host and x-amz-date) are signed.
+func signAWSRequest(req *http.Request, body []byte, c *awsCreds, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.Token)
+	}
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		names = append(names, lk)
+		values[lk] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, n := range names {
+		canonHeaders.WriteString(n + ":" + values[n] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{req.Method, path, req.URL.RawQuery, canonHeaders.String(), signed, sha256Hex(body)}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	sig := hex.EncodeToString(hmacSHA256(awsSigningKey(c.SecretAccessKey, day, region, service), toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.AccessKeyID, scope, signed, sig))
+}
+
+// awsError is the error body of JSON-protocol AWS APIs.
+type awsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *awsError) Error() string {
+	return e.Type + ": " + e.Message
+}
+
+// awsJSONCall calls action (e.g. "secretsmanager.GetSecretValue") of a JSON-protocol service.
+func awsJSONCall(ctx context.Context, service, action string, in, out any) error {
+	region := awsRegion()
+	if region == "" {
+		return errors.New("AWS_REGION is not set")
+	}
+	creds, err := awsCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+service+"."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", action)
+	signAWSRequest(req, body, creds, region, service, time.Now())
+	resp, err := awsHTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", action, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%s: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &awsError{}
+		if json.Unmarshal(b, e) != nil || e.Type == "" {
+			e.Type, e.Message = resp.Status, string(b)
+		}
+		if i := strings.LastIndex(e.Type, "#"); i >= 0 {
+			e.Type = e.Type[i+1:]
+		}
+		return fmt.Errorf("%s: %w", action, e)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// Secrets Manager backend. AUTOPG_<TARGET>_AWS_SECRET_ID names the secret holding the admin
+// credentials, a JSON object with "username" and "password" as RDS writes them.
+
+var (
+	awsSecretCacheMu sync.Mutex
+	awsSecretCache   = map[string]struct {
+		user, pass string
+		at         time.Time
+	}{}
+)
+
+func awsAdminCreds(ctx context.Context, target string) (string, string, error) {
+	id := os.Getenv(toEnvKey(target, "AWS_SECRET_ID"))
+	if id == "" {
+		return "", "", fmt.Errorf("%s is not set", toEnvKey(target, "AWS_SECRET_ID"))
+	}
+	awsSecretCacheMu.Lock()
+	defer awsSecretCacheMu.Unlock()
+	if c, ok := awsSecretCache[id]; ok && time.Since(c.at) < vaultRefresh {
+		return c.user, c.pass, nil
+	}
+	var out struct {
+		SecretString string
+	}
+	if err := awsJSONCall(ctx, "secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": id}, &out); err != nil {
+		return "", "", err
+	}
+	var secret struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal([]byte(out.SecretString), &secret); err != nil || secret.Username == "" || secret.Password == "" {
+		return "", "", fmt.Errorf("secret %s is not a JSON object with username and password", id)
+	}
+	awsSecretCache[id] = struct {
+		user, pass string
+		at         time.Time
+	}{secret.Username, secret.Password, time.Now()}
+	return secret.Username, secret.Password, nil
+}
+
+// awsStoreCredential writes a generated app credential to Secrets Manager as
+// <AUTOPG_<TARGET>_AWS_SECRET_PREFIX><target>/<user> (default prefix "autopg/"), creating the secret
+// tagged with the container and compose project, or adding a new version when it exists.
+func awsStoreCredential(ctx context.Context, rec exportedCredential) error {
+	prefix := os.Getenv(toEnvKey(rec.Target, "AWS_SECRET_PREFIX"))
+	if prefix == "" {
+		prefix = "autopg/"
+	}
+	name := prefix + rec.Target + "/" + rec.User
+	value, err := json.Marshal(rec.secretValue())
+	if err != nil {
+		return err
+	}
+	tags := []map[string]string{{"Key": "autopg:target", "Value": rec.Target}}
+	for k, v := range map[string]string{"autopg:container": rec.Container, "autopg:project": rec.Project} {
+		if v != "" {
+			tags = append(tags, map[string]string{"Key": k, "Value": v})
+		}
+	}
+	err = awsJSONCall(ctx, "secretsmanager", "secretsmanager.CreateSecret", map[string]any{
+		"Name":         name,
+		"SecretString": string(value),
+		"Description":  "Generated by autopg for " + rec.Container,
+		"Tags":         tags,
+	}, nil)
+	var ae *awsError
+	if errors.As(err, &ae) && ae.Type == "ResourceExistsException" {
+		err = awsJSONCall(ctx, "secretsmanager", "secretsmanager.PutSecretValue", map[string]string{
+			"SecretId":     name,
+			"SecretString": string(value),
+		}, nil)
+	}
+	return err
+}
+
+// awsQueryEscape escapes per RFC 3986 as Signature V4 requires.
+func awsQueryEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(s), "+", "%20"), "%7E", "~")
+}
+
+// rdsAuthToken builds an RDS IAM auth token for user on host:port: a Signature V4 presigned
+// rds-db:connect URL without its scheme, valid 15 minutes.
+func rdsAuthToken(c *awsCreds, region, host, port, user string, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	scope := day + "/" + region + "/rds-db/aws4_request"
+	params := map[string]string{
+		"Action":              "connect",
+		"DBUser":              user,
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    c.AccessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       "900",
+		"X-Amz-SignedHeaders": "host",
+	}
+	if c.Token != "" {
+		params["X-Amz-Security-Token"] = c.Token
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	query := make([]string, len(keys))
+	for i, k := range keys {
+		query[i] = awsQueryEscape(k) + "=" + awsQueryEscape(params[k])
+	}
+	endpoint := host + ":" + port
+	canonical := strings.Join([]string{"GET", "/", strings.Join(query, "&"), "host:" + endpoint + "\n", "host", sha256Hex(nil)}, "\n")
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	sig := hex.EncodeToString(hmacSHA256(awsSigningKey(c.SecretAccessKey, day, region, "rds-db"), toSign))
+	return endpoint + "/?" + strings.Join(query, "&") + "&X-Amz-Signature=" + sig
+}
+
+var (
+	rdsTokensMu sync.Mutex
+	rdsTokens   = map[string]struct {
+		token string
+		at    time.Time
+	}{}
+)
+
+// rdsAdminToken returns an RDS IAM auth token for the admin of target, reusing it for 10 of its 15
+// minutes. The region is AUTOPG_<TARGET>_AWS_REGION or the default one.
+func rdsAdminToken(ctx context.Context, target, host, port, user string) (string, error) {
+	if sslMode(target) == "disable" {
+		return "", fmt.Errorf("RDS IAM authentication needs TLS; set %s", toEnvKey(target, "SSLMODE"))
+	}
+	region := os.Getenv(toEnvKey(target, "AWS_REGION"))
+	if region == "" {
+		region = awsRegion()
+	}
+	if region == "" {
+		return "", errors.New("AWS_REGION is not set")
+	}
+	key := region + "/" + host + ":" + port + "/" + user
+	rdsTokensMu.Lock()
+	defer rdsTokensMu.Unlock()
+	if t, ok := rdsTokens[key]; ok && time.Since(t.at) < 10*time.Minute {
+		return t.token, nil
+	}
+	creds, err := awsCredentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := rdsAuthToken(creds, region, host, port, user, now)
+	rdsTokens[key] = struct {
+		token string
+		at    time.Time
+	}{token, now}
+	return token, nil
+}
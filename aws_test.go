@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example credentials of the AWS documentation and Signature V4 test suite.
+var awsExampleCreds = &awsCreds{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+func TestAWSSigningKey(t *testing.T) {
+	got := hex.EncodeToString(awsSigningKey(awsExampleCreds.SecretAccessKey, "20120215", "us-east-1", "iam"))
+	if want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Errorf("awsSigningKey = %s, want %s", got, want)
+	}
+}
+
+// The get-vanilla and post-vanilla cases of the Signature V4 test suite.
+func TestSignAWSRequest(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		method, sig string
+	}{
+		{http.MethodGet, "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{http.MethodPost, "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "https://example.amazonaws.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signAWSRequest(req, nil, awsExampleCreds, "us-east-1", "service", now)
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + tt.sig
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s: Authorization = %q, want %q", tt.method, got, want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s: X-Amz-Date = %q", tt.method, got)
+		}
+	}
+}
+
+func TestSignAWSRequestSessionToken(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := *awsExampleCreds
+	creds.Token = "session"
+	signAWSRequest(req, nil, &creds, "us-east-1", "service", time.Now())
+	if req.Header.Get("X-Amz-Security-Token") != "session" ||
+		!strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("session token not signed: %v", req.Header)
+	}
+}
+
+func TestAWSQueryEscape(t *testing.T) {
+	tests := map[string]string{
+		"AKIDEXAMPLE/20150830/us-east-1/rds-db/aws4_request": "AKIDEXAMPLE%2F20150830%2Fus-east-1%2Frds-db%2Faws4_request",
+		"a b+c~d":  "a%20b%2Bc~d",
+		"app_user": "app_user",
+	}
+	for in, want := range tests {
+		if got := awsQueryEscape(in); got != want {
+			t.Errorf("awsQueryEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRDSAuthToken(t *testing.T) {
+	creds := *awsExampleCreds
+	creds.Token = "tok/en"
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	token := rdsAuthToken(&creds, "us-east-1", "db.example.com", "5432", "app", now)
+	endpoint, query, ok := strings.Cut(token, "/?")
+	if !ok || endpoint != "db.example.com:5432" {
+		t.Fatalf("token %q is not a presigned URL of db.example.com:5432", token)
+	}
+	// Signature V4 needs the parameters sorted, and the signature last.
+	var names []string
+	for _, p := range strings.Split(query, "&") {
+		name, _, _ := strings.Cut(p, "=")
+		names = append(names, name)
+	}
+	want := []string{"Action", "DBUser", "X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-Expires", "X-Amz-Security-Token", "X-Amz-SignedHeaders", "X-Amz-Signature"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("parameters %v, want %v", names, want)
+	}
+	v, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Get("X-Amz-Credential") != "AKIDEXAMPLE/20150830/us-east-1/rds-db/aws4_request" || v.Get("X-Amz-Security-Token") != "tok/en" ||
+		v.Get("DBUser") != "app" || len(v.Get("X-Amz-Signature")) != 64 {
+		t.Errorf("parameters %v", v)
+	}
+	if again := rdsAuthToken(&creds, "us-east-1", "db.example.com", "5432", "app", now); again != token {
+		t.Error("rdsAuthToken is not deterministic")
+	}
+	if other := rdsAuthToken(&creds, "us-east-1", "db.example.com", "5432", "other", now); other == token {
+		t.Error("the token does not depend on the user")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestAWSJSONCall(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-3")
+	t.Setenv("AWS_ACCESS_KEY_ID", awsExampleCreds.AccessKeyID)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", awsExampleCreds.SecretAccessKey)
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	defer func(c *http.Client) { awsHTTP = c }(awsHTTP)
+	var status int
+	var body string
+	awsHTTP = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://secretsmanager.eu-west-3.amazonaws.com/" || req.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" ||
+			!strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+			t.Errorf("request %s %v", req.URL, req.Header)
+		}
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader(body))}, nil
+	})}
+
+	status, body = http.StatusOK, `{"SecretString":"s3cret"}`
+	var out struct{ SecretString string }
+	if err := awsJSONCall(t.Context(), "secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": "x"}, &out); err != nil || out.SecretString != "s3cret" {
+		t.Errorf("awsJSONCall = %+v, %v", out, err)
+	}
+
+	status, body = http.StatusBadRequest, `{"__type":"com.amazonaws.secretsmanager#ResourceNotFoundException","message":"no such secret"}`
+	var ae *awsError
+	err := awsJSONCall(t.Context(), "secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": "x"}, nil)
+	if !errors.As(err, &ae) || ae.Type != "ResourceNotFoundException" || ae.Message != "no such secret" {
+		t.Errorf("awsJSONCall error = %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal Azure Key Vault client. Tokens come from a client secret (AZURE_TENANT_ID, AZURE_CLIENT_ID,
+// AZURE_CLIENT_SECRET) or, without one, from the managed identity endpoint (AZURE_CLIENT_ID then selects
+// a user-assigned identity).
+
+const (
+	azureVaultResource    = "https://vault.azure.net"
+	azurePostgresResource = "https://ossrdbms-aad.database.windows.net"
+)
+
+type azureCachedToken struct {
+	token  string
+	expiry time.Time
+}
+
+var (
+	azureTokensMu sync.Mutex
+	azureTokens   = map[string]azureCachedToken{}
+	azureHTTP     = &http.Client{Timeout: 20 * time.Second}
+)
+
+// azureAccessToken returns a cached access token for resource, fetching a new one shortly before expiry.
+func azureAccessToken(ctx context.Context, resource string) (string, error) {
+	azureTokensMu.Lock()
+	defer azureTokensMu.Unlock()
+	if t, ok := azureTokens[resource]; ok && time.Until(t.expiry) > 2*time.Minute {
+		return t.token, nil
+	}
+	var req *http.Request
+	var err error
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {secret},
+			"scope":         {resource + "/.default"},
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost,
+			"https://login.microsoftonline.com/"+url.PathEscape(os.Getenv("AZURE_TENANT_ID"))+"/oauth2/v2.0/token",
+			strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		q := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+		if clientID != "" {
+			q.Set("client_id", clientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	var tok struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresIn   json.RawMessage `json:"expires_in"` // a number, or a string from managed identity
+	}
+	if err := azureDo(req, &tok); err != nil {
+		return "", fmt.Errorf("azure token: %w", err)
+	}
+	secs, _ := strconv.Atoi(strings.Trim(string(tok.ExpiresIn), `"`))
+	registerSecret("azure token "+resource, tok.AccessToken)
+	azureTokens[resource] = azureCachedToken{tok.AccessToken, time.Now().Add(time.Duration(secs) * time.Second)}
+	return tok.AccessToken, nil
+}
+
+func azureDo(req *http.Request, out any) error {
+	resp, err := azureHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// azureVaultURL accepts a vault name or URL.
+func azureVaultURL(v string) string {
+	if strings.HasPrefix(v, "https://") {
+		return strings.TrimRight(v, "/")
+	}
+	return "https://" + v + ".vault.azure.net"
+}
+
+func azureSecretCall(ctx context.Context, method, vaultURL, name string, in, out any) error {
+	token, err := azureAccessToken(ctx, azureVaultResource)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, vaultURL+"/secrets/"+name+"?api-version=7.4", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return azureDo(req, out)
+}
+
+// Key Vault backend. AUTOPG_<TARGET>_AZURE_VAULT is the vault name or URL and AUTOPG_<TARGET>_AZURE_SECRET
+// the secret holding the admin credentials as a JSON object with "username" and "password".
+
+var (
+	azureSecretCacheMu sync.Mutex
+	azureSecretCache   = map[string]struct {
+		user, pass string
+		at         time.Time
+	}{}
+)
+
+func azureAdminCreds(ctx context.Context, target string) (string, string, error) {
+	vaultName, name := os.Getenv(toEnvKey(target, "AZURE_VAULT")), os.Getenv(toEnvKey(target, "AZURE_SECRET"))
+	if vaultName == "" || name == "" {
+		return "", "", fmt.Errorf("%s and %s must be set", toEnvKey(target, "AZURE_VAULT"), toEnvKey(target, "AZURE_SECRET"))
+	}
+	key := azureVaultURL(vaultName) + "/" + name
+	azureSecretCacheMu.Lock()
+	defer azureSecretCacheMu.Unlock()
+	if c, ok := azureSecretCache[key]; ok && time.Since(c.at) < vaultRefresh {
+		return c.user, c.pass, nil
+	}
+	var out struct {
+		Value string `json:"value"`
+	}
+	if err := azureSecretCall(ctx, http.MethodGet, azureVaultURL(vaultName), url.PathEscape(name), nil, &out); err != nil {
+		return "", "", err
+	}
+	var secret struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal([]byte(out.Value), &secret); err != nil || secret.Username == "" || secret.Password == "" {
+		return "", "", fmt.Errorf("secret %s is not a JSON object with username and password", name)
+	}
+	azureSecretCache[key] = struct {
+		user, pass string
+		at         time.Time
+	}{secret.Username, secret.Password, time.Now()}
+	return secret.Username, secret.Password, nil
+}
+
+var azureSecretNameRe = regexp.MustCompile(`[^0-9A-Za-z-]`)
+
+// azureStoreCredential writes a generated app credential as a new version of the secret
+// <AUTOPG_<TARGET>_AZURE_SECRET_PREFIX><target>-<user> (default prefix "autopg-") in the target's vault,
+// tagged with the container and compose project.
+func azureStoreCredential(ctx context.Context, rec exportedCredential) error {
+	vaultName := os.Getenv(toEnvKey(rec.Target, "AZURE_VAULT"))
+	if vaultName == "" {
+		return fmt.Errorf("%s is not set", toEnvKey(rec.Target, "AZURE_VAULT"))
+	}
+	prefix := os.Getenv(toEnvKey(rec.Target, "AZURE_SECRET_PREFIX"))
+	if prefix == "" {
+		prefix = "autopg-"
+	}
+	name := azureSecretNameRe.ReplaceAllString(prefix+rec.Target+"-"+rec.User, "-")
+	value, err := json.Marshal(rec.secretValue())
+	if err != nil {
+		return err
+	}
+	tags := map[string]string{"autopg-target": rec.Target}
+	if rec.Container != "" {
+		tags["autopg-container"] = rec.Container
+	}
+	if rec.Project != "" {
+		tags["autopg-project"] = rec.Project
+	}
+	return azureSecretCall(ctx, http.MethodPut, azureVaultURL(vaultName), name, map[string]any{
+		"value":       string(value),
+		"contentType": "application/json",
+		"tags":        tags,
+	}, nil)
+}
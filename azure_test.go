@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAzure serves the Azure endpoints with handler, starting without cached tokens.
+func fakeAzure(t *testing.T, handler func(req *http.Request) (int, string)) {
+	t.Helper()
+	oldHTTP, oldTokens := azureHTTP, azureTokens
+	t.Cleanup(func() { azureHTTP, azureTokens = oldHTTP, oldTokens })
+	azureTokens = map[string]azureCachedToken{}
+	azureHTTP = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		code, body := handler(req)
+		return &http.Response{StatusCode: code, Status: http.StatusText(code), Body: io.NopCloser(strings.NewReader(body))}, nil
+	})}
+}
+
+func TestAzureAccessToken(t *testing.T) {
+	tests := []struct {
+		name, secret, url, body, token string
+	}{
+		{"client secret", "s3cret", "https://login.microsoftonline.com/tenant/oauth2/v2.0/token",
+			`{"access_token":"from-secret","expires_in":3599}`, "from-secret"},
+		// managed identity gives expires_in as a string
+		{"managed identity", "", "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&client_id=app&resource=https%3A%2F%2Fvault.azure.net",
+			`{"access_token":"from-identity","expires_in":"3599"}`, "from-identity"},
+	}
+	for _, tt := range tests {
+		t.Setenv("AZURE_TENANT_ID", "tenant")
+		t.Setenv("AZURE_CLIENT_ID", "app")
+		t.Setenv("AZURE_CLIENT_SECRET", tt.secret)
+		calls := 0
+		fakeAzure(t, func(req *http.Request) (int, string) {
+			calls++
+			if req.URL.String() != tt.url {
+				t.Errorf("%s: token request to %s", tt.name, req.URL)
+			}
+			if tt.secret != "" {
+				req.ParseForm()
+				if req.PostForm.Get("client_secret") != "s3cret" || req.PostForm.Get("scope") != azureVaultResource+"/.default" {
+					t.Errorf("%s: form %v", tt.name, req.PostForm)
+				}
+			} else if req.Header.Get("Metadata") != "true" {
+				t.Errorf("%s: no Metadata header", tt.name)
+			}
+			return http.StatusOK, tt.body
+		})
+		for range 2 {
+			if tok, err := azureAccessToken(t.Context(), azureVaultResource); err != nil || tok != tt.token {
+				t.Errorf("%s: azureAccessToken = %q, %v, want %q", tt.name, tok, err, tt.token)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("%s: %d token requests, want 1 then the cached token", tt.name, calls)
+		}
+		if exp := azureTokens[azureVaultResource].expiry; time.Until(exp) < 59*time.Minute {
+			t.Errorf("%s: token expires at %v", tt.name, exp)
+		}
+	}
+}
+
+func TestAzureVaultURL(t *testing.T) {
+	tests := map[string]string{
+		"kv-prod":                          "https://kv-prod.vault.azure.net",
+		"https://kv-prod.vault.azure.net/": "https://kv-prod.vault.azure.net",
+		"https://kv.vault.azure.cn":        "https://kv.vault.azure.cn",
+	}
+	for in, want := range tests {
+		if got := azureVaultURL(in); got != want {
+			t.Errorf("azureVaultURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAzureAdminCreds(t *testing.T) {
+	t.Setenv("AUTOPG_MAIN_AZURE_VAULT", "kv-prod")
+	t.Setenv("AUTOPG_MAIN_AZURE_SECRET", "pg-admin")
+	fakeAzure(t, func(req *http.Request) (int, string) {
+		switch {
+		case req.URL.Host == "login.microsoftonline.com" || req.URL.Host == "169.254.169.254":
+			return http.StatusOK, `{"access_token":"tok","expires_in":3599}`
+		case req.URL.String() == "https://kv-prod.vault.azure.net/secrets/pg-admin?api-version=7.4" && req.Header.Get("Authorization") == "Bearer tok":
+			return http.StatusOK, `{"value":"{\"username\":\"postgres\",\"password\":\"s3cret\"}"}`
+		}
+		return http.StatusNotFound, `{"error":{"code":"SecretNotFound"}}`
+	})
+	user, pass, err := azureAdminCreds(t.Context(), "main")
+	if err != nil || user != "postgres" || pass != "s3cret" {
+		t.Errorf("azureAdminCreds = %q, %q, %v", user, pass, err)
+	}
+}
+
+func TestAzureStoreCredential(t *testing.T) {
+	t.Setenv("AUTOPG_MAIN_AZURE_VAULT", "kv-prod")
+	var put *http.Request
+	var body []byte
+	fakeAzure(t, func(req *http.Request) (int, string) {
+		if req.Method == http.MethodPut {
+			put = req
+			body, _ = io.ReadAll(req.Body)
+			return http.StatusOK, `{}`
+		}
+		return http.StatusOK, `{"access_token":"tok","expires_in":3599}`
+	})
+	err := azureStoreCredential(t.Context(), exportedCredential{Target: "main", User: "app_user", Pass: "pw", Container: "shop-web-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put == nil || put.URL.String() != "https://kv-prod.vault.azure.net/secrets/autopg-main-app-user?api-version=7.4" {
+		t.Fatalf("secret written to %v", put)
+	}
+	var in struct {
+		Value string
+		Tags  map[string]string
+	}
+	if err := json.Unmarshal(body, &in); err != nil || !strings.Contains(in.Value, `"password":"pw"`) || in.Tags["autopg-container"] != "shop-web-1" {
+		t.Errorf("secret %s, %v", body, err)
+	}
+}
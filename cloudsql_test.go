@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for template, signed by parent (self-signed when nil).
+func testCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestCloudSQLVerifier(t *testing.T) {
+	ca := &x509.Certificate{Subject: pkix.Name{CommonName: "Google Cloud SQL Server CA"}, IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	root, rootKey := testCert(t, ca, nil, nil)
+	inter, interKey := testCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "CAS intermediate"}, IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, root, rootKey)
+	server := func(cn string, dns []string, parent *x509.Certificate, key *ecdsa.PrivateKey) []byte {
+		c, _ := testCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dns,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, parent, key)
+		return c.Raw
+	}
+	other, otherKey := testCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "another CA"}, IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	tests := []struct {
+		name  string
+		chain [][]byte
+		dns   string
+		err   string
+	}{
+		{"signed by the server CA", [][]byte{server("shop:db", nil, root, rootKey)}, "", ""},
+		{"through an intermediate", [][]byte{server("shop:db", nil, inter, interKey), inter.Raw}, "", ""},
+		{"intermediate missing", [][]byte{server("shop:db", nil, inter, interKey)}, "", "unknown authority"},
+		{"another CA", [][]byte{server("shop:db", nil, other, otherKey), other.Raw}, "", "unknown authority"},
+		{"another instance", [][]byte{server("shop:other", nil, root, rootKey)}, "", `server certificate is for "shop:other", not shop:db`},
+		{"DNS name", [][]byte{server("", []string{"abc.shop.sql.goog"}, inter, interKey), inter.Raw}, "abc.shop.sql.goog.", ""},
+		{"other DNS name", [][]byte{server("", []string{"xyz.shop.sql.goog"}, root, rootKey)}, "abc.shop.sql.goog.", "server certificate is for"},
+		{"no certificate", nil, "", "no server certificate"},
+	}
+	for _, tt := range tests {
+		err := cloudSQLVerifier(roots, "shop:db", tt.dns)(tt.chain, nil)
+		if (err == nil) != (tt.err == "") || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
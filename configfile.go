@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The target configuration may also come from a file, AUTOPG_CONFIG_FILE, typically encrypted so it
+// can be committed along with the admin passwords:
+//
+//	targets:
+//	  main:
+//	    host: pg1
+//	    admin: postgres
+//	    admin_pass: secret
+//	settings:
+//	  resync_interval: 1h
+//
+// targets.<t>.<key> becomes AUTOPG_<T>_<KEY> and settings.<key> becomes AUTOPG_<KEY>; variables already
+// set in the environment win. sops files are decrypted with `sops --decrypt`, age files with
+// `age --decrypt` using the identity in AUTOPG_AGE_KEY (or AUTOPG_AGE_KEY_FILE), which is also handed
+// to sops as SOPS_AGE_KEY. Plain files are read as is. The content is YAML (nested mappings of scalars)
+// or JSON.
+
+// loadConfigFile applies AUTOPG_CONFIG_FILE to the environment.
+func loadConfigFile() error {
+	path := os.Getenv("AUTOPG_CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	content, err := decryptConfig(path, raw)
+	if err != nil {
+		return fmt.Errorf("decrypt %s: %w", path, err)
+	}
+	cfg, err := parseConfig(content)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	env := map[string]string{}
+	for section, v := range cfg {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("parse %s: %s must be a mapping", path, section)
+		}
+		switch section {
+		case "targets":
+			for target, tv := range m {
+				tm, ok := tv.(map[string]any)
+				if !ok {
+					return fmt.Errorf("parse %s: targets.%s must be a mapping", path, target)
+				}
+				for k, val := range tm {
+					env[toEnvKey(target, strings.ToUpper(k))] = fmt.Sprint(val)
+				}
+			}
+		case "settings":
+			for k, val := range m {
+				env["AUTOPG_"+strings.ToUpper(k)] = fmt.Sprint(val)
+			}
+		default:
+			return fmt.Errorf("parse %s: unknown section %q; expected targets or settings", path, section)
+		}
+	}
+	for k, v := range env {
+		if _, set := os.LookupEnv(k); !set {
+			os.Setenv(k, v)
+		}
+	}
+	return nil
+}
+
+func decryptConfig(path string, raw []byte) ([]byte, error) {
+	key := os.Getenv("AUTOPG_AGE_KEY")
+	switch {
+	case isAgeCiphertext(raw):
+		return ageDecrypt(raw)
+	case bytes.Contains(raw, []byte("sops:")) || bytes.Contains(raw, []byte(`"sops"`)):
+		if _, err := exec.LookPath("sops"); err != nil {
+			return nil, fmt.Errorf("%s is sops encrypted but sops is not installed (the autopg image doesn't ship it; add it in a derived image or encrypt the file with age)", path)
+		}
+		cmd := exec.Command("sops", "--decrypt", path)
+		cmd.Env = os.Environ()
+		if key != "" && os.Getenv("SOPS_AGE_KEY") == "" {
+			cmd.Env = append(cmd.Env, "SOPS_AGE_KEY="+key)
+		}
+		return runDecrypt(cmd)
+	default:
+		return raw, nil
+	}
+}
+
+func runDecrypt(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// parseConfig parses JSON, or the YAML subset config files need: nested mappings whose leaves are plain
+// or quoted scalars, with comments.
+func parseConfig(b []byte) (map[string]any, error) {
+	if t := bytes.TrimSpace(b); len(t) > 0 && t[0] == '{' {
+		var m map[string]any
+		return m, json.Unmarshal(t, &m)
+	}
+	root := map[string]any{}
+	// each frame is an open mapping; indent is the indentation of its keys, -1 until its first key
+	type frame struct {
+		indent int
+		key    string
+		m      map[string]any
+	}
+	stack := []frame{{indent: -1, m: root}}
+	closeEmpty := func() {
+		// a "key:" line with nothing nested under it has an empty value
+		n := len(stack)
+		if n > 1 && stack[n-1].indent == -1 {
+			stack[n-2].m[stack[n-1].key] = ""
+			stack = stack[:n-1]
+		}
+	}
+	for n, line := range strings.Split(string(b), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if strings.HasPrefix(line[indent:], "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", n+1)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("line %d: expected key: value", n+1)
+		}
+		if top := len(stack) - 1; top > 0 && stack[top].indent == -1 {
+			if indent > stack[top-1].indent {
+				stack[top].indent = indent
+			} else {
+				closeEmpty()
+			}
+		}
+		for len(stack) > 1 && indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		top := len(stack) - 1
+		if stack[top].indent == -1 {
+			stack[top].indent = indent
+		}
+		if indent != stack[top].indent {
+			return nil, fmt.Errorf("line %d: inconsistent indentation", n+1)
+		}
+		key = unquoteYAML(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "#") {
+			value = ""
+		} else if !strings.HasPrefix(value, `"`) && !strings.HasPrefix(value, "'") {
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		if value == "" {
+			m := map[string]any{}
+			stack[top].m[key] = m
+			stack = append(stack, frame{indent: -1, key: key, m: m})
+			continue
+		}
+		stack[top].m[key] = unquoteYAML(value)
+	}
+	closeEmpty()
+	return root, nil
+}
+
+func unquoteYAML(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		var out string
+		if json.Unmarshal([]byte(s), &out) == nil {
+			return out
+		}
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
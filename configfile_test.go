@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"nested", `
+targets:
+  main:
+    host: pg1
+    port: 5432
+  replica:
+    host: pg2
+settings:
+  resync_interval: 1h
+`, `{"settings":{"resync_interval":"1h"},"targets":{"main":{"host":"pg1","port":"5432"},"replica":{"host":"pg2"}}}`},
+		{"comments and document start", `---
+# admin credentials
+targets:   # per target
+  main:
+    # the primary
+    host: pg1 # trailing comment
+    admin_pass: "p#ss # not a comment"
+`, `{"targets":{"main":{"admin_pass":"p#ss # not a comment","host":"pg1"}}}`},
+		{"quotes", `
+settings:
+  double: "a \"quoted\" é\n"
+  single: 'it''s'
+  "quoted key": x
+  url: postgres://u:p@h:5432/db
+  unterminated: "abc
+`, `{"settings":{"double":"a \"quoted\" é\n","quoted key":"x","single":"it's","unterminated":"\"abc","url":"postgres://u:p@h:5432/db"}}`},
+		{"empty values", `
+targets:
+  main:
+    host:
+    admin: postgres
+  empty:
+settings:
+`, `{"settings":"","targets":{"empty":"","main":{"admin":"postgres","host":""}}}`},
+		{"four spaces", `
+targets:
+    main:
+        host: pg1
+settings:
+    api_listen: ":8443"
+`, `{"settings":{"api_listen":":8443"},"targets":{"main":{"host":"pg1"}}}`},
+		{"JSON", ` {"targets": {"main": {"host": "pg1", "port": 5432}}}`, `{"targets":{"main":{"host":"pg1","port":5432}}}`},
+	}
+	for _, tt := range tests {
+		cfg, err := parseConfig([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got, _ := json.Marshal(cfg); string(got) != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, in, err string
+	}{
+		{"tab", "targets:\n\tmain:\n", "line 2: tabs are not allowed for indentation"},
+		{"list", "targets:\n  - main\n", "line 2: expected key: value"},
+		{"no colon", "targets\n", "line 1: expected key: value"},
+		{"dedent between levels", "targets:\n    main:\n      host: a\n  replica:\n", "line 4: inconsistent indentation"},
+		{"indent under a scalar", "settings:\n  a: 1\n    b: 2\n", "line 3: inconsistent indentation"},
+		{"invalid JSON", `{"targets":`, "unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig([]byte(tt.in)); err == nil || err.Error() != tt.err {
+			t.Errorf("%s: %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autopg.yaml")
+	err := os.WriteFile(path, []byte(`
+targets:
+  main:
+    host: pg1
+    admin_pass: from-file
+  eu-west:
+    host: pg2
+settings:
+  resync_interval: 1h
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTOPG_CONFIG_FILE", path)
+	t.Setenv("AUTOPG_MAIN_ADMIN_PASS", "from-env") // the environment wins
+	for _, k := range []string{"AUTOPG_MAIN_HOST", "AUTOPG_EU_WEST_HOST", "AUTOPG_RESYNC_INTERVAL"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	if err := loadConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"AUTOPG_MAIN_HOST":       "pg1",
+		"AUTOPG_MAIN_ADMIN_PASS": "from-env",
+		"AUTOPG_EU_WEST_HOST":    "pg2",
+		"AUTOPG_RESYNC_INTERVAL": "1h",
+	} {
+		if got := os.Getenv(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		in, err string
+	}{
+		{"targets: pg1\n", "targets must be a mapping"},
+		{"targets:\n  main: pg1\n", "targets.main must be a mapping"},
+		{"servers:\n  main: pg1\n", `unknown section "servers"; expected targets or settings`},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "autopg.yaml")
+		if err := os.WriteFile(path, []byte(tt.in), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("AUTOPG_CONFIG_FILE", path)
+		if err := loadConfigFile(); err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+			t.Errorf("%q: %v, want %s", tt.in, err, tt.err)
+		}
+	}
+}
+
+func TestDecryptConfigSopsMissing(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	raw := []byte("targets:\n  main:\n    admin_pass: ENC[AES256_GCM,data:abc]\nsops:\n  version: 3.8.1\n")
+	if _, err := decryptConfig("autopg.enc.yaml", raw); err == nil || !strings.Contains(err.Error(), "sops is not installed") {
+		t.Errorf("decryptConfig without sops: %v", err)
+	}
+	plain := []byte("targets:\n  main:\n    host: pg1\n")
+	if got, err := decryptConfig("autopg.yaml", plain); err != nil || string(got) != string(plain) {
+		t.Errorf("decryptConfig of a plain file = %q, %v", got, err)
+	}
+}
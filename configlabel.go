@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// expandConfigLabels returns labels with each autopg.<target>.config JSON object expanded into the
+// equivalent dotted labels, e.g. {"db":"x","extensions":["postgis"]} into autopg.<target>.db=x and
+// autopg.<target>.extensions=postgis. Arrays become comma-separated lists, objects nest (cron jobs as
+// {"cron":{"vacuum":"0 3 * * *|VACUUM"}}) except role_settings, whose object becomes name=value pairs.
+// A dotted label set next to the config label takes precedence over the same key in the config.
+func expandConfigLabels(labels map[string]string) (map[string]string, error) {
+	var configs []string
+	for k := range labels {
+		if strings.HasPrefix(k, labelPrefix) && strings.HasSuffix(k, ".config") && strings.Count(k[len(labelPrefix):], ".") == 1 {
+			configs = append(configs, k)
+		}
+	}
+	if len(configs) == 0 {
+		return labels, nil
+	}
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	for _, k := range configs {
+		prefix := strings.TrimSuffix(k, "config")
+		var cfg map[string]any
+		if err := json.Unmarshal([]byte(labels[k]), &cfg); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", k, err)
+		}
+		flat := map[string]string{}
+		if err := flattenConfig(flat, "", cfg); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", k, err)
+		}
+		for field, v := range flat {
+			if _, set := labels[prefix+field]; !set {
+				out[prefix+field] = v
+			}
+		}
+	}
+	return out, nil
+}
+
+func flattenConfig(flat map[string]string, prefix string, cfg map[string]any) error {
+	for k, v := range cfg {
+		key := prefix + k
+		if obj, ok := v.(map[string]any); ok && key == "role_settings" {
+			pairs := make([]string, 0, len(obj))
+			for name, val := range obj {
+				s, err := configScalar(val)
+				if err != nil {
+					return fmt.Errorf("role_settings.%s: %w", name, err)
+				}
+				pairs = append(pairs, name+"="+s)
+			}
+			sort.Strings(pairs)
+			flat[key] = strings.Join(pairs, ",")
+			continue
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			if err := flattenConfig(flat, key+".", v); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				s, err := configScalar(item)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				items[i] = s
+			}
+			flat[key] = strings.Join(items, ",")
+		default:
+			s, err := configScalar(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			flat[key] = s
+		}
+	}
+	return nil
+}
+
+func configScalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
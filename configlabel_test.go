@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandConfigLabels(t *testing.T) {
+	labels := map[string]string{
+		"com.docker.compose.project": "shop",
+		"autopg.main.config": `{"db": "shop", "user": "app", "extensions": ["postgis", "pg_trgm"], "conn_limit": 20,
+			"login": true, "cron": {"vacuum": "0 3 * * *|VACUUM"}, "role_settings": {"work_mem": "64MB", "statement_timeout": 30000}}`,
+		"autopg.main.user":      "shop_app", // set next to config, takes precedence
+		"autopg.replica.config": `{"db": "shop_ro"}`,
+	}
+	got, err := expandConfigLabels(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"com.docker.compose.project": "shop",
+		"autopg.main.config":         labels["autopg.main.config"],
+		"autopg.main.db":             "shop",
+		"autopg.main.user":           "shop_app",
+		"autopg.main.extensions":     "postgis,pg_trgm",
+		"autopg.main.conn_limit":     "20",
+		"autopg.main.login":          "true",
+		"autopg.main.cron.vacuum":    "0 3 * * *|VACUUM",
+		"autopg.main.role_settings":  "statement_timeout=30000,work_mem=64MB",
+		"autopg.replica.config":      labels["autopg.replica.config"],
+		"autopg.replica.db":          "shop_ro",
+	}
+	if len(got) != len(want) {
+		t.Errorf("expanded %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if labels["autopg.main.db"] != "" {
+		t.Error("expandConfigLabels changed its argument")
+	}
+}
+
+func TestExpandConfigLabelsUnchanged(t *testing.T) {
+	labels := map[string]string{"autopg.main.db": "shop", "autopg.main.cron.config": "x"}
+	got, err := expandConfigLabels(labels)
+	if err != nil || len(got) != 2 || got["autopg.main.db"] != "shop" {
+		t.Errorf("expandConfigLabels without config = %v, %v", got, err)
+	}
+}
+
+func TestExpandConfigLabelsInvalid(t *testing.T) {
+	tests := map[string]string{
+		`{"db": `:                               "invalid autopg.main.config: unexpected end of JSON input",
+		`["db"]`:                                "invalid autopg.main.config: json: cannot unmarshal array",
+		`{"db": null}`:                          "invalid autopg.main.config: db: unsupported value <nil>",
+		`{"extensions": [["postgis"]]}`:         "invalid autopg.main.config: extensions: unsupported value [postgis]",
+		`{"role_settings": {"work_mem": null}}`: "invalid autopg.main.config: role_settings.work_mem: unsupported value <nil>",
+	}
+	for in, want := range tests {
+		_, err := expandConfigLabels(map[string]string{"autopg.main.config": in})
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("expandConfigLabels(%s) = %v, want %s", in, err, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Created objects: the roles and databases autopg creates itself are recorded in the data directory
+// (created.json), per target, with the role a database was created for. Only those are changed in a way
+// that could take them over: a generated password is only set on a role autopg created, and
+// REAPPLY=always only re-asserts the login and password of such a role and the owner of a database
+// autopg created for that role. Teardown only drops what autopg created, and forgets it once dropped. A label naming a role or database that existed before, e.g. another
+// tenant's or a DBA's, can't reset its password or take its ownership. Those, including the ones
+// provisioned by versions of autopg that did not keep this record, are used as they are.
+//
+// A role autopg creates is also commented "autopg: role created for ...". The comment stands in for the
+// record when the data directory was lost, so a generated password can be set again on the role, by the
+// same owner only: only superusers and roles with CREATEROLE can comment on a role. A database's owner can change its
+// comment, so databases are only trusted from the record.
+
+const createdRoleComment = "autopg: role created for "
+
+// createdEntry is a role or database autopg created.
+type createdEntry struct {
+	Owner string    `json:"owner,omitempty"` // for a database, the role it was created for
+	For   string    `json:"for,omitempty"`   // what asked for it, its resource's owner
+	Time  time.Time `json:"time"`
+	// LinkAllow are, for a database, the link_allow patterns of the databases that may link to it.
+	LinkAllow []string `json:"link_allow,omitempty"`
+}
+
+var createdObjects = struct {
+	sync.Mutex
+	m map[string]createdEntry // target/kind/name -> entry, kind being "role" or "database"
+}{}
+
+func createdPath() string {
+	return filepath.Join(dataDir(), "created.json")
+}
+
+func createdKey(target, kind, name string) string {
+	return target + "/" + kind + "/" + name
+}
+
+// loadCreated reads the record on first use; the caller holds createdObjects.
+func loadCreated() {
+	if createdObjects.m != nil {
+		return
+	}
+	createdObjects.m = map[string]createdEntry{}
+	b, err := os.ReadFile(createdPath())
+	if err == nil {
+		err = json.Unmarshal(b, &createdObjects.m)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logf(context.Background(), "warning: could not read %s: %v", createdPath(), err)
+	}
+}
+
+// saveCreatedLocked writes the record; the caller holds createdObjects.
+func saveCreatedLocked() error {
+	b, err := json.Marshal(createdObjects.m)
+	if err != nil {
+		return err
+	}
+	tmp := createdPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, createdPath())
+}
+
+// markCreated records that autopg created the role or database name on target.
+func markCreated(target, kind, name string, e createdEntry) error {
+	createdObjects.Lock()
+	defer createdObjects.Unlock()
+	loadCreated()
+	e.Time = time.Now().UTC()
+	createdObjects.m[createdKey(target, kind, name)] = e
+	if err := saveCreatedLocked(); err != nil {
+		return fmt.Errorf("record created %s %s: %w", kind, name, err)
+	}
+	return nil
+}
+
+// setLinkAllow replaces the link_allow patterns of database name on target, which autopg created.
+func setLinkAllow(target, name string, allow []string) error {
+	createdObjects.Lock()
+	defer createdObjects.Unlock()
+	loadCreated()
+	key := createdKey(target, "database", name)
+	e, ok := createdObjects.m[key]
+	if !ok || slices.Equal(e.LinkAllow, allow) {
+		return nil
+	}
+	e.LinkAllow = allow
+	createdObjects.m[key] = e
+	if err := saveCreatedLocked(); err != nil {
+		return fmt.Errorf("record link_allow of database %s: %w", name, err)
+	}
+	return nil
+}
+
+// forgetCreated removes the record of the role or database name on target, once dropped.
+func forgetCreated(target, kind, name string) error {
+	createdObjects.Lock()
+	defer createdObjects.Unlock()
+	loadCreated()
+	key := createdKey(target, kind, name)
+	if _, ok := createdObjects.m[key]; !ok {
+		return nil
+	}
+	delete(createdObjects.m, key)
+	if err := saveCreatedLocked(); err != nil {
+		return fmt.Errorf("forget created %s %s: %w", kind, name, err)
+	}
+	return nil
+}
+
+// createdObject returns the record of the role or database name on target, if autopg created it.
+func createdObject(target, kind, name string) (createdEntry, bool) {
+	createdObjects.Lock()
+	defer createdObjects.Unlock()
+	loadCreated()
+	e, ok := createdObjects.m[createdKey(target, kind, name)]
+	return e, ok
+}
+
+// databaseCreatedFor reports whether autopg created database name on target for role.
+func databaseCreatedFor(target, name, role string) bool {
+	e, ok := createdObject(target, "database", name)
+	return ok && e.Owner == role
+}
+
+// roleCreatedByAutopg reports whether autopg created role on the target of admin connection db, from the
+// record or else the role's comment.
+func roleCreatedByAutopg(db *sql.DB, target, role string) (bool, error) {
+	_, ok, err := roleCreator(db, target, role)
+	return ok, err
+}
+
+// roleCreator returns the owner autopg created role for on the target of admin connection db (see
+// resource.owner), from the record or else the role's comment; ok is false when autopg did not create it.
+func roleCreator(db *sql.DB, target, role string) (owner string, ok bool, err error) {
+	if e, ok := createdObject(target, "role", role); ok {
+		return e.For, true, nil
+	}
+	var comment sql.NullString
+	err = db.QueryRow("SELECT shobj_description(oid, 'pg_authid') FROM pg_catalog.pg_roles WHERE rolname = $1;", role).Scan(&comment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("read comment of role %s: %w", role, err)
+	}
+	rest, ok := strings.CutPrefix(comment.String, createdRoleComment)
+	if !ok {
+		return "", false, nil
+	}
+	return strings.TrimSuffix(rest, " (target "+target+")"), true, nil
+}
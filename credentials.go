@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// storedCredential is a password autopg generated; it is kept so the same one is used on every run. It is
+// only handed back to the resource it was generated for, its owner (see resource.owner): another one
+// naming the same user is refused rather than given the password.
+type storedCredential struct {
+	Target string `json:"target"`
+	DB     string `json:"db"`
+	User   string `json:"user"`
+	Pass   string `json:"pass"`
+	Owner  string `json:"owner,omitempty"`
+}
+
+var credentialsMu sync.Mutex
+
+func credentialsPath() string {
+	return filepath.Join(dataDir(), "credentials.json")
+}
+
+func credentialKey(target, user string) string {
+	return target + "/" + user
+}
+
+func loadCredentials() (map[string]storedCredential, error) {
+	creds := map[string]storedCredential{}
+	b, err := os.ReadFile(credentialsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", credentialsPath(), err)
+	}
+	return creds, nil
+}
+
+// lookupCredential returns the stored generated password of user on target.
+func lookupCredential(target, user string) (storedCredential, bool, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	creds, err := loadCredentials()
+	if err != nil {
+		return storedCredential{}, false, err
+	}
+	c, ok := creds[credentialKey(target, user)]
+	return c, ok, nil
+}
+
+// saveCredential stores c, replacing the file atomically.
+func saveCredential(c storedCredential) error {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	creds[credentialKey(c.Target, c.User)] = c
+	return writeCredentials(creds)
+}
+
+// deleteCredential forgets the stored password of user on target, e.g. once the role is dropped.
+func deleteCredential(target, user string) error {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	if _, ok := creds[credentialKey(target, user)]; !ok {
+		return nil
+	}
+	delete(creds, credentialKey(target, user))
+	return writeCredentials(creds)
+}
+
+func writeCredentials(creds map[string]storedCredential) error {
+	b, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := credentialsPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, credentialsPath())
+}
+
+// passwordAlphabets are the named alphabets of generated passwords. The symbols are limited to ones
+// that need no quoting in URIs, shells or dotenv files.
+var passwordAlphabets = map[string]string{
+	"alnum":   "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+	"symbols": "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.~",
+	"lower":   "abcdefghijklmnopqrstuvwxyz0123456789",
+	"hex":     "0123456789abcdef",
+}
+
+// ambiguousChars are told apart badly when passwords are read or typed.
+const ambiguousChars = "0O1lI"
+
+// passwordOptions shape generated passwords.
+type passwordOptions struct {
+	Length   int
+	Alphabet string
+}
+
+// passwordOptionsFor reads the password options of a container on target: the labels
+// autopg.<target>.password_length (default 24), password_alphabet (alnum by default, symbols, lower,
+// hex, or chars:<characters>) and password_exclude_ambiguous, each defaulting to
+// AUTOPG_<TARGET>_PASSWORD_LENGTH, _PASSWORD_ALPHABET and _PASSWORD_EXCLUDE_AMBIGUOUS (or the global
+// setting).
+func passwordOptionsFor(target string, labels map[string]string) (passwordOptions, error) {
+	setting := func(field string) string {
+		if v := labels[labelPrefix+target+"."+strings.ToLower(field)]; v != "" {
+			return v
+		}
+		return targetSetting(target, field)
+	}
+	opts := passwordOptions{Length: 24, Alphabet: passwordAlphabets["alnum"]}
+	if v := setting("PASSWORD_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 8 || n > 1024 {
+			return opts, fmt.Errorf("invalid password_length %q; expected 8 to 1024", v)
+		}
+		opts.Length = n
+	}
+	if v := setting("PASSWORD_ALPHABET"); v != "" {
+		if chars, ok := strings.CutPrefix(v, "chars:"); ok {
+			opts.Alphabet = uniqueChars(chars)
+		} else if opts.Alphabet, ok = passwordAlphabets[v]; !ok {
+			return opts, fmt.Errorf("invalid password_alphabet %q; expected alnum, symbols, lower, hex or chars:<characters>", v)
+		}
+	}
+	if v := setting("PASSWORD_EXCLUDE_AMBIGUOUS"); v != "" {
+		exclude, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid password_exclude_ambiguous %q", v)
+		}
+		if exclude {
+			opts.Alphabet = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(ambiguousChars, r) {
+					return -1
+				}
+				return r
+			}, opts.Alphabet)
+		}
+	}
+	if len(opts.Alphabet) < 10 {
+		return opts, fmt.Errorf("password alphabet %q is too small; it needs at least 10 characters", opts.Alphabet)
+	}
+	return opts, nil
+}
+
+// uniqueChars returns the printable ASCII characters of s without repetitions, which would bias the draw.
+func uniqueChars(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r > ' ' && r < 0x7f && !strings.ContainsRune(b.String(), r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// generatePassword returns a random password drawn from crypto/rand, each character uniformly from
+// the alphabet of opts.
+func generatePassword(opts passwordOptions) (string, error) {
+	b := make([]byte, opts.Length)
+	size := big.NewInt(int64(len(opts.Alphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		b[i] = opts.Alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// runCredentials implements `autopg credentials [target]`: lists generated credentials.
+func runCredentials(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: autopg credentials [target]")
+	}
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(creds))
+	for k, c := range creds {
+		if len(args) == 1 && c.Target != args[0] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		c := creds[k]
+		fmt.Printf("target=%s db=%s user=%s pass=%s owner=%q\n", c.Target, c.DB, c.User, c.Pass, c.Owner)
+	}
+	return nil
+}
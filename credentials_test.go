@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStoredCredentials(t *testing.T) {
+	useDataDir(t)
+	if _, ok, err := lookupCredential("main", "shop"); ok || err != nil {
+		t.Fatalf("lookupCredential in an empty data dir = %v, %v", ok, err)
+	}
+	shop := storedCredential{Target: "main", DB: "shop", User: "shop", Pass: "s3cret", Owner: "container shop/web"}
+	for _, c := range []storedCredential{shop, {Target: "replica", DB: "shop", User: "shop", Pass: "other"}} {
+		if err := saveCredential(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c, ok, err := lookupCredential("main", "shop"); !ok || err != nil || c != shop {
+		t.Errorf("lookupCredential = %+v, %v, %v, want %+v", c, ok, err, shop)
+	}
+	if err := deleteCredential("main", "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := lookupCredential("main", "shop"); ok {
+		t.Error("deleted credential still stored")
+	}
+	if c, ok, _ := lookupCredential("replica", "shop"); !ok || c.Pass != "other" {
+		t.Errorf("credential of another target = %+v, %v", c, ok)
+	}
+}
+
+func TestResourceOwner(t *testing.T) {
+	tests := []struct {
+		r    resource
+		want string
+	}{
+		{resource{kind: "container", ref: "shop/web-2", project: "shop", service: "web"}, "container shop/web"},
+		{resource{kind: "container", ref: "pgadmin"}, "container pgadmin"},
+		{resource{kind: "PostgresDatabase", ref: "shop/db", project: "shop", service: "db"}, "PostgresDatabase shop/db"},
+		{resource{kind: "webhook request", ref: "ci"}, "webhook request ci"},
+	}
+	for _, tt := range tests {
+		if got := tt.r.owner(); got != tt.want {
+			t.Errorf("owner of %+v = %q, want %q", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestPassOwnerRefusal(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    provisionSpec
+		refused bool
+	}{
+		{"own password", provisionSpec{User: "shop", ManagedPass: true, PassOwner: "container shop/web"}, false},
+		{"another owner's", provisionSpec{User: "shop", ManagedPass: true, PassOwner: "container blog/web"}, true},
+		{"stored without owner", provisionSpec{User: "shop", ManagedPass: true}, false},
+		{"new password", provisionSpec{User: "shop", ManagedPass: true, NewPass: true}, false},
+		{"pass label", provisionSpec{User: "shop", Pass: "x", PassOwner: "container blog/web"}, false},
+	}
+	for _, tt := range tests {
+		if got := passOwnerRefusal(tt.spec, "container shop/web"); (got != "") != tt.refused {
+			t.Errorf("%s: %q", tt.name, got)
+		}
+	}
+}
+
+// TestProvisionRefusesAnotherOwnersPassword checks that a generated password is not handed to another
+// resource naming the same user: the refusal comes before autopg connects to the target.
+func TestProvisionRefusesAnotherOwnersPassword(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_MAIN_HOST", "pg.invalid")
+	t.Setenv("AUTOPG_MAIN_ADMIN", "postgres")
+	t.Setenv("AUTOPG_MAIN_ADMIN_PASS", "admin")
+	if err := saveCredential(storedCredential{Target: "main", DB: "shop", User: "shop", Pass: "s3cret", Owner: "container shop/web"}); err != nil {
+		t.Fatal(err)
+	}
+	r := resource{kind: "container", ref: "blog/web", project: "blog", service: "web", labels: map[string]string{
+		"autopg.main.enable": "true",
+		"autopg.main.db":     "blog",
+		"autopg.main.user":   "shop",
+	}}
+	_, exp, err := provision(t.Context(), r, "main")
+	if err == nil || !strings.Contains(err.Error(), "belongs to container shop/web") {
+		t.Errorf("provision = %v, want a refusal", err)
+	}
+	if exp.Pass != "" {
+		t.Errorf("refused provisioning exported the password %q", exp.Pass)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Credentials files: with AUTOPG_<TARGET>_CREDENTIALS_DIR set, autopg writes the connection info of every
+// provisioned container to <dir>/<project>_<service>/<target>.<json|env> (the container name outside
+// compose), e.g. in a volume shared with the apps, which read it instead of labels.
+
+// credentialsFilePath returns where the credentials of c are written, or "" when target writes none.
+func credentialsFilePath(c exportedCredential) (string, error) {
+	dir := targetSetting(c.Target, "CREDENTIALS_DIR")
+	if dir == "" {
+		return "", nil
+	}
+	ext := ".json"
+	switch format := targetSetting(c.Target, "CREDENTIALS_FORMAT"); format {
+	case "", "json":
+	case "dotenv":
+		ext = ".env"
+	default:
+		return "", fmt.Errorf("unknown CREDENTIALS_FORMAT %q; expected json or dotenv", format)
+	}
+	return filepath.Join(dir, strings.Trim(c.serviceName(), "."), safeNameRe.ReplaceAllString(strings.ToLower(c.Target), "_")+ext), nil
+}
+
+// uri is the postgres:// connection URI of c.
+func (c exportedCredential) uri() string {
+	u := url.URL{Scheme: "postgres", User: url.UserPassword(c.User, c.Pass), Host: c.Host + ":" + c.Port, Path: "/" + c.DB}
+	return u.String()
+}
+
+// document renders c as "json" (the secretValue layout plus "uri") or "dotenv" (libpq PG* variables plus
+// DATABASE_URL).
+func (c exportedCredential) document(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		doc := c.secretValue()
+		doc["uri"] = c.uri()
+		b, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case "dotenv":
+		var sb strings.Builder
+		for _, kv := range [][2]string{
+			{"PGHOST", c.Host}, {"PGPORT", c.Port}, {"PGDATABASE", c.DB}, {"PGUSER", c.User},
+			{"PGPASSWORD", c.Pass}, {"DATABASE_URL", c.uri()},
+		} {
+			fmt.Fprintf(&sb, "%s=%s\n", kv[0], strconv.Quote(kv[1]))
+		}
+		return []byte(sb.String()), nil
+	default:
+		return nil, fmt.Errorf("unknown credentials format %q; expected json or dotenv", format)
+	}
+}
+
+// writeCredentialsFile writes the credentials file of c, replacing it atomically. The file mode is
+// AUTOPG_<TARGET>_CREDENTIALS_FILE_MODE (octal, default 0600); use e.g. 0644 when apps run as another
+// user.
+func writeCredentialsFile(c exportedCredential) error {
+	path, err := credentialsFilePath(c)
+	if err != nil || path == "" {
+		return err
+	}
+	mode := os.FileMode(0o600)
+	if v := targetSetting(c.Target, "CREDENTIALS_FILE_MODE"); v != "" {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || m > 0o777 {
+			return fmt.Errorf("invalid CREDENTIALS_FILE_MODE %q", v)
+		}
+		mode = os.FileMode(m)
+	}
+	format := "json"
+	if strings.HasSuffix(path, ".env") {
+		format = "dotenv"
+	}
+	b, err := c.document(format)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, mode); err != nil {
+		return err
+	}
+	// WriteFile's mode is subject to the umask
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
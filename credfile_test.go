@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsFilePath(t *testing.T) {
+	c := exportedCredential{Target: "Main", Project: "shop", Service: "web"}
+	if path, err := credentialsFilePath(c); path != "" || err != nil {
+		t.Errorf("credentialsFilePath without a directory = %q, %v", path, err)
+	}
+	t.Setenv("AUTOPG_MAIN_CREDENTIALS_DIR", "/run/autopg")
+	tests := []struct {
+		format, container, want, err string
+	}{
+		{"", "", "/run/autopg/shop_web/main.json", ""},
+		{"dotenv", "", "/run/autopg/shop_web/main.env", ""},
+		{"yaml", "", "", `unknown CREDENTIALS_FORMAT "yaml"; expected json or dotenv`},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_CREDENTIALS_FORMAT", tt.format)
+		path, err := credentialsFilePath(c)
+		if path != tt.want || (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("credentialsFilePath with %q = %q, %v, want %q %s", tt.format, path, err, tt.want, tt.err)
+		}
+	}
+	// a container name made of dots only stays inside the directory
+	t.Setenv("AUTOPG_MAIN_CREDENTIALS_FORMAT", "")
+	if path, _ := credentialsFilePath(exportedCredential{Target: "main", Container: ".."}); path != "/run/autopg/main.json" {
+		t.Errorf("credentialsFilePath of %q = %q", "..", path)
+	}
+}
+
+func TestCredentialsDocument(t *testing.T) {
+	c := exportedCredential{Target: "main", Host: "pg", Port: "5432", DB: "shop", User: "shop", Pass: `p@ss "w/rd"`}
+	if got := c.uri(); got != "postgres://shop:p%40ss%20%22w%2Frd%22@pg:5432/shop" {
+		t.Errorf("uri = %s", got)
+	}
+	b, err := c.document("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]string
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["engine"] != "postgres" || doc["password"] != c.Pass || doc["uri"] != c.uri() || len(doc) != 7 {
+		t.Errorf("json document %v", doc)
+	}
+	b, err = c.document("dotenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `PGHOST="pg"
+PGPORT="5432"
+PGDATABASE="shop"
+PGUSER="shop"
+PGPASSWORD="p@ss \"w/rd\""
+DATABASE_URL="postgres://shop:p%40ss%20%22w%2Frd%22@pg:5432/shop"
+`
+	if string(b) != want {
+		t.Errorf("dotenv document:\n%s\nwant\n%s", b, want)
+	}
+	if _, err := c.document("toml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestWriteCredentialsFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AUTOPG_MAIN_CREDENTIALS_DIR", dir)
+	t.Setenv("AUTOPG_MAIN_CREDENTIALS_FORMAT", "dotenv")
+	t.Setenv("AUTOPG_MAIN_CREDENTIALS_FILE_MODE", "0640")
+	c := exportedCredential{Target: "main", Host: "pg", Port: "5432", DB: "shop", User: "shop", Pass: "s3cret", Container: "shop-web-1"}
+	if err := writeCredentialsFile(c); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "shop-web-1", "main.env")
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0o640 {
+		t.Fatalf("credentials file %v, %v", fi, err)
+	}
+	b, _ := os.ReadFile(path)
+	if !strings.Contains(string(b), `PGPASSWORD="s3cret"`) {
+		t.Errorf("credentials file:\n%s", b)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left: %v", err)
+	}
+	for _, mode := range []string{"0800", "rw-r--r--", "01777"} {
+		t.Setenv("AUTOPG_MAIN_CREDENTIALS_FILE_MODE", mode)
+		if err := writeCredentialsFile(c); err == nil {
+			t.Errorf("file mode %q accepted", mode)
+		}
+	}
+}
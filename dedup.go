@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Per-service deduplication: the replicas of a compose service, and the containers recreated for it,
+// carry the same labels and are one logical unit. Once a container of a service was provisioned on a
+// target, the other ones are not provisioned again as long as the service's labels for that target (as
+// resolved) are unchanged. Replicas starting together wait for the first one rather than provisioning
+// in parallel. Retriggered runs, AUTOPG_<TARGET>_REAPPLY=always and containers with a deliver or
+// post_signal label, which each need their own copy or signal, still provision every container.
+// The record lives in memory, so after a restart each service is provisioned once more.
+//
+// Swarm tasks are grouped by their service ID instead, across the Docker hosts autopg watches, since
+// the replicas of a Swarm service run on several nodes. Deduplication is per autopg instance: one
+// instance watching the nodes (AUTOPG_DOCKER_HOSTS) provisions a Swarm service once, while instances
+// on each node would each provision it.
+
+type serviceKey struct {
+	target, host, project, service string
+}
+
+// serviceState is the provisioning state of a compose or Swarm service on a target.
+type serviceState struct {
+	mu          sync.Mutex // held while a container of the service is provisioned
+	fingerprint string     // of the labels last provisioned successfully
+}
+
+var (
+	servicesMu sync.Mutex
+	services   = map[serviceKey]*serviceState{}
+)
+
+// lockService locks and returns the state of c's Swarm service, or compose service on the Docker host
+// of ctx, on target, or returns nil for a container of neither.
+func lockService(ctx context.Context, target string, c types.Container) *serviceState {
+	project, service := c.Labels["com.docker.compose.project"], c.Labels["com.docker.compose.service"]
+	key := serviceKey{target, dockerHostName(ctx), project, service}
+	if id := c.Labels["com.docker.swarm.service.id"]; id != "" {
+		key = serviceKey{target: target, service: id}
+	} else if project == "" || service == "" {
+		return nil
+	}
+	servicesMu.Lock()
+	s := services[key]
+	if s == nil {
+		s = &serviceState{}
+		services[key] = s
+	}
+	servicesMu.Unlock()
+	s.mu.Lock()
+	return s
+}
+
+// serviceFingerprint identifies the autopg labels of target in labels.
+func serviceFingerprint(target string, labels map[string]string) string {
+	sum := sha256.Sum256([]byte(labelSigPayload(target, labels)))
+	return hex.EncodeToString(sum[:])
+}
+
+// forgetProject drops the records of the compose services of project on the Docker host, so a project
+// brought up again after a teardown is provisioned again.
+func forgetProject(host, project string) {
+	servicesMu.Lock()
+	defer servicesMu.Unlock()
+	for key := range services {
+		if key.host == host && key.project == project {
+			delete(services, key)
+		}
+	}
+}
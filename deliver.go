@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Delivery by exec: with autopg.<target>.deliver=<path> the connection info is written into the app
+// container after provisioning by running a shell there (docker exec), typically onto a tmpfs, so it
+// needs neither a shared volume nor secrets in labels. The container needs sh, cat and mv.
+
+// deliverScript writes stdin to $1 through a temporary file, readable only by the container's user.
+const deliverScript = `umask 077 && mkdir -p "$(dirname "$1")" && cat > "$1.tmp" && mv "$1.tmp" "$1"`
+
+// deliveryContent renders what spec delivers for c: autopg.<target>.deliver_template, a Go template
+// over .Host, .Port, .DB, .User, .Pass and .URI, or else the deliver_format document (json by default).
+func deliveryContent(spec provisionSpec, c exportedCredential) ([]byte, error) {
+	if spec.DeliverTemplate == "" {
+		format := spec.DeliverFormat
+		if format == "" {
+			format = "json"
+		}
+		return c.document(format)
+	}
+	tmpl, err := template.New("deliver").Option("missingkey=error").Parse(spec.DeliverTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deliver_template: %w", err)
+	}
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, map[string]string{
+		"Host": c.Host, "Port": c.Port, "DB": c.DB, "User": c.User, "Pass": c.Pass, "URI": c.uri(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("expand deliver_template: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// deliverCredentials writes the connection info of c to spec.Deliver inside the container id.
+func deliverCredentials(ctx context.Context, cli *client.Client, id string, spec provisionSpec, c exportedCredential) error {
+	content, err := deliveryContent(spec, c)
+	if err != nil {
+		return err
+	}
+	code, _, stderr, err := containerExec(ctx, cli, id, container.ExecOptions{
+		Cmd: []string{"sh", "-c", deliverScript, "sh", spec.Deliver},
+	}, content)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("writing %s exited with %d: %s", spec.Deliver, code, strings.TrimSpace(string(stderr)))
+	}
+	return nil
+}
+
+// containerExec runs opts.Cmd in the container id with stdin as its input, and returns its exit code
+// and output.
+func containerExec(ctx context.Context, cli *client.Client, id string, opts container.ExecOptions, stdin []byte) (int, []byte, []byte, error) {
+	opts.AttachStdin, opts.AttachStdout, opts.AttachStderr = true, true, true
+	exec, err := cli.ContainerExecCreate(ctx, id, opts)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("exec create failed: %w", err)
+	}
+	resp, err := cli.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("exec attach failed: %w", err)
+	}
+	defer resp.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = resp.Conn.SetDeadline(deadline)
+	}
+	if _, err := resp.Conn.Write(stdin); err != nil {
+		return 0, nil, nil, fmt.Errorf("write to exec failed: %w", err)
+	}
+	if err := resp.CloseWrite(); err != nil {
+		return 0, nil, nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, resp.Reader); err != nil {
+		return 0, nil, nil, fmt.Errorf("read exec output failed: %w", err)
+	}
+	inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("exec inspect failed: %w", err)
+	}
+	return inspect.ExitCode, stdout.Bytes(), stderr.Bytes(), nil
+}
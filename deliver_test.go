@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeliveryContent(t *testing.T) {
+	c := exportedCredential{Target: "main", Host: "pg", Port: "5432", DB: "shop", User: "shop", Pass: "s3cret"}
+	tests := []struct {
+		name string
+		spec provisionSpec
+		want string
+		err  string
+	}{
+		{"template", provisionSpec{DeliverTemplate: "spring.datasource.url=jdbc:postgresql://{{.Host}}:{{.Port}}/{{.DB}}\n" +
+			"spring.datasource.password={{.Pass}}\n"},
+			"spring.datasource.url=jdbc:postgresql://pg:5432/shop\nspring.datasource.password=s3cret\n", ""},
+		{"URI", provisionSpec{DeliverTemplate: "{{.URI}}", DeliverFormat: "dotenv"}, "postgres://shop:s3cret@pg:5432/shop", ""},
+		{"dotenv", provisionSpec{DeliverFormat: "dotenv"}, `PGPASSWORD="s3cret"`, ""},
+		{"json by default", provisionSpec{}, `"uri": "postgres://shop:s3cret@pg:5432/shop"`, ""},
+		{"unknown key", provisionSpec{DeliverTemplate: "{{.Password}}"}, "", "expand deliver_template"},
+		{"invalid template", provisionSpec{DeliverTemplate: "{{.Pass"}, "", "invalid deliver_template"},
+		{"unknown format", provisionSpec{DeliverFormat: "xml"}, "", `unknown credentials format "xml"`},
+	}
+	for _, tt := range tests {
+		got, err := deliveryContent(tt.spec, c)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: %q, %v, want error %s", tt.name, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !strings.Contains(string(got), tt.want) {
+			t.Errorf("%s: %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// TestDeliverScript runs the script delivering the connection info, as a container's sh would.
+func TestDeliverScript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "secrets", "db.json")
+	cmd := exec.Command("sh", "-c", deliverScript, "sh", path)
+	cmd.Stdin = strings.NewReader(`{"password":"s3cret"}`)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != `{"password":"s3cret"}` {
+		t.Errorf("delivered %q, %v", b, err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o600 {
+		t.Errorf("delivered file mode %v, want 0600", fi.Mode().Perm())
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Dependents of a target container: when a container providing a target starts (autopg.target, or named
+// by AUTOPG_<TARGET>_CONTAINER), e.g. recreated with an empty volume, autopg waits for the server to
+// accept connections and provisions again the running containers of the same Docker host that use the
+// target, as `autopg retrigger` does. AUTOPG_REPROVISION_ON_TARGET_START=false turns it off.
+
+// targetStartWait bounds how many openAdmin rounds (about 30s each) wait for a started target.
+const targetStartWait = 4
+
+// providedTargets returns the targets container c provides.
+func providedTargets(c types.Container) []string {
+	targets := containerTargetNames(c)
+	if name := c.Labels[discoveryLabel]; name != "" && discoveryAllowed(name) {
+		targets = append(targets, name)
+	}
+	return targets
+}
+
+// reprovisionDependents provisions again, on targets, the containers using them, after the container c
+// providing them started.
+func reprovisionDependents(cli *client.Client, ctx context.Context, c types.Container, targets []string) {
+	if os.Getenv("AUTOPG_REPROVISION_ON_TARGET_START") == "false" {
+		return
+	}
+	discoverTarget(ctx, cli, c)
+	containerTargets(ctx, cli, c)
+	var ready []string
+	for _, target := range targets {
+		if waitForTarget(ctx, target) {
+			ready = append(ready, target)
+		}
+	}
+	if len(ready) == 0 {
+		return
+	}
+	containers, err := listClients(ctx, cli)
+	if err != nil {
+		logf(ctx, "container list error: %v", err)
+		return
+	}
+	n := 0
+	for _, dep := range containers {
+		if dep.ID == c.ID || dep.State != "running" {
+			continue
+		}
+		labels, err := expandConfigLabels(withEnvSpec(ctx, cli, dep).Labels)
+		if err != nil {
+			continue
+		}
+		uses := labelTargets(labels)
+		for _, target := range ready {
+			if usesTarget(uses, target) {
+				n++
+				processContainer(cli, withForce(withRequestID(ctx, newRequestID())), dep, nil)
+				break
+			}
+		}
+	}
+	if n > 0 {
+		logf(ctx, "target container %s started: provisioned %d dependent container(s) again on %s", displayName(c), n, strings.Join(ready, ", "))
+	}
+}
+
+// usesTarget reports whether targets has target, compared in their env form since targets named by
+// AUTOPG_<TARGET>_CONTAINER are uppercased.
+func usesTarget(targets map[string]struct{}, target string) bool {
+	for t := range targets {
+		if toEnvKey(t, "") == toEnvKey(target, "") {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForTarget waits until target accepts admin connections, reporting whether it does.
+func waitForTarget(ctx context.Context, target string) bool {
+	var err error
+	for i := 0; i < targetStartWait; i++ {
+		host, port, admin, adminPass, ok := getAdminCredsForTarget(target)
+		if !ok {
+			logf(ctx, "no admin creds for target %s in this instance; not provisioning its dependents", target)
+			return false
+		}
+		db, e := openAdmin(withTarget(ctx, target), host, port, admin, adminPass, "")
+		if err = e; err == nil {
+			db.Close()
+			return true
+		}
+	}
+	logf(ctx, "target %s did not come up; not provisioning its dependents: %v", target, err)
+	return false
+}
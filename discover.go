@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// Target discovery: with AUTOPG_DISCOVER_TARGETS=true (or a list of allowed names), a Postgres container registers itself as a target
+// with autopg.target=<name>, its settings being autopg.target.<key> labels (host, port, admin,
+// admin_pass, sslmode...) that become AUTOPG_<NAME>_<KEY> as with the configuration file. Values may
+// point into the Postgres container with env: and file: (see resolve.go), e.g.
+// autopg.target.admin_pass=env:POSTGRES_PASSWORD. host defaults to the container's address on a network
+// shared with autopg (see networks.go), port to 5432 and admin to postgres.
+//
+// A target configured in autopg's environment is never taken over, and a name stays with the container
+// that claimed it first while that container exists.
+
+// discoveryLabel names the target a Postgres container provides.
+var discoveryLabel = labelPrefix + "target"
+
+var discovered = struct {
+	sync.Mutex
+	owners map[string]discoveryOwner
+	keys   map[string]bool // variables set by discovery
+}{owners: map[string]discoveryOwner{}, keys: map[string]bool{}}
+
+// discoveryOwner is the container providing a discovered target.
+type discoveryOwner struct {
+	host, id string
+}
+
+// discoveryAllowed reports whether a container may provide target, per AUTOPG_DISCOVER_TARGETS: true
+// for any name, or a comma-separated list of names.
+func discoveryAllowed(target string) bool {
+	v := os.Getenv("AUTOPG_DISCOVER_TARGETS")
+	return v == "true" || contains(splitList(v), target)
+}
+
+// discoverTargets registers the targets declared by containers, and the hosts of those named by
+// AUTOPG_<TARGET>_CONTAINER, before their clients are processed.
+func discoverTargets(ctx context.Context, cli *client.Client, containers []types.Container) {
+	for _, c := range containers {
+		discoverTarget(ctx, cli, c)
+		containerTargets(ctx, cli, c)
+	}
+}
+
+// discoverTarget registers the target c declares, if any.
+func discoverTarget(ctx context.Context, cli *client.Client, c types.Container) {
+	name := c.Labels[discoveryLabel]
+	if name == "" {
+		return
+	}
+	if !discoveryAllowed(name) {
+		if os.Getenv("AUTOPG_DISCOVER_TARGETS") != "" {
+			logf(ctx, "container %s declares target %s, not allowed by AUTOPG_DISCOVER_TARGETS; ignoring", displayName(c), name)
+		}
+		return
+	}
+	discovered.Lock()
+	defer discovered.Unlock()
+	owner, known := discovered.owners[name]
+	self := discoveryOwner{dockerHostName(ctx), c.ID}
+	if !known && os.Getenv(toEnvKey(name, "HOST")) != "" {
+		logf(ctx, "container %s declares target %s, which is configured in the environment; ignoring", displayName(c), name)
+		return
+	}
+	if known && owner != self {
+		gone := false
+		if owner.host == self.host {
+			_, err := cli.ContainerInspect(ctx, owner.id)
+			gone = errdefs.IsNotFound(err)
+		}
+		if !gone {
+			logf(ctx, "container %s declares target %s, already provided by container %s; ignoring", displayName(c), name, owner.id[:12])
+			return
+		}
+	}
+	labels, err := resolveLabelValues(ctx, cli, c.ID, c.Labels)
+	if err != nil {
+		logf(ctx, "container %s: target %s: %v", displayName(c), name, err)
+		return
+	}
+	settings := map[string]string{"PORT": "5432", "ADMIN": "postgres"}
+	if labels[discoveryLabel+".host"] == "" {
+		host, err := containerAddress(ctx, cli, c)
+		if err != nil {
+			logf(ctx, "container %s declares target %s: %v; set %s.host", displayName(c), name, err, discoveryLabel)
+			return
+		}
+		settings["HOST"] = host
+	}
+	for k, v := range labels {
+		if key, ok := strings.CutPrefix(k, discoveryLabel+"."); ok && key != "" {
+			settings[strings.ToUpper(key)] = v
+		}
+	}
+	if settings["ADMIN_PASS"] == "" {
+		logf(ctx, "container %s declares target %s without %s.admin_pass; ignoring", displayName(c), name, discoveryLabel)
+		return
+	}
+	registerSecret("admin password of target "+name, settings["ADMIN_PASS"])
+	var keys []string
+	for field, v := range settings {
+		key := toEnvKey(name, field)
+		if _, set := os.LookupEnv(key); set && !discovered.keys[key] {
+			continue
+		}
+		os.Setenv(key, v)
+		discovered.keys[key] = true
+		keys = append(keys, strings.ToLower(field))
+	}
+	discovered.owners[name] = self
+	if owner != self {
+		sort.Strings(keys)
+		logf(ctx, "discovered target %s from container %s (%s)", name, displayName(c), strings.Join(keys, ", "))
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+)
+
+// dockerSocketCandidates lists where the Docker socket lives, rootful first, then rootless.
+func dockerSocketCandidates() []string {
+	paths := []string{"/var/run/docker.sock"}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "docker.sock"))
+	}
+	return append(paths, fmt.Sprintf("/run/user/%d/docker.sock", os.Getuid()))
+}
+
+// newDockerClient connects to DOCKER_HOST when set, otherwise to the first socket found, which
+// covers rootless Docker where the socket lives in the user's runtime dir.
+func newDockerClient() (*client.Client, error) {
+	if name := currentDockerContext(); name != "" && name != "default" {
+		return dockerContextClient(name)
+	}
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if os.Getenv("DOCKER_HOST") == "" {
+		for _, p := range dockerSocketCandidates() {
+			if _, err := os.Stat(p); err == nil {
+				opts = append(opts, client.WithHost("unix://"+p))
+				break
+			}
+		}
+	}
+	return client.NewClientWithOpts(opts...)
+}
+
+// dockerHost is a Docker engine autopg watches, named in logs and history when there are several.
+type dockerHost struct {
+	name string
+	cli  *client.Client
+}
+
+// dockerHosts returns the engines of AUTOPG_DOCKER_HOSTS, a comma-separated list of [name=]endpoint
+// (unix:// or tcp://) or docker context name, named after their address or context by default, or else
+// the single unnamed engine of newDockerClient. The TLS material of a tcp endpoint is set per host (see dockerHostTLS) or, for all of
+// them, by DOCKER_CERT_PATH and DOCKER_TLS_VERIFY.
+func dockerHosts() ([]dockerHost, error) {
+	list := splitList(os.Getenv("AUTOPG_DOCKER_HOSTS"))
+	if len(list) == 0 {
+		cli, err := newDockerClient()
+		if err != nil {
+			return nil, err
+		}
+		return []dockerHost{{cli: cli}}, nil
+	}
+	var hosts []dockerHost
+	seen := map[string]bool{}
+	for _, item := range list {
+		name, endpoint, ok := strings.Cut(item, "=")
+		if !ok {
+			endpoint = item
+			u, err := url.Parse(endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("invalid docker host %q: %w", endpoint, err)
+			}
+			if name = u.Host; name == "" {
+				name = u.Path
+			}
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("docker host %s listed twice in AUTOPG_DOCKER_HOSTS", name)
+		}
+		seen[name] = true
+		if !strings.Contains(endpoint, "://") {
+			cli, err := dockerContextClient(endpoint)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, dockerHost{name: name, cli: cli})
+			continue
+		}
+		opts := []client.Opt{client.FromEnv, client.WithHost(endpoint), client.WithAPIVersionNegotiation()}
+		tlsOpt, err := dockerHostTLS(name)
+		if err != nil {
+			return nil, err
+		}
+		if tlsOpt != nil {
+			opts = append(opts, tlsOpt)
+		} else if strings.HasPrefix(endpoint, "tcp://") && os.Getenv("DOCKER_CERT_PATH") == "" {
+			log.Printf("warning: docker host %s is reached over plain TCP; set %s", name, dockerHostEnvKey(name, "CERT_PATH"))
+		}
+		cli, err := client.NewClientWithOpts(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("docker host %s: %w", name, err)
+		}
+		hosts = append(hosts, dockerHost{name: name, cli: cli})
+	}
+	return hosts, nil
+}
+
+// dockerHostEnvKey returns the name of the AUTOPG_DOCKER_<HOST>_<FIELD> setting of the named host.
+func dockerHostEnvKey(name, field string) string {
+	return "AUTOPG_DOCKER_" + regexp.MustCompile(`[^A-Z0-9]`).ReplaceAllString(strings.ToUpper(name), "_") + "_" + field
+}
+
+// dockerHostTLS returns the client option for the TLS material of the named host, or nil when it has
+// none of its own:
+//   - AUTOPG_DOCKER_<HOST>_CERT_PATH is a directory holding ca.pem, cert.pem and key.pem, as for the
+//     docker CLI;
+//   - AUTOPG_DOCKER_<HOST>_TLS_CA, _TLS_CERT and _TLS_KEY name the files one by one, overriding those.
+//
+// The server certificate is always verified, against the CA when given, else the system roots.
+func dockerHostTLS(name string) (client.Opt, error) {
+	var ca, cert, key string
+	if dir := os.Getenv(dockerHostEnvKey(name, "CERT_PATH")); dir != "" {
+		ca, cert, key = filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	}
+	for field, v := range map[string]*string{"TLS_CA": &ca, "TLS_CERT": &cert, "TLS_KEY": &key} {
+		if f := os.Getenv(dockerHostEnvKey(name, field)); f != "" {
+			*v = f
+		}
+	}
+	if ca == "" && cert == "" && key == "" {
+		return nil, nil
+	}
+	if (cert == "") != (key == "") {
+		return nil, fmt.Errorf("docker host %s: %s and %s go together", name, dockerHostEnvKey(name, "TLS_CERT"), dockerHostEnvKey(name, "TLS_KEY"))
+	}
+	for _, f := range []string{ca, cert, key} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return nil, fmt.Errorf("docker host %s: %w", name, err)
+		}
+	}
+	return client.WithTLSClientConfig(ca, cert, key), nil
+}
+
+// context returns ctx tagged with the name of h.
+func (h dockerHost) context(ctx context.Context) context.Context {
+	if h.name == "" {
+		return ctx
+	}
+	return withDockerHost(ctx, h.name)
+}
+
+// listAndProcessAll rescans the containers of every host.
+func listAndProcessAll(hosts []dockerHost, ctx context.Context) {
+	for _, h := range hosts {
+		listAndProcess(h.cli, h.context(ctx))
+	}
+}
+
+// dockerFeatures lists the daemon capabilities autopg relies on that older API versions lack. On an
+// older engine the feature is disabled and autopg falls back to what the API offers.
+var dockerFeatures = []struct {
+	Name   string
+	MinAPI string
+}{
+	{"event type filter", "1.22"},
+	{"event actor", "1.22"},
+	{"named security options", "1.25"},
+}
+
+// dockerSupports reports whether feature is available on the API version negotiated by cli.
+func dockerSupports(cli *client.Client, feature string) bool {
+	for _, f := range dockerFeatures {
+		if f.Name == feature {
+			return !versions.LessThan(cli.ClientVersion(), f.MinAPI)
+		}
+	}
+	return true
+}
+
+// disabledDockerFeatures lists the features the negotiated API version lacks.
+func disabledDockerFeatures(cli *client.Client) []string {
+	var disabled []string
+	for _, f := range dockerFeatures {
+		if !dockerSupports(cli, f.Name) {
+			disabled = append(disabled, fmt.Sprintf("%s (API %s+)", f.Name, f.MinAPI))
+		}
+	}
+	return disabled
+}
+
+// dockerMode describes how the daemon isolates users: "rootful", "rootless" or "userns-remap".
+func dockerMode(ctx context.Context, cli *client.Client) (string, error) {
+	if !dockerSupports(cli, "named security options") {
+		return "", fmt.Errorf("not reported by Docker API %s", cli.ClientVersion())
+	}
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, opt := range info.SecurityOptions {
+		switch {
+		case strings.Contains(opt, "name=rootless"):
+			return "rootless", nil
+		case strings.Contains(opt, "name=userns"):
+			return "userns-remap", nil
+		}
+	}
+	return "rootful", nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// Docker contexts: `autopg --context <name> [command]`, DOCKER_CONTEXT, or else the current context of
+// the docker CLI when DOCKER_HOST is unset, selects a docker CLI context, whose endpoint and TLS
+// material are read from $DOCKER_CONFIG (default ~/.docker) the way the CLI does. In AUTOPG_DOCKER_HOSTS
+// an entry without "://" names a context. The "default" context is the usual DOCKER_HOST and socket
+// discovery. Mount the docker config directory read-only into the autopg container to use them.
+
+// dockerContextFlag is the --context given on the command line.
+var dockerContextFlag string
+
+// parseContextFlag removes a leading --context flag from args and records it.
+func parseContextFlag(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return args, nil
+	}
+	if name, ok := strings.CutPrefix(args[0], "--context="); ok {
+		dockerContextFlag = name
+		return args[1:], nil
+	}
+	if args[0] == "--context" || args[0] == "-c" {
+		if len(args) < 2 || args[1] == "" {
+			return nil, errors.New("--context needs a context name")
+		}
+		dockerContextFlag = args[1]
+		return args[2:], nil
+	}
+	return args, nil
+}
+
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// currentDockerContext returns the context selected as by the docker CLI, "" for none.
+func currentDockerContext() string {
+	if dockerContextFlag != "" {
+		return dockerContextFlag
+	}
+	if name := os.Getenv("DOCKER_CONTEXT"); name != "" {
+		return name
+	}
+	if os.Getenv("DOCKER_HOST") != "" {
+		return ""
+	}
+	b, err := os.ReadFile(filepath.Join(dockerConfigDir(), "config.json"))
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	if json.Unmarshal(b, &config) != nil {
+		return ""
+	}
+	return config.CurrentContext
+}
+
+// dockerContextClient connects to the docker endpoint of the named context.
+func dockerContextClient(name string) (*client.Client, error) {
+	id := sha256.Sum256([]byte(name))
+	dir := hex.EncodeToString(id[:])
+	b, err := os.ReadFile(filepath.Join(dockerConfigDir(), "contexts", "meta", dir, "meta.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("docker context %q not found in %s", name, dockerConfigDir())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("docker context %q: %w", name, err)
+	}
+	var meta struct {
+		Endpoints map[string]struct {
+			Host          string
+			SkipTLSVerify bool
+		}
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("docker context %q: %w", name, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return nil, fmt.Errorf("docker context %q has no docker endpoint", name)
+	}
+	if strings.HasPrefix(endpoint.Host, "ssh://") {
+		return nil, fmt.Errorf("docker context %q: ssh endpoints are not supported; use a tcp endpoint with TLS", name)
+	}
+	transport := &http.Transport{}
+	tlsDir := filepath.Join(dockerConfigDir(), "contexts", "tls", dir, "docker")
+	if _, err := os.Stat(tlsDir); err == nil {
+		config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: endpoint.SkipTLSVerify}
+		if ca, err := os.ReadFile(filepath.Join(tlsDir, "ca.pem")); err == nil {
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("docker context %q: ca.pem has no certificates", name)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(tlsDir, "cert.pem")); err == nil {
+			pair, err := tls.LoadX509KeyPair(filepath.Join(tlsDir, "cert.pem"), filepath.Join(tlsDir, "key.pem"))
+			if err != nil {
+				return nil, fmt.Errorf("docker context %q: %w", name, err)
+			}
+			config.Certificates = []tls.Certificate{pair}
+		}
+		transport.TLSClientConfig = config
+	} else if endpoint.SkipTLSVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return client.NewClientWithOpts(
+		client.WithHTTPClient(&http.Client{Transport: transport, CheckRedirect: client.CheckRedirect}),
+		client.WithHost(endpoint.Host),
+		client.WithAPIVersionNegotiation(),
+	)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// Docker secret store. With "docker" in AUTOPG_<TARGET>_CREDENTIAL_STORES each generated password becomes
+// a Swarm secret of the engine autopg watches, named after the service, so the app can mount it
+// (/run/secrets/<name>) instead of reading it from labels or logs. The engine must be a Swarm manager.
+//
+// With AUTOPG_<TARGET>_DOCKER_SECRET_MOUNT=true, autopg also mounts the secret into the Swarm service
+// whose task asked for the credentials, at /run/secrets/<name>. Secrets are then versioned by content
+// (<name>_<hash>), since the one a service uses can't be replaced: a new password is a new secret the
+// service is updated to (a rolling update), and the versions no longer used are removed on later runs.
+// The mount is checked on every run, so a `docker stack deploy` that drops it gets it back.
+
+// dockerSecretName is <prefix><target>_<project>_<service> (the container name outside compose), with
+// the prefix AUTOPG_<TARGET>_DOCKER_SECRET_PREFIX, "autopg_" by default.
+func dockerSecretName(c exportedCredential) string {
+	prefix := targetSetting(c.Target, "DOCKER_SECRET_PREFIX")
+	if prefix == "" {
+		prefix = "autopg_"
+	}
+	name := safeNameRe.ReplaceAllString(prefix+strings.ToLower(c.Target), "_") + "_" + c.serviceName()
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// dockerStoreCredential creates the secret for c. Its content is the password alone, as the
+// *_PASSWORD_FILE conventions of most images expect, or with AUTOPG_<TARGET>_DOCKER_SECRET_FORMAT=json
+// the JSON document the other stores write. Secrets are immutable, so an existing one is replaced; that
+// fails while a service still uses it.
+func dockerStoreCredential(ctx context.Context, c exportedCredential) error {
+	data, err := dockerSecretData(c)
+	if err != nil {
+		return err
+	}
+	cli, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	if dockerSecretMount(c.Target) && c.SwarmService != "" {
+		return mountDockerSecret(ctx, cli, c, data)
+	}
+	name := dockerSecretName(c)
+	existing, err := cli.SecretList(ctx, swarm.SecretListOptions{Filters: filters.NewArgs(filters.Arg("name", name))})
+	if err != nil {
+		return fmt.Errorf("list secrets (is the engine a Swarm manager?): %w", err)
+	}
+	for _, s := range existing {
+		if s.Spec.Name != name {
+			continue // the name filter matches prefixes
+		}
+		if err := cli.SecretRemove(ctx, s.ID); err != nil {
+			return fmt.Errorf("replace secret %s: %w", name, err)
+		}
+	}
+	spec := swarm.SecretSpec{
+		Annotations: swarm.Annotations{
+			Name: name,
+			Labels: map[string]string{
+				"autopg.target":    c.Target,
+				"autopg.container": c.Container,
+				"autopg.project":   c.Project,
+				"autopg.user":      c.User,
+			},
+		},
+		Data: data,
+	}
+	if _, err := cli.SecretCreate(ctx, spec); err != nil {
+		return fmt.Errorf("create secret %s: %w", name, err)
+	}
+	return nil
+}
+
+// dockerSecretData is the content of the secret for c.
+func dockerSecretData(c exportedCredential) ([]byte, error) {
+	switch format := targetSetting(c.Target, "DOCKER_SECRET_FORMAT"); format {
+	case "", "password":
+		return []byte(c.Pass), nil
+	case "json":
+		return json.Marshal(c.secretValue())
+	default:
+		return nil, fmt.Errorf("unknown DOCKER_SECRET_FORMAT %q; expected password or json", format)
+	}
+}
+
+func dockerSecretMount(target string) bool {
+	return targetSetting(target, "DOCKER_SECRET_MOUNT") == "true"
+}
+
+// mountDockerSecret creates the version of the secret for c holding data, unless it exists, and mounts
+// it into c's Swarm service in place of the previous one.
+func mountDockerSecret(ctx context.Context, cli *client.Client, c exportedCredential, data []byte) error {
+	base := dockerSecretName(c)
+	sum := sha256.Sum256(data)
+	name := base
+	if len(name) > 55 {
+		name = name[:55]
+	}
+	name += "_" + hex.EncodeToString(sum[:4])
+	versions, err := cli.SecretList(ctx, swarm.SecretListOptions{Filters: filters.NewArgs(filters.Arg("label", "autopg.secret="+base))})
+	if err != nil {
+		return fmt.Errorf("list secrets (is the engine a Swarm manager?): %w", err)
+	}
+	id := ""
+	for _, s := range versions {
+		if s.Spec.Name == name {
+			id = s.ID
+		}
+	}
+	if id == "" {
+		resp, err := cli.SecretCreate(ctx, swarm.SecretSpec{
+			Annotations: swarm.Annotations{
+				Name: name,
+				Labels: map[string]string{
+					"autopg.secret":    base,
+					"autopg.target":    c.Target,
+					"autopg.container": c.Container,
+					"autopg.project":   c.Project,
+					"autopg.user":      c.User,
+				},
+			},
+			Data: data,
+		})
+		if err != nil {
+			return fmt.Errorf("create secret %s: %w", name, err)
+		}
+		id = resp.ID
+	}
+	svc, _, err := cli.ServiceInspectWithRaw(ctx, c.SwarmService, swarm.ServiceInspectOptions{})
+	if err != nil {
+		return fmt.Errorf("inspect service: %w", err)
+	}
+	spec := svc.Spec
+	if spec.TaskTemplate.ContainerSpec == nil {
+		return fmt.Errorf("service %s has no container spec", spec.Name)
+	}
+	refs := []*swarm.SecretReference{{
+		File:     &swarm.SecretReferenceFileTarget{Name: base, UID: "0", GID: "0", Mode: 0o444},
+		SecretID: id, SecretName: name,
+	}}
+	mounted := false
+	for _, ref := range spec.TaskTemplate.ContainerSpec.Secrets {
+		if ref.SecretID == id && ref.File != nil && ref.File.Name == base {
+			mounted = true
+		}
+		if ref.File == nil || ref.File.Name != base {
+			refs = append(refs, ref)
+		}
+	}
+	if !mounted {
+		spec.TaskTemplate.ContainerSpec.Secrets = refs
+		if _, err := cli.ServiceUpdate(ctx, svc.ID, svc.Version, spec, swarm.ServiceUpdateOptions{}); err != nil {
+			return fmt.Errorf("mount secret %s into service %s: %w", name, spec.Name, err)
+		}
+		logf(ctx, "mounted secret %s into service %s at /run/secrets/%s", name, spec.Name, base)
+	}
+	// versions still used by old tasks can't be removed yet; later runs retry
+	for _, s := range versions {
+		if s.ID != id {
+			_ = cli.SecretRemove(ctx, s.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runDoctor implements `autopg doctor`: reports the environment autopg runs in and what it can reach.
+func runDoctor() error {
+	ctx := context.Background()
+	problems := 0
+	report := func(ok bool, format string, args ...any) {
+		mark := "ok  "
+		if !ok {
+			mark = "FAIL"
+			problems++
+		}
+		fmt.Printf("[%s] %s\n", mark, redact(fmt.Sprintf(format, args...)))
+	}
+
+	hosts, err := dockerHosts()
+	if err != nil {
+		report(false, "docker client: %v", err)
+	}
+	for _, h := range hosts {
+		cli, prefix := h.cli, ""
+		if h.name != "" {
+			prefix = h.name + ": "
+		}
+		report(true, "%sdocker endpoint: %s", prefix, cli.DaemonHost())
+		if v, err := cli.ServerVersion(ctx); err != nil {
+			report(false, "%sdocker daemon unreachable: %v", prefix, err)
+		} else {
+			report(true, "%sdocker %s (API %s, negotiated %s)", prefix, v.Version, v.APIVersion, cli.ClientVersion())
+			if disabled := disabledDockerFeatures(cli); len(disabled) > 0 {
+				report(true, "%sdisabled on this API version: %s", prefix, strings.Join(disabled, ", "))
+			}
+			mode, err := dockerMode(ctx, cli)
+			report(err == nil, "%sdocker mode: %s", prefix, modeDescription(mode, err))
+		}
+	}
+
+	dir := dataDir()
+	if err := checkWritable(dir); err != nil {
+		report(false, "data dir %s: %v", dir, err)
+	} else {
+		report(true, "data dir %s is writable (uid %d)", dir, os.Getuid())
+	}
+	if provisioningPaused() {
+		report(true, "provisioning: paused")
+	} else {
+		report(true, "provisioning: active")
+	}
+
+	targets := configuredTargets()
+	if len(targets) == 0 {
+		report(false, "no targets configured (AUTOPG_<TARGET>_HOST)")
+	}
+	for _, t := range targets {
+		host, port, admin, _, ok := getAdminCredsForTarget(t)
+		report(ok, "target %s: %s:%s as %s", t, host, port, admin)
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
+func modeDescription(mode string, err error) string {
+	switch {
+	case err != nil:
+		return fmt.Sprintf("unknown (%v)", err)
+	case mode == "rootless":
+		return "rootless; the socket lives in the user's runtime dir and files autopg writes on bind mounts are owned by that user on the host"
+	case mode == "userns-remap":
+		return "userns-remap; files autopg writes on bind mounts are owned by the remapped uid on the host"
+	}
+	return mode
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// hostSettings are the settings other than a target's own HOST whose variables end in _HOST.
+var hostSettings = []string{"FDW", "SSH"}
+
+// configuredTargets returns the targets with a AUTOPG_<TARGET>_HOST or AUTOPG_<TARGET>_ADMIN variable, in
+// their env form (uppercased), which getAdminCredsForTarget accepts as well. AUTOPG_<TARGET>_FDW_HOST,
+// AUTOPG_SSH_HOST and the like are settings, not targets.
+func configuredTargets() []string {
+	seen := map[string]bool{}
+	var targets []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(k, "AUTOPG_") {
+			continue
+		}
+		target, isHost := strings.CutSuffix(strings.TrimPrefix(k, "AUTOPG_"), "_HOST")
+		if !isHost {
+			var isAdmin bool
+			if target, isAdmin = strings.CutSuffix(strings.TrimPrefix(k, "AUTOPG_"), "_ADMIN"); !isAdmin {
+				continue
+			}
+		}
+		if target == "" || seen[target] {
+			continue
+		}
+		if isHost && isHostSetting(target) {
+			continue
+		}
+		seen[target] = true
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// isHostSetting reports whether name, from a AUTOPG_<name>_HOST variable, is one of hostSettings, global or
+// of a target, rather than a target.
+func isHostSetting(name string) bool {
+	for _, s := range hostSettings {
+		if name == s || strings.HasSuffix(name, "_"+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// userDataDir is the data dir fallback when /var/lib/autopg isn't writable, e.g. autopg running
+// directly on a rootless Docker host as an unprivileged user.
+func userDataDir() string {
+	if d := os.Getenv("XDG_STATE_HOME"); d != "" {
+		return filepath.Join(d, "autopg")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "autopg")
+	}
+	return ""
+}
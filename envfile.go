@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fileEnvVars lists the non-autopg variables that may also be given as <NAME>_FILE.
+var fileEnvVars = []string{"VAULT_TOKEN", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AZURE_CLIENT_SECRET"}
+
+// fileEnvSources maps each variable set by loadFileEnv to its file, for reloadFileEnv.
+var fileEnvSources = map[string]string{}
+
+// loadFileEnv follows the convention of the official images: for every AUTOPG_* variable (and the
+// credential variables above) given as <NAME>_FILE, e.g. AUTOPG_MAIN_ADMIN_PASS_FILE=/run/secrets/pg,
+// <NAME> is set to the file's content without its trailing newline. Setting both is an error.
+func loadFileEnv() error {
+	for _, kv := range os.Environ() {
+		key, path, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutSuffix(key, "_FILE")
+		if !ok || !(strings.HasPrefix(name, "AUTOPG_") || contains(fileEnvVars, name)) {
+			continue
+		}
+		if _, set := os.LookupEnv(name); set {
+			return fmt.Errorf("both %s and %s are set", name, key)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		os.Setenv(name, strings.TrimRight(string(b), "\r\n"))
+		fileEnvSources[name] = path
+	}
+	return nil
+}
+
+// reloadFileEnv reads the files of loadFileEnv again, picking up rotated secrets. It is only called from
+// the provisioning loop, after startup.
+func reloadFileEnv() error {
+	for name, path := range fileEnvSources {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %w", name, err)
+		}
+		os.Setenv(name, strings.TrimRight(string(b), "\r\n"))
+	}
+	return nil
+}
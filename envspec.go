@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Specs in the environment: with AUTOPG_ENV_SPEC=true, a container may ask for provisioning through its
+// environment rather than labels, for orchestration layers that template env more easily: AUTOPG_TARGET
+// names the target, and AUTOPG_<FIELD> variables (AUTOPG_DB, AUTOPG_USER, AUTOPG_PASS, AUTOPG_SCHEMA...)
+// stand for the autopg.<target>.<field> labels, field in lower case. A label set on the container wins
+// over the same variable. Reading the environment takes an inspect per container, and every scan lists
+// all containers (see listing.go).
+
+var envFieldRe = regexp.MustCompile(`^AUTOPG_([A-Z0-9_]+)=(.*)$`)
+
+func envSpecEnabled() bool {
+	return os.Getenv("AUTOPG_ENV_SPEC") == "true"
+}
+
+// withEnvSpec returns c with the labels its environment stands for added, when AUTOPG_ENV_SPEC is on.
+func withEnvSpec(ctx context.Context, cli *client.Client, c types.Container) types.Container {
+	if !envSpecEnabled() {
+		return c
+	}
+	info, err := cli.ContainerInspect(ctx, c.ID)
+	if err != nil {
+		logf(ctx, "container %s: inspect error: %v", displayName(c), err)
+		return c
+	}
+	if info.Config == nil {
+		return c
+	}
+	labels := envSpecLabels(info.Config.Env)
+	if len(labels) == 0 {
+		return c
+	}
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	c.Labels = labels
+	return c
+}
+
+// envSpecLabels returns the labels env, a container's environment, stands for.
+func envSpecLabels(env []string) map[string]string {
+	fields := map[string]string{}
+	for _, kv := range env {
+		if m := envFieldRe.FindStringSubmatch(kv); m != nil {
+			fields[m[1]] = m[2]
+		}
+	}
+	target := fields["TARGET"]
+	if target == "" || strings.Contains(target, ".") {
+		return nil
+	}
+	labels := map[string]string{}
+	for f, v := range fields {
+		if f != "TARGET" {
+			labels[labelPrefix+target+"."+strings.ToLower(f)] = v
+		}
+	}
+	return labels
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+// Event replay: the time of the last event processed from each Docker host is kept in the data directory
+// (events.json), and the event stream resumes from it, at startup and when it reconnects, so the events
+// of a disconnection or a restart of autopg are processed late rather than lost. Replayed create events
+// are skipped: the containers have been started since, and are not held (see events.go).
+
+var eventCursors = struct {
+	sync.Mutex
+	m map[string]int64 // Docker host -> time of the last event, in Unix nanoseconds
+}{}
+
+func eventCursorsPath() string {
+	return filepath.Join(dataDir(), "events.json")
+}
+
+// eventCursor returns the time of the last event processed from host, 0 if unknown.
+func eventCursor(host string) int64 {
+	eventCursors.Lock()
+	defer eventCursors.Unlock()
+	if eventCursors.m == nil {
+		eventCursors.m = map[string]int64{}
+		b, err := os.ReadFile(eventCursorsPath())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("warning: could not read %s: %v", eventCursorsPath(), err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, &eventCursors.m); err != nil {
+				log.Printf("warning: could not read %s: %v", eventCursorsPath(), err)
+			}
+		}
+	}
+	return eventCursors.m[host]
+}
+
+// saveEventCursor records that the events of host up to ns were processed.
+func saveEventCursor(host string, ns int64) {
+	eventCursor(host) // loads the file
+	eventCursors.Lock()
+	defer eventCursors.Unlock()
+	if ns <= eventCursors.m[host] {
+		return
+	}
+	eventCursors.m[host] = ns
+	b, err := json.Marshal(eventCursors.m)
+	if err == nil {
+		tmp := eventCursorsPath() + ".tmp"
+		if err = os.WriteFile(tmp, b, 0o600); err == nil {
+			err = os.Rename(tmp, eventCursorsPath())
+		}
+	}
+	if err != nil {
+		log.Printf("warning: could not save event position: %v", err)
+	}
+}
+
+// eventTime returns the time of e in Unix nanoseconds.
+func eventTime(e events.Message) int64 {
+	if e.TimeNano != 0 {
+		return e.TimeNano
+	}
+	return e.Time * 1e9
+}
+
+// eventsSince formats ns as the since parameter of the events API.
+func eventsSince(ns int64) string {
+	return fmt.Sprintf("%d.%09d", ns/1e9, ns%1e9)
+}
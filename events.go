@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// Container lifecycle events autopg reacts to. AUTOPG_ON_<EVENT> sets what each does:
+//   - "provision": processes the container as on start, skipped when already provisioned;
+//   - "reprovision": processes it even when marked provisioned, as `autopg retrigger` does;
+//   - "ignore": nothing.
+//
+// Only start provisions by default. Provisioning on create runs in the background; the start of the
+// container then waits for it rather than provisioning again. With AUTOPG_PROVISION_ON_CREATE=true (which
+// implies AUTOPG_ON_CREATE=provision), a container that starts before its provisioning ends is held
+// paused until it does, so the application doesn't run against a missing database.
+var lifecycleEvents = []struct {
+	action, setting, def string
+}{
+	{"start", "START", "provision"},
+	{"create", "CREATE", "ignore"},
+	{"restart", "RESTART", "ignore"},
+	{"unpause", "UNPAUSE", "ignore"},
+	{"health_status: healthy", "HEALTHY", "ignore"},
+}
+
+// eventBehaviors returns the behavior of each event action that isn't ignored.
+func eventBehaviors() (map[string]string, error) {
+	behaviors := map[string]string{}
+	for _, ev := range lifecycleEvents {
+		key := "AUTOPG_ON_" + ev.setting
+		v := strings.TrimSpace(os.Getenv(key))
+		if v == "" && ev.action == "create" && provisionOnCreate() {
+			v = "provision"
+		}
+		if v == "" {
+			v = ev.def
+		}
+		switch v {
+		case "ignore":
+		case "provision", "reprovision":
+			behaviors[ev.action] = v
+		default:
+			return nil, fmt.Errorf("invalid %s %q (provision, reprovision or ignore)", key, v)
+		}
+	}
+	return behaviors, nil
+}
+
+// eventFilter returns the event filter value matching action; the daemon matches health_status events
+// without their status.
+func eventFilter(action string) string {
+	name, _, _ := strings.Cut(action, ":")
+	return name
+}
+
+func provisionOnCreate() bool {
+	return os.Getenv("AUTOPG_PROVISION_ON_CREATE") == "true"
+}
+
+// createRuns are the provisioning runs started on create, by container ID, closed when they end.
+var createRuns = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: map[string]chan struct{}{}}
+
+// startCreateRun records a provisioning run on create of container id; close the channel when it ends.
+func startCreateRun(id string) chan struct{} {
+	done := make(chan struct{})
+	createRuns.Lock()
+	createRuns.m[id] = done
+	createRuns.Unlock()
+	return done
+}
+
+// takeCreateRun returns and forgets the run started on create of container id, if any.
+func takeCreateRun(id string) (chan struct{}, bool) {
+	createRuns.Lock()
+	defer createRuns.Unlock()
+	done, ok := createRuns.m[id]
+	delete(createRuns.m, id)
+	return done, ok
+}
+
+// awaitCreateRun waits for the provisioning run started on create of the started container c, holding
+// it paused meanwhile with AUTOPG_PROVISION_ON_CREATE or autopg.gate=pause.
+func awaitCreateRun(cli *client.Client, ctx context.Context, c types.Container, done chan struct{}) {
+	select {
+	case <-done:
+		return
+	default:
+	}
+	name := displayName(c)
+	if provisionOnCreate() || c.Labels[gateLabel] == "pause" {
+		if err := cli.ContainerPause(ctx, c.ID); err != nil {
+			logf(ctx, "could not hold container %s until provisioning ends: %v", name, err)
+		} else {
+			logf(ctx, "holding container %s paused until provisioning ends", name)
+			defer func() {
+				if err := cli.ContainerUnpause(context.WithoutCancel(ctx), c.ID); err != nil {
+					logf(ctx, "could not unpause container %s: %v", name, err)
+				}
+			}()
+		}
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// Start gating per container, with the autopg.gate label:
+//   - "pause": provisioning on create and holding the start, as AUTOPG_PROVISION_ON_CREATE does;
+//   - "file:<path>": once all the container's targets are provisioned, autopg writes <path> into it,
+//     for its entrypoint or healthcheck to wait on. It is copied into the container's filesystem, so
+//     it works before the container starts; its directory must exist in the image and not be a tmpfs
+//     or volume mounted at start.
+var gateLabel = labelPrefix + "gate"
+
+// openGate writes the gate file of c, if it has one.
+func openGate(ctx context.Context, cli *client.Client, c types.Container) {
+	gate := c.Labels[gateLabel]
+	if gate == "" || gate == "pause" {
+		return
+	}
+	path, ok := strings.CutPrefix(gate, "file:")
+	if !ok || !filepath.IsAbs(path) {
+		logf(ctx, "container %s: invalid %s %q (pause or file:<absolute path>)", displayName(c), gateLabel, gate)
+		return
+	}
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	now := time.Now()
+	content := []byte(now.UTC().Format(time.RFC3339) + "\n")
+	err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: filepath.Base(path), Mode: 0o644, Size: int64(len(content)), ModTime: now})
+	if err == nil {
+		_, err = tw.Write(content)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		logf(ctx, "container %s: gate file: %v", displayName(c), err)
+		return
+	}
+	if err := cli.CopyToContainer(ctx, c.ID, filepath.Dir(path), &b, container.CopyToContainerOptions{}); err != nil {
+		logf(ctx, "container %s: could not write gate file %s: %v", displayName(c), path, err)
+		return
+	}
+	logf(ctx, "container %s: wrote gate file %s", displayName(c), path)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// freezeWindow is a recurring period during which destructive operations on a target are deferred.
+type freezeWindow struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes since midnight; end <= start crosses midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseFreezeWindows parses "Mon-Fri 09:00-18:00;Sat 10:00-12:00". Days may be a single day, a range,
+// a comma-separated list of those, or "*" for every day.
+func parseFreezeWindows(s string) ([]freezeWindow, error) {
+	var windows []freezeWindow
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		dayPart, timePart, ok := strings.Cut(item, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid freeze window %q; expected e.g. Mon-Fri 09:00-18:00", item)
+		}
+		var w freezeWindow
+		if err := parseDays(dayPart, &w.days); err != nil {
+			return nil, fmt.Errorf("invalid freeze window %q: %w", item, err)
+		}
+		from, to, ok := strings.Cut(strings.TrimSpace(timePart), "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid freeze window %q: expected HH:MM-HH:MM", item)
+		}
+		var err error
+		if w.start, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("invalid freeze window %q: %w", item, err)
+		}
+		if w.end, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("invalid freeze window %q: %w", item, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseDays(s string, days *[7]bool) error {
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[to]; !ok {
+				return fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// endAfter returns when w ends if t falls inside it.
+func (w freezeWindow) endAfter(t time.Time) (time.Time, bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	m := t.Hour()*60 + t.Minute()
+	d := t.Weekday()
+	at := func(dayOffset, minutes int) time.Time {
+		return midnight.AddDate(0, 0, dayOffset).Add(time.Duration(minutes) * time.Minute)
+	}
+	if w.start < w.end {
+		if w.days[d] && m >= w.start && m < w.end {
+			return at(0, w.end), true
+		}
+		return time.Time{}, false
+	}
+	// crosses midnight: started today, or started yesterday and not over yet
+	if w.days[d] && m >= w.start {
+		return at(1, w.end), true
+	}
+	if w.days[(d+6)%7] && m < w.end {
+		return at(0, w.end), true
+	}
+	return time.Time{}, false
+}
+
+// frozenUntil returns when the freeze covering t ends, or the zero time when t is outside every window.
+// Back-to-back windows are merged.
+func frozenUntil(windows []freezeWindow, t time.Time) time.Time {
+	var until time.Time
+	for i := 0; i < 8; i++ {
+		extended := false
+		for _, w := range windows {
+			if end, ok := w.endAfter(t); ok && end.After(until) {
+				until, extended = end, true
+			}
+		}
+		if !extended {
+			break
+		}
+		t = until
+	}
+	return until
+}
+
+// targetFrozenUntil reads the target's freeze windows (AUTOPG_<TARGET>_FREEZE, in the time zone of
+// AUTOPG_<TARGET>_FREEZE_TZ or local time) and returns when the current freeze ends, if any.
+func targetFrozenUntil(target string, now time.Time) (time.Time, error) {
+	spec := os.Getenv(toEnvKey(target, "FREEZE"))
+	if spec == "" {
+		return time.Time{}, nil
+	}
+	windows, err := parseFreezeWindows(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if tz := os.Getenv(toEnvKey(target, "FREEZE_TZ")); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s: %w", toEnvKey(target, "FREEZE_TZ"), err)
+		}
+		now = now.In(loc)
+	}
+	return frozenUntil(windows, now), nil
+}
+
+// roleExists reports whether role exists on target, for provisionings that are only destructive on an
+// existing role.
+func roleExists(ctx context.Context, target, host, port, admin, adminPass, role string) (bool, error) {
+	db, err := openAdmin(withTarget(ctx, target), host, port, admin, adminPass, "")
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT FROM pg_catalog.pg_roles WHERE rolname = $1);", role).Scan(&exists); err != nil {
+		return false, fmt.Errorf("read role %s: %w", role, err)
+	}
+	return exists, nil
+}
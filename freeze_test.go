@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseFreezeWindows(t *testing.T) {
+	tests := []struct {
+		in, err string
+		windows int
+	}{
+		{"", "", 0},
+		{"Mon-Fri 09:00-18:00;Sat 10:00-12:00", "", 2},
+		{"fri-mon 22:00-06:00", "", 1},
+		{"* 00:00-24:00", `invalid freeze window "* 00:00-24:00": invalid time "24:00"`, 0},
+		{"Mon,Wed 09:00-18:00; ", "", 1},
+		{"Mon09:00-18:00", `invalid freeze window "Mon09:00-18:00"; expected e.g. Mon-Fri 09:00-18:00`, 0},
+		{"Lun 09:00-18:00", `invalid freeze window "Lun 09:00-18:00": unknown day "lun"`, 0},
+		{"Mon 09:00", `invalid freeze window "Mon 09:00": expected HH:MM-HH:MM`, 0},
+	}
+	for _, tt := range tests {
+		windows, err := parseFreezeWindows(tt.in)
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) || len(windows) != tt.windows {
+			t.Errorf("parseFreezeWindows(%q) = %d windows, %v, want %d, %s", tt.in, len(windows), err, tt.windows, tt.err)
+		}
+	}
+}
+
+func TestFrozenUntil(t *testing.T) {
+	windows, err := parseFreezeWindows("Mon-Fri 09:00-18:00;Fri 22:00-02:00;Sat 02:00-04:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, clock string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", day+" "+clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// 2026-10-12 is a Monday
+	tests := []struct {
+		now, want time.Time
+	}{
+		{at("2026-10-12", "08:59"), time.Time{}},
+		{at("2026-10-12", "09:00"), at("2026-10-12", "18:00")},
+		{at("2026-10-14", "17:59"), at("2026-10-14", "18:00")},
+		{at("2026-10-14", "18:00"), time.Time{}},
+		{at("2026-10-17", "10:00"), time.Time{}}, // Saturday
+		// crossing midnight, then merged with the back-to-back Saturday window
+		{at("2026-10-16", "23:00"), at("2026-10-17", "04:00")},
+		{at("2026-10-17", "01:00"), at("2026-10-17", "04:00")},
+	}
+	for _, tt := range tests {
+		if got := frozenUntil(windows, tt.now); !got.Equal(tt.want) {
+			t.Errorf("frozenUntil(%s) = %s, want %s", tt.now.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestTargetFrozenUntil(t *testing.T) {
+	now := time.Date(2026, 10, 12, 7, 30, 0, 0, time.UTC) // Monday
+	t.Setenv("AUTOPG_MAIN_FREEZE", "Mon 09:00-10:00")
+	t.Setenv("AUTOPG_MAIN_FREEZE_TZ", "Europe/Paris") // 09:30 there
+	want := time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC).Add(-2 * time.Hour)
+	if until, err := targetFrozenUntil("main", now); err != nil || !until.Equal(want) {
+		t.Errorf("targetFrozenUntil = %s, %v, want %s", until, err, want)
+	}
+	t.Setenv("AUTOPG_MAIN_FREEZE_TZ", "Mars/Olympus")
+	if _, err := targetFrozenUntil("main", now); err == nil {
+		t.Error("an unknown time zone accepted")
+	}
+	t.Setenv("AUTOPG_MAIN_FREEZE", "")
+	if until, err := targetFrozenUntil("main", now); err != nil || !until.IsZero() {
+		t.Errorf("targetFrozenUntil without windows = %s, %v", until, err)
+	}
+}
+
+func TestDestructive(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    provisionSpec
+		reapply string
+		want    bool
+	}{
+		{"first provisioning", provisionSpec{DB: "shop", User: "shop", ManagedPass: true, NewPass: true}, "", false},
+		{"post_sql", provisionSpec{PostSQL: "SELECT 1"}, "", true},
+		{"cron", provisionSpec{CronJobs: make([]cronJob, 1)}, "", true},
+		{"reapply", provisionSpec{}, "always", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_REAPPLY", tt.reapply)
+		if got := tt.spec.destructive("main"); got != tt.want {
+			t.Errorf("%s: destructive = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestFrozenResourceQueued checks that a resource of a provider other than Docker deferred by a freeze
+// window is queued to run again once it ends.
+func TestFrozenResourceQueued(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_MAIN_HOST", "pg.invalid")
+	t.Setenv("AUTOPG_MAIN_ADMIN", "postgres")
+	t.Setenv("AUTOPG_MAIN_ADMIN_PASS", "admin")
+	t.Setenv("AUTOPG_MAIN_FREEZE", "* 00:00-00:00")
+	retried := make(chan struct{})
+	r := resource{kind: "spec file", ref: "shop", id: "files:shop", project: "files", service: "shop",
+		labels: map[string]string{
+			"autopg.main.db":       "shop",
+			"autopg.main.user":     "shop",
+			"autopg.main.pass":     "Correct-Horse-42",
+			"autopg.main.post_sql": "SELECT 1",
+		},
+		targets: []string{"main"},
+		retry:   func(context.Context) { close(retried) },
+	}
+	results, err := reconcileResource(t.Context(), r)
+	if err != nil || len(results) != 1 || !errors.As(results[0].err, new(pendingError)) {
+		t.Fatalf("reconcileResource = %+v, %v, want a pending result", results, err)
+	}
+	schedulerMu.Lock()
+	timer := scheduled["spec file/files:shop"]
+	schedulerMu.Unlock()
+	if timer == nil {
+		t.Fatal("frozen resource not queued")
+	}
+	timer.Stop()
+	// queued again for now, the retry runs
+	scheduleRetry(r, r.targets, time.Now())
+	select {
+	case <-retried:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued resource not retried")
+	}
+}
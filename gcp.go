@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal Google Cloud client: OAuth tokens from a service account key (GOOGLE_APPLICATION_CREDENTIALS)
+// or, without one, from the metadata server, which covers GKE workload identity and Compute Engine
+// service accounts.
+
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var (
+	gcpTokenMu     sync.Mutex
+	gcpToken       string
+	gcpTokenExpiry time.Time
+	gcpHTTP        = &http.Client{Timeout: 20 * time.Second}
+)
+
+// gcpAccessToken returns a cached OAuth access token, fetching a new one shortly before expiry.
+func gcpAccessToken(ctx context.Context) (string, error) {
+	gcpTokenMu.Lock()
+	defer gcpTokenMu.Unlock()
+	if gcpToken != "" && time.Until(gcpTokenExpiry) > 2*time.Minute {
+		return gcpToken, nil
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	var err error
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		err = gcpKeyToken(ctx, path, &tok)
+	} else {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+			err = gcpDo(req, &tok)
+		}
+		if err != nil {
+			err = fmt.Errorf("no GOOGLE_APPLICATION_CREDENTIALS and no metadata server: %w", err)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	registerSecret("gcp token", tok.AccessToken)
+	gcpToken, gcpTokenExpiry = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return gcpToken, nil
+}
+
+// gcpKeyToken exchanges a JWT signed with the service account key at path for an access token.
+func gcpKeyToken(ctx context.Context, path string, out any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(b, &key); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return fmt.Errorf("%s: no private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: not an RSA key", path)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	now := time.Now()
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]any{
+		"iss": key.ClientEmail, "scope": gcpScope, "aud": key.TokenURI,
+		"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+	})
+	unsigned := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return gcpDo(req, out)
+}
+
+// gcpStatusError is a non-2xx response of a Google API.
+type gcpStatusError struct {
+	Code int
+	Body string
+}
+
+func (e *gcpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Code, e.Body)
+}
+
+func gcpDo(req *http.Request, out any) error {
+	resp, err := gcpHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return &gcpStatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// gcpCall calls a Google REST API with an access token.
+func gcpCall(ctx context.Context, method, url string, in, out any) error {
+	token, err := gcpAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	if err := gcpDo(req, out); err != nil {
+		return fmt.Errorf("%s %s: %w", method, url, err)
+	}
+	return nil
+}
+
+// Secret Manager backend. AUTOPG_<TARGET>_GCP_SECRET names the secret holding the admin credentials
+// ("projects/<p>/secrets/<name>", optionally with "/versions/<v>"; latest by default), a JSON object
+// with "username" and "password".
+
+const gcpSecretManager = "https://secretmanager.googleapis.com/v1/"
+
+var (
+	gcpSecretCacheMu sync.Mutex
+	gcpSecretCache   = map[string]struct {
+		user, pass string
+		at         time.Time
+	}{}
+)
+
+func gcpAdminCreds(ctx context.Context, target string) (string, string, error) {
+	name := os.Getenv(toEnvKey(target, "GCP_SECRET"))
+	if name == "" {
+		return "", "", fmt.Errorf("%s is not set", toEnvKey(target, "GCP_SECRET"))
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	gcpSecretCacheMu.Lock()
+	defer gcpSecretCacheMu.Unlock()
+	if c, ok := gcpSecretCache[name]; ok && time.Since(c.at) < vaultRefresh {
+		return c.user, c.pass, nil
+	}
+	var out struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+	}
+	if err := gcpCall(ctx, http.MethodGet, gcpSecretManager+name+":access", nil, &out); err != nil {
+		return "", "", err
+	}
+	var secret struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(out.Payload.Data, &secret); err != nil || secret.Username == "" || secret.Password == "" {
+		return "", "", fmt.Errorf("secret %s is not a JSON object with username and password", name)
+	}
+	gcpSecretCache[name] = struct {
+		user, pass string
+		at         time.Time
+	}{secret.Username, secret.Password, time.Now()}
+	return secret.Username, secret.Password, nil
+}
+
+var (
+	gcpLabelRe    = regexp.MustCompile(`[^a-z0-9_-]+`)
+	gcpSecretIDRe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// gcpLabel makes s a valid Secret Manager label value.
+func gcpLabel(s string) string {
+	s = gcpLabelRe.ReplaceAllString(strings.ToLower(s), "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// gcpStoreCredential writes a generated app credential to the secret
+// <AUTOPG_<TARGET>_GCP_SECRET_PREFIX><target>-<user> (default prefix "autopg-") of project
+// AUTOPG_<TARGET>_GCP_PROJECT, creating it labeled with the container and compose project, then adding
+// a version.
+func gcpStoreCredential(ctx context.Context, rec exportedCredential) error {
+	project := os.Getenv(toEnvKey(rec.Target, "GCP_PROJECT"))
+	if project == "" {
+		return fmt.Errorf("%s is not set", toEnvKey(rec.Target, "GCP_PROJECT"))
+	}
+	prefix := os.Getenv(toEnvKey(rec.Target, "GCP_SECRET_PREFIX"))
+	if prefix == "" {
+		prefix = "autopg-"
+	}
+	id := gcpSecretIDRe.ReplaceAllString(prefix+rec.Target+"-"+rec.User, "_")
+	parent := gcpSecretManager + "projects/" + url.PathEscape(project) + "/secrets"
+	labels := map[string]string{"autopg-target": gcpLabel(rec.Target)}
+	if rec.Container != "" {
+		labels["autopg-container"] = gcpLabel(rec.Container)
+	}
+	if rec.Project != "" {
+		labels["autopg-project"] = gcpLabel(rec.Project)
+	}
+	err := gcpCall(ctx, http.MethodPost, parent+"?secretId="+url.QueryEscape(id), map[string]any{
+		"replication": map[string]any{"automatic": map[string]any{}},
+		"labels":      labels,
+	}, nil)
+	var se *gcpStatusError
+	if err != nil && !(errors.As(err, &se) && se.Code == http.StatusConflict) {
+		return err
+	}
+	value, err := json.Marshal(rec.secretValue())
+	if err != nil {
+		return err
+	}
+	return gcpCall(ctx, http.MethodPost, parent+"/"+id+":addVersion", map[string]any{
+		"payload": map[string]any{"data": value},
+	}, nil)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCPKeyToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("token request %v, %v", r.Form, err)
+		}
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("assertion %q is not a JWT", r.Form.Get("assertion"))
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			t.Errorf("JWT signature: %v", err)
+		}
+		var claims struct {
+			Iss, Scope, Aud string
+			Iat, Exp        int64
+		}
+		b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := json.Unmarshal(b, &claims); err != nil || claims.Iss != "autopg@p.iam.gserviceaccount.com" ||
+			claims.Scope != gcpScope || claims.Aud != "http://"+r.Host+"/token" || claims.Exp-claims.Iat != 3600 {
+			t.Errorf("JWT claims %s, %v", b, err)
+		}
+		io.WriteString(w, `{"access_token":"ya29.token","expires_in":3599}`)
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "key.json")
+	b, _ := json.Marshal(map[string]string{
+		"client_email": "autopg@p.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    srv.URL + "/token",
+	})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := gcpKeyToken(t.Context(), path, &tok); err != nil || tok.AccessToken != "ya29.token" {
+		t.Errorf("gcpKeyToken = %+v, %v", tok, err)
+	}
+}
+
+// fakeGCP serves the Google APIs with handler, with a cached access token.
+func fakeGCP(t *testing.T, handler func(req *http.Request) (int, string)) {
+	t.Helper()
+	oldHTTP, oldToken, oldExpiry := gcpHTTP, gcpToken, gcpTokenExpiry
+	t.Cleanup(func() { gcpHTTP, gcpToken, gcpTokenExpiry = oldHTTP, oldToken, oldExpiry })
+	gcpToken, gcpTokenExpiry = "ya29.token", time.Now().Add(time.Hour)
+	gcpHTTP = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Authorization") != "Bearer ya29.token" {
+			t.Errorf("%s %s without the access token", req.Method, req.URL)
+		}
+		code, body := handler(req)
+		return &http.Response{StatusCode: code, Body: io.NopCloser(strings.NewReader(body))}, nil
+	})}
+}
+
+func TestGCPAdminCreds(t *testing.T) {
+	t.Setenv("AUTOPG_MAIN_GCP_SECRET", "projects/p/secrets/pg-admin")
+	fakeGCP(t, func(req *http.Request) (int, string) {
+		if req.URL.String() != gcpSecretManager+"projects/p/secrets/pg-admin/versions/latest:access" {
+			return http.StatusNotFound, `{"error":{"code":404}}`
+		}
+		data := base64.StdEncoding.EncodeToString([]byte(`{"username":"postgres","password":"s3cret"}`))
+		return http.StatusOK, `{"payload":{"data":"` + data + `"}}`
+	})
+	user, pass, err := gcpAdminCreds(t.Context(), "main")
+	if err != nil || user != "postgres" || pass != "s3cret" {
+		t.Errorf("gcpAdminCreds = %q, %q, %v", user, pass, err)
+	}
+}
+
+func TestGCPStoreCredential(t *testing.T) {
+	t.Setenv("AUTOPG_MAIN_GCP_PROJECT", "p")
+	var calls []string
+	fakeGCP(t, func(req *http.Request) (int, string) {
+		calls = append(calls, req.Method+" "+strings.TrimPrefix(req.URL.String(), gcpSecretManager))
+		b, _ := io.ReadAll(req.Body)
+		if strings.HasSuffix(req.URL.Path, ":addVersion") {
+			var in struct{ Payload struct{ Data []byte } }
+			if err := json.Unmarshal(b, &in); err != nil || !strings.Contains(string(in.Payload.Data), `"password":"pw"`) {
+				t.Errorf("addVersion body %s, %v", b, err)
+			}
+			return http.StatusOK, `{}`
+		}
+		if !strings.Contains(string(b), `"autopg-container":"shop_web-1"`) {
+			t.Errorf("create body %s", b)
+		}
+		return http.StatusConflict, `{"error":{"code":409,"status":"ALREADY_EXISTS"}}`
+	})
+	err := gcpStoreCredential(t.Context(), exportedCredential{Target: "main", User: "app.user", Pass: "pw", Container: "Shop_Web.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST projects/p/secrets?secretId=autopg-main-app_user",
+		"POST projects/p/secrets/autopg-main-app_user:addVersion",
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls %q, want %q", calls, want)
+	}
+}
+
+func TestGCPLabel(t *testing.T) {
+	tests := map[string]string{
+		"shop":                  "shop",
+		"Shop_Web.1":            "shop_web-1",
+		"a  b//c":               "a-b-c",
+		strings.Repeat("x", 70): strings.Repeat("x", 63),
+	}
+	for in, want := range tests {
+		if got := gcpLabel(in); got != want {
+			t.Errorf("gcpLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
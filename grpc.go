@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gRPC API: with AUTOPG_GRPC_LISTEN (e.g. ":8445") set, autopg serves the Autopg service of
+// proto/autopg.proto (Provision, Deprovision, ListManaged, GetStatus) for platform services integrating
+// programmatically. It takes the certificates and client restrictions of the control API (AUTOPG_API_TLS_*,
+// AUTOPG_API_CLIENT_CA, AUTOPG_API_ALLOWED_CLIENTS): mutual TLS is mandatory. The server is net/http's
+// HTTP/2 with the messages encoded by protowire.go, so it needs no gRPC library; it handles unary calls
+// without compression, which is what generated clients send by default.
+//
+// Provision works like the webhook's wait=true, "grpc" standing in for the compose project and the
+// request's name for the service. Deprovision only drops what was provisioned through this API for that
+// name and created by autopg (created.go), and like compose teardowns keeps a database or role also used
+// by someone else, and waits for the end of freeze windows and of a pause.
+
+// gRPC status codes.
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcUnavailable        = 14
+)
+
+// grpcError is an error answered with a gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e grpcError) Error() string { return e.msg }
+
+// grpcOwnerProject stands in for the compose project of what is provisioned through the gRPC API.
+const grpcOwnerProject = "grpc"
+
+var grpcMethods = map[string]func(ctx context.Context, req []pbField) (pbMessage, error){
+	"Provision":   grpcProvision,
+	"Deprovision": grpcDeprovision,
+	"ListManaged": grpcListManaged,
+	"GetStatus":   grpcGetStatus,
+}
+
+// grpcProvider serves the gRPC API.
+type grpcProvider struct {
+	addr   string
+	config *tls.Config
+}
+
+func newGRPCProvider() (provider, error) {
+	p := &grpcProvider{addr: os.Getenv("AUTOPG_GRPC_LISTEN")}
+	if p.addr == "" {
+		return nil, errors.New("AUTOPG_GRPC_LISTEN is required")
+	}
+	var err error
+	if p.config, err = apiTLSConfig("AUTOPG_GRPC_LISTEN"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// run serves the gRPC API until ctx is done.
+func (p *grpcProvider) run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              p.addr,
+		TLSConfig:         p.config,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler:           http.HandlerFunc(serveGRPC),
+	}
+	return serveUntilDone(ctx, srv, "gRPC API", func() error {
+		log.Printf("gRPC API listening on %s (mutual TLS)", p.addr)
+		return srv.ListenAndServeTLS("", "")
+	})
+}
+
+// serveGRPC answers a unary call of the Autopg service.
+func serveGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	resp, err := callGRPC(r)
+	w.WriteHeader(http.StatusOK)
+	if err == nil {
+		frame := make([]byte, 5, 5+len(resp))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+		w.Write(append(frame, resp...))
+	}
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcUnknown, err.Error()
+		var ge grpcError
+		if errors.As(err, &ge) {
+			code = ge.code
+		}
+	}
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", grpcPercentEncode(redact(msg)))
+	}
+}
+
+// callGRPC authorizes r, reads its request message and runs its method.
+func callGRPC(r *http.Request) (pbMessage, error) {
+	name, ok := apiClientAllowed(r)
+	if !ok {
+		log.Printf("gRPC API: client %q refused: %s", name, r.URL.Path)
+		return nil, grpcError{grpcPermissionDenied, "forbidden"}
+	}
+	log.Printf("gRPC API: %s by %s", r.URL.Path, name)
+	method, ok := grpcMethods[strings.TrimPrefix(r.URL.Path, "/autopg.v1.Autopg/")]
+	if !ok {
+		return nil, grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+	var header [5]byte
+	if _, err := io.ReadFull(r.Body, header[:]); err != nil {
+		return nil, grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if header[0] != 0 {
+		return nil, grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > 1<<20 {
+		return nil, grpcError{grpcInvalidArgument, "request message too large"}
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, body); err != nil {
+		return nil, grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	req, err := pbFields(body)
+	if err != nil {
+		return nil, grpcError{grpcInvalidArgument, "invalid request message: " + err.Error()}
+	}
+	return method(withRequestID(r.Context(), newRequestID()), req)
+}
+
+// grpcPercentEncode encodes s as the Grpc-Message trailer requires.
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func grpcProvision(ctx context.Context, req []pbField) (pbMessage, error) {
+	var name string
+	var f specFile
+	for _, field := range req {
+		switch field.num {
+		case 1:
+			name = string(field.b)
+		case 2:
+			f.Target = string(field.b)
+		case 3:
+			f.DB = string(field.b)
+		case 4:
+			f.User = string(field.b)
+		case 5:
+			k, v, err := pbMapEntry(field.b)
+			if err != nil {
+				return nil, grpcError{grpcInvalidArgument, "invalid options: " + err.Error()}
+			}
+			if f.Options == nil {
+				f.Options = map[string]string{}
+			}
+			f.Options[k] = v
+		}
+	}
+	if !webhookNameRe.MatchString(name) {
+		return nil, grpcError{grpcInvalidArgument, "name required: letters, digits, '_', '.' and '-'"}
+	}
+	r, err := f.resource(grpcOwnerProject, name)
+	if err != nil {
+		return nil, grpcError{grpcInvalidArgument, err.Error()}
+	}
+	r.kind = "gRPC request"
+	if _, _, _, _, ok := getAdminCredsForTarget(f.Target); !ok {
+		return nil, grpcError{grpcNotFound, "no admin creds for target " + f.Target + " in this instance"}
+	}
+	if provisioningPaused() {
+		return nil, grpcError{grpcUnavailable, "provisioning is paused"}
+	}
+	spec, err := provisionRequest(ctx, r)
+	if err != nil {
+		if errors.As(err, new(pendingError)) || errors.Is(err, errProvisioningPaused) {
+			return nil, grpcError{grpcUnavailable, err.Error()}
+		}
+		return nil, err
+	}
+	var resp pbMessage
+	resp.string(1, requestID(ctx))
+	resp.string(2, spec.DB)
+	resp.string(3, spec.User)
+	return resp, nil
+}
+
+// managedDatabase is a database and role provisioned for owner, as recorded in the history.
+type managedDatabase struct {
+	provisioned
+	owner, dockerHost string
+}
+
+// managedDatabases returns what the history records as provisioned and not dropped, per database and
+// role and owner, with the time of the last successful provisioning.
+func managedDatabases() (map[managedDatabase]time.Time, error) {
+	recs, err := readHistory(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	managed := map[managedDatabase]time.Time{}
+	for _, r := range recs {
+		m := managedDatabase{provisioned{r.Target, r.DB, r.User}, r.ContainerName, r.DockerHost}
+		switch r.Status {
+		case "ok":
+			managed[m] = r.Time
+		case "dropped":
+			// gone for every owner
+			for o := range managed {
+				if o.provisioned == m.provisioned {
+					delete(managed, o)
+				}
+			}
+		}
+	}
+	return managed, nil
+}
+
+func (m managedDatabase) message(at time.Time) pbMessage {
+	var msg pbMessage
+	msg.string(1, m.target)
+	msg.string(2, m.db)
+	msg.string(3, m.user)
+	msg.string(4, m.owner)
+	msg.string(5, m.dockerHost)
+	msg.int(6, at.Unix())
+	return msg
+}
+
+func grpcDeprovision(ctx context.Context, req []pbField) (pbMessage, error) {
+	var name, target string
+	for _, field := range req {
+		switch field.num {
+		case 1:
+			name = string(field.b)
+		case 2:
+			target = string(field.b)
+		}
+	}
+	if !webhookNameRe.MatchString(name) || target == "" {
+		return nil, grpcError{grpcInvalidArgument, "name and target required"}
+	}
+	if provisioningPaused() {
+		return nil, grpcError{grpcUnavailable, "provisioning is paused"}
+	}
+	if until, err := targetFrozenUntil(target, time.Now()); err != nil || !until.IsZero() {
+		return nil, grpcError{grpcUnavailable, "target " + target + " is frozen"}
+	}
+	managed, err := managedDatabases()
+	if err != nil {
+		return nil, err
+	}
+	owner := grpcOwnerProject + "/" + name
+	var drops []managedDatabase
+	for m := range managed {
+		if m.owner == owner && toEnvKey(m.target, "") == toEnvKey(target, "") {
+			drops = append(drops, m)
+		}
+	}
+	if len(drops) == 0 {
+		return nil, grpcError{grpcNotFound, fmt.Sprintf("nothing provisioned for %s on target %s", name, target)}
+	}
+	var resp pbMessage
+	resp.string(1, requestID(ctx))
+	for _, d := range drops {
+		for m := range managed {
+			if m.owner != owner && m.target == d.target && (m.db == d.db || m.user == d.user) {
+				return nil, grpcError{grpcFailedPrecondition, fmt.Sprintf("database %s or role %s is also used by %s", d.db, d.user, m.owner)}
+			}
+		}
+		// what was there before Provision named it is not the requester's to drop
+		_, roleCreated := createdObject(d.target, "role", d.user)
+		if !roleCreated || !databaseCreatedFor(d.target, d.db, d.user) {
+			return nil, grpcError{grpcFailedPrecondition, fmt.Sprintf("database %s or role %s was not created by autopg", d.db, d.user)}
+		}
+	}
+	for _, d := range drops {
+		if err := dropProvisioned(ctx, d.provisioned); err != nil {
+			return nil, fmt.Errorf("drop database %s and role %s: %w", d.db, d.user, err)
+		}
+		if err := deleteCredential(d.target, d.user); err != nil {
+			logf(ctx, "warning: could not forget the password of %s: %v", d.user, err)
+		}
+		recordHistory(historyRecord{SchemaVersion: schemaVersion, RequestID: requestID(ctx), Time: time.Now().UTC(), Target: d.target,
+			ContainerName: owner, Project: grpcOwnerProject, DB: d.db, User: d.user, Status: "dropped"})
+		logf(ctx, "dropped database %s and role %s of %s on target %s", d.db, d.user, owner, d.target)
+		resp.message(2, d.message(time.Now()))
+	}
+	return resp, nil
+}
+
+func grpcListManaged(ctx context.Context, req []pbField) (pbMessage, error) {
+	var target string
+	for _, field := range req {
+		if field.num == 1 {
+			target = string(field.b)
+		}
+	}
+	managed, err := managedDatabases()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]managedDatabase, 0, len(managed))
+	for m := range managed {
+		if target == "" || toEnvKey(m.target, "") == toEnvKey(target, "") {
+			list = append(list, m)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.target != b.target {
+			return a.target < b.target
+		}
+		if a.db != b.db {
+			return a.db < b.db
+		}
+		return a.owner < b.owner
+	})
+	var resp pbMessage
+	for _, m := range list {
+		resp.message(1, m.message(managed[m]))
+	}
+	return resp, nil
+}
+
+func grpcGetStatus(ctx context.Context, req []pbField) (pbMessage, error) {
+	var resp pbMessage
+	resp.int(1, schemaVersion)
+	resp.bool(2, provisioningPaused())
+	for _, t := range configuredTargets() {
+		resp.string(3, t)
+	}
+	return resp, nil
+}
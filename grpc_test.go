@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useDataDir points autopg's data directory at an empty temporary one.
+func useDataDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("AUTOPG_DATA_DIR", dir)
+	createdObjects.Lock()
+	created := createdObjects.m
+	createdObjects.m = nil
+	createdObjects.Unlock()
+	t.Cleanup(func() {
+		createdObjects.Lock()
+		createdObjects.m = created
+		createdObjects.Unlock()
+	})
+	return dir
+}
+
+// grpcCall calls method with the request message req as the client cn, and returns the response
+// message, status and message.
+func grpcCall(t *testing.T, cn, method string, req pbMessage, compressed bool) ([]byte, int, string) {
+	t.Helper()
+	frame := []byte{0, 0, 0, 0, 0}
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(req)))
+	r := httptest.NewRequest(http.MethodPost, "/autopg.v1.Autopg/"+method, bytes.NewReader(append(frame, req...)))
+	r.ProtoMajor = 2
+	r.Header.Set("Content-Type", "application/grpc")
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	w := httptest.NewRecorder()
+	serveGRPC(w, r)
+	resp := w.Result()
+	body := w.Body.Bytes()
+	if len(body) > 0 {
+		if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Fatalf("%s: malformed response frame % x", method, body)
+		}
+		body = body[5:]
+	}
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: Grpc-Status %q", method, resp.Trailer.Get("Grpc-Status"))
+	}
+	return body, code, resp.Trailer.Get("Grpc-Message")
+}
+
+func TestServeGRPC(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_API_ALLOWED_CLIENTS", "platform")
+	var provision pbMessage
+	provision.string(1, "bad name!")
+	provision.string(2, "main")
+	tests := []struct {
+		name, cn, method string
+		req              pbMessage
+		compressed       bool
+		code             int
+		msg              string
+	}{
+		{"refused client", "intruder", "GetStatus", nil, false, grpcPermissionDenied, "forbidden"},
+		{"unknown method", "platform", "Drop", nil, false, grpcUnimplemented, "unknown method /autopg.v1.Autopg/Drop"},
+		{"compressed", "platform", "GetStatus", nil, true, grpcUnimplemented, "compressed messages are not supported"},
+		{"invalid message", "platform", "GetStatus", pbMessage{0x0b}, false, grpcInvalidArgument, "invalid request message: field 1: unsupported wire type 3"},
+		{"invalid name", "platform", "Provision", provision, false, grpcInvalidArgument, "name required: letters, digits, '_', '.' and '-'"},
+		{"no name", "platform", "Deprovision", nil, false, grpcInvalidArgument, "name and target required"},
+	}
+	for _, tt := range tests {
+		body, code, msg := grpcCall(t, tt.cn, tt.method, tt.req, tt.compressed)
+		if code != tt.code || msg != tt.msg || len(body) != 0 {
+			t.Errorf("%s: %d %q % x, want %d %q", tt.name, code, msg, body, tt.code, tt.msg)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/autopg.v1.Autopg/GetStatus", nil)
+	w := httptest.NewRecorder()
+	serveGRPC(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("HTTP/1.1 request answered %d", w.Code)
+	}
+}
+
+func TestGRPCPercentEncode(t *testing.T) {
+	tests := map[string]string{
+		"plain message":   "plain message",
+		"100% done":       "100%25 done",
+		"line\nbreak":     "line%0Abreak",
+		"café":            "caf%C3%A9",
+		"tab\tand ~tilde": "tab%09and ~tilde",
+	}
+	for in, want := range tests {
+		if got := grpcPercentEncode(in); got != want {
+			t.Errorf("grpcPercentEncode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestGRPCGetStatus(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_MAIN_HOST", "db")
+	if err := setPaused(true); err != nil {
+		t.Fatal(err)
+	}
+	body, code, msg := grpcCall(t, "platform", "GetStatus", nil, false)
+	if code != grpcOK {
+		t.Fatalf("GetStatus: %d %s", code, msg)
+	}
+	fields, err := pbFields(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version, paused uint64
+	var targets []string
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			version = f.v
+		case 2:
+			paused = f.v
+		case 3:
+			targets = append(targets, string(f.b))
+		}
+	}
+	if version != schemaVersion || paused != 1 || !contains(targets, "MAIN") {
+		t.Errorf("GetStatus = version %d, paused %d, targets %v", version, paused, targets)
+	}
+}
+
+func TestGRPCListManaged(t *testing.T) {
+	useDataDir(t)
+	at := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, rec := range []historyRecord{
+		{Time: at, Target: "main", ContainerName: "grpc/shop", DB: "shop", User: "shop", Status: "ok"},
+		{Time: at, Target: "main", ContainerName: "grpc/blog", DB: "blog", User: "blog", Status: "ok"},
+		{Time: at, Target: "main", ContainerName: "grpc/old", DB: "old", User: "old", Status: "ok"},
+		{Time: at, Target: "main", ContainerName: "grpc/old", DB: "old", User: "old", Status: "dropped"},
+		{Time: at, Target: "main", ContainerName: "grpc/failed", DB: "failed", User: "failed", Status: "error"},
+		{Time: at, Target: "other", ContainerName: "web", DB: "web", User: "web", Status: "ok"},
+	} {
+		recordHistory(rec)
+	}
+	var req pbMessage
+	req.string(1, "main")
+	body, code, msg := grpcCall(t, "platform", "ListManaged", req, false)
+	if code != grpcOK {
+		t.Fatalf("ListManaged: %d %s", code, msg)
+	}
+	fields, err := pbFields(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dbs []string
+	for _, f := range fields {
+		m, err := pbFields(f.b)
+		if err != nil || f.num != 1 || len(m) != 5 || string(m[0].b) != "main" || m[4].num != 6 || m[4].v != uint64(at.Unix()) {
+			t.Errorf("managed database %+v, %v", m, err)
+			continue
+		}
+		dbs = append(dbs, string(m[1].b)+" of "+string(m[3].b))
+	}
+	if want := []string{"blog of grpc/blog", "shop of grpc/shop"}; len(dbs) != 2 || dbs[0] != want[0] || dbs[1] != want[1] {
+		t.Errorf("ListManaged = %q, want %q", dbs, want)
+	}
+}
+
+func TestGRPCDeprovisionRefusals(t *testing.T) {
+	useDataDir(t)
+	at := time.Now().UTC()
+	for _, rec := range []historyRecord{
+		{Time: at, Target: "main", ContainerName: "grpc/shop", DB: "shop", User: "shop", Status: "ok"},
+		{Time: at, Target: "main", ContainerName: "grpc/shared", DB: "shared", User: "shared", Status: "ok"},
+		{Time: at, Target: "main", ContainerName: "web", DB: "shared", User: "web", Status: "ok"},
+	} {
+		recordHistory(rec)
+	}
+	deprovision := func(name string) pbMessage {
+		var m pbMessage
+		m.string(1, name)
+		m.string(2, "main")
+		return m
+	}
+	tests := []struct {
+		name string
+		code int
+		msg  string
+	}{
+		{"nobody", grpcNotFound, "nothing provisioned for nobody on target main"},
+		{"shared", grpcFailedPrecondition, "database shared or role shared is also used by web"},
+		// shop's database and role were there before autopg was asked for them
+		{"shop", grpcFailedPrecondition, "database shop or role shop was not created by autopg"},
+	}
+	for _, tt := range tests {
+		_, code, msg := grpcCall(t, "platform", "Deprovision", deprovision(tt.name), false)
+		if code != tt.code || msg != tt.msg {
+			t.Errorf("Deprovision %s: %d %q, want %d %q", tt.name, code, msg, tt.code, tt.msg)
+		}
+	}
+
+	if err := setPaused(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, code, _ := grpcCall(t, "platform", "Deprovision", deprovision("shop"), false); code != grpcUnavailable {
+		t.Errorf("Deprovision while paused: %d, want %d", code, grpcUnavailable)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// historyRecord is one provisioning attempt, appended as a JSON line to the history file.
+// Its layout is the "event" schema (see schema.go).
+type historyRecord struct {
+	SchemaVersion int       `json:"schema_version"`
+	RequestID     string    `json:"request_id,omitempty"`
+	DockerHost    string    `json:"docker_host,omitempty"`
+	Time          time.Time `json:"time"`
+	Target        string    `json:"target"`
+	Container     string    `json:"container"`
+	ContainerName string    `json:"container_name,omitempty"`
+	Project       string    `json:"project,omitempty"`
+	DB            string    `json:"db"`
+	User          string    `json:"user"`
+	Status        string    `json:"status"` // "ok", "error" or "dropped"
+	Error         string    `json:"error,omitempty"`
+	Features      []string  `json:"features,omitempty"`
+}
+
+var historyMu sync.Mutex
+
+var defaultDataDir = sync.OnceValue(func() string {
+	const system = "/var/lib/autopg"
+	if os.Getuid() != 0 && checkWritable(system) != nil {
+		if d := userDataDir(); d != "" {
+			return d
+		}
+	}
+	return system
+})
+
+// dataDir is where autopg keeps its local state (history, ...): AUTOPG_DATA_DIR, /var/lib/autopg, or
+// a per-user state dir when running unprivileged outside the image.
+func dataDir() string {
+	if d := os.Getenv("AUTOPG_DATA_DIR"); d != "" {
+		return d
+	}
+	return defaultDataDir()
+}
+
+func historyPath() string {
+	return filepath.Join(dataDir(), "history.jsonl")
+}
+
+// recordHistory appends rec to the history file, compacting it once it outgrows historyMaxSize.
+// Failures are logged, never fatal.
+func recordHistory(rec historyRecord) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	f, err := os.OpenFile(historyPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("warning: could not write history: %v", err)
+		return
+	}
+	rec.Error = redact(rec.Error)
+	err = json.NewEncoder(f).Encode(rec)
+	var size int64
+	if fi, statErr := f.Stat(); statErr == nil {
+		size = fi.Size()
+	}
+	f.Close()
+	if err != nil {
+		log.Printf("warning: could not write history: %v", err)
+		return
+	}
+	if size > historyMaxSize() {
+		if err := compactHistoryLocked(time.Now().Add(-historyRetention())); err != nil {
+			log.Printf("warning: could not compact history: %v", err)
+		}
+	}
+}
+
+// historyMaxSize is the size of the history file, AUTOPG_HISTORY_MAX_SIZE in bytes (64 MiB by default),
+// past which it is compacted.
+func historyMaxSize() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("AUTOPG_HISTORY_MAX_SIZE"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 64 << 20
+}
+
+// historyRetention is how long compaction keeps every record, AUTOPG_HISTORY_RETENTION (30 days by
+// default, what `autopg stats` shows).
+func historyRetention() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("AUTOPG_HISTORY_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// historyKey identifies what a record is about: a database and role provisioned on a target for a
+// container, which teardowns, ListManaged and Deprovision look up by their last record.
+type historyKey struct {
+	target, db, user, dockerHost, project, containerName, container string
+}
+
+func (r historyRecord) key() historyKey {
+	return historyKey{r.Target, r.DB, r.User, r.DockerHost, r.Project, r.ContainerName, r.Container}
+}
+
+// compactHistoryLocked rewrites the history with the records at or after keepAll, and of the older ones
+// only the last successful or dropped record per historyKey; older failures are left out. The caller
+// holds historyMu.
+func compactHistoryLocked(keepAll time.Time) error {
+	recs, err := readHistory(time.Time{})
+	if err != nil {
+		return err
+	}
+	last := map[historyKey]int{}
+	for i, r := range recs {
+		if r.Time.Before(keepAll) && r.Status != "error" {
+			last[r.key()] = i
+		}
+	}
+	tmp := historyPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	kept := 0
+	for i, r := range recs {
+		if r.Time.Before(keepAll) && (r.Status == "error" || last[r.key()] != i) {
+			continue
+		}
+		if err = enc.Encode(r); err != nil {
+			break
+		}
+		kept++
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, historyPath()); err != nil {
+		return err
+	}
+	log.Printf("history compacted: kept %d of %d records", kept, len(recs))
+	return nil
+}
+
+// readHistory returns all records at or after since, oldest first.
+func readHistory(since time.Time) ([]historyRecord, error) {
+	f, err := os.Open(historyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var recs []historyRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec historyRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// skip torn lines (e.g. crash mid-write)
+			continue
+		}
+		if !rec.Time.Before(since) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, sc.Err()
+}
+
+// usageSummary is the anonymous view of the history: counts only, no names.
+type usageSummary struct {
+	Engines    map[string]int `json:"engines"`
+	Targets    int            `json:"targets"`
+	Provisions int            `json:"provisions"`
+	Failures   int            `json:"failures"`
+	Features   map[string]int `json:"features"`
+}
+
+func summarizeUsage(recs []historyRecord) usageSummary {
+	u := usageSummary{Engines: map[string]int{}, Features: map[string]int{}}
+	targets := map[string]struct{}{}
+	for _, r := range recs {
+		if r.Status == "dropped" {
+			continue
+		}
+		targets[r.Target] = struct{}{}
+		u.Engines["postgres"]++
+		if r.Status == "ok" {
+			u.Provisions++
+		} else {
+			u.Failures++
+		}
+		for _, f := range r.Features {
+			u.Features[f]++
+		}
+	}
+	u.Targets = len(targets)
+	return u
+}
+
+// logUsageSummary logs the anonymous usage summary of the last day, once a day.
+// Enabled with AUTOPG_USAGE_SUMMARY=true; nothing is sent anywhere.
+func logUsageSummary() {
+	for {
+		recs, err := readHistory(time.Now().Add(-24 * time.Hour))
+		if err != nil {
+			log.Printf("warning: usage summary: %v", err)
+		} else if b, err := json.Marshal(summarizeUsage(recs)); err == nil {
+			log.Printf("usage summary (24h): %s", b)
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// runStats implements `autopg stats`: provisioning activity per day and per target.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	days := fs.Int("days", 30, "number of days to summarize")
+	usage := fs.Bool("usage", false, "print the anonymous usage summary as JSON instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	since := time.Now().AddDate(0, 0, -*days).Truncate(24 * time.Hour)
+	recs, err := readHistory(since)
+	if err != nil {
+		return err
+	}
+	if *usage {
+		b, err := json.MarshalIndent(summarizeUsage(recs), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	if len(recs) == 0 {
+		fmt.Printf("no provisioning activity in the last %d days (%s)\n", *days, historyPath())
+		return nil
+	}
+
+	type counts struct{ ok, failed int }
+	perDay := map[string]*counts{}
+	perTarget := map[string]*counts{}
+	bump := func(m map[string]*counts, k string, ok bool) {
+		c := m[k]
+		if c == nil {
+			c = &counts{}
+			m[k] = c
+		}
+		if ok {
+			c.ok++
+		} else {
+			c.failed++
+		}
+	}
+	for _, r := range recs {
+		if r.Status == "dropped" {
+			continue
+		}
+		bump(perDay, r.Time.Format("2006-01-02"), r.Status == "ok")
+		bump(perTarget, r.Target, r.Status == "ok")
+	}
+	table := func(title string, m map[string]*counts) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Printf("%-20s %6s %6s\n", title, "ok", "failed")
+		for _, k := range keys {
+			fmt.Printf("%-20s %6d %6d\n", k, m[k].ok, m[k].failed)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("provisioning activity over the last %d days\n\n", *days)
+	table("day", perDay)
+	table("target", perTarget)
+	return nil
+}
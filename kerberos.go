@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Kerberos (GSSAPI) admin login: with AUTOPG_<TARGET>_ADMIN_AUTH=gss the admin authenticates to a server
+// whose pg_hba.conf has a gss line, with the keys of a keytab instead of a password. autopg implements
+// the client side of Kerberos itself (AES etypes, over TCP):
+//   - AUTOPG_<TARGET>_KRB5_KEYTAB is the keytab file;
+//   - AUTOPG_<TARGET>_KRB5_PRINCIPAL is the client principal (default <ADMIN>@<REALM>);
+//   - AUTOPG_<TARGET>_KRB5_REALM is the realm (default: the principal's);
+//   - AUTOPG_<TARGET>_KRB5_KDC lists KDCs as host[:port], comma-separated (default: DNS SRV records
+//     _kerberos._tcp.<realm>);
+//   - AUTOPG_<TARGET>_KRB5_SPN is the server's principal (default postgres/<HOST>@<REALM>).
+//
+// Tickets are cached until 5 minutes before they end, then obtained again from the keytab, so they
+// never need renewing. Cross-realm servers are not supported.
+//
+// lib/pq's auth/kerberos package is not used: it needs gokrb5 (and its crypto and config modules), or a
+// system GSSAPI library through cgo, where autopg ships as a static binary. Only what pq.GSS needs for a
+// keytab login is implemented here, and its crypto is checked against the RFC 3961 and 3962 vectors.
+
+const (
+	etypeAES128 = 17
+	etypeAES256 = 18
+
+	krbMsgASRep    = 11
+	krbMsgTGSRep   = 13
+	krbMsgKRBError = 30
+)
+
+// krbOIDKRB5 is the Kerberos V5 GSS-API mechanism.
+var krbOIDKRB5 = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+
+func init() {
+	pq.RegisterGSSProvider(func() (pq.GSS, error) { return krbGSS{}, nil })
+}
+
+type krbKey struct {
+	etype int
+	value []byte
+}
+
+// krbClient is the Kerberos identity of one target.
+type krbClient struct {
+	target string
+	realm  string
+	cname  []string
+	keys   []krbKey // strongest first
+	kdcs   []string
+}
+
+type krbTicket struct {
+	ticket []byte // the Ticket, DER
+	key    krbKey // its session key
+	end    time.Time
+}
+
+var (
+	krbSPNsMu sync.Mutex
+	krbSPNs   = map[string]string{} // SPN -> target
+
+	krbTicketsMu sync.Mutex
+	krbTickets   = map[string]*krbTicket{} // target + " " + SPN ("" for the TGT) -> ticket
+)
+
+// krbSPN returns the server principal of target, whose host is host, and remembers which target it
+// belongs to: pq's GSS provider only gets the SPN.
+func krbSPN(target, host string) (string, error) {
+	realm, err := krbRealm(target)
+	if err != nil {
+		return "", err
+	}
+	spn := targetSetting(target, "KRB5_SPN")
+	if spn == "" {
+		spn = "postgres/" + host
+	}
+	if !strings.Contains(spn, "@") {
+		spn += "@" + realm
+	}
+	krbSPNsMu.Lock()
+	defer krbSPNsMu.Unlock()
+	if other, ok := krbSPNs[spn]; ok && other != target {
+		return "", fmt.Errorf("targets %s and %s use the same Kerberos SPN %s; set %s", other, target, spn, toEnvKey(target, "KRB5_SPN"))
+	}
+	krbSPNs[spn] = target
+	return spn, nil
+}
+
+func krbPrincipal(target string) string {
+	if p := targetSetting(target, "KRB5_PRINCIPAL"); p != "" {
+		return p
+	}
+	return os.Getenv(toEnvKey(target, "ADMIN"))
+}
+
+func krbRealm(target string) (string, error) {
+	if realm := targetSetting(target, "KRB5_REALM"); realm != "" {
+		return realm, nil
+	}
+	if _, realm, ok := strings.Cut(krbPrincipal(target), "@"); ok && realm != "" {
+		return realm, nil
+	}
+	return "", fmt.Errorf("no Kerberos realm for target %s; set %s or a principal with @REALM", target, toEnvKey(target, "KRB5_REALM"))
+}
+
+// newKrbClient reads the Kerberos identity of target.
+func newKrbClient(target string) (*krbClient, error) {
+	realm, err := krbRealm(target)
+	if err != nil {
+		return nil, err
+	}
+	name, _, _ := strings.Cut(krbPrincipal(target), "@")
+	if name == "" {
+		return nil, fmt.Errorf("no Kerberos principal for target %s", target)
+	}
+	c := &krbClient{target: target, realm: realm, cname: strings.Split(name, "/")}
+	keytab := targetSetting(target, "KRB5_KEYTAB")
+	if keytab == "" {
+		return nil, fmt.Errorf("%s is not set", toEnvKey(target, "KRB5_KEYTAB"))
+	}
+	if c.keys, err = readKeytab(keytab, name+"@"+realm); err != nil {
+		return nil, err
+	}
+	if v := targetSetting(target, "KRB5_KDC"); v != "" {
+		for _, kdc := range splitList(v) {
+			if _, _, err := net.SplitHostPort(kdc); err != nil {
+				kdc = net.JoinHostPort(kdc, "88")
+			}
+			c.kdcs = append(c.kdcs, kdc)
+		}
+	} else {
+		_, srvs, err := net.LookupSRV("kerberos", "tcp", realm)
+		if err != nil {
+			return nil, fmt.Errorf("no KDC for realm %s (%v); set %s", realm, err, toEnvKey(target, "KRB5_KDC"))
+		}
+		for _, s := range srvs {
+			c.kdcs = append(c.kdcs, net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port))))
+		}
+	}
+	return c, nil
+}
+
+// krbGSS implements pq.GSS with the identity of the target the SPN belongs to.
+type krbGSS struct{}
+
+func (krbGSS) GetInitToken(host, service string) ([]byte, error) {
+	return nil, fmt.Errorf("no Kerberos SPN for %s/%s; only targets with ADMIN_AUTH=gss use Kerberos", service, host)
+}
+
+func (krbGSS) GetInitTokenFromSpn(spn string) ([]byte, error) {
+	krbSPNsMu.Lock()
+	target, ok := krbSPNs[spn]
+	krbSPNsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown Kerberos SPN %s", spn)
+	}
+	c, err := newKrbClient(target)
+	if err != nil {
+		return nil, err
+	}
+	name, realm, _ := strings.Cut(spn, "@")
+	if realm != c.realm {
+		return nil, fmt.Errorf("SPN %s is not in realm %s; cross-realm authentication is not supported", spn, c.realm)
+	}
+	t, err := c.serviceTicket(strings.Split(name, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return c.gssInitToken(t)
+}
+
+// Continue is only called when the server sends a token back, which it does not as mutual
+// authentication is not requested.
+func (krbGSS) Continue([]byte) (bool, []byte, error) {
+	return true, nil, nil
+}
+
+// cachedTicket returns the ticket cached under key while it is valid for 5 more minutes, or obtains
+// a new one with get.
+func cachedTicket(key string, get func() (*krbTicket, error)) (*krbTicket, error) {
+	krbTicketsMu.Lock()
+	t := krbTickets[key]
+	krbTicketsMu.Unlock()
+	if t != nil && time.Until(t.end) > 5*time.Minute {
+		return t, nil
+	}
+	t, err := get()
+	if err != nil {
+		return nil, err
+	}
+	krbTicketsMu.Lock()
+	krbTickets[key] = t
+	krbTicketsMu.Unlock()
+	return t, nil
+}
+
+// serviceTicket returns a ticket for sname in the client's realm.
+func (c *krbClient) serviceTicket(sname []string) (*krbTicket, error) {
+	tgt, err := cachedTicket(c.target+" ", c.asExchange)
+	if err != nil {
+		return nil, err
+	}
+	return cachedTicket(c.target+" "+strings.Join(sname, "/"), func() (*krbTicket, error) {
+		return c.tgsExchange(tgt, sname)
+	})
+}
+
+// asExchange obtains a ticket-granting ticket with the keytab, using encrypted timestamp pre-authentication.
+func (c *krbClient) asExchange() (*krbTicket, error) {
+	var lastErr error
+	for _, key := range c.keys {
+		now := time.Now().UTC()
+		ts := derSeq(derCtx(0, derTime(now)), derCtx(1, derInt(now.Nanosecond()/1000)))
+		encTS, err := krbEncrypt(key, 1, ts)
+		if err != nil {
+			return nil, err
+		}
+		padata := derSeq(derCtx(1, derInt(2)), derCtx(2, derOctets(derEncrypted(key.etype, encTS))))
+		nonce := krbNonce()
+		body := derSeq(
+			derCtx(0, derFlags(0)),
+			derCtx(1, derPrincipal(1, c.cname)),
+			derCtx(2, derString(c.realm)),
+			derCtx(3, derPrincipal(2, []string{"krbtgt", c.realm})),
+			derCtx(5, derTime(now.Add(24*time.Hour))),
+			derCtx(7, derInt(nonce)),
+			derCtx(8, derSeq(derInt(key.etype))),
+		)
+		req := derApp(10, derSeq(derCtx(1, derInt(5)), derCtx(2, derInt(10)), derCtx(3, derSeq(padata)), derCtx(4, body)))
+		t, err := c.kdcRep(req, krbMsgASRep, key, 3, nonce)
+		var kerr *krbError
+		if errors.As(err, &kerr) && (kerr.code == 14 || kerr.code == 24) {
+			lastErr = err // etype not supported or not the key the KDC has: try the next one
+			continue
+		}
+		return t, err
+	}
+	return nil, fmt.Errorf("kerberos login as %s@%s: %w", strings.Join(c.cname, "/"), c.realm, lastErr)
+}
+
+// tgsExchange obtains a ticket for sname with the ticket-granting ticket.
+func (c *krbClient) tgsExchange(tgt *krbTicket, sname []string) (*krbTicket, error) {
+	now := time.Now().UTC()
+	nonce := krbNonce()
+	body := derSeq(
+		derCtx(0, derFlags(0)),
+		derCtx(2, derString(c.realm)),
+		derCtx(3, derPrincipal(2, sname)),
+		derCtx(5, derTime(now.Add(24*time.Hour))),
+		derCtx(7, derInt(nonce)),
+		derCtx(8, derSeq(derInt(etypeAES256), derInt(etypeAES128))),
+	)
+	cksum, err := krbChecksum(tgt.key, 6, body)
+	if err != nil {
+		return nil, err
+	}
+	auth := derApp(2, derSeq(
+		derCtx(0, derInt(5)),
+		derCtx(1, derString(c.realm)),
+		derCtx(2, derPrincipal(1, c.cname)),
+		derCtx(3, derSeq(derCtx(0, derInt(krbChecksumType(tgt.key))), derCtx(1, derOctets(cksum)))),
+		derCtx(4, derInt(now.Nanosecond()/1000)),
+		derCtx(5, derTime(now)),
+	))
+	encAuth, err := krbEncrypt(tgt.key, 7, auth)
+	if err != nil {
+		return nil, err
+	}
+	padata := derSeq(derCtx(1, derInt(1)), derCtx(2, derOctets(krbAPReq(tgt, encAuth))))
+	req := derApp(12, derSeq(derCtx(1, derInt(5)), derCtx(2, derInt(12)), derCtx(3, derSeq(padata)), derCtx(4, body)))
+	t, err := c.kdcRep(req, krbMsgTGSRep, tgt.key, 8, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos ticket for %s: %w", strings.Join(sname, "/"), err)
+	}
+	return t, nil
+}
+
+// gssInitToken builds the GSS-API initial context token (RFC 4121) carrying an AP-REQ for t.
+func (c *krbClient) gssInitToken(t *krbTicket) ([]byte, error) {
+	now := time.Now().UTC()
+	// checksum 0x8003: 16 zero bytes of channel bindings and the integrity and confidentiality flags
+	gssCksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(gssCksum[0:], 16)
+	binary.LittleEndian.PutUint32(gssCksum[20:], 0x20|0x10)
+	auth := derApp(2, derSeq(
+		derCtx(0, derInt(5)),
+		derCtx(1, derString(c.realm)),
+		derCtx(2, derPrincipal(1, c.cname)),
+		derCtx(3, derSeq(derCtx(0, derInt(0x8003)), derCtx(1, derOctets(gssCksum)))),
+		derCtx(4, derInt(now.Nanosecond()/1000)),
+		derCtx(5, derTime(now)),
+	))
+	encAuth, err := krbEncrypt(t.key, 11, auth)
+	if err != nil {
+		return nil, err
+	}
+	oid, err := asn1.Marshal(krbOIDKRB5)
+	if err != nil {
+		return nil, err
+	}
+	inner := append(append(oid, 0x01, 0x00), krbAPReq(t, encAuth)...)
+	return derWrap(asn1.ClassApplication, 0, true, inner), nil
+}
+
+func krbAPReq(t *krbTicket, encAuth []byte) []byte {
+	return derApp(14, derSeq(
+		derCtx(0, derInt(5)),
+		derCtx(1, derInt(14)),
+		derCtx(2, derFlags(0)),
+		derCtx(3, t.ticket),
+		derCtx(4, derEncrypted(t.key.etype, encAuth)),
+	))
+}
+
+type krbEncryptedData struct {
+	EType  int    `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"explicit,optional,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type krbKDCRep struct {
+	PVNO    int              `asn1:"explicit,tag:0"`
+	MsgType int              `asn1:"explicit,tag:1"`
+	PAData  asn1.RawValue    `asn1:"explicit,optional,tag:2"`
+	CRealm  asn1.RawValue    `asn1:"explicit,tag:3"`
+	CName   asn1.RawValue    `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue    `asn1:"explicit,tag:5"`
+	EncPart krbEncryptedData `asn1:"explicit,tag:6"`
+}
+
+type krbEncKDCRepPart struct {
+	Key struct {
+		KeyType  int    `asn1:"explicit,tag:0"`
+		KeyValue []byte `asn1:"explicit,tag:1"`
+	} `asn1:"explicit,tag:0"`
+	LastReq       asn1.RawValue  `asn1:"explicit,tag:1"`
+	Nonce         int64          `asn1:"explicit,tag:2"`
+	KeyExpiration time.Time      `asn1:"generalized,explicit,optional,tag:3"`
+	Flags         asn1.BitString `asn1:"explicit,tag:4"`
+	AuthTime      time.Time      `asn1:"generalized,explicit,tag:5"`
+	StartTime     time.Time      `asn1:"generalized,explicit,optional,tag:6"`
+	EndTime       time.Time      `asn1:"generalized,explicit,tag:7"`
+}
+
+type krbErrorMsg struct {
+	PVNO      int           `asn1:"explicit,tag:0"`
+	MsgType   int           `asn1:"explicit,tag:1"`
+	CTime     time.Time     `asn1:"generalized,explicit,optional,tag:2"`
+	CUSec     int           `asn1:"explicit,optional,tag:3"`
+	STime     time.Time     `asn1:"generalized,explicit,tag:4"`
+	SUSec     int           `asn1:"explicit,tag:5"`
+	ErrorCode int           `asn1:"explicit,tag:6"`
+	CRealm    asn1.RawValue `asn1:"explicit,optional,tag:7"`
+	CName     asn1.RawValue `asn1:"explicit,optional,tag:8"`
+	Realm     asn1.RawValue `asn1:"explicit,tag:9"`
+	SName     asn1.RawValue `asn1:"explicit,tag:10"`
+	EText     asn1.RawValue `asn1:"explicit,optional,tag:11"`
+}
+
+// krbError is a KRB-ERROR answered by the KDC.
+type krbError struct {
+	code int
+	text string
+}
+
+var krbErrorNames = map[int]string{
+	6:  "client not found in Kerberos database",
+	7:  "server not found in Kerberos database",
+	14: "encryption type not supported",
+	18: "client's credentials have been revoked",
+	24: "pre-authentication failed (wrong key in keytab?)",
+	25: "additional pre-authentication required",
+	37: "clock skew too great",
+}
+
+func (e *krbError) Error() string {
+	msg := fmt.Sprintf("KDC error %d", e.code)
+	if name, ok := krbErrorNames[e.code]; ok {
+		msg += " (" + name + ")"
+	}
+	if e.text != "" {
+		msg += ": " + e.text
+	}
+	return msg
+}
+
+// kdcRep sends req to the KDCs and decrypts the reply of type msgType with key (key usage usage).
+func (c *krbClient) kdcRep(req []byte, msgType int, key krbKey, usage uint32, nonce int) (*krbTicket, error) {
+	var rv asn1.RawValue
+	var err error
+	for _, kdc := range c.kdcs {
+		if rv, err = krbSend(kdc, req); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rv.Class != asn1.ClassApplication {
+		return nil, errors.New("invalid KDC reply")
+	}
+	if rv.Tag == krbMsgKRBError {
+		var e krbErrorMsg
+		if _, err := asn1.Unmarshal(rv.Bytes, &e); err != nil {
+			return nil, fmt.Errorf("invalid KRB-ERROR: %w", err)
+		}
+		return nil, &krbError{code: e.ErrorCode, text: krbString(e.EText)}
+	}
+	if rv.Tag != msgType {
+		return nil, fmt.Errorf("unexpected KDC reply %d", rv.Tag)
+	}
+	var rep krbKDCRep
+	if _, err := asn1.Unmarshal(rv.Bytes, &rep); err != nil {
+		return nil, fmt.Errorf("invalid KDC reply: %w", err)
+	}
+	if rep.EncPart.EType != key.etype {
+		return nil, fmt.Errorf("KDC reply encrypted with etype %d, expected %d", rep.EncPart.EType, key.etype)
+	}
+	plain, err := krbDecrypt(key, usage, rep.EncPart.Cipher)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt KDC reply: %w", err)
+	}
+	var inner asn1.RawValue
+	if _, err := asn1.Unmarshal(plain, &inner); err != nil || inner.Class != asn1.ClassApplication || (inner.Tag != 25 && inner.Tag != 26) {
+		return nil, errors.New("invalid encrypted part of KDC reply")
+	}
+	var part krbEncKDCRepPart
+	if _, err := asn1.Unmarshal(inner.Bytes, &part); err != nil {
+		return nil, fmt.Errorf("invalid encrypted part of KDC reply: %w", err)
+	}
+	if part.Nonce != int64(nonce) {
+		return nil, errors.New("KDC reply does not match the request")
+	}
+	if part.Key.KeyType != etypeAES128 && part.Key.KeyType != etypeAES256 {
+		return nil, fmt.Errorf("session key etype %d is not supported; enable AES for the principal", part.Key.KeyType)
+	}
+	return &krbTicket{ticket: rep.Ticket.Bytes, key: krbKey{etype: part.Key.KeyType, value: part.Key.KeyValue}, end: part.EndTime}, nil
+}
+
+// krbSend exchanges one message with a KDC over TCP.
+func krbSend(kdc string, req []byte) (asn1.RawValue, error) {
+	var rv asn1.RawValue
+	conn, err := net.DialTimeout("tcp", kdc, 10*time.Second)
+	if err != nil {
+		return rv, fmt.Errorf("KDC %s: %w", kdc, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(req)))
+	if _, err := conn.Write(append(msg, req...)); err != nil {
+		return rv, fmt.Errorf("KDC %s: %w", kdc, err)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return rv, fmt.Errorf("KDC %s: %w", kdc, err)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > 1<<20 {
+		return rv, fmt.Errorf("KDC %s: reply too large", kdc)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return rv, fmt.Errorf("KDC %s: %w", kdc, err)
+	}
+	if _, err := asn1.Unmarshal(b, &rv); err != nil {
+		return rv, fmt.Errorf("KDC %s: invalid reply: %w", kdc, err)
+	}
+	return rv, nil
+}
+
+// krbString returns the text of an explicitly tagged KerberosString.
+func krbString(rv asn1.RawValue) string {
+	var s asn1.RawValue
+	if _, err := asn1.Unmarshal(rv.Bytes, &s); err != nil {
+		return ""
+	}
+	return string(s.Bytes)
+}
+
+func krbNonce() int {
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<31-1))
+	if err != nil {
+		return int(time.Now().UnixNano() & 0x7fffffff)
+	}
+	return int(n.Int64())
+}
+
+// readKeytab returns the AES keys of principal in the keytab file at path (MIT format, version 2),
+// of the highest key version, strongest first.
+func readKeytab(path, principal string) ([]krbKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("keytab: %w", err)
+	}
+	if len(b) < 2 || b[0] != 5 || b[1] != 2 {
+		return nil, fmt.Errorf("keytab %s: unsupported format", path)
+	}
+	type entry struct {
+		kvno uint32
+		key  krbKey
+	}
+	best := map[int]entry{}
+	r := bytes.NewReader(b[2:])
+	for r.Len() > 0 {
+		var size int32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, fmt.Errorf("keytab %s: %w", path, err)
+		}
+		if size < 0 { // a hole left by a deleted entry
+			r.Seek(int64(-size), io.SeekCurrent)
+			continue
+		}
+		rec := make([]byte, size)
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return nil, fmt.Errorf("keytab %s: %w", path, err)
+		}
+		name, kvno, key, err := parseKeytabEntry(rec)
+		if err != nil {
+			return nil, fmt.Errorf("keytab %s: %w", path, err)
+		}
+		if name != principal || (key.etype != etypeAES128 && key.etype != etypeAES256) {
+			continue
+		}
+		if e, ok := best[key.etype]; !ok || kvno > e.kvno {
+			best[key.etype] = entry{kvno, key}
+		}
+	}
+	var keys []krbKey
+	for _, etype := range []int{etypeAES256, etypeAES128} {
+		if e, ok := best[etype]; ok {
+			keys = append(keys, e.key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keytab %s has no AES key for %s", path, principal)
+	}
+	return keys, nil
+}
+
+// parseKeytabEntry parses one keytab entry into its principal name, key version and key.
+func parseKeytabEntry(rec []byte) (string, uint32, krbKey, error) {
+	var key krbKey
+	errShort := errors.New("truncated entry")
+	u16 := func() (int, bool) {
+		if len(rec) < 2 {
+			return 0, false
+		}
+		v := int(binary.BigEndian.Uint16(rec))
+		rec = rec[2:]
+		return v, true
+	}
+	data := func() ([]byte, bool) {
+		n, ok := u16()
+		if !ok || len(rec) < n {
+			return nil, false
+		}
+		v := rec[:n]
+		rec = rec[n:]
+		return v, true
+	}
+	count, ok := u16()
+	if !ok {
+		return "", 0, key, errShort
+	}
+	realm, ok := data()
+	if !ok {
+		return "", 0, key, errShort
+	}
+	components := make([]string, count)
+	for i := range components {
+		c, ok := data()
+		if !ok {
+			return "", 0, key, errShort
+		}
+		components[i] = string(c)
+	}
+	// name type (4), timestamp (4), 8-bit key version (1)
+	if len(rec) < 9 {
+		return "", 0, key, errShort
+	}
+	kvno := uint32(rec[8])
+	rec = rec[9:]
+	etype, ok := u16()
+	if !ok {
+		return "", 0, key, errShort
+	}
+	value, ok := data()
+	if !ok {
+		return "", 0, key, errShort
+	}
+	if len(rec) >= 4 {
+		if v := binary.BigEndian.Uint32(rec); v != 0 {
+			kvno = v
+		}
+	}
+	key = krbKey{etype: etype, value: append([]byte(nil), value...)}
+	return strings.Join(components, "/") + "@" + string(realm), kvno, key, nil
+}
+
+// AES-CTS-HMAC-SHA1-96 (RFC 3961, RFC 3962).
+
+// krbEncrypt encrypts plaintext for key usage usage.
+func krbEncrypt(key krbKey, usage uint32, plaintext []byte) ([]byte, error) {
+	ke, ki := krbUsageKey(key, usage, 0xAA), krbUsageKey(key, usage, 0x55)
+	data := make([]byte, aes.BlockSize, aes.BlockSize+len(plaintext))
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	data = append(data, plaintext...)
+	ct, err := ctsEncrypt(ke, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ct, krbHMAC(ki, data)...), nil
+}
+
+// krbDecrypt decrypts and verifies ciphertext of key usage usage.
+func krbDecrypt(key krbKey, usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize+12 {
+		return nil, errors.New("ciphertext too short")
+	}
+	ke, ki := krbUsageKey(key, usage, 0xAA), krbUsageKey(key, usage, 0x55)
+	ct, mac := ciphertext[:len(ciphertext)-12], ciphertext[len(ciphertext)-12:]
+	data, err := ctsDecrypt(ke, ct)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, krbHMAC(ki, data)) {
+		return nil, errors.New("integrity check failed")
+	}
+	return data[aes.BlockSize:], nil
+}
+
+// krbChecksum is the hmac-sha1-96-aes checksum of data for key usage usage.
+func krbChecksum(key krbKey, usage uint32, data []byte) ([]byte, error) {
+	return krbHMAC(krbUsageKey(key, usage, 0x99), data), nil
+}
+
+func krbChecksumType(key krbKey) int {
+	if key.etype == etypeAES128 {
+		return 15
+	}
+	return 16
+}
+
+func krbHMAC(key, data []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:12]
+}
+
+func krbUsageKey(key krbKey, usage uint32, kind byte) []byte {
+	return krbDeriveKey(key.value, append(binary.BigEndian.AppendUint32(nil, usage), kind))
+}
+
+// krbDeriveKey is DK(key, constant) of RFC 3961 for AES.
+func krbDeriveKey(key, constant []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+	in := nfold(constant, aes.BlockSize)
+	out := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(out) < len(key) {
+		b := make([]byte, aes.BlockSize)
+		block.Encrypt(b, in)
+		out = append(out, b...)
+		in = b
+	}
+	return out[:len(key)]
+}
+
+// nfold stretches or folds in to size bytes (RFC 3961, section 5.1).
+func nfold(in []byte, size int) []byte {
+	inBits, outBits := len(in)*8, size*8
+	l := inBits / gcd(inBits, outBits) * outBits
+	// the input repeated l/inBits times, each copy rotated 13 bits more to the right
+	buf := make([]byte, l/8)
+	for i := 0; i < l/inBits; i++ {
+		for bit := 0; bit < inBits; bit++ {
+			if in[bit/8]&(0x80>>(bit%8)) != 0 {
+				pos := i*inBits + (bit+13*i)%inBits
+				buf[pos/8] |= 0x80 >> (pos % 8)
+			}
+		}
+	}
+	// ones' complement addition of the size-byte chunks
+	out := make([]byte, size)
+	for off := 0; off < len(buf); off += size {
+		carry := 0
+		for j := size - 1; j >= 0; j-- {
+			s := int(out[j]) + int(buf[off+j]) + carry
+			out[j], carry = byte(s), s>>8
+		}
+		for j := size - 1; carry != 0 && j >= 0; j-- {
+			s := int(out[j]) + carry
+			out[j], carry = byte(s), s>>8
+		}
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// ctsEncrypt is AES-CBC with ciphertext stealing and a zero IV, as Kerberos uses it: the last two
+// blocks are always swapped.
+func ctsEncrypt(key, pt []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	bs := aes.BlockSize
+	if len(pt) < bs {
+		return nil, errors.New("plaintext shorter than a block")
+	}
+	padded := make([]byte, (len(pt)+bs-1)/bs*bs)
+	copy(padded, pt)
+	ct := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, make([]byte, bs)).CryptBlocks(ct, padded)
+	if len(pt) == bs {
+		return ct, nil
+	}
+	n := len(ct) / bs
+	r := len(pt) - (n-1)*bs
+	out := append([]byte(nil), ct[:(n-2)*bs]...)
+	out = append(out, ct[(n-1)*bs:]...)
+	return append(out, ct[(n-2)*bs:(n-2)*bs+r]...), nil
+}
+
+func ctsDecrypt(key, ct []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	bs := aes.BlockSize
+	if len(ct) < bs {
+		return nil, errors.New("ciphertext shorter than a block")
+	}
+	iv := make([]byte, bs)
+	if len(ct) == bs {
+		pt := make([]byte, bs)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(pt, ct)
+		return pt, nil
+	}
+	n := (len(ct) + bs - 1) / bs
+	r := len(ct) - (n-1)*bs
+	head := ct[:(n-2)*bs]
+	last := ct[(n-2)*bs : (n-1)*bs] // the last full cipher block, swapped in front
+	partial := ct[(n-1)*bs:]
+	pt := make([]byte, 0, len(ct))
+	if len(head) > 0 {
+		p := make([]byte, len(head))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(p, head)
+		pt = append(pt, p...)
+		iv = head[len(head)-bs:]
+	}
+	d := make([]byte, bs)
+	block.Decrypt(d, last)
+	prev := append(append([]byte(nil), partial...), d[r:]...) // the full second-to-last cipher block
+	lastPT := make([]byte, r)
+	for i := range lastPT {
+		lastPT[i] = d[i] ^ partial[i]
+	}
+	p := make([]byte, bs)
+	block.Decrypt(p, prev)
+	for i := range p {
+		p[i] ^= iv[i]
+	}
+	return append(append(pt, p...), lastPT...), nil
+}
+
+// DER building blocks for Kerberos messages.
+
+func derWrap(class, tag int, compound bool, content []byte) []byte {
+	b, _ := asn1.Marshal(asn1.RawValue{Class: class, Tag: tag, IsCompound: compound, Bytes: content})
+	return b
+}
+
+func derSeq(items ...[]byte) []byte {
+	return derWrap(asn1.ClassUniversal, asn1.TagSequence, true, bytes.Join(items, nil))
+}
+
+func derCtx(tag int, item []byte) []byte {
+	return derWrap(asn1.ClassContextSpecific, tag, true, item)
+}
+
+func derApp(tag int, item []byte) []byte {
+	return derWrap(asn1.ClassApplication, tag, true, item)
+}
+
+func derInt(i int) []byte {
+	b, _ := asn1.Marshal(i)
+	return b
+}
+
+func derOctets(v []byte) []byte {
+	b, _ := asn1.Marshal(v)
+	return b
+}
+
+// derString is a KerberosString (GeneralString).
+func derString(s string) []byte {
+	return derWrap(asn1.ClassUniversal, asn1.TagGeneralString, false, []byte(s))
+}
+
+func derTime(t time.Time) []byte {
+	b, _ := asn1.MarshalWithParams(t.UTC(), "generalized")
+	return b
+}
+
+func derFlags(flags uint32) []byte {
+	b, _ := asn1.Marshal(asn1.BitString{Bytes: binary.BigEndian.AppendUint32(nil, flags), BitLength: 32})
+	return b
+}
+
+func derPrincipal(nameType int, components []string) []byte {
+	names := make([][]byte, len(components))
+	for i, c := range components {
+		names[i] = derString(c)
+	}
+	return derSeq(derCtx(0, derInt(nameType)), derCtx(1, derSeq(names...)))
+}
+
+func derEncrypted(etype int, cipher []byte) []byte {
+	return derSeq(derCtx(0, derInt(etype)), derCtx(2, derOctets(cipher)))
+}
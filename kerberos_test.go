@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 3961, appendix A.1.
+func TestNfold(t *testing.T) {
+	tests := []struct {
+		in   string
+		bits int
+		want string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 64, "bb6ed30870b7f0e0"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"MASSACHVSETTS INSTITVTE OF TECHNOLOGY", 192, "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{"Q", 168, "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{"ba", 168, "fb25d531ae8974499f52fd92ea9857c4ba24cf297e"},
+		{"kerberos", 64, "6b657262 65726f73"},
+		{"kerberos", 128, "6b657262 65726f73 7b9b5b2b 93132b93"},
+		{"kerberos", 168, "8372c236 344e5f15 50cd0747 e15d62ca 7a5a3bce a4"},
+		{"kerberos", 256, "6b657262 65726f73 7b9b5b2b 93132b93 5c9bdcda d95c9899 c4cae4de e6d6cae4"},
+	}
+	for _, tt := range tests {
+		if got := nfold([]byte(tt.in), tt.bits/8); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("%d-fold(%q) = %x, want %s", tt.bits, tt.in, got, tt.want)
+		}
+	}
+}
+
+// RFC 3962, appendix B: AES 128 with ciphertext stealing and a zero IV.
+func TestCTS(t *testing.T) {
+	key := []byte("chicken teriyaki")
+	const text = "I would like the General Gau's Chicken, please, and wonton soup."
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{17, "c6353568f2bf8cb4d8a580362da7ff7f 97"},
+		{31, "fc00783e0efdb2c1d445d4c8eff7ed22 97687268d6ecccc0c07b25e25ecfe5"},
+		{32, "39312523a78662d5be7fcbcc98ebf5a8 97687268d6ecccc0c07b25e25ecfe584"},
+		{47, "97687268d6ecccc0c07b25e25ecfe584 b3fffd940c16a18c1b5549d2f838029e 39312523a78662d5be7fcbcc98ebf5"},
+		{48, "97687268d6ecccc0c07b25e25ecfe584 9dad8bbb96c4cdc03bc103e1a194bbd8 39312523a78662d5be7fcbcc98ebf5a8"},
+		{64, "97687268d6ecccc0c07b25e25ecfe584 39312523a78662d5be7fcbcc98ebf5a8 4807efe836ee89a526730dbc2f7bc840 9dad8bbb96c4cdc03bc103e1a194bbd8"},
+	}
+	for _, tt := range tests {
+		pt, want := []byte(text[:tt.n]), unhex(t, tt.want)
+		ct, err := ctsEncrypt(key, pt)
+		if err != nil || !bytes.Equal(ct, want) {
+			t.Errorf("ctsEncrypt(%d bytes) = %x, %v, want %x", tt.n, ct, err, want)
+			continue
+		}
+		if got, err := ctsDecrypt(key, want); err != nil || !bytes.Equal(got, pt) {
+			t.Errorf("ctsDecrypt(%d bytes) = %q, %v, want %q", tt.n, got, err, pt)
+		}
+	}
+	if _, err := ctsEncrypt(key, []byte("short")); err == nil {
+		t.Error("ctsEncrypt accepted less than a block")
+	}
+}
+
+// MIT krb5's t_derive.c vectors: the Kc, Ke and Ki keys of key usage 2.
+func TestKrbUsageKey(t *testing.T) {
+	k128 := krbKey{etypeAES128, unhex(t, "42263C6E89F4FC28B8DF68EE09799F15")}
+	k256 := krbKey{etypeAES256, unhex(t, "FE697B52BC0D3CE14432BA036A92E65BBB52280990A2FA27883998D72AF30161")}
+	tests := []struct {
+		key  krbKey
+		kind byte
+		want string
+	}{
+		{k128, 0x99, "34280A382BC92769B2DA2F9EF066854B"},
+		{k128, 0xAA, "5B14FC4E250E14DDF9DCCF1AF6674F53"},
+		{k128, 0x55, "4ED31063621684F09AE8D89991AF3E8F"},
+		{k256, 0x99, "BFAB388BDCB238E9F9C98D6A878304F04D30C82556375AC507A7A852790F4674"},
+		{k256, 0xAA, "C7CFD9CD75FE793A586A542D87E0D1396F1134A104BB1A9190B8C90ADA3DDF37"},
+		{k256, 0x55, "97151B4C76945063E2EB0529DC067D97D7BBA90776D8126D91F34F3101AEA8BA"},
+	}
+	for _, tt := range tests {
+		if got := krbUsageKey(tt.key, 2, tt.kind); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("etype %d, kind %#x: %X, want %s", tt.key.etype, tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestKrbEncryptRoundTrip(t *testing.T) {
+	for _, key := range []krbKey{
+		{etypeAES128, bytes.Repeat([]byte{0x42}, 16)},
+		{etypeAES256, bytes.Repeat([]byte{0x17}, 32)},
+	} {
+		for _, n := range []int{0, 1, 15, 16, 17, 100} {
+			pt := bytes.Repeat([]byte("k"), n)
+			ct, err := krbEncrypt(key, 7, pt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := krbDecrypt(key, 7, ct); err != nil || !bytes.Equal(got, pt) {
+				t.Errorf("etype %d, %d bytes: decrypt = %q, %v", key.etype, n, got, err)
+			}
+			if _, err := krbDecrypt(key, 8, ct); err == nil {
+				t.Errorf("etype %d, %d bytes: decrypted with another key usage", key.etype, n)
+			}
+			ct[0] ^= 1
+			if _, err := krbDecrypt(key, 7, ct); err == nil {
+				t.Errorf("etype %d, %d bytes: tampered ciphertext decrypted", key.etype, n)
+			}
+		}
+	}
+}
+
+// writeKeytab writes a version 2 keytab of entries to a temporary file.
+func writeKeytab(t *testing.T, entries ...[]byte) string {
+	t.Helper()
+	b := []byte{5, 2}
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(e)))
+		b = append(b, e...)
+	}
+	path := filepath.Join(t.TempDir(), "krb5.keytab")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func keytabEntry(realm string, components []string, kvno uint32, etype int, key []byte) []byte {
+	data := func(b []byte, v string) []byte {
+		return append(binary.BigEndian.AppendUint16(b, uint16(len(v))), v...)
+	}
+	e := binary.BigEndian.AppendUint16(nil, uint16(len(components)))
+	e = data(e, realm)
+	for _, c := range components {
+		e = data(e, c)
+	}
+	e = binary.BigEndian.AppendUint32(e, 1) // KRB5_NT_PRINCIPAL
+	e = binary.BigEndian.AppendUint32(e, uint32(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix()))
+	e = append(e, byte(kvno))
+	e = binary.BigEndian.AppendUint16(e, uint16(etype))
+	e = data(e, string(key))
+	return binary.BigEndian.AppendUint32(e, kvno)
+}
+
+func TestReadKeytab(t *testing.T) {
+	old128, new128 := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{2}, 16)
+	key256 := bytes.Repeat([]byte{3}, 32)
+	path := writeKeytab(t,
+		keytabEntry("EXAMPLE.COM", []string{"autopg"}, 1, etypeAES128, old128),
+		keytabEntry("EXAMPLE.COM", []string{"autopg"}, 300, etypeAES128, new128), // kvno past 8 bits
+		keytabEntry("EXAMPLE.COM", []string{"autopg"}, 2, etypeAES256, key256),
+		keytabEntry("EXAMPLE.COM", []string{"autopg"}, 3, 23, bytes.Repeat([]byte{4}, 16)), // RC4, unsupported
+		keytabEntry("EXAMPLE.COM", []string{"other"}, 9, etypeAES256, bytes.Repeat([]byte{5}, 32)),
+	)
+	keys, err := readKeytab(path, "autopg@EXAMPLE.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].etype != etypeAES256 || !bytes.Equal(keys[0].value, key256) ||
+		keys[1].etype != etypeAES128 || !bytes.Equal(keys[1].value, new128) {
+		t.Errorf("readKeytab = %+v, want the AES256 key, then the latest AES128 key", keys)
+	}
+	if _, err := readKeytab(path, "nobody@EXAMPLE.COM"); err == nil {
+		t.Error("readKeytab found keys of an absent principal")
+	}
+	truncated := keytabEntry("EXAMPLE.COM", []string{"autopg"}, 1, etypeAES128, old128)
+	if _, err := readKeytab(writeKeytab(t, truncated[:10]), "autopg@EXAMPLE.COM"); err == nil {
+		t.Error("readKeytab accepted a truncated entry")
+	}
+}
+
+func TestParseKeytabEntry(t *testing.T) {
+	name, kvno, key, err := parseKeytabEntry(keytabEntry("EXAMPLE.COM", []string{"postgres", "db.example.com"}, 5, etypeAES256, bytes.Repeat([]byte{9}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "postgres/db.example.com@EXAMPLE.COM" || kvno != 5 || key.etype != etypeAES256 || len(key.value) != 32 {
+		t.Errorf("parseKeytabEntry = %q, %d, %+v", name, kvno, key)
+	}
+}
+
+func TestDERPrincipal(t *testing.T) {
+	var name struct {
+		Type   int      `asn1:"explicit,tag:0"`
+		String []string `asn1:"general,explicit,tag:1"`
+	}
+	if _, err := asn1.Unmarshal(derPrincipal(2, []string{"postgres", "db.example.com"}), &name); err != nil {
+		t.Fatal(err)
+	}
+	if name.Type != 2 || strings.Join(name.String, "/") != "postgres/db.example.com" {
+		t.Errorf("derPrincipal decodes to %+v", name)
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kubernetes operator mode: `autopg operator` runs autopg as a controller in a cluster. Instead of Docker
+// labels it reconciles PostgresDatabase resources (kubernetes/crd.yaml), whose spec holds the target, db,
+// user and, in options, any other label field by name (e.g. extensions: postgis). The resource goes
+// through the same provisioning as a container with the equivalent autopg.<target>.* labels, enable=true
+// implied, its namespace and name standing in for the compose project and service. The credentials are
+// written to a Secret owned by the resource (spec.secretName, default <name>-postgres) with the keys of
+// the json credentials file and DATABASE_URL, and the outcome to the resource's status.
+//   - AUTOPG_KUBE_WATCH lists what is reconciled: databases (default) and/or pods (kubepods.go);
+//   - AUTOPG_KUBE_NAMESPACE is the namespace watched (default: autopg's own), or * for all of them;
+//   - AUTOPG_KUBE_RESYNC is how often every resource is listed again, retrying failed ones and
+//     restoring deleted Secrets (default 5m);
+//   - AUTOPG_KUBE_API overrides the API server, e.g. http://127.0.0.1:8001 with kubectl proxy;
+//     otherwise the in-cluster service account is used.
+// Deleting a resource deletes its Secret but keeps the database and role, like a removed container.
+
+const (
+	kubeGroup       = "autopg.journaudbe.github.io"
+	kubeVersion     = "v1alpha1"
+	kubePlural      = "postgresdatabases"
+	kubeAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount/"
+)
+
+// postgresDatabase is a PostgresDatabase resource.
+type postgresDatabase struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   kubeObject `json:"metadata"`
+	Spec       struct {
+		Target     string            `json:"target"`
+		DB         string            `json:"db,omitempty"`
+		User       string            `json:"user,omitempty"`
+		SecretName string            `json:"secretName,omitempty"`
+		Options    map[string]string `json:"options,omitempty"`
+	} `json:"spec"`
+	Status postgresDatabaseStatus `json:"status"`
+}
+
+type postgresDatabaseStatus struct {
+	Phase              string `json:"phase,omitempty"` // Ready, Pending or Failed
+	Message            string `json:"message,omitempty"`
+	DB                 string `json:"db,omitempty"`
+	User               string `json:"user,omitempty"`
+	SecretName         string `json:"secretName,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	RequestID          string `json:"requestID,omitempty"`
+	LastReconciled     string `json:"lastReconciled,omitempty"`
+}
+
+type kubeObject struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Generation      int64             `json:"generation,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	OwnerReferences []kubeOwner       `json:"ownerReferences,omitempty"`
+}
+
+type kubeOwner struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+	Controller bool   `json:"controller"`
+}
+
+type kubeSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubeObject        `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data"`
+}
+
+func (d postgresDatabase) displayName() string {
+	return d.Metadata.Namespace + "/" + d.Metadata.Name
+}
+
+func (d postgresDatabase) secretName() string {
+	if d.Spec.SecretName != "" {
+		return d.Spec.SecretName
+	}
+	return d.Metadata.Name + "-postgres"
+}
+
+// resource returns d as a resource with the labels equivalent to its spec, whose credentials go to its
+// Secret.
+func (d postgresDatabase) resource(k *kubeClient) (resource, error) {
+	target := d.Spec.Target
+	if target == "" {
+		return resource{}, errors.New("spec.target is required")
+	}
+	if strings.Contains(target, ".") {
+		return resource{}, fmt.Errorf("invalid spec.target %q", target)
+	}
+	prefix := labelPrefix + target + "."
+	labels := map[string]string{prefix + "enable": "true"}
+	if d.Spec.DB != "" {
+		labels[prefix+"db"] = d.Spec.DB
+	}
+	if d.Spec.User != "" {
+		labels[prefix+"user"] = d.Spec.User
+	}
+	for k, v := range d.Spec.Options {
+		if contains(reservedOptions, k) {
+			return resource{}, fmt.Errorf("options.%s cannot be set on a PostgresDatabase", k)
+		}
+		labels[prefix+k] = v
+	}
+	owner := kubeOwner{APIVersion: kubeGroup + "/" + kubeVersion, Kind: "PostgresDatabase", Name: d.Metadata.Name, UID: d.Metadata.UID, Controller: true}
+	ref := kubeSecretRef{Namespace: d.Metadata.Namespace, Name: d.secretName(), Owner: &owner}
+	return resource{
+		kind: "PostgresDatabase", ref: d.displayName(),
+		id: d.Metadata.UID, name: d.Metadata.Name,
+		project: d.Metadata.Namespace, service: d.Metadata.Name,
+		labels:  labels,
+		targets: []string{target},
+		sink:    func(string) (credentialSink, error) { return &kubeSecretSink{k: k, ref: ref}, nil },
+	}, nil
+}
+
+// kubeClient talks to the Kubernetes API server.
+type kubeClient struct {
+	base      string
+	tokenFile string
+	http      *http.Client
+}
+
+func newKubeClient() (*kubeClient, error) {
+	if base := os.Getenv("AUTOPG_KUBE_API"); base != "" {
+		return &kubeClient{base: strings.TrimSuffix(base, "/"), http: &http.Client{}}, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster; set AUTOPG_KUBE_API")
+	}
+	ca, err := os.ReadFile(kubeAccountPath + "ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("service account CA has no certificates")
+	}
+	return &kubeClient{
+		base:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: kubeAccountPath + "token",
+		http:      &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}}},
+	}, nil
+}
+
+// kubeError is an error status answered by the API server.
+type kubeError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API: %s (%d)", e.Message, e.Code)
+}
+
+func isKubeNotFound(err error) bool {
+	var ke *kubeError
+	return errors.As(err, &ke) && ke.Code == http.StatusNotFound
+}
+
+// request sends a request to the API server and returns the response when it succeeded. The token is
+// read for every request, as projected service account tokens are rotated.
+func (k *kubeClient) request(ctx context.Context, method, path, contentType string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		ke := &kubeError{Code: resp.StatusCode}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(b, ke) != nil || ke.Message == "" {
+			ke.Message = strings.TrimSpace(string(b))
+		}
+		ke.Code = resp.StatusCode
+		return nil, ke
+	}
+	return resp, nil
+}
+
+// do is request with the JSON response decoded into out, if not nil.
+func (k *kubeClient) do(ctx context.Context, method, path, contentType string, body, out any) error {
+	resp, err := k.request(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// databasesPath is the API path of the PostgresDatabases in namespace, or of all of them for "*".
+func databasesPath(namespace string) string {
+	if namespace == "*" {
+		return "/apis/" + kubeGroup + "/" + kubeVersion + "/" + kubePlural
+	}
+	return "/apis/" + kubeGroup + "/" + kubeVersion + "/namespaces/" + url.PathEscape(namespace) + "/" + kubePlural
+}
+
+// kubeNamespace returns the namespace the operator watches.
+func kubeNamespace() (string, error) {
+	if ns := os.Getenv("AUTOPG_KUBE_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	b, err := os.ReadFile(kubeAccountPath + "namespace")
+	if err != nil {
+		return "", fmt.Errorf("own namespace unknown; set AUTOPG_KUBE_NAMESPACE: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func kubeResync() time.Duration {
+	if v := os.Getenv("AUTOPG_KUBE_RESYNC"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 10*time.Second {
+			return d
+		}
+		log.Printf("warning: invalid AUTOPG_KUBE_RESYNC %q, using 5m", v)
+	}
+	return 5 * time.Minute
+}
+
+// kubeKind is a kind of resource the operator reconciles.
+type kubeKind struct {
+	name string
+	path func(namespace string) string
+	// listed is called for every resource at each resync, changed for the resources a watch reports
+	// as added or modified
+	listed, changed func(ctx context.Context, k *kubeClient, obj json.RawMessage) error
+}
+
+var kubeKinds = map[string]kubeKind{
+	"databases": {name: kubePlural, path: databasesPath, listed: databaseListed, changed: databaseChanged},
+	"pods":      {name: "pods", path: podsPath, listed: podListed, changed: podChanged},
+}
+
+// runOperator implements `autopg operator`: runs the kubernetes provider alone.
+func runOperator(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: autopg operator")
+	}
+	p, err := newKubeProvider()
+	if err != nil {
+		return err
+	}
+	return p.run(context.Background())
+}
+
+// kubeProvider reconciles the kinds of resources in AUTOPG_KUBE_WATCH (default "databases").
+type kubeProvider struct {
+	k         *kubeClient
+	namespace string
+	kinds     []kubeKind
+	resync    time.Duration
+}
+
+func newKubeProvider() (provider, error) {
+	k, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := kubeNamespace()
+	if err != nil {
+		return nil, err
+	}
+	watched := splitList(os.Getenv("AUTOPG_KUBE_WATCH"))
+	if len(watched) == 0 {
+		watched = []string{"databases"}
+	}
+	p := &kubeProvider{k: k, namespace: namespace, resync: kubeResync()}
+	for _, name := range watched {
+		kind, ok := kubeKinds[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid AUTOPG_KUBE_WATCH %q; expected databases or pods", name)
+		}
+		p.kinds = append(p.kinds, kind)
+	}
+	return p, nil
+}
+
+func (p *kubeProvider) run(ctx context.Context) error {
+	for _, kind := range p.kinds {
+		log.Printf("operator: reconciling %s in namespace %s via %s", kind.name, p.namespace, p.k.base)
+		go p.k.loop(ctx, kind, p.namespace, p.resync)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// loop reconciles the resources of kind forever: every resync lists all of them, then watches for
+// changes until the next one.
+func (k *kubeClient) loop(ctx context.Context, kind kubeKind, namespace string, resync time.Duration) {
+	for {
+		version, err := k.reconcileAll(ctx, kind, namespace)
+		if err == nil {
+			err = k.watch(ctx, kind, namespace, version, resync)
+		}
+		if err != nil {
+			log.Printf("operator: %v; listing again in 10s", err)
+			time.Sleep(10 * time.Second)
+		}
+	}
+}
+
+// reconcileAll hands every resource of kind to kind.listed and returns the resource version to watch
+// from.
+func (k *kubeClient) reconcileAll(ctx context.Context, kind kubeKind, namespace string) (string, error) {
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := k.do(ctx, http.MethodGet, kind.path(namespace), "", nil, &list); err != nil {
+		return "", fmt.Errorf("list %s: %w", kind.name, err)
+	}
+	for _, item := range list.Items {
+		if err := kind.listed(ctx, k, item); err != nil {
+			log.Printf("operator: %s: %v", kind.name, err)
+		}
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch hands the resources of kind added or modified from version on to kind.changed, for at most d.
+func (k *kubeClient) watch(ctx context.Context, kind kubeKind, namespace, version string, d time.Duration) error {
+	path := kind.path(namespace) + "?watch=1&allowWatchBookmarks=true&timeoutSeconds=" + strconv.Itoa(int(d.Seconds())) +
+		"&resourceVersion=" + url.QueryEscape(version)
+	resp, err := k.request(ctx, http.MethodGet, path, "", nil)
+	if err != nil {
+		return fmt.Errorf("watch %s: %w", kind.name, err)
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("watch %s: %w", kind.name, err)
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			if err := kind.changed(ctx, k, ev.Object); err != nil {
+				log.Printf("operator: %s: %v", kind.name, err)
+			}
+		case "ERROR":
+			// typically 410 Gone once the resource version is too old; listing again starts over
+			var ke kubeError
+			json.Unmarshal(ev.Object, &ke)
+			return fmt.Errorf("watch %s: %w", kind.name, &ke)
+		}
+	}
+}
+
+// databaseListed reconciles a PostgresDatabase that is not Ready for its current generation, or whose
+// Secret is gone.
+func databaseListed(ctx context.Context, k *kubeClient, obj json.RawMessage) error {
+	var d postgresDatabase
+	if err := json.Unmarshal(obj, &d); err != nil {
+		return err
+	}
+	if upToDate(d) && !reapplyAlways(d.Spec.Target) {
+		_, err := k.getSecret(ctx, d.Metadata.Namespace, d.secretName())
+		if err == nil {
+			return nil
+		}
+		if !isKubeNotFound(err) {
+			return fmt.Errorf("%s: secret %s: %w", d.displayName(), d.secretName(), err)
+		}
+	}
+	k.reconcile(ctx, d)
+	return nil
+}
+
+// databaseChanged reconciles a PostgresDatabase whose spec changed. Status updates, including autopg's
+// own, do not change the generation and are ignored.
+func databaseChanged(ctx context.Context, k *kubeClient, obj json.RawMessage) error {
+	var d postgresDatabase
+	if err := json.Unmarshal(obj, &d); err != nil {
+		return err
+	}
+	if d.Status.ObservedGeneration != d.Metadata.Generation {
+		k.reconcile(ctx, d)
+	}
+	return nil
+}
+
+func upToDate(d postgresDatabase) bool {
+	return d.Status.Phase == "Ready" && d.Status.ObservedGeneration == d.Metadata.Generation
+}
+
+// reconcile provisions d and records the outcome in its status.
+func (k *kubeClient) reconcile(ctx context.Context, d postgresDatabase) {
+	ctx = withRequestID(ctx, newRequestID())
+	name := d.displayName()
+	status := postgresDatabaseStatus{Phase: "Ready", SecretName: d.secretName(), ObservedGeneration: d.Metadata.Generation, RequestID: requestID(ctx)}
+	r, err := d.resource(k)
+	if err == nil {
+		r.retry = func(ctx context.Context) {
+			var cur postgresDatabase
+			path := databasesPath(d.Metadata.Namespace) + "/" + url.PathEscape(d.Metadata.Name)
+			if err := k.do(ctx, http.MethodGet, path, "", nil, &cur); err != nil {
+				logf(ctx, "scheduled run for %s dropped: %v", name, err)
+				return
+			}
+			k.reconcile(ctx, cur)
+		}
+		var results []resourceResult
+		if results, err = reconcileResource(ctx, r); err != nil || len(results) == 0 {
+			// paused, or another instance's target
+			return
+		}
+		status.DB, status.User, err = results[0].spec.DB, results[0].spec.User, results[0].err
+	} else {
+		logf(ctx, "%s: %v", name, err)
+	}
+	if err != nil {
+		status.Phase, status.Message = "Failed", redact(err.Error())
+		if errors.As(err, new(pendingError)) {
+			status.Phase = "Pending"
+		}
+	}
+	status.LastReconciled = time.Now().UTC().Format(time.RFC3339)
+	path := databasesPath(d.Metadata.Namespace) + "/" + url.PathEscape(d.Metadata.Name) + "/status"
+	if err := k.do(ctx, http.MethodPatch, path, "application/merge-patch+json", map[string]any{"status": status}, nil); err != nil {
+		logf(ctx, "warning: could not update status of %s: %v", name, err)
+	}
+}
+
+// kubeSecretRef is the Secret the credentials of a Kubernetes resource are written to. Without an
+// owner it can only replace a Secret autopg created. Workload, for the Secrets of pods, is added to the
+// Secret's owners, so it is garbage collected with the last workload using it.
+type kubeSecretRef struct {
+	Namespace, Name string
+	Owner           *kubeOwner
+	Workload        *kubeOwner
+}
+
+func (r kubeSecretRef) owns(s *kubeSecret) bool {
+	if r.Owner == nil {
+		return s.Metadata.Labels["app.kubernetes.io/managed-by"] == "autopg"
+	}
+	return ownedBy(s.Metadata, r.Owner.UID)
+}
+
+// kubeSecretSink writes the credentials of a Kubernetes resource to the Secret ref, if named.
+type kubeSecretSink struct {
+	k      *kubeClient
+	ref    kubeSecretRef
+	secret *kubeSecret
+}
+
+func (s *kubeSecretSink) stored(ctx context.Context) (string, string, error) {
+	if s.ref.Name == "" {
+		return "", "", nil
+	}
+	secret, err := s.k.getSecret(ctx, s.ref.Namespace, s.ref.Name)
+	if isKubeNotFound(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("secret %s: %w", s.ref.Name, err)
+	}
+	if !s.ref.owns(secret) {
+		return "", "", fmt.Errorf("secret %s exists and is not autopg's", s.ref.Name)
+	}
+	s.secret = secret
+	return string(secret.Data["username"]), string(secret.Data["password"]), nil
+}
+
+func (s *kubeSecretSink) write(ctx context.Context, c exportedCredential) error {
+	if s.ref.Name == "" {
+		return nil
+	}
+	if err := s.k.writeSecret(ctx, s.ref, s.secret, c); err != nil {
+		return fmt.Errorf("secret %s: %w", s.ref.Name, err)
+	}
+	return nil
+}
+
+func ownedBy(m kubeObject, uid string) bool {
+	for _, o := range m.OwnerReferences {
+		if o.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *kubeClient) getSecret(ctx context.Context, namespace, name string) (*kubeSecret, error) {
+	var s kubeSecret
+	path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets/" + url.PathEscape(name)
+	if err := k.do(ctx, http.MethodGet, path, "", nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// writeSecret creates the Secret ref with the credentials c, or updates existing when its data differs.
+func (k *kubeClient) writeSecret(ctx context.Context, ref kubeSecretRef, existing *kubeSecret, c exportedCredential) error {
+	data := map[string][]byte{"uri": []byte(c.uri()), "DATABASE_URL": []byte(c.uri())}
+	for key, v := range c.secretValue() {
+		data[key] = []byte(v)
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(ref.Namespace) + "/secrets"
+	if existing == nil {
+		s := kubeSecret{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Type:       "Opaque",
+			Metadata: kubeObject{
+				Name:      ref.Name,
+				Namespace: ref.Namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "autopg"},
+			},
+			Data: data,
+		}
+		if ref.Owner != nil {
+			s.Metadata.OwnerReferences = []kubeOwner{*ref.Owner}
+		}
+		if ref.Workload != nil {
+			s.Metadata.OwnerReferences = append(s.Metadata.OwnerReferences, *ref.Workload)
+		}
+		return k.do(ctx, http.MethodPost, path, "application/json", s, nil)
+	}
+	patch := map[string]any{}
+	same := len(existing.Data) == len(data)
+	for key, v := range data {
+		same = same && bytes.Equal(existing.Data[key], v)
+	}
+	if !same {
+		encoded := map[string]string{}
+		for key, v := range data {
+			encoded[key] = base64.StdEncoding.EncodeToString(v)
+		}
+		patch["data"] = encoded
+	}
+	if ref.Workload != nil && !ownedBy(existing.Metadata, ref.Workload.UID) {
+		// a merge patch replaces the whole list
+		patch["metadata"] = map[string]any{"ownerReferences": append(existing.Metadata.OwnerReferences, *ref.Workload)}
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+	return k.do(ctx, http.MethodPatch, path+"/"+url.PathEscape(ref.Name), "application/merge-patch+json", patch, nil)
+}
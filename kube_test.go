@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// kubeRequest is a request the fake API server received.
+type kubeRequest struct {
+	method, path, contentType, auth string
+	body                            string
+}
+
+// fakeKubeAPI starts an API server answering with handler and returns a client of it and the requests
+// it received.
+func fakeKubeAPI(t *testing.T, handler func(r kubeRequest) (int, string)) (*kubeClient, *[]kubeRequest) {
+	t.Helper()
+	var requests []kubeRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		req := kubeRequest{r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type"), r.Header.Get("Authorization"), string(b)}
+		requests = append(requests, req)
+		code, body := handler(req)
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return &kubeClient{base: srv.URL, http: srv.Client()}, &requests
+}
+
+const kubeNotFound = `{"kind":"Status","status":"Failure","reason":"NotFound","message":"secrets \"x\" not found","code":404}`
+
+func TestPostgresDatabaseResource(t *testing.T) {
+	var d postgresDatabase
+	d.Metadata = kubeObject{Name: "shop", Namespace: "prod", UID: "uid-1"}
+	d.Spec.Target = "main"
+	d.Spec.DB = "shop"
+	d.Spec.Options = map[string]string{"extensions": "postgis"}
+	r, err := d.resource(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"autopg.main.enable": "true", "autopg.main.db": "shop", "autopg.main.extensions": "postgis"}
+	if len(r.labels) != len(want) {
+		t.Errorf("labels %v, want %v", r.labels, want)
+	}
+	for k, v := range want {
+		if r.labels[k] != v {
+			t.Errorf("labels %v, want %v", r.labels, want)
+		}
+	}
+	if r.project != "prod" || r.service != "shop" || strings.Join(r.targets, ",") != "main" || r.displayName() != "prod/shop" {
+		t.Errorf("resource %+v", r)
+	}
+	sink, _ := r.sink("main")
+	if ref := sink.(*kubeSecretSink).ref; ref.Name != "shop-postgres" || ref.Owner == nil || ref.Owner.UID != "uid-1" {
+		t.Errorf("secret %+v", ref)
+	}
+
+	for _, bad := range []func(*postgresDatabase){
+		func(d *postgresDatabase) { d.Spec.Target = "" },
+		func(d *postgresDatabase) { d.Spec.Target = "main.db" },
+		func(d *postgresDatabase) { d.Spec.Options = map[string]string{"user": "postgres"} },
+		func(d *postgresDatabase) { d.Spec.Options = map[string]string{"deliver": "exec"} },
+		func(d *postgresDatabase) { d.Spec.Options = map[string]string{"post_exec": "reload"} },
+		func(d *postgresDatabase) { d.Spec.Options = map[string]string{"config": `{"user":"postgres"}`} },
+	} {
+		d := d
+		d.Spec.Options = nil
+		bad(&d)
+		if _, err := d.resource(nil); err == nil {
+			t.Errorf("resource of %+v succeeded", d.Spec)
+		}
+	}
+}
+
+func TestKubeRequest(t *testing.T) {
+	k, requests := fakeKubeAPI(t, func(r kubeRequest) (int, string) {
+		if strings.HasSuffix(r.path, "/missing") {
+			return http.StatusNotFound, kubeNotFound
+		}
+		if strings.HasSuffix(r.path, "/broken") {
+			return http.StatusBadGateway, "upstream down\n"
+		}
+		return http.StatusOK, `{"metadata":{"name":"shop"}}`
+	})
+	// the token is read at every request, as projected tokens rotate
+	k.tokenFile = filepath.Join(t.TempDir(), "token")
+	for _, token := range []string{"one", "two"} {
+		os.WriteFile(k.tokenFile, []byte(token+"\n"), 0o600)
+		var out kubeSecret
+		if err := k.do(t.Context(), http.MethodGet, "/api/v1/namespaces/prod/secrets/shop", "", nil, &out); err != nil || out.Metadata.Name != "shop" {
+			t.Errorf("do = %+v, %v", out, err)
+		}
+		if got := (*requests)[len(*requests)-1].auth; got != "Bearer "+token {
+			t.Errorf("Authorization %q, want the token %s", got, token)
+		}
+	}
+
+	err := k.do(t.Context(), http.MethodGet, "/api/v1/namespaces/prod/secrets/missing", "", nil, nil)
+	var ke *kubeError
+	if !isKubeNotFound(err) || !errors.As(err, &ke) || ke.Reason != "NotFound" {
+		t.Errorf("not found: %v", err)
+	}
+	err = k.do(t.Context(), http.MethodGet, "/broken", "", nil, nil)
+	if !errors.As(err, &ke) || ke.Code != http.StatusBadGateway || ke.Message != "upstream down" || isKubeNotFound(err) {
+		t.Errorf("non-Status error: %v", err)
+	}
+}
+
+func TestDatabasesPath(t *testing.T) {
+	if got := databasesPath("prod"); got != "/apis/autopg.journaudbe.github.io/v1alpha1/namespaces/prod/postgresdatabases" {
+		t.Errorf("databasesPath(prod) = %s", got)
+	}
+	if got := databasesPath("*"); got != "/apis/autopg.journaudbe.github.io/v1alpha1/postgresdatabases" {
+		t.Errorf("databasesPath(*) = %s", got)
+	}
+}
+
+func TestKubeWatch(t *testing.T) {
+	k, requests := fakeKubeAPI(t, func(r kubeRequest) (int, string) {
+		return http.StatusOK, `{"type":"ADDED","object":{"metadata":{"name":"a"}}}
+{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"12"}}}
+{"type":"MODIFIED","object":{"metadata":{"name":"b"}}}
+{"type":"DELETED","object":{"metadata":{"name":"c"}}}
+{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired","message":"too old resource version"}}
+{"type":"ADDED","object":{"metadata":{"name":"d"}}}
+`
+	})
+	var changed []string
+	kind := kubeKind{name: "things", path: func(ns string) string { return "/apis/x/v1/namespaces/" + ns + "/things" },
+		changed: func(_ context.Context, _ *kubeClient, obj json.RawMessage) error {
+			var o struct{ Metadata kubeObject }
+			json.Unmarshal(obj, &o)
+			changed = append(changed, o.Metadata.Name)
+			return nil
+		}}
+	err := k.watch(t.Context(), kind, "prod", "11", 5*time.Minute)
+	var ke *kubeError
+	if !errors.As(err, &ke) || ke.Code != 410 {
+		t.Errorf("watch = %v, want the 410 of the ERROR event", err)
+	}
+	if strings.Join(changed, ",") != "a,b" {
+		t.Errorf("changed %v, want a,b then the watch ends", changed)
+	}
+	if want := "/apis/x/v1/namespaces/prod/things?watch=1&allowWatchBookmarks=true&timeoutSeconds=300&resourceVersion=11"; (*requests)[0].path != want {
+		t.Errorf("watch path %s, want %s", (*requests)[0].path, want)
+	}
+}
+
+func TestKubeSecretSinkStored(t *testing.T) {
+	owner := &kubeOwner{UID: "uid-1"}
+	secrets := map[string]string{
+		"ours":     `{"metadata":{"name":"ours","ownerReferences":[{"uid":"uid-1"}]},"data":{"username":"YXBw","password":"cHc="}}`,
+		"labelled": `{"metadata":{"name":"labelled","labels":{"app.kubernetes.io/managed-by":"autopg"}},"data":{"username":"YXBw"}}`,
+		"foreign":  `{"metadata":{"name":"foreign"},"data":{"username":"cm9vdA=="}}`,
+	}
+	k, _ := fakeKubeAPI(t, func(r kubeRequest) (int, string) {
+		if s, ok := secrets[strings.TrimPrefix(r.path, "/api/v1/namespaces/prod/secrets/")]; ok {
+			return http.StatusOK, s
+		}
+		return http.StatusNotFound, kubeNotFound
+	})
+	tests := []struct {
+		name       string
+		owner      *kubeOwner
+		user, pass string
+		err        bool
+	}{
+		{"ours", owner, "app", "pw", false},
+		{"absent", owner, "", "", false},
+		{"foreign", owner, "", "", true},
+		{"labelled", owner, "", "", true}, // a resource only takes over the Secrets it owns
+		{"labelled", nil, "app", "", false},
+		{"foreign", nil, "", "", true},
+		{"", owner, "", "", false},
+	}
+	for _, tt := range tests {
+		s := &kubeSecretSink{k: k, ref: kubeSecretRef{Namespace: "prod", Name: tt.name, Owner: tt.owner}}
+		user, pass, err := s.stored(t.Context())
+		if user != tt.user || pass != tt.pass || (err != nil) != tt.err {
+			t.Errorf("stored(%s, owner %v) = %q, %q, %v", tt.name, tt.owner != nil, user, pass, err)
+		}
+	}
+}
+
+func TestWriteSecret(t *testing.T) {
+	k, requests := fakeKubeAPI(t, func(r kubeRequest) (int, string) { return http.StatusOK, `{}` })
+	c := exportedCredential{Target: "main", Host: "db", Port: "5432", DB: "shop", User: "app", Pass: "pw"}
+	owner, workload := &kubeOwner{UID: "uid-1"}, &kubeOwner{Kind: "Deployment", UID: "uid-2"}
+	ref := kubeSecretRef{Namespace: "prod", Name: "shop-postgres", Owner: owner}
+
+	if err := k.writeSecret(t.Context(), ref, nil, c); err != nil {
+		t.Fatal(err)
+	}
+	var created kubeSecret
+	json.Unmarshal([]byte((*requests)[0].body), &created)
+	if r := (*requests)[0]; r.method != http.MethodPost || r.path != "/api/v1/namespaces/prod/secrets" ||
+		string(created.Data["DATABASE_URL"]) != "postgres://app:pw@db:5432/shop" || string(created.Data["password"]) != "pw" ||
+		created.Metadata.Labels["app.kubernetes.io/managed-by"] != "autopg" || len(created.Metadata.OwnerReferences) != 1 {
+		t.Errorf("create %s %s %s", r.method, r.path, r.body)
+	}
+
+	// the same data is not written again
+	*requests = nil
+	if err := k.writeSecret(t.Context(), ref, &created, c); err != nil || len(*requests) != 0 {
+		t.Errorf("unchanged secret written: %v, %v", *requests, err)
+	}
+
+	// a new password patches the data; a new workload is added to the owners
+	c.Pass = "new"
+	ref.Workload = workload
+	if err := k.writeSecret(t.Context(), ref, &created, c); err != nil || len(*requests) != 1 {
+		t.Fatalf("patch: %v, %v", *requests, err)
+	}
+	r := (*requests)[0]
+	var patch struct {
+		Data     map[string][]byte
+		Metadata struct{ OwnerReferences []kubeOwner }
+	}
+	json.Unmarshal([]byte(r.body), &patch)
+	if r.method != http.MethodPatch || r.path != "/api/v1/namespaces/prod/secrets/shop-postgres" || r.contentType != "application/merge-patch+json" ||
+		string(patch.Data["password"]) != "new" || len(patch.Metadata.OwnerReferences) != 2 || patch.Metadata.OwnerReferences[1].UID != "uid-2" {
+		t.Errorf("patch %s %s %s", r.method, r.path, r.body)
+	}
+}
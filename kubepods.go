@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Pod annotations: with pods in AUTOPG_KUBE_WATCH (e.g. "databases,pods"), `autopg operator` provisions
+// pods from autopg.<target>.* annotations exactly like containers from the same labels, for teams not
+// ready to manage the PostgresDatabase CRD. The namespace stands in for the compose project and the pod's
+// app.kubernetes.io/name or app label (else its name) for the service.
+//   - autopg.<target>.secret names a Secret in the pod's namespace the credentials are written to, with
+//     the keys of a PostgresDatabase's; a pod referencing it waits in ContainerCreating until it exists.
+//     The Secret is owned by the pod's workload (its Deployment, StatefulSet, DaemonSet, CronJob...,
+//     found through the controller references), or the pod itself when it has none, so it is garbage
+//     collected with the last workload using it.
+// A pod provisioned for a target is annotated autopg.provisioned.<target>=true; with REAPPLY=always it is
+// provisioned again at every resync. Replicas share their annotations and provision the same database,
+// which is idempotent.
+
+func podsPath(namespace string) string {
+	if namespace == "*" {
+		return "/api/v1/pods"
+	}
+	return "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+}
+
+type kubePod struct {
+	Metadata struct {
+		kubeObject
+		DeletionTimestamp string `json:"deletionTimestamp,omitempty"`
+	} `json:"metadata"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+// resource returns p as a resource, with its autopg annotations as labels.
+func (p kubePod) resource() resource {
+	service := p.Metadata.Labels["app.kubernetes.io/name"]
+	if service == "" {
+		service = p.Metadata.Labels["app"]
+	}
+	if service == "" {
+		service = p.Metadata.Name
+	}
+	labels := map[string]string{}
+	for k, v := range p.Metadata.Annotations {
+		if !strings.HasPrefix(k, labelPrefix) {
+			continue
+		}
+		labels[k] = v
+	}
+	return resource{
+		kind: "pod", ref: p.Metadata.Namespace + "/" + p.Metadata.Name,
+		id: p.Metadata.UID, name: p.Metadata.Name,
+		project: p.Metadata.Namespace, service: service,
+		labels: labels,
+	}
+}
+
+func podListed(ctx context.Context, k *kubeClient, obj json.RawMessage) error {
+	return k.reconcilePod(ctx, obj, true)
+}
+
+func podChanged(ctx context.Context, k *kubeClient, obj json.RawMessage) error {
+	return k.reconcilePod(ctx, obj, false)
+}
+
+// reconcilePod provisions the pod obj on every target its annotations request and it is not annotated
+// provisioned for, or on all of them with REAPPLY=always when resync is set.
+func (k *kubeClient) reconcilePod(ctx context.Context, obj json.RawMessage, resync bool) error {
+	var p kubePod
+	if err := json.Unmarshal(obj, &p); err != nil {
+		return err
+	}
+	if p.Metadata.DeletionTimestamp != "" || p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+		return nil
+	}
+	r := p.resource()
+	labels, err := expandConfigLabels(r.labels)
+	if err != nil {
+		return fmt.Errorf("pod %s: %w", r.ref, err)
+	}
+	for target := range labelTargets(labels) {
+		if labels[provisionedLabelPrefix+target] == "true" && !(resync && reapplyAlways(target)) {
+			continue
+		}
+		r.targets = append(r.targets, target)
+	}
+	if len(r.targets) == 0 {
+		return nil
+	}
+	sort.Strings(r.targets)
+	ctx = withRequestID(ctx, newRequestID())
+	r.sink = func(target string) (credentialSink, error) {
+		ref := kubeSecretRef{Namespace: p.Metadata.Namespace, Name: labels[labelPrefix+target+".secret"]}
+		if ref.Name != "" {
+			ref.Workload = k.podWorkload(ctx, p)
+		}
+		return &kubeSecretSink{k: k, ref: ref}, nil
+	}
+	r.retry = func(ctx context.Context) {
+		var cur json.RawMessage
+		if err := k.do(ctx, http.MethodGet, podsPath(p.Metadata.Namespace)+"/"+url.PathEscape(p.Metadata.Name), "", nil, &cur); err != nil {
+			logf(ctx, "scheduled run for pod %s dropped: %v", r.ref, err)
+			return
+		}
+		if err := k.reconcilePod(ctx, cur, false); err != nil {
+			logf(ctx, "pod %s: %v", r.ref, err)
+		}
+	}
+	results, _ := reconcileResource(ctx, r)
+	for _, res := range results {
+		if res.err != nil {
+			continue
+		}
+		patch := map[string]any{"metadata": map[string]any{"annotations": map[string]string{provisionedLabelPrefix + res.target: "true"}}}
+		path := podsPath(p.Metadata.Namespace) + "/" + url.PathEscape(p.Metadata.Name)
+		if err := k.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil); err != nil {
+			logf(ctx, "warning: could not annotate pod %s provisioned: %v", r.ref, err)
+		}
+	}
+	return nil
+}
+
+// podWorkload returns the outermost controller of p, or p itself for a bare pod, as a (non-controller)
+// owner. A controller autopg can't read (RBAC) ends the walk.
+func (k *kubeClient) podWorkload(ctx context.Context, p kubePod) *kubeOwner {
+	owner := &kubeOwner{APIVersion: "v1", Kind: "Pod", Name: p.Metadata.Name, UID: p.Metadata.UID}
+	refs := p.Metadata.OwnerReferences
+	for depth := 0; depth < 4; depth++ {
+		var next *kubeOwner
+		for _, o := range refs {
+			if o.Controller {
+				next = &kubeOwner{APIVersion: o.APIVersion, Kind: o.Kind, Name: o.Name, UID: o.UID}
+			}
+		}
+		if next == nil {
+			break
+		}
+		owner = next
+		var obj struct {
+			Metadata kubeObject `json:"metadata"`
+		}
+		path := "/apis/" + owner.APIVersion + "/namespaces/" + url.PathEscape(p.Metadata.Namespace) + "/" +
+			strings.ToLower(owner.Kind) + "s/" + url.PathEscape(owner.Name)
+		if err := k.do(ctx, http.MethodGet, path, "", nil, &obj); err != nil {
+			if !isKubeNotFound(err) {
+				logf(ctx, "warning: could not read %s %s: %v", owner.Kind, owner.Name, err)
+			}
+			break
+		}
+		refs = obj.Metadata.OwnerReferences
+	}
+	return owner
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Signed labels: with AUTOPG_<TARGET>_LABEL_HMAC_KEY (or AUTOPG_LABEL_HMAC_KEY) set, a container is only
+// provisioned on the target when autopg.<target>.sig holds the HMAC-SHA256 (hex) of its other
+// autopg.<target>.* labels, as written on the container, and of the template variables names are derived
+// from, in the canonical form signedPayload builds. The variables bind the signature to the compose
+// project and service (and branch): copied onto another container, the labels of an enable=true service
+// would otherwise provision whatever names that container's unsigned compose labels derive. The key is
+// shared by the operator and the CI pipeline that renders compose files, so being able to create
+// containers is not enough to obtain a database.
+
+// labelSigVars are the template variables (see labelVars) every signature covers, set or not.
+var labelSigVars = []string{"ComposeProject", "ComposeService", "Branch"}
+
+// labelSigPayload is "<label>=<value>\n" for each autopg.<target>.* label but sig, sorted by label.
+func labelSigPayload(target string, labels map[string]string) string {
+	prefix := labelPrefix + target + "."
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if strings.HasPrefix(k, prefix) && k != prefix+"sig" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + labels[k] + "\n")
+	}
+	return b.String()
+}
+
+// signedPayload is labelSigPayload followed by "{{.<Var>}}=<value>\n" for each of labelSigVars, in that
+// order, and for ContainerName when a signed label uses it; vars are the resource's template variables.
+func signedPayload(target string, labels, vars map[string]string) string {
+	payload := labelSigPayload(target, labels)
+	names := labelSigVars
+	if strings.Contains(payload, ".ContainerName") {
+		names = append(slices.Clone(names), "ContainerName")
+	}
+	var b strings.Builder
+	b.WriteString(payload)
+	for _, name := range names {
+		b.WriteString("{{." + name + "}}=" + vars[name] + "\n")
+	}
+	return b.String()
+}
+
+func labelSignature(key, target string, labels, vars map[string]string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signedPayload(target, labels, vars)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLabelSignature checks the sig label of target against the raw container labels and the
+// resource's template variables vars when target requires signed labels.
+func verifyLabelSignature(target string, labels, vars map[string]string) error {
+	key := targetSetting(target, "LABEL_HMAC_KEY")
+	if key == "" {
+		return nil
+	}
+	sig := strings.ToLower(strings.TrimSpace(labels[labelPrefix+target+".sig"]))
+	if sig == "" {
+		return fmt.Errorf("target %s requires signed labels and %ssig is missing", target, labelPrefix+target+".")
+	}
+	if !hmac.Equal([]byte(sig), []byte(labelSignature(key, target, labels, vars))) {
+		return fmt.Errorf("label signature for target %s does not match", target)
+	}
+	return nil
+}
+
+// runSign implements `autopg sign <target> <label>=<value>...`: prints the sig label value for the
+// given labels with the target's key. ComposeProject=, ComposeService=, Branch= and ContainerName= give
+// the template variables.
+func runSign(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: autopg sign <target> [ComposeProject=<project>] [ComposeService=<service>] [Branch=<branch>] <label>=<value>...")
+	}
+	target := args[0]
+	key := targetSetting(target, "LABEL_HMAC_KEY")
+	if key == "" {
+		return fmt.Errorf("%s (or AUTOPG_LABEL_HMAC_KEY) is not set", toEnvKey(target, "LABEL_HMAC_KEY"))
+	}
+	labels, vars := map[string]string{}, map[string]string{}
+	for _, kv := range args[1:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("invalid label %q; expected <label>=<value>", kv)
+		}
+		if slices.Contains(labelSigVars, k) || k == "ContainerName" {
+			vars[k] = v
+		} else {
+			labels[k] = v
+		}
+	}
+	fmt.Println(labelSignature(key, target, labels, vars))
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelSigPayload(t *testing.T) {
+	labels := map[string]string{
+		"autopg.main.user":   "shop",
+		"autopg.main.db":     "shop",
+		"autopg.main.sig":    "ignored",
+		"autopg.replica.db":  "other target",
+		"autopg.mainly.db":   "other target",
+		"com.example.owner":  "team",
+		"autopg.main.params": "a=b\nc",
+	}
+	want := "autopg.main.db=shop\nautopg.main.params=a=b\nc\nautopg.main.user=shop\n"
+	if got := labelSigPayload("main", labels); got != want {
+		t.Errorf("labelSigPayload = %q, want %q", got, want)
+	}
+}
+
+func TestSignedPayload(t *testing.T) {
+	labels := map[string]string{"autopg.main.db": "{{.ComposeProject}}", "autopg.main.enable": "true"}
+	vars := map[string]string{"ComposeProject": "shop", "ComposeService": "api", "ContainerName": "shop-api-1"}
+	want := "autopg.main.db={{.ComposeProject}}\nautopg.main.enable=true\n{{.ComposeProject}}=shop\n{{.ComposeService}}=api\n{{.Branch}}=\n"
+	if got := signedPayload("main", labels, vars); got != want {
+		t.Errorf("signedPayload = %q, want %q", got, want)
+	}
+	// the container name only binds signatures of labels using it, so replicas share the others
+	labels["autopg.main.user"] = "{{.ContainerName}}"
+	want = "autopg.main.db={{.ComposeProject}}\nautopg.main.enable=true\nautopg.main.user={{.ContainerName}}\n" +
+		"{{.ComposeProject}}=shop\n{{.ComposeService}}=api\n{{.Branch}}=\n{{.ContainerName}}=shop-api-1\n"
+	if got := signedPayload("main", labels, vars); got != want {
+		t.Errorf("signedPayload = %q, want %q", got, want)
+	}
+}
+
+func TestLabelSignature(t *testing.T) {
+	// printf 'autopg.main.db=shop\nautopg.main.user=shop\n{{.ComposeProject}}=shop\n{{.ComposeService}}=api\n{{.Branch}}=\n' \
+	//   | openssl dgst -sha256 -hmac ci-key
+	const want = "6980d8aa7730b8f3bcb1e91007a749bf30b96cba7baf0dc58b4725a9adf61113"
+	labels := map[string]string{"autopg.main.db": "shop", "autopg.main.user": "shop"}
+	vars := map[string]string{"ComposeProject": "shop", "ComposeService": "api"}
+	if got := labelSignature("ci-key", "main", labels, vars); got != want {
+		t.Errorf("labelSignature = %s, want %s", got, want)
+	}
+}
+
+func TestVerifyLabelSignature(t *testing.T) {
+	const sig = "6980d8aa7730b8f3bcb1e91007a749bf30b96cba7baf0dc58b4725a9adf61113"
+	signed := func(extra map[string]string) map[string]string {
+		labels := map[string]string{"autopg.main.db": "shop", "autopg.main.user": "shop", "com.docker.compose.service": "api"}
+		for k, v := range extra {
+			labels[k] = v
+		}
+		return labels
+	}
+	shopAPI := map[string]string{"ComposeProject": "shop", "ComposeService": "api", "ContainerName": "shop-api-1"}
+	tests := []struct {
+		name   string
+		key    string
+		labels map[string]string
+		vars   map[string]string
+		err    string
+	}{
+		{"no key", "", signed(nil), shopAPI, ""},
+		{"signed", "ci-key", signed(map[string]string{"autopg.main.sig": sig}), shopAPI, ""},
+		{"another replica", "ci-key", signed(map[string]string{"autopg.main.sig": sig}), map[string]string{"ComposeProject": "shop", "ComposeService": "api", "ContainerName": "shop-api-2"}, ""},
+		{"case and spaces", "ci-key", signed(map[string]string{"autopg.main.sig": " " + strings.ToUpper(sig) + "\n"}), shopAPI, ""},
+		{"other labels", "ci-key", signed(map[string]string{"autopg.main.sig": sig, "autopg.replica.db": "x", "traefik.enable": "true"}), shopAPI, ""},
+		{"missing", "ci-key", signed(nil), shopAPI, "target main requires signed labels and autopg.main.sig is missing"},
+		{"added label", "ci-key", signed(map[string]string{"autopg.main.sig": sig, "autopg.main.superuser": "true"}), shopAPI, "label signature for target main does not match"},
+		{"other key", "another-key", signed(map[string]string{"autopg.main.sig": sig}), shopAPI, "label signature for target main does not match"},
+		{"copied to another service", "ci-key", signed(map[string]string{"autopg.main.sig": sig}), map[string]string{"ComposeProject": "shop", "ComposeService": "billing"}, "label signature for target main does not match"},
+		{"copied to a branch", "ci-key", signed(map[string]string{"autopg.main.sig": sig}), map[string]string{"ComposeProject": "shop", "ComposeService": "api", "Branch": "main"}, "label signature for target main does not match"},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_LABEL_HMAC_KEY", tt.key)
+		err := verifyLabelSignature("main", tt.labels, tt.vars)
+		if (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// Container listing: the Docker API filters labels by exact key, not by prefix, so autopg can't ask for
+// the containers with autopg.* labels in one request. Instead each Docker host's containers are listed
+// once, with a single request, and the list is kept until a container event (any action) says it
+// changed; scans in between (resync, control API retrigger, dependents) reuse it without asking Docker.
+// Once a host was scanned in full, later scans only return the containers with an autopg.* label.
+// AUTOPG_LIST_ALL=true, or AUTOPG_ENV_SPEC=true (specs in the environment aren't in labels), returns
+// every container at every scan.
+
+var listings = struct {
+	sync.Mutex
+	scanned map[string]bool              // Docker hosts scanned in full
+	watched map[string]bool              // Docker hosts whose events are followed by watchListing
+	cache   map[string][]types.Container // Docker host -> containers as last listed, while watched
+	changes map[string]int               // Docker host -> invalidations, so a list racing an event isn't kept
+}{scanned: map[string]bool{}, watched: map[string]bool{}, cache: map[string][]types.Container{}, changes: map[string]int{}}
+
+// invalidateListing drops the cached list of host's containers.
+func invalidateListing(host string) {
+	listings.Lock()
+	delete(listings.cache, host)
+	listings.changes[host]++
+	listings.Unlock()
+}
+
+// watchListing follows the container events of the Docker host of ctx until ctx is done, dropping its
+// cached list on each. While the stream is down nothing is cached, since events may be missed.
+func watchListing(cli *client.Client, ctx context.Context) {
+	host := dockerHostName(ctx)
+	f := filters.NewArgs()
+	if dockerSupports(cli, "event type filter") {
+		f.Add("type", "container")
+	}
+	setWatched := func(watched bool) {
+		listings.Lock()
+		listings.watched[host] = watched
+		delete(listings.cache, host)
+		listings.changes[host]++
+		listings.Unlock()
+	}
+	defer setWatched(false)
+	for {
+		msgs, errs := cli.Events(ctx, events.ListOptions{Filters: f})
+		setWatched(true)
+	stream:
+		for {
+			select {
+			case e := <-msgs:
+				if e.Type == "" || e.Type == events.ContainerEventType {
+					invalidateListing(host)
+				}
+			case <-errs:
+				break stream
+			case <-ctx.Done():
+				return
+			}
+		}
+		setWatched(false)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listClients returns the containers of the Docker host of ctx that may need provisioning, stopped
+// ones included.
+func listClients(ctx context.Context, cli *client.Client) ([]types.Container, error) {
+	host := dockerHostName(ctx)
+	listings.Lock()
+	full := !listings.scanned[host] || os.Getenv("AUTOPG_LIST_ALL") == "true" || envSpecEnabled()
+	containers, cached := listings.cache[host]
+	changes := listings.changes[host]
+	listings.Unlock()
+	if !cached {
+		var err error
+		if containers, err = cli.ContainerList(ctx, container.ListOptions{All: true}); err != nil {
+			return nil, err
+		}
+		listings.Lock()
+		listings.scanned[host] = true
+		if listings.watched[host] && listings.changes[host] == changes {
+			listings.cache[host] = containers
+		}
+		listings.Unlock()
+		pruneProvisioned(host, containers)
+	}
+	if full {
+		return containers, nil
+	}
+	var clients []types.Container
+	for _, c := range containers {
+		if hasAutopgLabel(c.Labels) {
+			clients = append(clients, c)
+		}
+	}
+	return clients, nil
+}
+
+// hasAutopgLabel reports whether labels has an autopg.* label.
+func hasAutopgLabel(labels map[string]string) bool {
+	for k := range labels {
+		if strings.HasPrefix(k, labelPrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,18 +3,24 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const provisionedLabelPrefix = "autopg.provisioned."
@@ -30,126 +36,1257 @@ func toEnvKey(target, field string) string {
 }
 
 func getAdminCredsForTarget(target string) (host string, port string, admin string, adminPass string, ok bool) {
+	service, err := serviceParams(target)
+	if err != nil {
+		log.Printf("connection service of target %s: %v", target, err)
+		return
+	}
 	host = os.Getenv(toEnvKey(target, "HOST"))
+	if host == "" {
+		host = cloudSQLInstance(target)
+	}
+	if host == "" {
+		host = service["host"]
+	}
 	if host == "" {
 		return
 	}
 	port = os.Getenv(toEnvKey(target, "PORT"))
+	if port == "" {
+		port = service["port"]
+	}
 	if port == "" {
 		port = "5432"
 	}
 	admin = os.Getenv(toEnvKey(target, "ADMIN"))
+	if admin == "" {
+		admin = service["user"]
+	}
 	adminPass = os.Getenv(toEnvKey(target, "ADMIN_PASS"))
-	if admin == "" || adminPass == "" {
+	if adminPass == "" {
+		adminPass = service["password"]
+	}
+	if source := os.Getenv(toEnvKey(target, "ADMIN_SOURCE")); source != "" && source != "env" {
+		if admin, adminPass, err = adminFromSource(target, source); err != nil {
+			log.Printf("admin credentials of target %s from %s: %v", target, source, err)
+			return
+		}
+	}
+	if adminAuth(target) == "rds-iam" && admin != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if adminPass, err = rdsAdminToken(ctx, target, host, port, admin); err != nil {
+			log.Printf("RDS IAM token for target %s: %v", target, err)
+			return
+		}
+	}
+	if adminAuth(target) == "gcp-iam" && admin != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if adminPass, err = gcpAccessToken(ctx); err != nil {
+			log.Printf("GCP access token for target %s: %v", target, err)
+			return
+		}
+	}
+	if adminAuth(target) == "azure-ad" && admin != "" {
+		if sslMode(target) == "disable" {
+			log.Printf("Azure AD authentication for target %s needs TLS; set %s", target, toEnvKey(target, "SSLMODE"))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if adminPass, err = azureAccessToken(ctx, azurePostgresResource); err != nil {
+			log.Printf("Azure AD token for target %s: %v", target, err)
+			return
+		}
+	}
+	if adminPass == "" && admin != "" && adminAuth(target) == "password" {
+		if adminPass, err = pgpassLookup(host, port, admin); err != nil {
+			log.Printf("password file for target %s: %v", target, err)
+			return
+		}
+	}
+	if admin == "" || (adminPass == "" && adminAuth(target) != "cert" && adminAuth(target) != "gss" && !isUnixSocket(host)) {
 		return
 	}
 	ok = true
 	return
 }
 
-func ensureUserDB(dbHost, dbPort, admin, adminPass, username, password, dbname string) error {
-	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s sslmode=disable", dbHost, dbPort, admin, adminPass)
-	// Retry until reachable (with timeout)
-	var db *sql.DB
+// provisionSpec is what a container asks for on one target, read from its labels.
+type provisionSpec struct {
+	DB              string
+	User            string
+	Pass            string
+	Enabled         bool // enable=true: missing db/user/pass are derived
+	DerivedNames    bool // db and user both come from the naming strategy
+	ManagedPass     bool // Pass is generated and stored by autopg
+	PassOptions     passwordOptions
+	NewPass         bool   // Pass was generated on this run and still has to be set and stored
+	PassOwner       string // owner of the stored Pass; empty when new or stored by an older version
+	RoleSettings    []roleSetting
+	SearchPath      []string
+	PGVersion       int // pinned server major version, 0 when not pinned
+	MinVersion      int // minimum server_version_num, 0 when not set
+	CronJobs        []cronJob
+	PostSQL         string        // run as the provisioned user once everything is in place
+	GrantSchemas    []string      // when set, grants are limited to these schemas instead of the whole database
+	Template        string        // database cloned when creating the new one
+	Analyze         bool          // ANALYZE the database after it was seeded from Template
+	Expires         time.Duration // role validity, renewed on every run; 0 means no expiry
+	Extensions      []extension
+	Links           []dbLink
+	LinkAllow       []string // glob patterns of the databases that may link to this one
+	Replication     bool     // REPLICATION attribute, only honored for allowlisted containers
+	Presets         []string
+	LocaleProvider  string // "icu" or "libc" for CREATE DATABASE, empty for the server default
+	ICULocale       string
+	AutoGrants      []autoGrant
+	VaultCreds      bool   // credentials=vault: User is a NOLOGIN parent role, apps get dynamic logins from Vault
+	Deliver         string // path in the container the connection info is written to with docker exec
+	DeliverFormat   string // "json" or "dotenv"
+	DeliverTemplate string
+	PostExec        string // command run in the container (sh -c) once the database is ready
+	PostExecUser    string
+	PostSignal      string // signal sent to the container, or "restart", once it was first provisioned
+}
+
+// dbLink is a postgres_fdw server in the new database pointing at another autopg-managed database.
+type dbLink struct {
+	DB     string
+	Server string
+}
+
+// extension is a CREATE EXTENSION request, optionally into a dedicated schema.
+type extension struct {
+	Name   string
+	Schema string // "" keeps the extension's default schema
+}
+
+// cronJob is a pg_cron job registered in the provisioned database.
+type cronJob struct {
+	Name     string
+	Schedule string
+	Command  string
+}
+
+// roleSetting is one name=value pair applied with ALTER ROLE ... SET.
+type roleSetting struct {
+	Name  string
+	Value string
+}
+
+var settingNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+
+// labelVars returns the placeholders available in db/user label values, e.g. {{.ComposeProject}}.
+// Only non-empty values are set so that referencing a missing one is an error.
+func labelVars(r resource) map[string]string {
+	vars := map[string]string{}
+	set := func(k, v string) {
+		if v != "" {
+			vars[k] = v
+		}
+	}
+	set("ContainerName", r.name)
+	set("ComposeProject", r.project)
+	set("ComposeService", r.service)
+	set("Branch", r.labels["autopg.branch"])
+	return vars
+}
+
+// expandLabel expands {{.Var}} placeholders in a label value.
+func expandLabel(v string, vars map[string]string) (string, error) {
+	if !strings.Contains(v, "{{") {
+		return v, nil
+	}
+	tmpl, err := template.New("label").Option("missingkey=error").Parse(v)
+	if err != nil {
+		return "", fmt.Errorf("invalid template %q: %w", v, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("expand %q: %w", v, err)
+	}
+	return b.String(), nil
+}
+
+func specFromLabels(labels map[string]string, target string, vars map[string]string) (provisionSpec, error) {
+	spec := provisionSpec{
+		DB:   labels[labelPrefix+target+".db"],
+		User: labels[labelPrefix+target+".user"],
+		Pass: labels[labelPrefix+target+".pass"],
+	}
+	if v := labels[labelPrefix+target+".enable"]; v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return spec, fmt.Errorf("invalid enable %q", v)
+		}
+		spec.Enabled = enabled
+	}
+	if spec.Enabled && (spec.DB == "" || spec.User == "") {
+		// zero-config: names come from the target's naming strategy, the password is generated
+		name, err := deriveName(target, vars)
+		if err != nil {
+			return spec, err
+		}
+		spec.DerivedNames = spec.DB == "" && spec.User == ""
+		if spec.DB == "" {
+			spec.DB = name
+		}
+		if spec.User == "" {
+			spec.User = name
+		}
+	}
+	switch v := labels[labelPrefix+target+".credentials"]; v {
+	case "", "static":
+	case "vault":
+		if spec.Pass != "" {
+			return spec, errors.New("credentials=vault issues passwords dynamically; remove the pass label")
+		}
+		spec.VaultCreds = true
+	default:
+		return spec, fmt.Errorf("invalid credentials %q; expected static or vault", v)
+	}
+	if spec.DB == "" || spec.User == "" || (spec.Pass == "" && !spec.Enabled && !spec.VaultCreds) {
+		return spec, errors.New("incomplete labels; need db,user,pass (or enable=true)")
+	}
+	var err error
+	if strings.HasPrefix(spec.Pass, "age:") {
+		if spec.Pass, err = decryptAgeValue(spec.Pass); err != nil {
+			return spec, fmt.Errorf("decrypt pass: %w", err)
+		}
+		if spec.Pass == "" {
+			return spec, errors.New("decrypted pass is empty")
+		}
+	}
+	if spec.DB, err = expandLabel(spec.DB, vars); err != nil {
+		return spec, err
+	}
+	if spec.User, err = expandLabel(spec.User, vars); err != nil {
+		return spec, err
+	}
+	if spec.DB, err = normalizeIdent(target, "db", spec.DB); err != nil {
+		return spec, err
+	}
+	if spec.User, err = normalizeIdent(target, "user", spec.User); err != nil {
+		return spec, err
+	}
+	if spec.PassOptions, err = passwordOptionsFor(target, labels); err != nil {
+		return spec, err
+	}
+	if spec.Pass == "" && !spec.VaultCreds {
+		spec.ManagedPass = true
+		if err := resolvePass(target, &spec); err != nil {
+			return spec, err
+		}
+	}
+	settings, err := parseRoleSettings(labels[labelPrefix+target+".role_settings"])
+	if err != nil {
+		return spec, err
+	}
+	for _, rs := range settings {
+		if !roleSettingAllowed(target, rs.Name) {
+			return spec, fmt.Errorf("role setting %s is not allowed on target %s (see %s)", rs.Name, target, toEnvKey(target, "ROLE_SETTINGS_ALLOW"))
+		}
+	}
+	spec.RoleSettings = settings
+	spec.SearchPath = splitList(labels[labelPrefix+target+".search_path"])
+	if v := labels[labelPrefix+target+".pg_version"]; v != "" {
+		major, err := strconv.Atoi(v)
+		if err != nil || major < 10 {
+			return spec, fmt.Errorf("invalid pg_version %q; expected a major version such as 16", v)
+		}
+		spec.PGVersion = major
+	}
+	if v := labels[labelPrefix+target+".min_pg_version"]; v != "" {
+		num, err := parseVersionNum(v)
+		if err != nil {
+			return spec, fmt.Errorf("invalid min_pg_version %q; expected e.g. 15 or 15.4", v)
+		}
+		spec.MinVersion = num
+	}
+	spec.PostSQL = labels[labelPrefix+target+".post_sql"]
+	if v := labels[labelPrefix+target+".replication"]; v != "" {
+		replication, err := strconv.ParseBool(v)
+		if err != nil {
+			return spec, fmt.Errorf("invalid replication %q", v)
+		}
+		spec.Replication = replication
+	}
+	spec.GrantSchemas = splitList(labels[labelPrefix+target+".grant_schemas"])
+	spec.Template = labels[labelPrefix+target+".template"]
+	for _, item := range splitList(labels[labelPrefix+target+".link"]) {
+		other, server, ok := strings.Cut(item, ":")
+		if !ok || other == "" || server == "" {
+			return spec, fmt.Errorf("invalid link %q; expected other_db:fdw_name", item)
+		}
+		// the linked database carries the target's mandatory prefix/suffix like any other
+		if other, err = normalizeIdent(target, "link", other); err != nil {
+			return spec, err
+		}
+		spec.Links = append(spec.Links, dbLink{DB: other, Server: server})
+	}
+	spec.LinkAllow = splitList(labels[labelPrefix+target+".link_allow"])
+	for _, item := range splitList(labels[labelPrefix+target+".extensions"]) {
+		name, schema, _ := strings.Cut(item, "@")
+		if name == "" || strings.HasSuffix(item, "@") {
+			return spec, fmt.Errorf("invalid extension %q; expected name or name@schema", item)
+		}
+		spec.Extensions = append(spec.Extensions, extension{Name: name, Schema: schema})
+	}
+	for _, name := range splitList(labels[labelPrefix+target+".preset"]) {
+		p, ok := presets[name]
+		if !ok {
+			return spec, fmt.Errorf("unknown preset %q; available: %s", name, presetNames())
+		}
+		spec.Presets = append(spec.Presets, name)
+		for _, ext := range p.Extensions {
+			listed := false
+			for _, e := range spec.Extensions {
+				listed = listed || e.Name == ext
+			}
+			if !listed {
+				spec.Extensions = append(spec.Extensions, extension{Name: ext})
+			}
+		}
+	}
+	if spec.AutoGrants, err = parseAutoGrants(labels[labelPrefix+target+".auto_grant"]); err != nil {
+		return spec, err
+	}
+	spec.LocaleProvider = labels[labelPrefix+target+".locale_provider"]
+	spec.ICULocale = labels[labelPrefix+target+".icu_locale"]
+	if spec.ICULocale != "" && spec.LocaleProvider == "" {
+		spec.LocaleProvider = "icu"
+	}
+	switch {
+	case spec.LocaleProvider != "" && spec.LocaleProvider != "icu" && spec.LocaleProvider != "libc":
+		return spec, fmt.Errorf("invalid locale_provider %q; expected icu or libc", spec.LocaleProvider)
+	case spec.LocaleProvider == "icu" && spec.ICULocale == "":
+		return spec, errors.New("locale_provider=icu needs icu_locale, e.g. en-US")
+	case spec.LocaleProvider == "libc" && spec.ICULocale != "":
+		return spec, errors.New("icu_locale needs locale_provider=icu")
+	}
+	if v := labels[labelPrefix+target+".expires"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return spec, fmt.Errorf("invalid expires %q; expected a duration such as 720h", v)
+		}
+		spec.Expires = d
+	}
+	if v := labels[labelPrefix+target+".analyze"]; v != "" {
+		analyze, err := strconv.ParseBool(v)
+		if err != nil {
+			return spec, fmt.Errorf("invalid analyze %q", v)
+		}
+		spec.Analyze = analyze
+	}
+	cronPrefix := labelPrefix + target + ".cron."
+	for k, v := range labels {
+		if !strings.HasPrefix(k, cronPrefix) {
+			continue
+		}
+		schedule, command, ok := strings.Cut(v, "|")
+		if !ok || strings.TrimSpace(schedule) == "" || strings.TrimSpace(command) == "" {
+			return spec, fmt.Errorf("invalid cron label %s; expected <schedule>|<command>", k)
+		}
+		spec.CronJobs = append(spec.CronJobs, cronJob{
+			Name:     strings.TrimPrefix(k, cronPrefix),
+			Schedule: strings.TrimSpace(schedule),
+			Command:  strings.TrimSpace(command),
+		})
+	}
+	spec.Deliver = labels[labelPrefix+target+".deliver"]
+	spec.DeliverFormat = labels[labelPrefix+target+".deliver_format"]
+	spec.DeliverTemplate = labels[labelPrefix+target+".deliver_template"]
+	spec.PostExec = labels[labelPrefix+target+".post_exec"]
+	spec.PostExecUser = labels[labelPrefix+target+".post_exec_user"]
+	spec.PostSignal = labels[labelPrefix+target+".post_signal"]
+	switch {
+	case spec.Deliver != "" && !strings.HasPrefix(spec.Deliver, "/"):
+		return spec, fmt.Errorf("invalid deliver %q; expected an absolute path in the container", spec.Deliver)
+	case spec.Deliver == "" && (spec.DeliverFormat != "" || spec.DeliverTemplate != ""):
+		return spec, errors.New("deliver_format and deliver_template need deliver")
+	case spec.DeliverFormat != "" && spec.DeliverFormat != "json" && spec.DeliverFormat != "dotenv":
+		return spec, fmt.Errorf("invalid deliver_format %q; expected json or dotenv", spec.DeliverFormat)
+	case spec.DeliverFormat != "" && spec.DeliverTemplate != "":
+		return spec, errors.New("set deliver_format or deliver_template, not both")
+	}
+	if spec.PostExecUser != "" && spec.PostExec == "" {
+		return spec, errors.New("post_exec_user needs post_exec")
+	}
+	if spec.PostSignal != "" && spec.PostSignal != "restart" && !signalRe.MatchString(spec.PostSignal) {
+		return spec, fmt.Errorf("invalid post_signal %q; expected a signal name such as SIGHUP, or restart", spec.PostSignal)
+	}
+	if spec.VaultCreds && (spec.PostSQL != "" || len(spec.Links) > 0 || spec.Deliver != "" || spec.PostExec != "") {
+		return spec, errors.New("post_sql, link, deliver and post_exec need the role's password and can't be used with credentials=vault")
+	}
+	if isSCRAMVerifier(spec.Pass) && (spec.PostSQL != "" || len(spec.Links) > 0 || spec.Deliver != "" || spec.PostExec != "") {
+		return spec, errors.New("post_sql, link, deliver and post_exec need the role's password and can't be used with a SCRAM verifier as pass")
+	}
+	return spec, nil
+}
+
+// resolvePass sets a managed password: the stored one for the user, or a newly generated one. Whether the
+// stored one may be used is up to the caller, which knows who asks (see provision).
+func resolvePass(target string, spec *provisionSpec) error {
+	c, ok, err := lookupCredential(target, spec.User)
+	if err != nil {
+		return fmt.Errorf("read stored credentials: %w", err)
+	}
+	spec.NewPass, spec.PassOwner = !ok, c.Owner
+	if !ok {
+		if c.Pass, err = generatePassword(spec.PassOptions); err != nil {
+			return err
+		}
+	}
+	spec.Pass = c.Pass
+	return nil
+}
+
+// features lists the optional features the spec uses, for history and usage stats.
+func (s provisionSpec) features() []string {
+	var f []string
+	if s.Enabled {
+		f = append(f, "enable")
+	}
+	if len(s.RoleSettings) > 0 {
+		f = append(f, "role_settings")
+	}
+	if len(s.SearchPath) > 0 {
+		f = append(f, "search_path")
+	}
+	if s.PGVersion != 0 {
+		f = append(f, "pg_version")
+	}
+	if s.MinVersion != 0 {
+		f = append(f, "min_pg_version")
+	}
+	if len(s.CronJobs) > 0 {
+		f = append(f, "cron")
+	}
+	if s.PostSQL != "" {
+		f = append(f, "post_sql")
+	}
+	if len(s.GrantSchemas) > 0 {
+		f = append(f, "grant_schemas")
+	}
+	if s.Template != "" {
+		f = append(f, "template")
+	}
+	if s.Analyze {
+		f = append(f, "analyze")
+	}
+	if s.Expires != 0 {
+		f = append(f, "expires")
+	}
+	if len(s.Extensions) > 0 {
+		f = append(f, "extensions")
+	}
+	if len(s.Links) > 0 {
+		f = append(f, "link")
+	}
+	if s.Replication {
+		f = append(f, "replication")
+	}
+	if len(s.Presets) > 0 {
+		f = append(f, "preset")
+	}
+	if s.LocaleProvider != "" {
+		f = append(f, "locale_provider")
+	}
+	if len(s.AutoGrants) > 0 {
+		f = append(f, "auto_grant")
+	}
+	if s.VaultCreds {
+		f = append(f, "credentials")
+	}
+	if s.Deliver != "" {
+		f = append(f, "deliver")
+	}
+	if s.PostExec != "" {
+		f = append(f, "post_exec")
+	}
+	if s.PostSignal != "" {
+		f = append(f, "post_signal")
+	}
+	return f
+}
+
+// splitList splits a comma-separated label value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// destructive reports whether provisioning the spec on target overwrites existing state whatever the
+// target holds: re-asserting a role's password or a database's owner (REAPPLY=always), replacing cron
+// jobs, or running application SQL. Such specs are deferred while the target is in a freeze window. A
+// newly generated password is only destructive when its role already exists, which provision checks.
+func (s provisionSpec) destructive(target string) bool {
+	return reapplyAlways(target) || len(s.CronJobs) > 0 || s.PostSQL != ""
+}
+
+// parseRoleSettings parses "work_mem=32MB,statement_timeout=15s".
+func parseRoleSettings(s string) ([]roleSetting, error) {
+	var settings []roleSetting
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || !settingNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid role setting %q", item)
+		}
+		settings = append(settings, roleSetting{Name: name, Value: strings.TrimSpace(value)})
+	}
+	return settings, nil
+}
+
+// openDB connects to the target once. An empty dbname uses the user's default database.
+// The request ID of ctx is reported as application_name so sessions can be traced in pg_stat_activity.
+// targetKey carries the target a connection is for, which selects its TLS settings.
+type targetKey struct{}
+
+func withTarget(ctx context.Context, target string) context.Context {
+	return context.WithValue(ctx, targetKey{}, target)
+}
+
+// openDB connects as an application role.
+func openDB(ctx context.Context, dbHost, dbPort, user, pass, dbname string) (*sql.DB, error) {
+	return connect(ctx, dbHost, dbPort, user, pass, dbname, false)
+}
+
+func connect(ctx context.Context, dbHost, dbPort, user, pass, dbname string, admin bool) (*sql.DB, error) {
+	target, _ := ctx.Value(targetKey{}).(string)
+	instance := cloudSQLInstance(target)
+	tls := "sslmode=disable" // the Cloud SQL dialer does TLS itself; sockets are local
+	if instance == "" && !isUnixSocket(dbHost) {
+		var err error
+		if tls, err = tlsParams(target, admin); err != nil {
+			return nil, err
+		}
+	}
+	dsn := fmt.Sprintf("host=%s port=%s user=%s %s", dbHost, dbPort, dsnQuote(user), tls)
+	if pass != "" {
+		registerSecret("password of "+user+"@"+dbHost+":"+dbPort, pass)
+		dsn += " password=" + dsnQuote(pass)
+	}
+	if dbname != "" {
+		dsn += " dbname=" + dsnQuote(dbname)
+	}
+	if admin && adminAuth(target) == "gss" {
+		spn, err := krbSPN(target, dbHost)
+		if err != nil {
+			return nil, err
+		}
+		dsn += " krbspn=" + dsnQuote(spn)
+	}
+	appName := "autopg"
+	if id := requestID(ctx); id != "" {
+		appName += "/" + id
+	}
+	dsn += " application_name=" + dsnQuote(appName)
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if instance != "" {
+		connector.Dialer(cloudSQLDialer{target: target, instance: instance})
+	} else if sshHost(target) != "" {
+		if isUnixSocket(dbHost) {
+			return nil, fmt.Errorf("target %s: Unix sockets cannot be reached through an SSH bastion", target)
+		}
+		connector.Dialer(sshDialer{target: target})
+	} else if proxy, err := targetProxy(target); err != nil {
+		return nil, err
+	} else if proxy != nil {
+		if isUnixSocket(dbHost) {
+			return nil, fmt.Errorf("target %s: Unix sockets cannot be reached through a proxy", target)
+		}
+		connector.Dialer(proxyDialer{proxy: proxy})
+	}
+	var dc driver.Connector = connector
+	if rec := auditFrom(ctx); rec != nil {
+		dc = auditConnector{Connector: connector, rec: rec}
+	}
+	db := sql.OpenDB(dc)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// isUnixSocket reports whether host is the directory of a PostgreSQL Unix socket, as libpq reads it.
+func isUnixSocket(host string) bool {
+	return strings.HasPrefix(host, "/")
+}
+
+// openAdmin connects to the target as admin, retrying until reachable (with timeout). When the login is
+// rejected, the admin credentials are read again in case they were rotated.
+func openAdmin(ctx context.Context, dbHost, dbPort, admin, adminPass, dbname string) (*sql.DB, error) {
+	target, _ := ctx.Value(targetKey{}).(string)
+	if err := authSuspended(target); err != nil {
+		return nil, err
+	}
 	var err error
 	for i := 0; i < 30; i++ {
-		db, err = sql.Open("postgres", dsn)
-		if err == nil {
-			err = db.Ping()
+		var db *sql.DB
+		if db, err = connect(ctx, dbHost, dbPort, admin, adminPass, dbname, true); err == nil {
+			recordAuthSuccess(ctx, target)
+			return db, nil
 		}
-		if err == nil {
-			break
+		if isAuthError(err) {
+			if target == "" {
+				break
+			}
+			newAdmin, newPass, ok := refreshAdminCreds(ctx, target)
+			if !ok || (newAdmin == admin && newPass == adminPass) {
+				recordAuthFailure(ctx, target, err)
+				break // waiting won't fix wrong credentials
+			}
+			logf(ctx, "admin credentials of target %s changed; retrying", target)
+			admin, adminPass = newAdmin, newPass
+			continue
 		}
 		time.Sleep(1 * time.Second)
 	}
+	return nil, fmt.Errorf("could not connect to postgres %s:%s: %w", dbHost, dbPort, err)
+}
+
+// serverVersionNum returns the server_version_num of the connected server (e.g. 160002).
+func serverVersionNum(db *sql.DB) (int, error) {
+	var num int
+	if err := db.QueryRow("SHOW server_version_num;").Scan(&num); err != nil {
+		return 0, fmt.Errorf("read server version: %w", err)
+	}
+	return num, nil
+}
+
+// parseVersionNum turns "15" or "15.4" into its server_version_num form (150000, 150004).
+func parseVersionNum(v string) (int, error) {
+	majorStr, minorStr, hasMinor := strings.Cut(v, ".")
+	major, err := strconv.Atoi(majorStr)
+	if err != nil || major < 10 {
+		return 0, fmt.Errorf("invalid version %q", v)
+	}
+	minor := 0
+	if hasMinor {
+		if minor, err = strconv.Atoi(minorStr); err != nil || minor < 0 {
+			return 0, fmt.Errorf("invalid version %q", v)
+		}
+	}
+	return major*10000 + minor, nil
+}
+
+// formatVersionNum is the inverse of parseVersionNum.
+func formatVersionNum(num int) string {
+	return fmt.Sprintf("%d.%d", num/10000, num%10000)
+}
+
+// ensureUserDB provisions spec on the target. meta describes the requesting container and is passed to
+// the target's on_provision hook.
+func ensureUserDB(ctx context.Context, target, dbHost, dbPort, admin, adminPass string, spec provisionSpec, meta map[string]any) error {
+	ctx = withTarget(ctx, target)
+	username, password, dbname := spec.User, spec.Pass, spec.DB
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, "")
 	if err != nil {
-		return fmt.Errorf("could not connect to postgres %s:%s: %w", dbHost, dbPort, err)
+		return err
 	}
 	defer db.Close()
 
-	// Create role if not exists
-	createRole := fmt.Sprintf("DO $ BEGIN IF NOT EXISTS (SELECT FROM pg_catalog.pg_roles WHERE rolname = %s) THEN CREATE ROLE %s WITH LOGIN PASSWORD %s; END IF; END $;",
-		pqQuote(username), pqQuote(username), pqQuote(password))
-	if _, err = db.Exec(createRole); err != nil {
+	// Refuse to provision on a server whose version doesn't match what the application expects
+	if spec.PGVersion != 0 || spec.MinVersion != 0 || spec.LocaleProvider != "" {
+		num, err := serverVersionNum(db)
+		if err != nil {
+			return err
+		}
+		if spec.LocaleProvider != "" && num < 150000 {
+			return fmt.Errorf("locale_provider needs PostgreSQL 15 or later; target runs %s", formatVersionNum(num))
+		}
+		if spec.MinVersion != 0 && num < spec.MinVersion {
+			return fmt.Errorf("target runs PostgreSQL %s but the application requires at least %s (min_pg_version)",
+				formatVersionNum(num), formatVersionNum(spec.MinVersion))
+		}
+		if major := num / 10000; spec.PGVersion != 0 && major != spec.PGVersion {
+			return fmt.Errorf("target runs PostgreSQL %d but pg_version pins %d; refusing to provision (see `autopg upgrade-guide %s %s`)",
+				major, spec.PGVersion, target, dbname)
+		}
+	}
+
+	// Create role if not exists; with Vault-issued credentials it is the NOLOGIN parent of the dynamic logins
+	var roleExists bool
+	if err = db.QueryRow("SELECT EXISTS (SELECT FROM pg_catalog.pg_roles WHERE rolname = $1);", username).Scan(&roleExists); err != nil {
 		return fmt.Errorf("create role failed: %w", err)
 	}
+	roleCreated := false
+	if !roleExists {
+		createRole := fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD %s;", pqQuoteIdent(username), pqQuote(password))
+		if spec.VaultCreds {
+			createRole = fmt.Sprintf("CREATE ROLE %s WITH NOLOGIN;", pqQuoteIdent(username))
+		}
+		// another autopg may create it concurrently
+		if _, err = db.Exec(createRole); err != nil && !strings.Contains(err.Error(), "already exists") {
+			return fmt.Errorf("create role failed: %w", err)
+		}
+		roleCreated = err == nil
+	}
+	owner := fmt.Sprint(meta["owner"])
+	if roleCreated {
+		if err := markCreated(target, "role", username, createdEntry{For: owner}); err != nil {
+			return err
+		}
+		comment := fmt.Sprintf("%s%s (target %s)", createdRoleComment, owner, target)
+		if err := commentIfUnset(db, "ROLE", username, comment); err != nil {
+			return err
+		}
+	} else if spec.NewPass {
+		// the role may predate the generated password (e.g. lost data dir, or a password kept in the
+		// resource's credential sink); make them match, but only on a role autopg created for the same
+		// owner: resetting anyone else's would hand it over to the label's author
+		creator, ours, err := roleCreator(db, target, username)
+		if err != nil {
+			return err
+		}
+		if !ours {
+			return fmt.Errorf("role %s already exists and was not created by autopg; refusing to set a generated password on it", username)
+		}
+		if creator != owner {
+			return fmt.Errorf("role %s was created by autopg for %s; refusing to set a generated password on it for %s", username, creator, owner)
+		}
+		if _, err = db.Exec(fmt.Sprintf("ALTER ROLE %s WITH PASSWORD %s;", pqQuoteIdent(username), pqQuote(password))); err != nil {
+			return fmt.Errorf("set generated password failed: %w", err)
+		}
+	}
+	// attributes and settings are only changed on roles autopg created, not on a DBA's or another tenant's
+	ours := roleCreated
+	if !ours {
+		if ours, err = roleCreatedByAutopg(db, target, username); err != nil {
+			return err
+		}
+	}
+	if reapplyAlways(target) && !roleCreated && !spec.NewPass && !spec.VaultCreds {
+		// heal drift on a role autopg created: login revoked or password changed by hand
+		if !ours {
+			logf(ctx, "role %s was not created by autopg; leaving its login and password as they are", username)
+		} else if _, err = db.Exec(fmt.Sprintf("ALTER ROLE %s WITH LOGIN PASSWORD %s;", pqQuoteIdent(username), pqQuote(password))); err != nil {
+			return fmt.Errorf("reassert role failed: %w", err)
+		}
+	}
+	if spec.Replication && !ours {
+		return fmt.Errorf("role %s already exists and was not created by autopg; refusing to grant it REPLICATION", username)
+	}
+	if spec.Replication {
+		if _, err = db.Exec(fmt.Sprintf("ALTER ROLE %s WITH REPLICATION;", pqQuoteIdent(username))); err != nil {
+			return fmt.Errorf("grant replication failed: %w", err)
+		}
+	}
+	if spec.Expires != 0 && !ours {
+		logf(ctx, "role %s was not created by autopg; leaving its validity as it is", username)
+	} else if spec.Expires != 0 {
+		// renewed on every run, so the role only lapses once its container is gone
+		validUntil := time.Now().Add(spec.Expires).UTC().Format(time.RFC3339)
+		if _, err = db.Exec(fmt.Sprintf("ALTER ROLE %s VALID UNTIL %s;", pqQuoteIdent(username), pqQuote(validUntil))); err != nil {
+			return fmt.Errorf("set role expiry failed: %w", err)
+		}
+	}
 
 	// Create database if not exists
 	createDB := fmt.Sprintf("SELECT 1 FROM pg_database WHERE datname = %s;", pqQuote(dbname))
 	var exists int
+	created := false
 	err = db.QueryRow(createDB).Scan(&exists)
 	if err == sql.ErrNoRows || err == nil {
 		// check existence via query: if no row, create
 		if err == sql.ErrNoRows {
-			_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s OWNER %s;", pqQuoteIdent(dbname), pqQuoteIdent(username)))
+			if err := checkTemplate(db, target, spec.Template); err != nil {
+				return err
+			}
+			_, err = db.Exec(createDatabaseSQL(spec))
 			if err != nil {
 				return fmt.Errorf("create database failed: %w", err)
 			}
+			created = true
 		}
 	} else {
 		// QueryRow returned a value (exists). But simpler: attempt CREATE DATABASE and ignore duplicate_database error
-		_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s OWNER %s;", pqQuoteIdent(dbname), pqQuoteIdent(username)))
+		if err := checkTemplate(db, target, spec.Template); err != nil {
+			return err
+		}
+		_, err = db.Exec(createDatabaseSQL(spec))
 		if err != nil && !strings.Contains(err.Error(), "already exists") {
 			return fmt.Errorf("create database failed: %w", err)
 		}
+		created = err == nil
+	}
+	if created {
+		if err := markCreated(target, "database", dbname, createdEntry{Owner: username, For: owner}); err != nil {
+			return err
+		}
+		// leave a trail of who asked for the database, without overwriting a comment set by a DBA
+		comment := fmt.Sprintf("autopg: provisioned for %v (target %s)", meta["display_name"], target)
+		if err := commentIfUnset(db, "DATABASE", dbname, comment); err != nil {
+			return err
+		}
+	}
+	if databaseCreatedFor(target, dbname, username) {
+		// replaced on every run, so removing the label stops further links
+		if err := setLinkAllow(target, dbname, spec.LinkAllow); err != nil {
+			return err
+		}
+	}
+	if !created && reapplyAlways(target) && len(spec.GrantSchemas) == 0 {
+		// dedicated databases belong to their role; shared ones (grant_schemas) are left alone, and so are
+		// databases autopg did not create for this very role
+		if !databaseCreatedFor(target, dbname, username) {
+			logf(ctx, "database %s was not created by autopg for role %s; leaving its owner as it is", dbname, username)
+		} else if _, err = db.Exec(fmt.Sprintf("ALTER DATABASE %s OWNER TO %s;", pqQuoteIdent(dbname), pqQuoteIdent(username))); err != nil {
+			return fmt.Errorf("reassert database owner failed: %w", err)
+		}
+	}
+	if created && spec.Template != "" && spec.Analyze {
+		if err := analyzeSeeded(ctx, dbHost, dbPort, admin, adminPass, spec); err != nil {
+			return err
+		}
+	}
+
+	// Grant privileges: minimal or database-wide, or only on the requested schemas for shared databases
+	switch {
+	case len(spec.GrantSchemas) == 0 && grantMode(target) == "all":
+		_, err = db.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s;", pqQuoteIdent(dbname), pqQuoteIdent(username)))
+		if err != nil {
+			return fmt.Errorf("grant privileges failed: %w", err)
+		}
+	case len(spec.GrantSchemas) == 0:
+		_, err = db.Exec(fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s;", pqQuoteIdent(dbname), pqQuoteIdent(username)))
+		if err != nil {
+			return fmt.Errorf("grant privileges failed: %w", err)
+		}
+		if err := grantPublicUsage(ctx, dbHost, dbPort, admin, adminPass, spec); err != nil {
+			return err
+		}
+	default:
+		_, err = db.Exec(fmt.Sprintf("GRANT CONNECT, TEMPORARY ON DATABASE %s TO %s;", pqQuoteIdent(dbname), pqQuoteIdent(username)))
+		if err != nil {
+			return fmt.Errorf("grant privileges failed: %w", err)
+		}
+		if err := grantSchemas(ctx, dbHost, dbPort, admin, adminPass, spec); err != nil {
+			return err
+		}
+	}
+
+	// Per-role settings; ALTER ROLE ... SET is idempotent so label changes are picked up on the next run
+	if len(spec.RoleSettings) > 0 && !ours {
+		logf(ctx, "role %s was not created by autopg; leaving its settings as they are", username)
+		spec.RoleSettings = nil
+	}
+	for _, rs := range spec.RoleSettings {
+		_, err = db.Exec(fmt.Sprintf("ALTER ROLE %s SET %s = %s;", pqQuoteIdent(username), rs.Name, pqQuote(rs.Value)))
+		if err != nil {
+			return fmt.Errorf("set %s on role failed: %w", rs.Name, err)
+		}
 	}
+	if len(spec.SearchPath) > 0 && !ours {
+		logf(ctx, "role %s was not created by autopg; leaving its search_path as it is", username)
+	} else if len(spec.SearchPath) > 0 {
+		schemas := make([]string, len(spec.SearchPath))
+		for i, schema := range spec.SearchPath {
+			schemas[i] = pqQuoteIdent(schema)
+		}
+		_, err = db.Exec(fmt.Sprintf("ALTER ROLE %s SET search_path = %s;", pqQuoteIdent(username), strings.Join(schemas, ", ")))
+		if err != nil {
+			return fmt.Errorf("set search_path on role failed: %w", err)
+		}
+	}
+
+	// post_sql runs as the new role, proving its credentials and privileges actually work
+	if spec.PostSQL != "" {
+		udb, err := openDB(ctx, dbHost, dbPort, username, password, dbname)
+		if err != nil {
+			return fmt.Errorf("connect as %s failed: %w", username, err)
+		}
+		_, err = udb.Exec(spec.PostSQL)
+		udb.Close()
+		if err != nil {
+			return fmt.Errorf("post_sql as %s failed: %w", username, err)
+		}
+	}
+
+	if len(spec.Extensions) > 0 {
+		if err := createExtensions(ctx, dbHost, dbPort, admin, adminPass, spec); err != nil {
+			return err
+		}
+	}
+	for _, name := range spec.Presets {
+		if err := presets[name].Setup(ctx, dbHost, dbPort, admin, adminPass, spec); err != nil {
+			return err
+		}
+	}
+
+	if len(spec.AutoGrants) > 0 {
+		if err := installAutoGrants(ctx, dbHost, dbPort, admin, adminPass, spec); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range spec.Links {
+		if err := createLink(ctx, db, target, dbHost, dbPort, admin, adminPass, spec, l); err != nil {
+			return err
+		}
+	}
+
+	if table := os.Getenv(toEnvKey(target, "PGBOUNCER_AUTH_TABLE")); table != "" && !spec.VaultCreds {
+		if err := syncPgbouncerAuth(ctx, dbHost, dbPort, admin, adminPass, os.Getenv(toEnvKey(target, "PGBOUNCER_AUTH_DB")), table, username); err != nil {
+			return err
+		}
+	}
+
+	if spec.VaultCreds {
+		if err := configureVaultDBRole(ctx, target, spec); err != nil {
+			return err
+		}
+	}
+
+	if len(spec.CronJobs) > 0 {
+		if err := scheduleCronJobs(ctx, db, dbHost, dbPort, admin, adminPass, spec); err != nil {
+			return err
+		}
+	}
+
+	return runProvisionHook(db, spec, meta)
+}
 
-	// Grant privileges
-	_, err = db.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s;", pqQuoteIdent(dbname), pqQuoteIdent(username)))
+// commentIfUnset sets the comment of a database or role unless it already has one.
+func commentIfUnset(db *sql.DB, kind, name, comment string) error {
+	q := "SELECT shobj_description(oid, 'pg_database') FROM pg_catalog.pg_database WHERE datname = $1;"
+	if kind == "ROLE" {
+		q = "SELECT shobj_description(oid, 'pg_authid') FROM pg_catalog.pg_roles WHERE rolname = $1;"
+	}
+	var existing sql.NullString
+	if err := db.QueryRow(q, name).Scan(&existing); err != nil {
+		return fmt.Errorf("read comment of %s %s: %w", strings.ToLower(kind), name, err)
+	}
+	if existing.Valid {
+		return nil
+	}
+	if _, err := db.Exec(fmt.Sprintf("COMMENT ON %s %s IS %s;", kind, pqQuoteIdent(name), pqQuote(comment))); err != nil {
+		return fmt.Errorf("comment on %s %s failed: %w", strings.ToLower(kind), name, err)
+	}
+	return nil
+}
+
+// checkTemplate returns an error unless the database template may be cloned on target: CREATE DATABASE
+// ... TEMPLATE runs as the admin and copies every row, so a container may only clone databases marked
+// datistemplate or listed in AUTOPG_<TARGET>_TEMPLATE_ALLOW, not another tenant's data.
+func checkTemplate(db *sql.DB, target, template string) error {
+	if template == "" || templateAllowListed(target, template) {
+		return nil
+	}
+	var isTemplate bool
+	err := db.QueryRow("SELECT datistemplate FROM pg_catalog.pg_database WHERE datname = $1;", template).Scan(&isTemplate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("template database %s does not exist", template)
+	}
 	if err != nil {
-		return fmt.Errorf("grant privileges failed: %w", err)
+		return fmt.Errorf("check template database %s: %w", template, err)
+	}
+	if !isTemplate {
+		return fmt.Errorf("database %s is not a template; mark it with ALTER DATABASE ... IS_TEMPLATE true or list it in %s", template, toEnvKey(target, "TEMPLATE_ALLOW"))
 	}
 	return nil
 }
 
-// minimal quoting helpers
-func pqQuote(s string) string {
-	// simple single-quote and escape
-	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+func createDatabaseSQL(spec provisionSpec) string {
+	q := fmt.Sprintf("CREATE DATABASE %s OWNER %s", pqQuoteIdent(spec.DB), pqQuoteIdent(spec.User))
+	if spec.Template != "" {
+		q += " TEMPLATE " + pqQuoteIdent(spec.Template)
+	} else if spec.LocaleProvider != "" {
+		// template1 may use another locale; template0 is the only template any locale can be applied to
+		q += " TEMPLATE template0"
+	}
+	if spec.LocaleProvider != "" {
+		q += " LOCALE_PROVIDER " + spec.LocaleProvider
+	}
+	if spec.ICULocale != "" {
+		q += " ICU_LOCALE " + pqQuote(spec.ICULocale)
+	}
+	return q + ";"
 }
-func pqQuoteIdent(s string) string {
-	// double-quote identifiers, escape double quotes
-	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+
+// analyzeSeeded runs ANALYZE on a freshly seeded database so it doesn't start life with default
+// statistics, and logs its size and row estimates.
+func analyzeSeeded(ctx context.Context, dbHost, dbPort, admin, adminPass string, spec provisionSpec) error {
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, spec.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	start := time.Now()
+	if _, err := db.Exec("ANALYZE;"); err != nil {
+		return fmt.Errorf("analyze %s failed: %w", spec.DB, err)
+	}
+	var size string
+	var tables int
+	var rows float64
+	err = db.QueryRow(`SELECT pg_size_pretty(pg_database_size(current_database())), count(*), coalesce(sum(greatest(c.reltuples, 0)), 0)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%';`).Scan(&size, &tables, &rows)
+	if err != nil {
+		return fmt.Errorf("read statistics of %s: %w", spec.DB, err)
+	}
+	logf(ctx, "analyzed %s (seeded from %s) in %s: size=%s tables=%d estimated_rows=%.0f",
+		spec.DB, spec.Template, time.Since(start).Round(time.Millisecond), size, tables, rows)
+	return nil
 }
 
-func markProvisioned(cli *client.Client, ctx context.Context, containerID, target string) error {
-	// get current labels
-	inspect, err := cli.ContainerInspect(ctx, containerID)
+// createExtensions installs spec.Extensions in the new database. Extensions placed in a dedicated
+// schema get that schema created, and the user gets USAGE on it so the extension is usable.
+func createExtensions(ctx context.Context, dbHost, dbPort, admin, adminPass string, spec provisionSpec) error {
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, spec.DB)
 	if err != nil {
 		return err
 	}
-	if inspect.Config == nil {
-		return errors.New("no config on container inspect")
+	defer db.Close()
+	for _, ext := range spec.Extensions {
+		q := fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s", pqQuoteIdent(ext.Name))
+		if ext.Schema != "" {
+			stmts := []string{
+				fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", pqQuoteIdent(ext.Schema)),
+				fmt.Sprintf("GRANT USAGE ON SCHEMA %s TO %s;", pqQuoteIdent(ext.Schema), pqQuoteIdent(spec.User)),
+			}
+			for _, stmt := range stmts {
+				if _, err := db.Exec(stmt); err != nil {
+					return fmt.Errorf("prepare schema %s for extension %s failed: %w", ext.Schema, ext.Name, err)
+				}
+			}
+			q += " SCHEMA " + pqQuoteIdent(ext.Schema)
+		}
+		if _, err := db.Exec(q + ";"); err != nil {
+			return fmt.Errorf("create extension %s failed: %w", ext.Name, err)
+		}
+	}
+	return nil
+}
+
+// createLink creates a postgres_fdw server in the new database pointing at l.DB on the same target,
+// mapped to the provisioned user's own credentials. l.DB must be managed by autopg. The server connects
+// to AUTOPG_<TARGET>_FDW_HOST (default localhost) as seen from the Postgres server itself.
+func createLink(ctx context.Context, db *sql.DB, target, dbHost, dbPort, admin, adminPass string, spec provisionSpec, l dbLink) error {
+	e, ok := createdObject(target, "database", l.DB)
+	if !ok {
+		return fmt.Errorf("link %s: database %s was not created by autopg", l.Server, l.DB)
+	}
+	if !linkAllowed(target, spec.DB, l.DB, e.LinkAllow) {
+		return fmt.Errorf("link %s: database %s does not allow links from %s; set autopg.%s.link_allow on its container or %s",
+			l.Server, l.DB, spec.DB, target, toEnvKey(target, "LINK_ALLOW"))
+	}
+	if _, err := db.Exec(fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s;", pqQuoteIdent(l.DB), pqQuoteIdent(spec.User))); err != nil {
+		return fmt.Errorf("link %s: grant connect failed: %w", l.Server, err)
+	}
+	fdwHost := os.Getenv(toEnvKey(target, "FDW_HOST"))
+	if fdwHost == "" {
+		fdwHost = "localhost"
+	}
+
+	ldb, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, spec.DB)
+	if err != nil {
+		return err
 	}
-	labels := inspect.Config.Labels
-	if labels == nil {
-		labels = map[string]string{}
+	defer ldb.Close()
+	var port string
+	if err := ldb.QueryRow("SELECT current_setting('port');").Scan(&port); err != nil {
+		return fmt.Errorf("link %s: read server port: %w", l.Server, err)
 	}
-	key := provisionedLabelPrefix + target
-	if labels[key] == "true" {
+	server, user := pqQuoteIdent(l.Server), pqQuoteIdent(spec.User)
+	stmts := []string{
+		"CREATE EXTENSION IF NOT EXISTS postgres_fdw;",
+		fmt.Sprintf("CREATE SERVER IF NOT EXISTS %s FOREIGN DATA WRAPPER postgres_fdw OPTIONS (host %s, port %s, dbname %s);",
+			server, pqQuote(fdwHost), pqQuote(port), pqQuote(l.DB)),
+		fmt.Sprintf("GRANT USAGE ON FOREIGN SERVER %s TO %s;", server, user),
+		fmt.Sprintf("CREATE USER MAPPING IF NOT EXISTS FOR %s SERVER %s;", user, server),
+	}
+	for _, q := range stmts {
+		if _, err := ldb.Exec(q); err != nil {
+			return fmt.Errorf("link %s failed: %w", l.Server, err)
+		}
+	}
+	// (re)set the mapped credentials so password changes propagate
+	var opts []string
+	if err := ldb.QueryRow(`SELECT coalesce(umoptions, '{}') FROM pg_user_mappings WHERE srvname = $1 AND usename = $2;`, l.Server, spec.User).Scan(pq.Array(&opts)); err != nil {
+		return fmt.Errorf("link %s: read user mapping: %w", l.Server, err)
+	}
+	var set []string
+	for _, kv := range []struct{ k, v string }{{"user", spec.User}, {"password", spec.Pass}} {
+		verb := "ADD"
+		for _, o := range opts {
+			if strings.HasPrefix(o, kv.k+"=") {
+				verb = "SET"
+			}
+		}
+		set = append(set, fmt.Sprintf("%s %s %s", verb, kv.k, pqQuote(kv.v)))
+	}
+	if _, err := ldb.Exec(fmt.Sprintf("ALTER USER MAPPING FOR %s SERVER %s OPTIONS (%s);", user, server, strings.Join(set, ", "))); err != nil {
+		return fmt.Errorf("link %s: set user mapping failed: %w", l.Server, err)
+	}
+	return nil
+}
+
+// syncPgbouncerAuth upserts the role's password hash into the table pgbouncer's auth_query reads,
+// creating the table if needed. authDB is the database pgbouncer's auth_user connects to ("" for the
+// admin's default database).
+func syncPgbouncerAuth(ctx context.Context, dbHost, dbPort, admin, adminPass, authDB, table, username string) error {
+	schema, name, ok := strings.Cut(table, ".")
+	if !ok {
+		schema, name = "public", table
+	}
+	qualified := pqQuoteIdent(schema) + "." + pqQuoteIdent(name)
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, authDB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	stmts := []string{
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", pqQuoteIdent(schema)),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (usename name PRIMARY KEY, passwd text);", qualified),
+	}
+	for _, q := range stmts {
+		if _, err := db.Exec(q); err != nil {
+			return fmt.Errorf("prepare pgbouncer auth table failed: %w", err)
+		}
+	}
+	// the hash is copied from pg_authid, so pgbouncer sees exactly what the server verifies against
+	res, err := db.Exec(fmt.Sprintf(`INSERT INTO %s (usename, passwd) SELECT rolname, rolpassword FROM pg_authid WHERE rolname = $1
+		ON CONFLICT (usename) DO UPDATE SET passwd = EXCLUDED.passwd;`, qualified), username)
+	if err != nil {
+		return fmt.Errorf("update pgbouncer auth table failed: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("update pgbouncer auth table failed: role %s not found in pg_authid", username)
+	}
+	return nil
+}
+
+// grantSchemas gives the user USAGE and CREATE on each of spec.GrantSchemas, creating missing schemas.
+func grantSchemas(ctx context.Context, dbHost, dbPort, admin, adminPass string, spec provisionSpec) error {
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, spec.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, schema := range spec.GrantSchemas {
+		if _, err := db.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", pqQuoteIdent(schema))); err != nil {
+			return fmt.Errorf("create schema %s failed: %w", schema, err)
+		}
+		_, err := db.Exec(fmt.Sprintf("GRANT USAGE, CREATE ON SCHEMA %s TO %s;", pqQuoteIdent(schema), pqQuoteIdent(spec.User)))
+		if err != nil {
+			return fmt.Errorf("grant on schema %s failed: %w", schema, err)
+		}
+	}
+	return nil
+}
+
+// grantPublicUsage grants USAGE on the public schema of the new database, when it has one.
+func grantPublicUsage(ctx context.Context, dbHost, dbPort, admin, adminPass string, spec provisionSpec) error {
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, spec.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var exists bool
+	if err := db.QueryRow("SELECT to_regnamespace('public') IS NOT NULL;").Scan(&exists); err != nil {
+		return fmt.Errorf("look up public schema: %w", err)
+	}
+	if !exists {
 		return nil
 	}
-	labels[key] = "true"
-	// Update container with new labels via ContainerUpdate is not supported for labels; use ContainerCommit as workaround is heavy.
-	// Instead use Docker API to update via ContainerRename is not applicable. Best approach: use container update API for labels (available in newer API).
-	// Use client.ContainerCommit to create a new image with labels is intrusive. Alternative: use Docker Engine API's ContainerUpdate which supports Labels in newer versions.
-	_, err = cli.ContainerUpdate(ctx, containerID, types.ContainerUpdateConfig{RestartPolicy: types.RestartPolicy{}})
+	if _, err := db.Exec(fmt.Sprintf("GRANT USAGE ON SCHEMA public TO %s;", pqQuoteIdent(spec.User))); err != nil {
+		return fmt.Errorf("grant on schema public failed: %w", err)
+	}
+	return nil
+}
+
+// runProvisionHook calls autopg_registry.on_provision(db, role, meta) when the target owner defined it in
+// the admin database. Raising an exception from the hook fails the provisioning.
+func runProvisionHook(db *sql.DB, spec provisionSpec, meta map[string]any) error {
+	var defined bool
+	err := db.QueryRow("SELECT to_regprocedure('autopg_registry.on_provision(text,text,jsonb)') IS NOT NULL;").Scan(&defined)
 	if err != nil {
-		// ignore update failure, but log — still ok: we rely on label to avoid double provision; if can't set label, we will tolerate idempotence.
-		log.Printf("warning: could not mark container %s as provisioned: %v", containerID, err)
+		return fmt.Errorf("look up on_provision hook: %w", err)
+	}
+	if !defined {
+		return nil
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("SELECT autopg_registry.on_provision($1, $2, $3::jsonb);", spec.DB, spec.User, string(b)); err != nil {
+		return fmt.Errorf("on_provision hook failed: %w", err)
 	}
-	// Best-effort: attempt to set label via docker API using container commit (less ideal).
 	return nil
 }
 
-func processContainer(cli *client.Client, ctx context.Context, c types.Container, selfTargets map[string]struct{}) {
-	labels := c.Labels
-	if labels == nil {
-		return
+// scheduleCronJobs registers the spec's pg_cron jobs to run in its database as its role.
+// Jobs are keyed by name, so re-running updates them in place. Targets without pg_cron are skipped.
+func scheduleCronJobs(ctx context.Context, db *sql.DB, dbHost, dbPort, admin, adminPass string, spec provisionSpec) error {
+	// pg_cron lives in a single database, named by cron.database_name (unset when not preloaded)
+	var cronDB sql.NullString
+	if err := db.QueryRow("SELECT current_setting('cron.database_name', true);").Scan(&cronDB); err != nil {
+		return fmt.Errorf("read cron.database_name: %w", err)
+	}
+	if cronDB.String == "" {
+		logf(ctx, "warning: pg_cron is not loaded on target; skipping %d cron job(s) for %s", len(spec.CronJobs), spec.DB)
+		return nil
+	}
+	cdb, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, cronDB.String)
+	if err != nil {
+		return err
+	}
+	defer cdb.Close()
+	var installed bool
+	if err := cdb.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_cron');").Scan(&installed); err != nil {
+		return fmt.Errorf("check pg_cron extension: %w", err)
+	}
+	if !installed {
+		logf(ctx, "warning: pg_cron extension not installed in %s; skipping %d cron job(s) for %s", cronDB.String, len(spec.CronJobs), spec.DB)
+		return nil
+	}
+	for _, j := range spec.CronJobs {
+		jobName := spec.DB + "_" + j.Name
+		_, err := cdb.Exec("SELECT cron.schedule_in_database($1, $2, $3, $4, $5);", jobName, j.Schedule, j.Command, spec.DB, spec.User)
+		if err != nil {
+			return fmt.Errorf("schedule cron job %s failed: %w", jobName, err)
+		}
 	}
-	// find labels starting with labelPrefix
+	return nil
+}
+
+// minimal quoting helpers
+func pqQuote(s string) string {
+	// simple single-quote and escape
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+func pqQuoteIdent(s string) string {
+	// double-quote identifiers, escape double quotes
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+func dsnQuote(s string) string {
+	// libpq key=value syntax: single-quote, backslash-escape quotes and backslashes
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// labelTargets returns the targets a container asks provisioning for, i.e. those with a db, user, pass
+// or enable label.
+func labelTargets(labels map[string]string) map[string]struct{} {
 	targets := map[string]struct{}{}
-	for k, v := range labels {
+	for k := range labels {
 		if !strings.HasPrefix(k, labelPrefix) {
 			continue
 		}
@@ -161,105 +1298,415 @@ func processContainer(cli *client.Client, ctx context.Context, c types.Container
 		}
 		target := parts[0]
 		field := parts[1]
-		if field != "db" && field != "user" && field != "pass" {
+		if field != "db" && field != "user" && field != "pass" && field != "enable" {
 			continue
 		}
 		targets[target] = struct{}{}
-		_ = v // value used later
 	}
+	return targets
+}
+
+func processContainer(cli *client.Client, ctx context.Context, c types.Container, selfTargets map[string]struct{}) {
+	c = withEnvSpec(ctx, cli, c)
+	if c.Labels == nil {
+		return
+	}
+	discoverTarget(ctx, cli, c)
+	containerTargets(ctx, cli, c)
+	raw := c.Labels
+	declared, err := expandConfigLabels(c.Labels)
+	labels := declared
+	if err == nil {
+		labels, err = resolveLabelValues(ctx, cli, c.ID, declared)
+	}
+	if err != nil {
+		logf(ctx, "container %s: %v", displayName(c), err)
+		return
+	}
+	c.Labels = labels
+	targets := labelTargets(labels)
 	if len(targets) == 0 {
 		return
 	}
+	if requestID(ctx) == "" {
+		ctx = withRequestID(ctx, newRequestID())
+	}
+	name := displayName(c)
+	if provisioningPaused() {
+		logf(ctx, "provisioning paused; skipping container %s (%d target(s))", name, len(targets))
+		return
+	}
+	r := containerResource(cli, c, raw, declared)
+	ready := true
 	for target := range targets {
-		// If this autopg instance does not have creds for this target, skip
-		host, port, admin, adminPass, ok := getAdminCredsForTarget(target)
-		if !ok {
-			log.Printf("no admin creds for target %s in this instance; skipping", target)
-			continue
+		if !processTarget(ctx, r, target) {
+			ready = false
 		}
-		// check provisioned label
-		provKey := provisionedLabelPrefix + target
-		if val, has := labels[provKey]; has && val == "true" {
-			log.Printf("container %s already provisioned for target %s", c.ID[:12], target)
-			continue
+	}
+	if ready {
+		openGate(ctx, cli, c)
+	}
+}
+
+// processTarget provisions the container r, whose labels are resolved, on target, with what the Docker
+// provider adds around provision: skipping what is already provisioned, one container of a service at
+// a time, delivery, post_exec and post_signal. It reports whether the container is provisioned there, or
+// needs nothing from it.
+func processTarget(ctx context.Context, r resource, target string) bool {
+	cli, c := r.docker.cli, r.docker.c
+	labels, name := r.labels, r.displayName()
+	if enabled, err := r.enabled(target); err != nil {
+		logf(ctx, "container %s: %v; skipping", name, err)
+		return false
+	} else if !enabled {
+		logf(ctx, "provisioning disabled for container %s target %s (enabled=false)", name, target)
+		return true
+	}
+	// expiring roles are renewed and delivered files rewritten at every run
+	renew := labels[labelPrefix+target+".expires"] != "" || labels[labelPrefix+target+".deliver"] != ""
+	if !renew && !reapplyAlways(target) && !forced(ctx) && isProvisioned(ctx, c.ID, target, labels) {
+		logf(ctx, "container %s already provisioned for target %s", name, target)
+		return true
+	}
+	var svc *serviceState
+	// delivered credentials and signals are per container
+	if labels[labelPrefix+target+".deliver"] == "" && labels[labelPrefix+target+".post_signal"] == "" {
+		svc = lockService(ctx, target, c)
+	}
+	if svc != nil {
+		defer svc.mu.Unlock()
+		if svc.fingerprint == serviceFingerprint(target, labels) && !reapplyAlways(target) && !forced(ctx) {
+			logf(ctx, "container %s: service already provisioned for target %s", name, target)
+			return true
 		}
-		// gather label values
-		dbLabel := labels[labelPrefix+target+".db"]
-		userLabel := labels[labelPrefix+target+".user"]
-		passLabel := labels[labelPrefix+target+".pass"]
-		if dbLabel == "" || userLabel == "" || passLabel == "" {
-			log.Printf("incomplete labels for target %s on container %s; need db,user,pass", target, c.ID[:12])
-			continue
+	}
+	// the signal is only sent after the container's first successful provisioning
+	first := labels[labelPrefix+target+".post_signal"] != "" && !provisionedBefore(c.ID, target)
+	spec, exp, err := provision(ctx, r, target)
+	var pending pendingError
+	switch {
+	case errors.Is(err, errNotOurTarget):
+		logf(ctx, "no admin creds for target %s in this instance; skipping", target)
+		return false
+	case errors.As(err, &pending):
+		logf(ctx, "%v; queueing container %s", err, name)
+		scheduleReprocess(cli, ctx, c.ID, pending.until)
+		return false
+	case err != nil:
+		logf(ctx, "container %s target %s: %v", name, target, err)
+		return false
+	}
+	if spec.ManagedPass && !spec.NewPass && exp.SwarmService != "" && dockerSecretMount(target) &&
+		contains(splitList(targetSetting(target, "CREDENTIAL_STORES")), "docker") {
+		// keep the secret mounted, e.g. after a stack deploy replaced the service spec
+		sctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := dockerStoreCredential(sctx, exp); err != nil {
+			logf(ctx, "warning: %v", err)
 		}
-		log.Printf("provisioning target=%s host=%s container=%s db=%s user=%s", target, host, c.ID[:12], dbLabel, userLabel)
-		err := ensureUserDB(host, port, admin, adminPass, userLabel, passLabel, dbLabel)
-		if err != nil {
-			log.Printf("provision failed for container %s target %s: %v", c.ID[:12], target, err)
-			continue
+		cancel()
+	}
+	if spec.Deliver != "" {
+		if err := deliverCredentials(ctx, cli, c.ID, spec, exp); err != nil {
+			logf(ctx, "warning: could not deliver credentials to container %s: %v", name, err)
+		} else {
+			logf(ctx, "delivered credentials to %s in container %s", spec.Deliver, name)
 		}
-		// mark provisioned
-		if err := markProvisioned(cli, context.Background(), c.ID, target); err != nil {
-			log.Printf("warning marking provisioned: %v", err)
+	}
+	done := true
+	if spec.PostExec != "" {
+		if err := runPostExec(ctx, cli, c, target, spec, exp, labels); err != nil {
+			logf(ctx, "warning: post_exec in container %s: %v", name, err)
+			done = false // retried at the next run
+		}
+	}
+	if first && spec.PostSignal != "" {
+		if err := sendPostSignal(ctx, cli, c, spec.PostSignal); err != nil {
+			logf(ctx, "warning: post_signal to container %s: %v", name, err)
 		}
-		log.Printf("provisioning done for container %s target %s", c.ID[:12], target)
 	}
+	if done {
+		markProvisioned(ctx, c.ID, target, labels)
+	}
+	if svc != nil {
+		svc.fingerprint = serviceFingerprint(target, labels)
+	}
+	logf(ctx, "provisioning done for container %s target %s", name, target)
+	return true
+}
+
+// displayName is the human-meaningful name of a container used in logs, history and comments:
+// compose project/service (with the replica number when scaled), else the container name.
+func displayName(c types.Container) string {
+	project, service := c.Labels["com.docker.compose.project"], c.Labels["com.docker.compose.service"]
+	if project != "" && service != "" {
+		name := project + "/" + service
+		if n := c.Labels["com.docker.compose.container-number"]; n != "" && n != "1" {
+			name += "-" + n
+		}
+		return name
+	}
+	if name := strings.TrimPrefix(firstName(c.Names), "/"); name != "" {
+		return name
+	}
+	return c.ID[:12]
+}
+
+func firstName(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// containerFromInspect converts an inspect result to the list form processContainer takes.
+func containerFromInspect(cont container.InspectResponse) types.Container {
+	c := types.Container{ID: cont.ID, Names: []string{cont.Name}}
+	if cont.Config != nil {
+		c.Labels = cont.Config.Labels
+	}
+	if cont.NetworkSettings != nil {
+		c.NetworkSettings = &container.NetworkSettingsSummary{Networks: cont.NetworkSettings.Networks}
+	}
+	return c
 }
 
 func listAndProcess(cli *client.Client, ctx context.Context) {
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	containers, err := listClients(ctx, cli)
 	if err != nil {
 		log.Printf("container list error: %v", err)
 		return
 	}
+	discoverTargets(ctx, cli, containers)
 	for _, c := range containers {
-		processContainer(cli, ctx, c, nil)
+		processContainer(cli, withRequestID(ctx, newRequestID()), c, nil)
 	}
 }
 
-func monitorEvents(cli *client.Client, ctx context.Context) {
+func monitorEvents(cli *client.Client, ctx context.Context, behaviors map[string]string) {
 	f := filters.NewArgs()
-	f.Add("type", "container")
-	f.Add("event", "start")
-	eventOptions := types.EventsOptions{Filters: f}
-	msgs, errs := cli.Events(ctx, eventOptions)
+	if dockerSupports(cli, "event type filter") {
+		f.Add("type", "container")
+	}
+	// create is always watched for autopg.gate=pause, destroy for compose teardowns
+	f.Add("event", "create")
+	f.Add("event", "destroy")
+	for action := range behaviors {
+		f.Add("event", eventFilter(action))
+	}
+	eventOptions := events.ListOptions{Filters: f}
+	host := dockerHostName(ctx)
+	// last is the time of the last event received, pending that of the one being handled
+	last, pending, live := eventCursor(host), int64(0), int64(0)
+	connect := func() (<-chan events.Message, <-chan error) {
+		if pending != 0 {
+			saveEventCursor(host, pending)
+		}
+		if last != 0 {
+			eventOptions.Since = eventsSince(last)
+		}
+		live = time.Now().UnixNano()
+		return cli.Events(ctx, eventOptions)
+	}
+	msgs, errs := connect()
 	for {
 		select {
 		case e := <-msgs:
+			ts := eventTime(e)
+			if ts <= last {
+				continue // since is inclusive
+			}
+			if pending != 0 {
+				saveEventCursor(host, pending)
+			}
+			last, pending = ts, ts
+			if e.Action == "destroy" {
+				forgetProvisioned(dockerHostName(ctx), e.Actor.ID)
+				watchTeardown(cli, ctx, e.Actor.Attributes)
+				continue
+			}
+			if e.Action == "create" && ts < live {
+				continue // replayed: started since, or never
+			}
+			behavior, ok := behaviors[string(e.Action)]
+			if !ok && e.Action == "create" && e.Actor.Attributes[gateLabel] == "pause" {
+				behavior, ok = "provision", true
+			}
+			if !ok {
+				// e.g. health_status: unhealthy
+				continue
+			}
 			// parse actor.ID -> container id
 			contID := e.Actor.ID
-			cont, err := cli.ContainerInspect(ctx, contID)
+			if !dockerSupports(cli, "event actor") {
+				contID = e.ID //nolint:staticcheck // only field set before API 1.22
+			}
+			rctx := withRequestID(ctx, newRequestID())
+			if behavior == "reprovision" {
+				rctx = withForce(rctx)
+			}
+			cont, err := cli.ContainerInspect(rctx, contID)
 			if err != nil {
-				log.Printf("inspect error %v", err)
+				logf(rctx, "inspect error %v", err)
 				continue
 			}
-			c := types.Container{
-				ID:     cont.ID,
-				Names:  cont.Name,
-				Labels: cont.Config.Labels,
+			name := strings.TrimPrefix(cont.Name, "/")
+			if e.Action != "start" {
+				logf(rctx, "%s event for %s: %s", e.Action, name, behavior)
+			}
+			c := containerFromInspect(cont)
+			if e.Action == "start" {
+				if targets := providedTargets(c); len(targets) > 0 {
+					go reprovisionDependents(cli, rctx, c, targets)
+				}
+			}
+			switch e.Action {
+			case "create":
+				if labels, err := expandConfigLabels(withEnvSpec(rctx, cli, c).Labels); err != nil || len(labelTargets(labels)) == 0 {
+					break
+				}
+				done := startCreateRun(cont.ID)
+				go func() {
+					defer close(done)
+					processContainer(cli, rctx, c, nil)
+				}()
+				continue
+			case "start":
+				if done, ok := takeCreateRun(cont.ID); ok {
+					go func() {
+						awaitCreateRun(cli, rctx, c, done)
+						if behavior == "reprovision" {
+							processContainer(cli, rctx, c, nil)
+						}
+					}()
+					continue
+				}
 			}
-			processContainer(cli, ctx, c, nil)
+			processContainer(cli, rctx, c, nil)
 		case err := <-errs:
 			if err == context.Canceled {
+				if pending != 0 {
+					saveEventCursor(host, pending)
+				}
 				return
 			}
 			log.Printf("events error: %v (reconnect in 2s)", err)
 			time.Sleep(2 * time.Second)
-			msgs, errs = cli.Events(ctx, eventOptions)
+			msgs, errs = connect()
 		case <-ctx.Done():
+			if pending != 0 {
+				saveEventCursor(host, pending)
+			}
 			return
 		}
 	}
 }
 
+// printUpgradeGuide prints the dump/restore steps to move a database across a major version change.
+func printUpgradeGuide(target, dbname string) error {
+	host, port, admin, adminPass, ok := getAdminCredsForTarget(target)
+	if !ok {
+		return fmt.Errorf("no admin creds for target %s", target)
+	}
+	db, err := openAdmin(withTarget(context.Background(), target), host, port, admin, adminPass, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	num, err := serverVersionNum(db)
+	if err != nil {
+		return err
+	}
+	major := num / 10000
+	fmt.Printf(`# target %[1]s currently runs PostgreSQL %[2]d on %[3]s:%[4]s
+# 1. stop the application, then dump the database from the current server
+pg_dump --host=%[3]s --port=%[4]s --username=%[5]s --format=custom --file=%[6]s.dump %[6]s
+# 2. start the new major version server and point %[7]s/%[8]s at it
+# 3. restore into the new server (the role is recreated by autopg on the next start)
+pg_restore --host=<new-host> --port=<new-port> --username=%[5]s --create --dbname=postgres %[6]s.dump
+# 4. bump autopg.%[1]s.pg_version on the application container and restart it
+`, target, major, host, port, admin, dbname, toEnvKey(target, "HOST"), toEnvKey(target, "PORT"))
+	return nil
+}
+
+func runCommand(args []string) error {
+	switch args[0] {
+	case "upgrade-guide":
+		if len(args) != 3 {
+			return errors.New("usage: autopg upgrade-guide <target> <db>")
+		}
+		return printUpgradeGuide(args[1], args[2])
+	case "stats":
+		return runStats(args[1:])
+	case "schema":
+		return runSchema(args[1:])
+	case "credentials":
+		return runCredentials(args[1:])
+	case "pause", "resume":
+		return runPause(args[0] == "pause")
+	case "doctor":
+		return runDoctor()
+	case "plan":
+		return runPlan(args[1:])
+	case "retrigger":
+		return runRetrigger(args[1:])
+	case "sign":
+		return runSign(args[1:])
+	case "operator":
+		return runOperator(args[1:])
+	case "nomad":
+		return runNomad(args[1:])
+	case "files":
+		return runFiles(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err := loadFileEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadConfigFile(); err != nil {
+		log.Fatalf("config file: %v", err)
+	}
+	registerEnvSecrets()
+	log.SetOutput(redactingWriter{os.Stderr})
+	args, err := parseContextFlag(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) > 0 {
+		if err := runCommand(args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	enabled, docker, err := enabledProviders()
 	if err != nil {
-		log.Fatalf("docker client: %v", err)
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(dataDir(), 0o700); err != nil {
+		log.Printf("warning: data dir %s unavailable, history disabled: %v", dataDir(), err)
+	}
+	if os.Getenv("AUTOPG_USAGE_SUMMARY") == "true" {
+		go logUsageSummary()
+	}
+	if os.Getenv("AUTOPG_PAUSED") == "true" {
+		if err := setPaused(true); err != nil {
+			log.Fatalf("pause: %v", err)
+		}
+	}
+	if provisioningPaused() {
+		log.Printf("provisioning is paused; run `autopg resume` to continue")
 	}
 	ctx := context.Background()
-	// initial scan
-	listAndProcess(cli, ctx)
-	// monitor events
-	monitorEvents(cli, ctx)
+	var hosts []dockerHost
+	if docker != nil {
+		hosts = docker.hosts
+	}
+	if err := startAPI(hosts, ctx); err != nil {
+		log.Fatalf("control API: %v", err)
+	}
+	runProviders(ctx, enabled)
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Naming strategies derive db/user names for containers that set enable=true without db/user labels.
+// The strategy is chosen per target with AUTOPG_<TARGET>_NAME_STRATEGY or globally with
+// AUTOPG_NAME_STRATEGY:
+//   - compose (default): <project>_<service>
+//   - branch-slug: <branch slug>_<service>, the branch coming from the autopg.branch label (falls back to
+//     the compose project)
+//   - short-hash: <service>_<first 8 hex chars of sha256(project)>
+//   - sequential: <project>_<n>, n allocated per project in order of first appearance and remembered
+//     in the data dir
+
+var slugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// plainIdentRe matches identifiers PostgreSQL accepts without quoting (ignoring reserved words).
+var plainIdentRe = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// maxIdentLen is NAMEDATALEN-1; PostgreSQL silently truncates longer identifiers.
+const maxIdentLen = 63
+
+// normalizeIdent applies the target's name normalization to a db or user name and validates it.
+// AUTOPG_<TARGET>_NAME_NORMALIZE (or AUTOPG_NAME_NORMALIZE) lists the steps, comma-separated:
+//   - lower: lowercase the name;
+//   - dashes: replace dashes, dots and spaces with underscores;
+//   - truncate: shorten names over 63 bytes to 54 bytes plus "_" and 8 hex chars of their sha256.
+//
+// With AUTOPG_<TARGET>_NAME_STRICT=true names must be plain lowercase identifiers that need no quoting.
+// AUTOPG_<TARGET>_NAME_PREFIX and _NAME_SUFFIX are then added unless the name already carries them;
+// truncation leaves room for them.
+func normalizeIdent(target, kind, name string) (string, error) {
+	prefix, suffix := nameAffixes(target)
+	name = strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+	limit := maxIdentLen - len(prefix) - len(suffix)
+	for _, step := range splitList(targetSetting(target, "NAME_NORMALIZE")) {
+		switch step {
+		case "lower":
+			name = strings.ToLower(name)
+		case "dashes":
+			name = strings.NewReplacer("-", "_", ".", "_", " ", "_").Replace(name)
+		case "truncate":
+			if len(name) > limit && limit > 9 {
+				sum := sha256.Sum256([]byte(name))
+				cut := limit - 9
+				for cut > 0 && !utf8.RuneStart(name[cut]) {
+					cut--
+				}
+				name = name[:cut] + "_" + hex.EncodeToString(sum[:])[:8]
+			}
+		default:
+			return "", fmt.Errorf("unknown name normalization %q; expected lower, dashes or truncate", step)
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("%s name is empty", kind)
+	}
+	name = prefix + name + suffix
+	switch {
+	case len(name) > maxIdentLen:
+		return "", fmt.Errorf("%s name %q is longer than %d bytes; PostgreSQL would truncate it (see NAME_NORMALIZE=truncate)", kind, name, maxIdentLen)
+	case strings.ContainsRune(name, 0):
+		return "", fmt.Errorf("%s name %q contains a NUL byte", kind, name)
+	case targetSetting(target, "NAME_STRICT") == "true" && !plainIdentRe.MatchString(name):
+		return "", fmt.Errorf("%s name %q is not a plain identifier (lowercase letters, digits and _, not starting with a digit)", kind, name)
+	}
+	return name, nil
+}
+
+func slugify(s string) string {
+	s = strings.Trim(slugRe.ReplaceAllString(strings.ToLower(s), "_"), "_")
+	if len(s) > 40 {
+		s = strings.TrimRight(s[:40], "_")
+	}
+	return s
+}
+
+// deriveName returns the name a container gets on target under the target's naming strategy.
+func deriveName(target string, vars map[string]string) (string, error) {
+	project, service := vars["ComposeProject"], vars["ComposeService"]
+	if project == "" || service == "" {
+		return "", errors.New("enable=true without db/user labels needs a compose service (com.docker.compose.project/service labels)")
+	}
+	switch strategy := targetSetting(target, "NAME_STRATEGY"); strategy {
+	case "", "compose":
+		return project + "_" + service, nil
+	case "branch-slug":
+		branch := vars["Branch"]
+		if branch == "" {
+			branch = project
+		}
+		return slugify(branch) + "_" + service, nil
+	case "short-hash":
+		sum := sha256.Sum256([]byte(project))
+		return service + "_" + hex.EncodeToString(sum[:])[:8], nil
+	case "sequential":
+		n, err := sequenceNumber(target, project, service)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s_%d", project, n), nil
+	default:
+		return "", fmt.Errorf("unknown naming strategy %q", strategy)
+	}
+}
+
+var sequencesMu sync.Mutex
+
+// sequenceNumber returns the number of service within project on target, allocating the next free one
+// on first sight. Allocations are kept in names.json in the data dir so they stay stable.
+func sequenceNumber(target, project, service string) (int, error) {
+	sequencesMu.Lock()
+	defer sequencesMu.Unlock()
+	path := filepath.Join(dataDir(), "names.json")
+	seqs := map[string]int{}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &seqs); err != nil {
+			return 0, fmt.Errorf("parse %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	key := target + "/" + project + "/" + service
+	if n, ok := seqs[key]; ok {
+		return n, nil
+	}
+	next := 1
+	prefix := target + "/" + project + "/"
+	for k, n := range seqs {
+		if strings.HasPrefix(k, prefix) && n >= next {
+			next = n + 1
+		}
+	}
+	seqs[key] = next
+	b, err := json.MarshalIndent(seqs, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return 0, err
+	}
+	return next, os.Rename(tmp, path)
+}
+
+// resolveNameCollision renames a spec with derived names when its database already exists but belongs
+// to another role, trying <name>_2, <name>_3, ... The check is deterministic, so later runs land on the
+// same name.
+func resolveNameCollision(ctx context.Context, target, dbHost, dbPort, admin, adminPass string, spec *provisionSpec) error {
+	ctx = withTarget(ctx, target)
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	base := spec.DB
+	_, suffix := nameAffixes(target)
+	for i := 1; i <= 20; i++ {
+		name := base
+		if i > 1 {
+			// keep a mandatory suffix last
+			name = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(base, suffix), i, suffix)
+		}
+		var owner string
+		err := db.QueryRow("SELECT pg_get_userbyid(datdba) FROM pg_catalog.pg_database WHERE datname = $1;", name).Scan(&owner)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("check name collision: %w", err)
+		}
+		if err == nil && owner != name {
+			continue
+		}
+		if name != spec.DB {
+			logf(ctx, "database %s belongs to another role; using %s", spec.DB, name)
+			spec.DB, spec.User = name, name
+			if spec.ManagedPass {
+				return resolvePass(target, spec)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no free name found for %s", base)
+}
+
+// nameAffixes returns the prefix and suffix every db and role name on target must carry, per
+// AUTOPG_<TARGET>_NAME_PREFIX / AUTOPG_<TARGET>_NAME_SUFFIX (or the global AUTOPG_NAME_PREFIX/SUFFIX).
+func nameAffixes(target string) (prefix, suffix string) {
+	return targetSetting(target, "NAME_PREFIX"), targetSetting(target, "NAME_SUFFIX")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"feature/JIRA-123-login":       "feature_jira_123_login",
+		"--main--":                     "main",
+		"release 2.0 (rc)":             "release_2_0_rc",
+		strings.Repeat("ab-", 20):      strings.Repeat("ab_", 13) + "a",
+		strings.Repeat("x", 39) + "-y": strings.Repeat("x", 39), // no trailing _ after the cut
+	}
+	for in, want := range tests {
+		if got := slugify(in); got != want {
+			t.Errorf("slugify(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDeriveName(t *testing.T) {
+	useDataDir(t)
+	vars := map[string]string{"ComposeProject": "shop", "ComposeService": "api", "Branch": "feature/Login"}
+	tests := []struct {
+		strategy, want, err string
+	}{
+		{"", "shop_api", ""},
+		{"compose", "shop_api", ""},
+		{"branch-slug", "feature_login_api", ""},
+		{"short-hash", "api_8d9001d3", ""}, // sha256("shop")
+		{"sequential", "shop_1", ""},
+		{"random", "", `unknown naming strategy "random"`},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_NAME_STRATEGY", tt.strategy)
+		got, err := deriveName("main", vars)
+		if got != tt.want || (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("deriveName with %q = %q, %v, want %q %s", tt.strategy, got, err, tt.want, tt.err)
+		}
+	}
+	t.Setenv("AUTOPG_MAIN_NAME_STRATEGY", "branch-slug")
+	if got, _ := deriveName("main", map[string]string{"ComposeProject": "My Shop", "ComposeService": "api"}); got != "my_shop_api" {
+		t.Errorf("branch-slug without branch = %q, want the project's slug", got)
+	}
+	if _, err := deriveName("main", map[string]string{"ComposeService": "api"}); err == nil {
+		t.Error("deriveName without compose project succeeded")
+	}
+}
+
+func TestSequenceNumber(t *testing.T) {
+	dir := useDataDir(t)
+	steps := []struct {
+		target, project, service string
+		want                     int
+	}{
+		{"main", "shop", "api", 1},
+		{"main", "shop", "worker", 2},
+		{"main", "shop", "api", 1}, // stable
+		{"main", "blog", "web", 1}, // per project
+		{"other", "shop", "worker", 1},
+		{"main", "shop", "cron", 3},
+	}
+	for _, s := range steps {
+		if n, err := sequenceNumber(s.target, s.project, s.service); err != nil || n != s.want {
+			t.Errorf("sequenceNumber(%s, %s, %s) = %d, %v, want %d", s.target, s.project, s.service, n, err, s.want)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "names.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sequenceNumber("main", "shop", "api"); err == nil {
+		t.Error("sequenceNumber with a corrupt names.json succeeded")
+	}
+}
+
+func TestNormalizeIdent(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	accented := "x" + strings.Repeat("é", 40) // 81 bytes
+	tests := []struct {
+		normalize, strict string
+		name, want, err   string
+	}{
+		{"", "", "Shop-API", "Shop-API", ""},
+		{"lower,dashes", "", "Shop-API.v2 eu", "shop_api_v2_eu", ""},
+		{"lower", "true", "shop-api", "", `role name "shop-api" is not a plain identifier`},
+		{"lower,dashes", "true", "2shop", "", `role name "2shop" is not a plain identifier`},
+		{"lower,dashes", "true", "shop_api$1", "shop_api$1", ""},
+		{"", "", long, "", "is longer than 63 bytes"},
+		{"truncate", "", long, strings.Repeat("a", 54) + "_6bd5e503", ""},
+		// the cut does not split a character
+		{"truncate", "", accented, "x" + strings.Repeat("é", 26) + "_85c6ce9f", ""},
+		{"", "", "sh\x00op", "", "contains a NUL byte"},
+		{"upper", "", "shop", "", `unknown name normalization "upper"`},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_NAME_NORMALIZE", tt.normalize)
+		t.Setenv("AUTOPG_MAIN_NAME_STRICT", tt.strict)
+		got, err := normalizeIdent("main", "role", tt.name)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("normalizeIdent(%q) with %q = %q, %v, want error %s", tt.name, tt.normalize, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeIdent(%q) with %q = %q, %v, want %q", tt.name, tt.normalize, got, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeIdentAffixes(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	tests := []struct {
+		normalize, prefix, suffix string
+		name, want, err           string
+	}{
+		{"", "app_", "", "shop", "app_shop", ""},
+		{"", "app_", "", "app_shop", "app_shop", ""}, // not added twice
+		{"", "app_", "", "app_", "", "role name is empty"},
+		{"lower", "", "_prod", "Shop", "shop_prod", ""},
+		{"lower", "", "_prod", "shop_prod", "shop_prod", ""},
+		// room is left for the prefix
+		{"truncate", "app_", "", long, "app_" + strings.Repeat("a", 50) + "_6bd5e503", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_NAME_NORMALIZE", tt.normalize)
+		t.Setenv("AUTOPG_MAIN_NAME_PREFIX", tt.prefix)
+		t.Setenv("AUTOPG_NAME_SUFFIX", tt.suffix)
+		got, err := normalizeIdent("main", "role", tt.name)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("normalizeIdent(%q) with %q%q = %q, %v, want error %s", tt.name, tt.prefix, tt.suffix, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeIdent(%q) with %q%q = %q, %v, want %q", tt.name, tt.prefix, tt.suffix, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// Target hosts from Docker networks: when the target Postgres runs in a container, AUTOPG_<TARGET>_CONTAINER
+// (compose name, container name or ID) can replace AUTOPG_<TARGET>_HOST. autopg then reaches it on a
+// network both containers are on, by its container name (Docker DNS), or by its IP address on the
+// default bridge, which has no DNS. When autopg doesn't run in a container, the container's IP address
+// is used. The host is derived again each time the Postgres container starts and at each scan, so a
+// recreated container is followed. Targets discovered from labels get the same default host.
+
+// containerTargets sets the host of the targets whose AUTOPG_<TARGET>_CONTAINER is c.
+func containerTargets(ctx context.Context, cli *client.Client, c types.Container) {
+	for _, target := range containerTargetNames(c) {
+		key := toEnvKey(target, "HOST")
+		discovered.Lock()
+		if _, set := os.LookupEnv(key); set && !discovered.keys[key] {
+			discovered.Unlock()
+			continue
+		}
+		host, err := containerAddress(ctx, cli, c)
+		if err != nil {
+			logf(ctx, "target %s: %v", target, err)
+		} else if os.Getenv(key) != host {
+			os.Setenv(key, host)
+			discovered.keys[key] = true
+			logf(ctx, "target %s reached at %s (container %s)", target, host, displayName(c))
+		}
+		discovered.Unlock()
+	}
+}
+
+// containerTargetNames returns the targets whose AUTOPG_<TARGET>_CONTAINER is c, in their env form.
+func containerTargetNames(c types.Container) []string {
+	var targets []string
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		target, ok := strings.CutSuffix(strings.TrimPrefix(k, "AUTOPG_"), "_CONTAINER")
+		if ok && strings.HasPrefix(k, "AUTOPG_") && target != "" && matchesContainer([]string{v}, c) {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// containerAddress returns the address autopg reaches container c at.
+func containerAddress(ctx context.Context, cli *client.Client, c types.Container) (string, error) {
+	if c.NetworkSettings == nil || len(c.NetworkSettings.Networks) == 0 {
+		return "", fmt.Errorf("container %s is on no network", displayName(c))
+	}
+	names := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	self, err := selfNetworks(ctx, cli)
+	if err != nil {
+		return "", err
+	}
+	if _, hostMode := self["host"]; self == nil || hostMode {
+		// the host reaches container addresses
+		for _, name := range names {
+			if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+				return ip, nil
+			}
+		}
+		return "", fmt.Errorf("container %s has no IP address", displayName(c))
+	}
+	for _, name := range names {
+		if _, shared := self[name]; !shared {
+			continue
+		}
+		if name == "bridge" {
+			if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+				return ip, nil
+			}
+			continue
+		}
+		return strings.TrimPrefix(firstName(c.Names), "/"), nil
+	}
+	return "", fmt.Errorf("container %s shares no network with autopg (it is on %s)", displayName(c), strings.Join(names, ", "))
+}
+
+// selfNetworks returns the networks of autopg's own container, nil when autopg doesn't run in one. The
+// container is found by its hostname, which Docker sets to the container ID unless told otherwise.
+func selfNetworks(ctx context.Context, cli *client.Client) (map[string]*network.EndpointSettings, error) {
+	if _, err := os.Stat("/.dockerenv"); err != nil {
+		return nil, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	self, err := cli.ContainerInspect(ctx, hostname)
+	if err != nil {
+		return nil, fmt.Errorf("find autopg's container by its hostname %s: %w", hostname, err)
+	}
+	if self.NetworkSettings == nil {
+		return nil, errors.New("autopg's container has no network settings")
+	}
+	return self.NetworkSettings.Networks, nil
+}
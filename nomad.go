@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nomad: `autopg nomad` provisions Nomad allocations instead of Docker containers, from autopg.<target>.*
+// keys in the meta of their job, task group and tasks (the inner ones taking precedence), which play the
+// part of the container labels. It follows the Allocation topic of the event stream and needs no access
+// to the clients. The job ID stands in for the compose project and the task group for the service.
+//   - NOMAD_ADDR, NOMAD_TOKEN, NOMAD_CACERT, NOMAD_CLIENT_CERT and NOMAD_CLIENT_KEY are read as by the
+//     nomad CLI; the token needs read-job (and variables write for autopg.<target>.variable);
+//   - NOMAD_NAMESPACE is the namespace followed (default: all, "*");
+//   - autopg.<target>.variable is a Nomad variable path in the job's namespace the credentials are
+//     written to, e.g. nomad/jobs/web/api, for templates to read with nomadVar.
+// Allocations are provisioned when they are placed; failed ones are retried when listed again every 5
+// minutes, and all of them when autopg restarts, which is idempotent.
+
+// nomadAlloc is the part of a Nomad allocation autopg reads.
+type nomadAlloc struct {
+	ID            string
+	Name          string
+	Namespace     string
+	JobID         string
+	TaskGroup     string
+	ClientStatus  string
+	DesiredStatus string
+	Job           *struct {
+		Meta       map[string]string
+		TaskGroups []struct {
+			Name  string
+			Meta  map[string]string
+			Tasks []struct {
+				Meta map[string]string
+			}
+		}
+	}
+}
+
+// live reports whether a is placed to run and not finished.
+func (a nomadAlloc) live() bool {
+	return a.DesiredStatus == "run" && (a.ClientStatus == "pending" || a.ClientStatus == "running")
+}
+
+// resource returns a as a resource, with the autopg keys of its merged meta as labels.
+func (a nomadAlloc) resource() resource {
+	labels := map[string]string{}
+	merge := func(meta map[string]string) {
+		for k, v := range meta {
+			if strings.HasPrefix(k, labelPrefix) {
+				labels[k] = v
+			}
+		}
+	}
+	if a.Job != nil {
+		merge(a.Job.Meta)
+		for _, g := range a.Job.TaskGroups {
+			if g.Name != a.TaskGroup {
+				continue
+			}
+			merge(g.Meta)
+			for _, t := range g.Tasks {
+				merge(t.Meta)
+			}
+		}
+	}
+	return resource{
+		kind: "allocation", ref: a.Namespace + "/" + a.Name,
+		id: a.ID, name: a.Name,
+		project: a.JobID, service: a.TaskGroup,
+		labels: labels,
+	}
+}
+
+// nomadClient talks to the Nomad HTTP API.
+type nomadClient struct {
+	addr, token, namespace string
+	http                   *http.Client
+
+	mu   sync.Mutex
+	done map[string]bool // allocations provisioned on all their targets
+}
+
+func newNomadClient() (*nomadClient, error) {
+	n := &nomadClient{
+		addr:      strings.TrimSuffix(os.Getenv("NOMAD_ADDR"), "/"),
+		token:     os.Getenv("NOMAD_TOKEN"),
+		namespace: os.Getenv("NOMAD_NAMESPACE"),
+		http:      &http.Client{},
+		done:      map[string]bool{},
+	}
+	if n.addr == "" {
+		n.addr = "http://127.0.0.1:4646"
+	}
+	if n.namespace == "" {
+		n.namespace = "*"
+	}
+	registerSecret("nomad token", n.token)
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca := os.Getenv("NOMAD_CACERT"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("NOMAD_CACERT: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("NOMAD_CACERT %s has no certificates", ca)
+		}
+	}
+	if cert := os.Getenv("NOMAD_CLIENT_CERT"); cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, os.Getenv("NOMAD_CLIENT_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("NOMAD_CLIENT_CERT: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	n.http.Transport = &http.Transport{TLSClientConfig: config}
+	return n, nil
+}
+
+// errNomadNotFound is the error of a request for something that does not exist.
+var errNomadNotFound = errors.New("not found")
+
+// request sends a request to the Nomad API and returns the response when it succeeded.
+func (n *nomadClient) request(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	u := n.addr + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if n.token != "" {
+		req.Header.Set("X-Nomad-Token", n.token)
+	}
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("nomad %s: %w", path, errNomadNotFound)
+		}
+		return nil, fmt.Errorf("nomad %s: %s: %s", path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+func (n *nomadClient) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	resp, err := n.request(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// runNomad implements `autopg nomad`: runs the nomad provider alone.
+func runNomad(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: autopg nomad")
+	}
+	n, err := newNomadClient()
+	if err != nil {
+		return err
+	}
+	return n.run(context.Background())
+}
+
+func newNomadProvider() (provider, error) {
+	n, err := newNomadClient()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// run provisions the live allocations, then follows the event stream.
+func (n *nomadClient) run(ctx context.Context) error {
+	log.Printf("nomad: following allocations in namespace %s via %s", n.namespace, n.addr)
+	for {
+		index, err := n.reconcileAll(ctx)
+		if err == nil {
+			err = n.follow(ctx, index, 5*time.Minute)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Printf("nomad: %v; listing again in 10s", err)
+			time.Sleep(10 * time.Second)
+		}
+	}
+}
+
+// reconcileAll provisions every live allocation and returns the index to follow the events from.
+func (n *nomadClient) reconcileAll(ctx context.Context) (uint64, error) {
+	resp, err := n.request(ctx, http.MethodGet, "/v1/allocations", url.Values{"namespace": {n.namespace}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var allocs []nomadAlloc
+	if err := json.NewDecoder(resp.Body).Decode(&allocs); err != nil {
+		return 0, fmt.Errorf("list allocations: %w", err)
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+	for _, a := range allocs {
+		n.allocChanged(ctx, a)
+	}
+	return index, nil
+}
+
+// follow provisions the allocations the event stream reports from index on, for at most d.
+func (n *nomadClient) follow(ctx context.Context, index uint64, d time.Duration) error {
+	// only the stream is bounded by d, not the provisioning runs
+	streamCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	query := url.Values{"topic": {"Allocation"}, "namespace": {n.namespace}, "index": {strconv.FormatUint(index+1, 10)}}
+	resp, err := n.request(streamCtx, http.MethodGet, "/v1/event/stream", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		// heartbeats are empty objects
+		var batch struct {
+			Events []struct {
+				Topic   string
+				Payload struct {
+					Allocation *nomadAlloc
+				}
+			}
+		}
+		if err := dec.Decode(&batch); err != nil {
+			if streamCtx.Err() != nil {
+				return nil
+			}
+			if err == io.EOF {
+				return errors.New("event stream closed")
+			}
+			return fmt.Errorf("event stream: %w", err)
+		}
+		for _, ev := range batch.Events {
+			if ev.Topic == "Allocation" && ev.Payload.Allocation != nil {
+				n.allocChanged(ctx, *ev.Payload.Allocation)
+			}
+		}
+	}
+}
+
+// allocChanged provisions a if it is live and was not provisioned yet. The job is not in list results
+// and events, so the allocation is read in full first.
+func (n *nomadClient) allocChanged(ctx context.Context, a nomadAlloc) {
+	n.mu.Lock()
+	done := n.done[a.ID]
+	if !a.live() {
+		delete(n.done, a.ID)
+	}
+	n.mu.Unlock()
+	if done || !a.live() {
+		return
+	}
+	var full nomadAlloc
+	if err := n.do(ctx, http.MethodGet, "/v1/allocation/"+url.PathEscape(a.ID), url.Values{"namespace": {a.Namespace}}, nil, &full); err != nil {
+		log.Printf("nomad: allocation %s: %v", a.ID, err)
+		return
+	}
+	r := full.resource()
+	r.sink = func(target string) (credentialSink, error) {
+		path := r.labels[labelPrefix+target+".variable"]
+		if path == "" {
+			return nil, nil
+		}
+		if strings.Contains("/"+path+"/", "/../") {
+			return nil, fmt.Errorf("invalid variable %q for target %s", path, target)
+		}
+		return &nomadVariableSink{n: n, namespace: full.Namespace, path: path}, nil
+	}
+	r.retry = func(ctx context.Context) {
+		var cur nomadAlloc
+		if err := n.do(ctx, http.MethodGet, "/v1/allocation/"+url.PathEscape(a.ID), url.Values{"namespace": {a.Namespace}}, nil, &cur); err != nil {
+			logf(ctx, "scheduled run for allocation %s dropped: %v", a.ID, err)
+			return
+		}
+		n.allocChanged(ctx, cur)
+	}
+	results, err := reconcileResource(withRequestID(ctx, newRequestID()), r)
+	if err != nil {
+		return
+	}
+	for _, res := range results {
+		if res.err != nil {
+			return
+		}
+	}
+	n.markDone(a.ID)
+}
+
+func (n *nomadClient) markDone(id string) {
+	n.mu.Lock()
+	n.done[id] = true
+	n.mu.Unlock()
+}
+
+// nomadVariableSink writes credentials to a Nomad variable, which it replaces as a whole.
+type nomadVariableSink struct {
+	n               *nomadClient
+	namespace, path string
+}
+
+func (s *nomadVariableSink) stored(ctx context.Context) (string, string, error) {
+	var v struct {
+		Items map[string]string
+	}
+	err := s.n.do(ctx, http.MethodGet, "/v1/var/"+s.path, url.Values{"namespace": {s.namespace}}, nil, &v)
+	if errors.Is(err, errNomadNotFound) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("variable %s: %w", s.path, err)
+	}
+	if v.Items["engine"] != "postgres" {
+		return "", "", fmt.Errorf("variable %s exists and is not autopg's", s.path)
+	}
+	return v.Items["username"], v.Items["password"], nil
+}
+
+func (s *nomadVariableSink) write(ctx context.Context, c exportedCredential) error {
+	items := c.secretValue()
+	items["uri"] = c.uri()
+	body := map[string]any{"Namespace": s.namespace, "Path": s.path, "Items": items}
+	if err := s.n.do(ctx, http.MethodPut, "/v1/var/"+s.path, url.Values{"namespace": {s.namespace}}, body, nil); err != nil {
+		return fmt.Errorf("variable %s: %w", s.path, err)
+	}
+	return nil
+}
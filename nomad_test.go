@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNomad starts a Nomad API answering with handler and returns a client of it and the requests it
+// received, as "METHOD path?query body".
+func fakeNomad(t *testing.T, handler func(r *http.Request) (int, string)) (*nomadClient, *[]string) {
+	t.Helper()
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.RequestURI()+" "+string(b)))
+		if r.Header.Get("X-Nomad-Token") != "secret-id" {
+			t.Errorf("%s without the token", r.URL)
+		}
+		code, body := handler(r)
+		w.WriteHeader(code)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return &nomadClient{addr: srv.URL, token: "secret-id", namespace: "*", http: srv.Client(), done: map[string]bool{}}, &requests
+}
+
+func TestNomadAllocResource(t *testing.T) {
+	var a nomadAlloc
+	err := json.Unmarshal([]byte(`{"ID":"a1","Name":"web.api[0]","Namespace":"prod","JobID":"web","TaskGroup":"api","Job":{
+		"Meta":{"autopg.main.db":"job","autopg.main.user":"job","owner":"team"},
+		"TaskGroups":[
+			{"Name":"api","Meta":{"autopg.main.db":"group"},"Tasks":[{"Meta":{"autopg.main.user":"task"}}]},
+			{"Name":"worker","Meta":{"autopg.main.db":"worker"}}]}}`), &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := a.resource()
+	want := map[string]string{"autopg.main.db": "group", "autopg.main.user": "task"}
+	if len(r.labels) != len(want) || r.labels["autopg.main.db"] != "group" || r.labels["autopg.main.user"] != "task" {
+		t.Errorf("labels %v, want %v", r.labels, want)
+	}
+	if r.ref != "prod/web.api[0]" || r.project != "web" || r.service != "api" || r.id != "a1" {
+		t.Errorf("resource %+v", r)
+	}
+}
+
+func TestNomadAllocLive(t *testing.T) {
+	tests := []struct {
+		desired, client string
+		live            bool
+	}{
+		{"run", "pending", true},
+		{"run", "running", true},
+		{"run", "complete", false},
+		{"run", "failed", false},
+		{"stop", "running", false},
+		{"evict", "pending", false},
+	}
+	for _, tt := range tests {
+		if got := (nomadAlloc{DesiredStatus: tt.desired, ClientStatus: tt.client}).live(); got != tt.live {
+			t.Errorf("live(%s, %s) = %v, want %v", tt.desired, tt.client, got, tt.live)
+		}
+	}
+}
+
+func TestNomadRequest(t *testing.T) {
+	n, _ := fakeNomad(t, func(r *http.Request) (int, string) {
+		switch r.URL.Path {
+		case "/v1/var/missing":
+			return http.StatusNotFound, "variable not found"
+		case "/v1/var/denied":
+			return http.StatusForbidden, "Permission denied\n"
+		}
+		return http.StatusOK, `{}`
+	})
+	if err := n.do(t.Context(), http.MethodGet, "/v1/var/missing", nil, nil, nil); !errors.Is(err, errNomadNotFound) {
+		t.Errorf("404: %v", err)
+	}
+	err := n.do(t.Context(), http.MethodGet, "/v1/var/denied", nil, nil, nil)
+	if err == nil || errors.Is(err, errNomadNotFound) || !strings.HasSuffix(err.Error(), "403 Forbidden: Permission denied") {
+		t.Errorf("403: %v", err)
+	}
+}
+
+func TestNomadFollow(t *testing.T) {
+	n, requests := fakeNomad(t, func(r *http.Request) (int, string) {
+		return http.StatusOK, `{}
+{"Index":43,"Events":[{"Topic":"Allocation","Payload":{"Allocation":{"ID":"a1","DesiredStatus":"run","ClientStatus":"running"}}}]}
+{}
+{"Index":44,"Events":[{"Topic":"Allocation","Payload":{"Allocation":{"ID":"a2","DesiredStatus":"stop","ClientStatus":"complete"}}}]}
+`
+	})
+	// both were provisioned: a1 is left alone and a2, now stopped, is forgotten
+	n.markDone("a1")
+	n.markDone("a2")
+	err := n.follow(t.Context(), 42, time.Minute)
+	if err == nil || err.Error() != "event stream closed" {
+		t.Errorf("follow = %v, want the stream closed", err)
+	}
+	if len(*requests) != 1 || (*requests)[0] != "GET /v1/event/stream?index=43&namespace=%2A&topic=Allocation" {
+		t.Errorf("requests %q, want only the event stream from index 43", *requests)
+	}
+	if !n.done["a1"] || n.done["a2"] {
+		t.Errorf("done %v, want a1 only", n.done)
+	}
+}
+
+func TestNomadVariableSink(t *testing.T) {
+	vars := map[string]string{
+		"nomad/jobs/web/api": `{"Path":"nomad/jobs/web/api","Items":{"engine":"postgres","username":"app","password":"pw"}}`,
+		"nomad/jobs/other":   `{"Path":"nomad/jobs/other","Items":{"api_key":"k"}}`,
+	}
+	n, requests := fakeNomad(t, func(r *http.Request) (int, string) {
+		if r.Method == http.MethodPut {
+			return http.StatusOK, `{}`
+		}
+		if v, ok := vars[strings.TrimPrefix(r.URL.Path, "/v1/var/")]; ok {
+			return http.StatusOK, v
+		}
+		return http.StatusNotFound, "variable not found"
+	})
+	tests := []struct {
+		path, user, pass string
+		err              bool
+	}{
+		{"nomad/jobs/web/api", "app", "pw", false},
+		{"nomad/jobs/web/new", "", "", false},
+		{"nomad/jobs/other", "", "", true}, // not autopg's, so not replaced
+	}
+	for _, tt := range tests {
+		s := &nomadVariableSink{n: n, namespace: "prod", path: tt.path}
+		user, pass, err := s.stored(t.Context())
+		if user != tt.user || pass != tt.pass || (err != nil) != tt.err {
+			t.Errorf("stored(%s) = %q, %q, %v", tt.path, user, pass, err)
+		}
+	}
+
+	*requests = nil
+	s := &nomadVariableSink{n: n, namespace: "prod", path: "nomad/jobs/web/api"}
+	if err := s.write(t.Context(), exportedCredential{Host: "db", Port: "5432", DB: "shop", User: "app", Pass: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	method, body, _ := strings.Cut((*requests)[0], " {")
+	var v struct {
+		Namespace, Path string
+		Items           map[string]string
+	}
+	if err := json.Unmarshal([]byte("{"+body), &v); err != nil {
+		t.Fatal(err)
+	}
+	if method != "PUT /v1/var/nomad/jobs/web/api?namespace=prod" || v.Namespace != "prod" || v.Path != "nomad/jobs/web/api" ||
+		v.Items["engine"] != "postgres" || v.Items["password"] != "new" || v.Items["uri"] != "postgres://app:new@db:5432/shop" {
+		t.Errorf("write %s %+v", method, v)
+	}
+}
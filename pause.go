@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Provisioning is paused while the pause file exists in the data dir. Events are still consumed and
+// logged; containers skipped while paused are picked up by a rescan on resume.
+
+func pausePath() string {
+	return filepath.Join(dataDir(), "paused")
+}
+
+func provisioningPaused() bool {
+	_, err := os.Stat(pausePath())
+	return err == nil
+}
+
+func setPaused(paused bool) error {
+	if !paused {
+		if err := os.Remove(pausePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(pausePath(), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o600)
+}
+
+// watchPause rescans all containers when provisioning is resumed.
+func watchPause(hosts []dockerHost, ctx context.Context) {
+	paused := provisioningPaused()
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			now := provisioningPaused()
+			if now == paused {
+				continue
+			}
+			paused = now
+			if paused {
+				log.Printf("provisioning paused")
+				continue
+			}
+			log.Printf("provisioning resumed; rescanning containers")
+			listAndProcessAll(hosts, ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runPause implements `autopg pause` and `autopg resume`.
+func runPause(paused bool) error {
+	if err := setPaused(paused); err != nil {
+		return err
+	}
+	if paused {
+		fmt.Println("provisioning paused; run `autopg resume` to continue")
+	} else {
+		fmt.Println("provisioning resumed")
+	}
+	return nil
+}
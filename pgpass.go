@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// libpq connection files, so targets can reuse what DBAs already distribute:
+//   - AUTOPG_<TARGET>_SERVICE names a section of the connection service file, whose host, port, user,
+//     password and TLS parameters apply where the AUTOPG_<TARGET>_* variables are not set;
+//   - the password file supplies the admin password when none is configured otherwise.
+//
+// Both are looked up like libpq does: PGSERVICEFILE (default ~/.pg_service.conf), then
+// $PGSYSCONFDIR/pg_service.conf, and PGPASSFILE (default ~/.pgpass).
+
+// serviceParams returns the parameters of target's connection service, or nil when it has none.
+func serviceParams(target string) (map[string]string, error) {
+	name := targetSetting(target, "SERVICE")
+	if name == "" {
+		return nil, nil
+	}
+	var files []string
+	if f := os.Getenv("PGSERVICEFILE"); f != "" {
+		files = append(files, f)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".pg_service.conf"))
+	}
+	if d := os.Getenv("PGSYSCONFDIR"); d != "" {
+		files = append(files, filepath.Join(d, "pg_service.conf"))
+	}
+	for _, f := range files {
+		params, err := readService(f, name)
+		if err != nil || params != nil {
+			return params, err
+		}
+	}
+	return nil, fmt.Errorf("service %q of target %s not found in %s", name, target, strings.Join(files, ", "))
+}
+
+// readService reads the section name of the service file path; a missing file has no sections.
+func readService(path, name string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var params map[string]string
+	in := false
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if in {
+				break
+			}
+			in = line[1:len(line)-1] == name
+			if in {
+				params = map[string]string{}
+			}
+			continue
+		}
+		if !in {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: syntax error in service file", path, n)
+		}
+		params[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return params, sc.Err()
+}
+
+// serviceSetting returns the service parameter of target for field (e.g. SSLMODE -> sslmode), or "".
+// Errors were already reported by getAdminCredsForTarget.
+func serviceSetting(target, field string) string {
+	params, _ := serviceParams(target)
+	return params[strings.ToLower(field)]
+}
+
+// pgpassLookup returns the password of user on host:port from the password file, or "". The database
+// field is not matched: the admin connects to many databases, and a role has one password anyway.
+// Unlike libpq, a file readable by others is accepted, as Docker mounts secrets 0444.
+func pgpassLookup(host, port, user string) (string, error) {
+	path := os.Getenv("PGPASSFILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		path = filepath.Join(home, ".pgpass")
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if isUnixSocket(host) {
+		host = "localhost" // as libpq matches socket connections
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitPgpass(line)
+		if len(fields) != 5 {
+			continue
+		}
+		match := func(pattern, v string) bool { return pattern == "*" || pattern == v }
+		if match(fields[0], host) && match(fields[1], port) && match(fields[3], user) {
+			return fields[4], nil
+		}
+	}
+	return "", sc.Err()
+}
+
+// splitPgpass splits a password file line at unescaped colons and removes the backslash escapes.
+func splitPgpass(line string) []string {
+	var fields []string
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line):
+			i++
+			b.WriteByte(line[i])
+		case c == ':' && len(fields) < 4:
+			fields = append(fields, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(fields, b.String())
+}
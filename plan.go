@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/lib/pq"
+)
+
+// A plan lists what provisioning would do for each container, without changing anything. With
+// --against-live the target catalogs are read and only the actual delta is shown. Steps are prefixed
+// with "+" (create), "~" (change) or "!" (left as is, needs attention).
+
+// runPlan implements `autopg plan [--against-live] [container...]`.
+func runPlan(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	live := fs.Bool("against-live", false, "query the target catalogs and show only the actual delta")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	hosts, err := dockerHosts()
+	if err != nil {
+		return fmt.Errorf("docker client: %w", err)
+	}
+	for _, h := range hosts {
+		if err := planHost(ctx, h, fs.Args(), *live); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planHost prints the plan of the containers of h named in names, or all of them. With several Docker
+// hosts, containers are prefixed with the host's name.
+func planHost(ctx context.Context, h dockerHost, names []string, live bool) error {
+	prefix := ""
+	if h.name != "" {
+		prefix = h.name + ": "
+	}
+	containers, err := h.cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("container list: %w", err)
+	}
+	discoverTargets(ctx, h.cli, containers)
+	for _, c := range containers {
+		if len(names) > 0 && !matchesContainer(names, c) {
+			continue
+		}
+		c = withEnvSpec(ctx, h.cli, c)
+		raw := c.Labels
+		declared, err := expandConfigLabels(c.Labels)
+		labels := declared
+		if err == nil {
+			labels, err = resolveLabelValues(ctx, h.cli, c.ID, declared)
+		}
+		if err != nil {
+			fmt.Printf("%s%s: %s\n", prefix, displayName(c), redact(err.Error()))
+			continue
+		}
+		c.Labels = labels
+		r := containerResource(h.cli, c, raw, declared)
+		targets := make([]string, 0)
+		for t := range labelTargets(c.Labels) {
+			targets = append(targets, t)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			fmt.Printf("%s%s -> %s\n", prefix, displayName(c), target)
+			steps, err := planTarget(ctx, r, target, live)
+			if err != nil {
+				fmt.Printf("  ! %s\n", redact(err.Error()))
+				continue
+			}
+			if len(steps) == 0 {
+				fmt.Println("  = up to date")
+			}
+			for _, s := range steps {
+				fmt.Println("  " + s)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesContainer reports whether c is one of the containers named on the command line, by display
+// name, container name or ID prefix.
+func matchesContainer(names []string, c types.Container) bool {
+	for _, n := range names {
+		if n == displayName(c) || n == strings.TrimPrefix(firstName(c.Names), "/") || strings.HasPrefix(c.ID, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// planTarget plans the container r on target.
+func planTarget(ctx context.Context, r resource, target string, live bool) ([]string, error) {
+	ctx = withTarget(ctx, target)
+	host, port, admin, adminPass, ok := getAdminCredsForTarget(target)
+	if !ok {
+		return nil, fmt.Errorf("no admin creds for target %s", target)
+	}
+	if err := verifyLabelSignature(target, r.raw, labelVars(r)); err != nil {
+		return []string{"= skipped (" + err.Error() + ")"}, nil
+	}
+	if enabled, err := r.enabled(target); err == nil && !enabled {
+		return []string{"= skipped (enabled=false)"}, nil
+	}
+	if isProvisioned(ctx, r.id, target, r.labels) && !reapplyAlways(target) && r.labels[labelPrefix+target+".expires"] == "" &&
+		r.labels[labelPrefix+target+".deliver"] == "" {
+		return []string{"= skipped (already provisioned)"}, nil
+	}
+	spec, err := specFromLabels(r.labels, target, labelVars(r))
+	if err != nil {
+		return nil, fmt.Errorf("invalid labels: %w", err)
+	}
+	if live && spec.DerivedNames {
+		if err := resolveNameCollision(ctx, target, host, port, admin, adminPass, &spec); err != nil {
+			return nil, err
+		}
+	}
+	if reason, err := evaluatePolicy(ctx, target, r, &spec); err != nil {
+		return nil, fmt.Errorf("policy evaluation failed: %w", err)
+	} else if reason != "" {
+		return []string{"= skipped (" + reason + ")"}, nil
+	}
+	if reason := policyRefusal(target, admin, r, spec); reason != "" {
+		return []string{"= skipped (" + reason + ")"}, nil
+	}
+	if reason := passOwnerRefusal(spec, r.owner()); reason != "" {
+		return []string{"= skipped (" + reason + ")"}, nil
+	}
+	if !live {
+		return plannedSteps(target, spec), nil
+	}
+	return liveDelta(ctx, target, host, port, admin, adminPass, spec, r.owner())
+}
+
+// plannedSteps lists every step provisioning spec runs, whatever the target already has.
+func plannedSteps(target string, spec provisionSpec) []string {
+	steps := []string{"+ role " + spec.User + " (if missing)"}
+	if spec.NewPass {
+		steps = append(steps, "~ generated password set on role "+spec.User)
+	}
+	db := "+ database " + spec.DB + " owned by " + spec.User + " (if missing)"
+	if spec.Template != "" {
+		db += " from template " + spec.Template
+	}
+	steps = append(steps, db)
+	if reapplyAlways(target) {
+		steps = append(steps, "~ role login, password and database owner re-asserted where autopg created them (REAPPLY=always)")
+	}
+	switch {
+	case len(spec.GrantSchemas) == 0 && grantMode(target) == "all":
+		steps = append(steps, "+ grant all privileges on database "+spec.DB)
+	case len(spec.GrantSchemas) == 0:
+		steps = append(steps, "+ grant connect on database "+spec.DB, "+ grant usage on schema public")
+	default:
+		steps = append(steps, "+ grant connect, temporary on database "+spec.DB)
+		for _, s := range spec.GrantSchemas {
+			steps = append(steps, "+ grant usage, create on schema "+s)
+		}
+	}
+	for _, rs := range spec.RoleSettings {
+		steps = append(steps, "~ role setting "+rs.Name+"="+rs.Value)
+	}
+	if len(spec.SearchPath) > 0 {
+		steps = append(steps, "~ role setting search_path="+strings.Join(spec.SearchPath, ", "))
+	}
+	for _, ext := range spec.Extensions {
+		steps = append(steps, "+ extension "+ext.Name+" (if missing)")
+	}
+	if len(spec.AutoGrants) > 0 {
+		steps = append(steps, fmt.Sprintf("~ auto_grant trigger for %d role(s)", len(spec.AutoGrants)))
+	}
+	for _, p := range spec.Presets {
+		steps = append(steps, "+ "+p+" preset grants")
+	}
+	for _, l := range spec.Links {
+		steps = append(steps, "+ foreign server "+l.Server+" to "+l.DB)
+	}
+	return append(steps, alwaysRunSteps(spec)...)
+}
+
+// alwaysRunSteps lists the steps that run on every provisioning, so they are part of any delta.
+func alwaysRunSteps(spec provisionSpec) []string {
+	var steps []string
+	if spec.VaultCreds {
+		steps = append(steps, "~ vault database role for "+spec.User+" written")
+	}
+	if spec.PostSQL != "" {
+		steps = append(steps, "~ post_sql runs as "+spec.User)
+	}
+	if len(spec.CronJobs) > 0 {
+		steps = append(steps, fmt.Sprintf("~ %d cron job(s) replaced", len(spec.CronJobs)))
+	}
+	if spec.Deliver != "" {
+		steps = append(steps, "~ connection info written to "+spec.Deliver+" in the container")
+	}
+	return steps
+}
+
+// liveDelta compares spec, asked for by requester (see resource.owner), with the target catalogs and lists only what provisioning
+// would change.
+func liveDelta(ctx context.Context, target, host, port, admin, adminPass string, spec provisionSpec, requester string) ([]string, error) {
+	db, err := openAdmin(ctx, host, port, admin, adminPass, "")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	reapply := reapplyAlways(target)
+	var steps []string
+
+	var canLogin, replication bool
+	err = db.QueryRow("SELECT rolcanlogin, rolreplication FROM pg_catalog.pg_roles WHERE rolname = $1;", spec.User).Scan(&canLogin, &replication)
+	roleExists := err == nil
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		steps = append(steps, "+ create role "+spec.User)
+	case err != nil:
+		return nil, fmt.Errorf("read role: %w", err)
+	case spec.VaultCreds:
+		// a NOLOGIN parent role; logins are issued by Vault
+	case spec.NewPass:
+		creator, ours, err := roleCreator(db, target, spec.User)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !ours:
+			steps = append(steps, "! role "+spec.User+" exists and was not created by autopg; provisioning will be refused")
+		case creator != requester:
+			steps = append(steps, "! role "+spec.User+" was created by autopg for "+creator+"; provisioning will be refused")
+		default:
+			steps = append(steps, "~ role "+spec.User+" exists but its password is unknown to autopg; a generated password will be set")
+		}
+	default:
+		// drift is only healed on roles autopg created
+		heal := reapply
+		if heal {
+			if heal, err = roleCreatedByAutopg(db, target, spec.User); err != nil {
+				return nil, err
+			}
+		}
+		if ok, err := passwordMatches(ctx, host, port, spec); err != nil {
+			return nil, err
+		} else if !ok && heal {
+			steps = append(steps, "~ password of role "+spec.User+" reset to the configured one (REAPPLY=always)")
+		} else if !ok {
+			steps = append(steps, "! password of role "+spec.User+" differs from the configured one and is left as is")
+		}
+		if !canLogin && heal {
+			steps = append(steps, "~ LOGIN restored on role "+spec.User+" (REAPPLY=always)")
+		} else if !canLogin {
+			steps = append(steps, "! role "+spec.User+" cannot log in and is left as is")
+		}
+	}
+	// attributes and settings are only changed on roles autopg created
+	ours := !roleExists
+	if roleExists {
+		if ours, err = roleCreatedByAutopg(db, target, spec.User); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case spec.Replication && !ours:
+		steps = append(steps, "! role "+spec.User+" was not created by autopg; REPLICATION will be refused")
+	case spec.Replication && !replication:
+		steps = append(steps, "~ grant REPLICATION to "+spec.User)
+	}
+
+	var owner string
+	err = db.QueryRow("SELECT pg_get_userbyid(datdba) FROM pg_catalog.pg_database WHERE datname = $1;", spec.DB).Scan(&owner)
+	dbExists := err == nil
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		create := "+ create database " + spec.DB + " owned by " + spec.User
+		if spec.Template != "" {
+			create += " from template " + spec.Template
+		}
+		steps = append(steps, create)
+	case err != nil:
+		return nil, fmt.Errorf("read database: %w", err)
+	case owner != spec.User && len(spec.GrantSchemas) == 0 && reapply && databaseCreatedFor(target, spec.DB, spec.User):
+		steps = append(steps, "~ owner of database "+spec.DB+" changed from "+owner+" to "+spec.User+" (REAPPLY=always)")
+	case owner != spec.User && len(spec.GrantSchemas) == 0:
+		steps = append(steps, "! database "+spec.DB+" is owned by "+owner+", not "+spec.User+"; left as is")
+	}
+
+	privs := []string{"CONNECT"}
+	switch {
+	case len(spec.GrantSchemas) > 0:
+		privs = []string{"CONNECT", "TEMPORARY"}
+	case grantMode(target) == "all":
+		privs = []string{"CONNECT", "CREATE", "TEMPORARY"}
+	}
+	for _, p := range privs {
+		has := false
+		if roleExists && dbExists {
+			if err := db.QueryRow("SELECT has_database_privilege($1, $2, $3);", spec.User, spec.DB, p).Scan(&has); err != nil {
+				return nil, fmt.Errorf("read database privileges: %w", err)
+			}
+		}
+		if !has {
+			steps = append(steps, "+ grant "+p+" on database "+spec.DB)
+		}
+	}
+
+	var current []string
+	if roleExists {
+		err := db.QueryRow(`SELECT coalesce(s.setconfig, '{}') FROM pg_catalog.pg_roles r
+			LEFT JOIN pg_catalog.pg_db_role_setting s ON s.setrole = r.oid AND s.setdatabase = 0
+			WHERE r.rolname = $1;`, spec.User).Scan(pq.Array(&current))
+		if err != nil {
+			return nil, fmt.Errorf("read role settings: %w", err)
+		}
+	}
+	wanted := make([]string, 0, len(spec.RoleSettings)+1)
+	for _, rs := range spec.RoleSettings {
+		wanted = append(wanted, rs.Name+"="+rs.Value)
+	}
+	if len(spec.SearchPath) > 0 {
+		wanted = append(wanted, "search_path="+strings.Join(spec.SearchPath, ", "))
+	}
+	for _, w := range wanted {
+		switch {
+		case contains(current, w):
+		case ours:
+			steps = append(steps, "~ role setting "+w)
+		default:
+			steps = append(steps, "! role setting "+w+" is not applied: role "+spec.User+" was not created by autopg")
+		}
+	}
+
+	if dbExists {
+		inDB, err := catalogDelta(ctx, host, port, admin, adminPass, spec)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, inDB...)
+	} else {
+		for _, s := range spec.GrantSchemas {
+			steps = append(steps, "+ create schema "+s+" and grant usage, create")
+		}
+		for _, ext := range spec.Extensions {
+			steps = append(steps, "+ create extension "+ext.Name)
+		}
+		for _, l := range spec.Links {
+			steps = append(steps, "+ create foreign server "+l.Server+" to "+l.DB)
+		}
+	}
+	return append(steps, alwaysRunSteps(spec)...), nil
+}
+
+// catalogDelta compares the objects provisioning creates inside the existing database of spec.
+func catalogDelta(ctx context.Context, host, port, admin, adminPass string, spec provisionSpec) ([]string, error) {
+	db, err := openAdmin(ctx, host, port, admin, adminPass, spec.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var steps []string
+	for _, s := range spec.GrantSchemas {
+		var usage, create bool
+		err := db.QueryRow(`SELECT has_schema_privilege($2, oid, 'USAGE'), has_schema_privilege($2, oid, 'CREATE')
+			FROM pg_catalog.pg_namespace WHERE nspname = $1;`, s, spec.User).Scan(&usage, &create)
+		if errors.Is(err, sql.ErrNoRows) {
+			steps = append(steps, "+ create schema "+s+" and grant usage, create")
+			continue
+		}
+		if err != nil && !strings.Contains(err.Error(), "does not exist") {
+			return nil, fmt.Errorf("read schema %s: %w", s, err)
+		}
+		if !usage || !create {
+			steps = append(steps, "+ grant usage, create on schema "+s)
+		}
+	}
+	for _, ext := range spec.Extensions {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT FROM pg_catalog.pg_extension WHERE extname = $1);", ext.Name).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("read extension %s: %w", ext.Name, err)
+		}
+		if !exists {
+			steps = append(steps, "+ create extension "+ext.Name)
+		}
+	}
+	for _, l := range spec.Links {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT FROM pg_catalog.pg_foreign_server WHERE srvname = $1);", l.Server).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("read foreign server %s: %w", l.Server, err)
+		}
+		if !exists {
+			steps = append(steps, "+ create foreign server "+l.Server+" to "+l.DB)
+		}
+	}
+	return steps, nil
+}
+
+// passwordMatches reports whether spec.User can log in with spec.Pass. Only a rejected password counts
+// as a mismatch; other connection errors (e.g. missing CONNECT) are inconclusive and count as a match.
+func passwordMatches(ctx context.Context, host, port string, spec provisionSpec) (bool, error) {
+	udb, err := openDB(ctx, host, port, spec.User, spec.Pass, "postgres")
+	if err == nil {
+		err = udb.PingContext(ctx)
+		udb.Close()
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "28P01" {
+		return false, nil
+	}
+	return true, nil
+}
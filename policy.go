@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Operator-side policy: what containers may ask for, configured on autopg rather than in labels.
+
+// targetSetting returns AUTOPG_<TARGET>_<field>, falling back to the global AUTOPG_<field>.
+func targetSetting(target, field string) string {
+	if v := os.Getenv(toEnvKey(target, field)); v != "" {
+		return v
+	}
+	return os.Getenv("AUTOPG_" + field)
+}
+
+// reapplyAlways reports whether target re-asserts grants, ownership and settings on every container
+// start (AUTOPG_<TARGET>_REAPPLY=always) instead of skipping containers already provisioned.
+func reapplyAlways(target string) bool {
+	return targetSetting(target, "REAPPLY") == "always"
+}
+
+// grantMode is how much a dedicated database's role is granted on target, per AUTOPG_<TARGET>_GRANTS or
+// AUTOPG_GRANTS: "minimal" (default), CONNECT on the database and USAGE on its public schema, or "all",
+// ALL PRIVILEGES on the database.
+func grantMode(target string) string {
+	if targetSetting(target, "GRANTS") == "all" {
+		return "all"
+	}
+	return "minimal"
+}
+
+// matchesAny reports whether r's project (e.g. compose project) or name (e.g. container name) matches one
+// of the comma-separated glob patterns, e.g. "cdc,debezium-*".
+func matchesAny(patterns string, r resource) bool {
+	candidates := []string{r.name}
+	if r.project != "" {
+		candidates = append(candidates, r.project)
+	}
+	for _, pattern := range splitList(patterns) {
+		for _, cand := range candidates {
+			if ok, _ := path.Match(pattern, cand); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replicationAllowed reports whether r may get a REPLICATION role on target, per
+// AUTOPG_<TARGET>_REPLICATION_ALLOW or AUTOPG_REPLICATION_ALLOW. Nothing is allowed by default.
+func replicationAllowed(target string, r resource) bool {
+	return matchesAny(targetSetting(target, "REPLICATION_ALLOW"), r)
+}
+
+// targetAllowed reports whether r may provision on target at all, per AUTOPG_<TARGET>_ALLOW_CONTAINERS or
+// AUTOPG_ALLOW_CONTAINERS (glob patterns as for matchesAny). Without either every container is allowed.
+func targetAllowed(target string, r resource) bool {
+	patterns := targetSetting(target, "ALLOW_CONTAINERS")
+	return patterns == "" || matchesAny(patterns, r)
+}
+
+// defaultReservedNames are the db and role names containers may not request unless
+// AUTOPG_<TARGET>_RESERVED_NAMES says otherwise.
+const defaultReservedNames = "postgres,admin,template0,template1,pg_*"
+
+// reservedName returns the reserved pattern name matches on target, or "". Reserved are the comma-separated
+// glob patterns of AUTOPG_<TARGET>_RESERVED_NAMES (or AUTOPG_RESERVED_NAMES, else defaultReservedNames),
+// matched case-insensitively, and always the target's admin role.
+func reservedName(target, admin, name string) string {
+	if strings.EqualFold(name, admin) {
+		return admin
+	}
+	patterns := targetSetting(target, "RESERVED_NAMES")
+	if patterns == "" {
+		patterns = defaultReservedNames
+	}
+	for _, pattern := range splitList(patterns) {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// templateAllowListed reports whether AUTOPG_<TARGET>_TEMPLATE_ALLOW (or AUTOPG_TEMPLATE_ALLOW), comma-separated
+// glob patterns matched case-insensitively, lists name: a database that may be cloned by the template label
+// though it is not marked datistemplate.
+func templateAllowListed(target, name string) bool {
+	for _, pattern := range splitList(targetSetting(target, "TEMPLATE_ALLOW")) {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// linkAllowed reports whether database from may link to database to on target: to's own link_allow
+// patterns (allow) or AUTOPG_<TARGET>_LINK_ALLOW (or AUTOPG_LINK_ALLOW), comma-separated from:to glob pairs
+// set by the operator, must match.
+func linkAllowed(target, from, to string, allow []string) bool {
+	for _, pattern := range allow {
+		if ok, _ := path.Match(pattern, from); ok {
+			return true
+		}
+	}
+	for _, pair := range splitList(targetSetting(target, "LINK_ALLOW")) {
+		fromPattern, toPattern, _ := strings.Cut(pair, ":")
+		okFrom, _ := path.Match(fromPattern, from)
+		okTo, _ := path.Match(toPattern, to)
+		if okFrom && okTo {
+			return true
+		}
+	}
+	return false
+}
+
+// policyRefusal returns why target refuses to provision spec for r, or "" when it is permitted.
+func policyRefusal(target, admin string, r resource, spec provisionSpec) string {
+	if !targetAllowed(target, r) {
+		return "container is not in the target's allowlist"
+	}
+	for _, n := range []struct{ kind, name string }{{"database", spec.DB}, {"role", spec.User}} {
+		if pattern := reservedName(target, admin, n.name); pattern != "" {
+			return fmt.Sprintf("%s name %s is reserved (%s)", n.kind, n.name, pattern)
+		}
+	}
+	if spec.Template != "" {
+		if pattern := reservedName(target, admin, spec.Template); pattern != "" {
+			return fmt.Sprintf("template database %s is reserved (%s)", spec.Template, pattern)
+		}
+	}
+	if refused := featurePolicyViolations(target, spec); len(refused) > 0 {
+		return "features not permitted (" + strings.Join(refused, ", ") + ")"
+	}
+	if spec.Replication && !replicationAllowed(target, r) {
+		return "REPLICATION role requested but container is not in the replication allowlist"
+	}
+	return ""
+}
+
+// featurePolicyViolations returns the features spec uses that target does not permit.
+// AUTOPG_<TARGET>_ALLOW_FEATURES, when set, lists the only features allowed; AUTOPG_<TARGET>_DENY_FEATURES
+// lists features refused on top of that. Both are comma-separated names as reported by features(), and
+// both fall back to the global AUTOPG_ALLOW_FEATURES / AUTOPG_DENY_FEATURES.
+func featurePolicyViolations(target string, spec provisionSpec) []string {
+	allow, deny := splitList(targetSetting(target, "ALLOW_FEATURES")), splitList(targetSetting(target, "DENY_FEATURES"))
+	var refused []string
+	for _, f := range spec.features() {
+		if (len(allow) > 0 && !contains(allow, f)) || contains(deny, f) {
+			refused = append(refused, f)
+		}
+	}
+	return refused
+}
+
+// commonPasswords are refused whenever a password policy is set.
+var commonPasswords = []string{"postgres", "password", "passw0rd", "secret", "changeme", "admin", "root",
+	"123456", "12345678", "qwerty", "letmein", "example", "test"}
+
+// passwordPolicyViolation returns why a label-supplied password for user breaks target's password
+// policy, or "" when it complies. The policy is AUTOPG_<TARGET>_PASSWORD_MIN_LENGTH (characters),
+// AUTOPG_<TARGET>_PASSWORD_MIN_CLASSES (of lowercase, uppercase, digits and symbols) and
+// AUTOPG_<TARGET>_PASSWORD_MIN_ENTROPY (bits, estimated from the length and the classes used), each
+// falling back to the global setting. With any of them set, well-known passwords and the user name
+// itself are refused too. Without any, every password is accepted.
+func passwordPolicyViolation(target, user, pass string) (string, error) {
+	limits := map[string]int{}
+	for _, field := range []string{"PASSWORD_MIN_LENGTH", "PASSWORD_MIN_CLASSES", "PASSWORD_MIN_ENTROPY"} {
+		v := targetSetting(target, field)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid %s %q", field, v)
+		}
+		limits[field] = n
+	}
+	if len(limits) == 0 {
+		return "", nil
+	}
+	if strings.EqualFold(pass, user) || contains(commonPasswords, strings.ToLower(pass)) {
+		return "password is the user name or a well-known password", nil
+	}
+	length := len([]rune(pass))
+	if min := limits["PASSWORD_MIN_LENGTH"]; length < min {
+		return fmt.Sprintf("password has %d characters, the policy requires %d", length, min), nil
+	}
+	var lower, upper, digit, symbol bool
+	for _, r := range pass {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes, charset := 0, 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}} {
+		if c.used {
+			classes++
+			charset += c.size
+		}
+	}
+	if min := limits["PASSWORD_MIN_CLASSES"]; classes < min {
+		return fmt.Sprintf("password uses %d character classes, the policy requires %d", classes, min), nil
+	}
+	if bits, min := float64(length)*math.Log2(float64(charset)), limits["PASSWORD_MIN_ENTROPY"]; bits < float64(min) {
+		return fmt.Sprintf("password has about %.0f bits of entropy, the policy requires %d", bits, min), nil
+	}
+	return "", nil
+}
+
+// isSCRAMVerifier reports whether pass is a pre-hashed SCRAM-SHA-256 verifier, which PostgreSQL stores
+// as given instead of hashing it.
+func isSCRAMVerifier(pass string) bool {
+	return strings.HasPrefix(pass, "SCRAM-SHA-256$")
+}
+
+// plaintextPassRefusal returns why the pass label of target is refused, or "" when it is accepted. With
+// AUTOPG_<TARGET>_FORBID_PLAINTEXT_PASS=true, the pass label as declared (after config expansion, before
+// env: and file: are resolved) must be absent (generated), env:, file:, age: or a SCRAM verifier.
+func plaintextPassRefusal(target string, declared map[string]string) string {
+	if targetSetting(target, "FORBID_PLAINTEXT_PASS") != "true" {
+		return ""
+	}
+	v := declared[labelPrefix+target+".pass"]
+	for _, prefix := range []string{"env:", "file:", "age:"} {
+		if strings.HasPrefix(v, prefix) {
+			return ""
+		}
+	}
+	if v == "" || isSCRAMVerifier(v) {
+		return ""
+	}
+	return fmt.Sprintf("plaintext %spass is forbidden; remove it to have a password generated, or point it at "+
+		"a secret with env:NAME or file:/path, encrypt it (age:) or give a SCRAM-SHA-256 verifier", labelPrefix+target+".")
+}
+
+// defaultRoleSettingsAllow are the settings role_settings may set when the target has no allowlist:
+// session settings any role may change for itself with SET.
+var defaultRoleSettingsAllow = []string{
+	"application_name", "client_min_messages", "datestyle", "default_transaction_isolation",
+	"default_transaction_read_only", "effective_cache_size", "extra_float_digits", "idle_in_transaction_session_timeout",
+	"idle_session_timeout", "intervalstyle", "jit", "lock_timeout", "maintenance_work_mem", "random_page_cost",
+	"statement_timeout", "synchronous_commit", "temp_buffers", "timezone", "work_mem",
+}
+
+// roleSettingAllowed reports whether role_settings may set name on target. ALTER ROLE ... SET runs as
+// the admin, so a setting only a superuser may change (session_preload_libraries, log_*, lc_messages,
+// ...) would otherwise be applied to the role. AUTOPG_<TARGET>_ROLE_SETTINGS_ALLOW (or the global
+// AUTOPG_ROLE_SETTINGS_ALLOW) replaces the default list, comma-separated.
+func roleSettingAllowed(target, name string) bool {
+	allow := defaultRoleSettingsAllow
+	if v := targetSetting(target, "ROLE_SETTINGS_ALLOW"); v != "" {
+		allow = splitList(strings.ToLower(v))
+	}
+	return contains(allow, name)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
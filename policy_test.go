@@ -0,0 +1,273 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoleSettingAllowed(t *testing.T) {
+	tests := []struct {
+		allow, name string
+		want        bool
+	}{
+		{"", "statement_timeout", true},
+		{"", "work_mem", true},
+		{"", "session_preload_libraries", false},
+		{"", "log_statement", false},
+		{"", "lc_messages", false},
+		{"Search_Path, statement_timeout", "search_path", true},
+		{"search_path", "work_mem", false}, // the setting replaces the defaults
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_ROLE_SETTINGS_ALLOW", tt.allow)
+		if got := roleSettingAllowed("main", tt.name); got != tt.want {
+			t.Errorf("roleSettingAllowed(%s) with %q = %v, want %v", tt.name, tt.allow, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateAllowListed(t *testing.T) {
+	t.Setenv("AUTOPG_TEMPLATE_ALLOW", "golden_*, Fixtures")
+	tests := map[string]bool{"golden_v2": true, "GOLDEN_v3": true, "fixtures": true, "shop": false, "golden": false}
+	for name, want := range tests {
+		if got := templateAllowListed("main", name); got != want {
+			t.Errorf("templateAllowListed(%s) = %v, want %v", name, got, want)
+		}
+	}
+	t.Setenv("AUTOPG_MAIN_TEMPLATE_ALLOW", "")
+	t.Setenv("AUTOPG_TEMPLATE_ALLOW", "")
+	if templateAllowListed("main", "golden_v2") {
+		t.Error("a template allowed without allowlist")
+	}
+}
+
+func TestLinkAllowed(t *testing.T) {
+	t.Setenv("AUTOPG_MAIN_LINK_ALLOW", "reporting:*,etl_*:warehouse")
+	tests := []struct {
+		from, to string
+		allow    []string
+		want     bool
+	}{
+		{"shop", "billing", nil, false},
+		{"shop", "billing", []string{"shop"}, true}, // billing's own link_allow
+		{"shop", "billing", []string{"blog", "sh*"}, true},
+		{"shop", "billing", []string{"blog"}, false},
+		{"reporting", "billing", nil, true}, // the operator's pairs
+		{"etl_daily", "warehouse", nil, true},
+		{"etl_daily", "billing", nil, false},
+		{"warehouse", "etl_daily", nil, false}, // pairs are one way
+	}
+	for _, tt := range tests {
+		if got := linkAllowed("main", tt.from, tt.to, tt.allow); got != tt.want {
+			t.Errorf("linkAllowed(%s -> %s, %v) = %v, want %v", tt.from, tt.to, tt.allow, got, tt.want)
+		}
+	}
+}
+
+func TestTargetSetting(t *testing.T) {
+	t.Setenv("AUTOPG_GRANTS", "all")
+	t.Setenv("AUTOPG_EU_WEST_GRANTS", "minimal")
+	t.Setenv("AUTOPG_MAIN_GRANTS", "")
+	tests := map[string]string{"eu-west": "minimal", "main": "all", "other": "all"}
+	for target, want := range tests {
+		if got := targetSetting(target, "GRANTS"); got != want {
+			t.Errorf("targetSetting(%s, GRANTS) = %q, want %q", target, got, want)
+		}
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	r := resource{name: "shop-cdc-1", project: "shop"}
+	tests := []struct {
+		patterns string
+		want     bool
+	}{
+		{"", false},
+		{"shop", true},    // the project
+		{"*-cdc-*", true}, // the name
+		{"blog, shop-cdc-?", true},
+		{"shop-*-2,debezium", false},
+		{"[", false}, // invalid patterns match nothing
+	}
+	for _, tt := range tests {
+		if got := matchesAny(tt.patterns, r); got != tt.want {
+			t.Errorf("matchesAny(%q) = %v, want %v", tt.patterns, got, tt.want)
+		}
+	}
+	if matchesAny("*", resource{name: ""}) != true {
+		t.Error("* does not match a resource without name")
+	}
+}
+
+func TestFeaturePolicyViolations(t *testing.T) {
+	spec := provisionSpec{Extensions: []extension{{Name: "postgis"}}, Analyze: true, Replication: true}
+	tests := []struct {
+		allow, deny string
+		want        []string
+	}{
+		{"", "", nil},
+		{"", "replication", []string{"replication"}},
+		{"extensions, analyze", "", []string{"replication"}},
+		{"extensions,analyze,replication", "analyze", []string{"analyze"}},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_ALLOW_FEATURES", tt.allow)
+		t.Setenv("AUTOPG_MAIN_DENY_FEATURES", tt.deny)
+		if got := featurePolicyViolations("main", spec); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("allow %q, deny %q: %v, want %v", tt.allow, tt.deny, got, tt.want)
+		}
+	}
+}
+
+func TestPasswordPolicyViolation(t *testing.T) {
+	tests := []struct {
+		length, classes, entropy string
+		user, pass               string
+		want                     string
+	}{
+		{"", "", "", "app", "app", ""}, // no policy
+		{"8", "", "", "app", "App", "password is the user name or a well-known password"},
+		{"8", "", "", "app", "Changeme", "password is the user name or a well-known password"},
+		{"12", "", "", "app", "short-pass", "password has 10 characters, the policy requires 12"},
+		{"8", "", "", "app", "pässwört", ""}, // characters, not bytes
+		{"", "3", "", "app", "lowercase-only", "password uses 2 character classes, the policy requires 3"},
+		{"", "4", "", "app", "Upper-lower-42", ""},
+		{"", "", "60", "app", "abcdefghij", "password has about 47 bits of entropy, the policy requires 60"},
+		{"", "", "60", "app", "abcdefghijklm", ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_PASSWORD_MIN_LENGTH", tt.length)
+		t.Setenv("AUTOPG_MAIN_PASSWORD_MIN_CLASSES", tt.classes)
+		t.Setenv("AUTOPG_MAIN_PASSWORD_MIN_ENTROPY", tt.entropy)
+		got, err := passwordPolicyViolation("main", tt.user, tt.pass)
+		if err != nil || got != tt.want {
+			t.Errorf("%q (length %s, classes %s, entropy %s) = %q, %v, want %q", tt.pass, tt.length, tt.classes, tt.entropy, got, err, tt.want)
+		}
+	}
+	t.Setenv("AUTOPG_MAIN_PASSWORD_MIN_LENGTH", "twelve")
+	if _, err := passwordPolicyViolation("main", "app", "pw"); err == nil {
+		t.Error("an invalid PASSWORD_MIN_LENGTH accepted")
+	}
+}
+
+func TestTargetAllowed(t *testing.T) {
+	r := resource{name: "web-1", project: "shop"}
+	if !targetAllowed("main", r) {
+		t.Error("a target without allowlist refused")
+	}
+	t.Setenv("AUTOPG_MAIN_ALLOW_CONTAINERS", "blog,billing-*")
+	if targetAllowed("main", r) {
+		t.Error("a container outside the allowlist allowed")
+	}
+	if !targetAllowed("main", resource{name: "billing-api", project: "billing"}) {
+		t.Error("a container of the allowlist refused")
+	}
+}
+
+func TestReservedName(t *testing.T) {
+	tests := []struct {
+		reserved, name, want string
+	}{
+		{"", "shop", ""},
+		{"", "postgres", "postgres"},
+		{"", "Template1", "template1"},
+		{"", "pg_monitor", "pg_*"},
+		{"", "PG_SIGNAL_BACKEND", "pg_*"},
+		{"", "dba", "dba"}, // the admin
+		{"", "DBA", "dba"},
+		{"shop_*", "shop_eu", "shop_*"},
+		{"shop_*", "postgres", ""}, // the setting replaces the defaults
+		{"shop_*", "dba", "dba"},   // but the admin stays reserved
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_RESERVED_NAMES", tt.reserved)
+		if got := reservedName("main", "dba", tt.name); got != tt.want {
+			t.Errorf("reservedName(%q) with %q = %q, want %q", tt.name, tt.reserved, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyRefusal(t *testing.T) {
+	t.Setenv("AUTOPG_MAIN_ALLOW_CONTAINERS", "shop,cdc")
+	t.Setenv("AUTOPG_MAIN_REPLICATION_ALLOW", "cdc")
+	t.Setenv("AUTOPG_MAIN_DENY_FEATURES", "post_sql,cron")
+	shop, cdc := resource{name: "shop"}, resource{name: "cdc"}
+	tests := []struct {
+		name string
+		r    resource
+		spec provisionSpec
+		want string
+	}{
+		{"permitted", shop, provisionSpec{DB: "shop", User: "shop"}, ""},
+		{"not allowlisted", resource{name: "blog"}, provisionSpec{DB: "blog", User: "blog"}, "container is not in the target's allowlist"},
+		{"reserved database", shop, provisionSpec{DB: "template1", User: "shop"}, "database name template1 is reserved (template1)"},
+		{"admin role", shop, provisionSpec{DB: "shop", User: "DBA"}, "role name DBA is reserved (dba)"},
+		{"reserved template", shop, provisionSpec{DB: "shop", User: "shop", Template: "postgres"}, "template database postgres is reserved (postgres)"},
+		{"denied features", shop, provisionSpec{DB: "shop", User: "shop", PostSQL: "SELECT 1", CronJobs: make([]cronJob, 1)}, "features not permitted (cron, post_sql)"},
+		{"replication", shop, provisionSpec{DB: "shop", User: "shop", Replication: true}, "REPLICATION role requested but container is not in the replication allowlist"},
+		{"replication allowed", cdc, provisionSpec{DB: "cdc", User: "cdc", Replication: true}, ""},
+	}
+	for _, tt := range tests {
+		if got := policyRefusal("main", "dba", tt.r, tt.spec); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlaintextPassRefusal(t *testing.T) {
+	tests := []struct {
+		pass    string
+		refused bool
+	}{
+		{"", false},
+		{"env:SHOP_DB_PASSWORD", false},
+		{"file:/run/secrets/shop", false},
+		{"age:YWdlLWVuY3J5cHRpb24ub3Jn", false},
+		{"SCRAM-SHA-256$4096:c2FsdA==$a2V5:c2VydmVy", false},
+		{"hunter2", true},
+		{"ENV:SHOP", true},
+	}
+	for _, tt := range tests {
+		declared := map[string]string{"autopg.main.pass": tt.pass}
+		t.Setenv("AUTOPG_MAIN_FORBID_PLAINTEXT_PASS", "true")
+		if got := plaintextPassRefusal("main", declared); (got != "") != tt.refused {
+			t.Errorf("plaintextPassRefusal(%q) = %q", tt.pass, got)
+		}
+		t.Setenv("AUTOPG_MAIN_FORBID_PLAINTEXT_PASS", "")
+		if got := plaintextPassRefusal("main", declared); got != "" {
+			t.Errorf("plaintextPassRefusal(%q) without the setting = %q", tt.pass, got)
+		}
+	}
+}
+
+// TestRefusalHistory checks that a refused provisioning is recorded under the check that refused it.
+func TestRefusalHistory(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_MAIN_HOST", "pg.invalid")
+	t.Setenv("AUTOPG_MAIN_ADMIN", "postgres")
+	t.Setenv("AUTOPG_MAIN_ADMIN_PASS", "admin")
+	t.Setenv("AUTOPG_MAIN_PASSWORD_MIN_LENGTH", "12")
+	tests := []struct {
+		forbid, pass, want string
+	}{
+		{"true", "Correct-Horse-42", "plaintext pass: label forbidden"},
+		{"", "short", "password policy: "},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTOPG_MAIN_FORBID_PLAINTEXT_PASS", tt.forbid)
+		start := time.Now()
+		r := resource{kind: "container", ref: "shop/web", id: "c1", project: "shop", service: "web", labels: map[string]string{
+			"autopg.main.db":   "shop",
+			"autopg.main.user": "shop",
+			"autopg.main.pass": tt.pass,
+		}}
+		if _, _, err := provision(t.Context(), r, "main"); err == nil {
+			t.Fatalf("provisioning with %q succeeded", tt.pass)
+		}
+		recs, err := readHistory(start)
+		if err != nil || len(recs) != 1 || !strings.HasPrefix(recs[0].Error, tt.want) {
+			t.Errorf("history after refusing %q: %+v, %v, want %q", tt.pass, recs, err, tt.want)
+		}
+	}
+}
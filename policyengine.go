@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// External policy engine. AUTOPG_<TARGET>_POLICY (or AUTOPG_POLICY) hands each provisioning request to a
+// policy that may deny or mutate it, after the labels are parsed and before the built-in policy
+// (allowlists, reserved names, feature policy) is applied to the result:
+//   - opa:<url> POSTs {"input": <request>} to an OPA data API URL, e.g.
+//     opa:http://opa:8181/v1/data/autopg/provision, and reads the decision from "result";
+//   - exec:<command> runs the command with the request on stdin and reads the decision from stdout.
+//
+// The request is the "policy-request" schema, the decision the "policy-decision" schema.
+//
+// Rego is not embedded (github.com/open-policy-agent/opa/rego): the OPA library roughly doubles the
+// binary and pins its own dependencies, while an OPA server (or sidecar) evaluates the same policy with
+// its bundles, decision logs and tooling. exec: covers policies written in anything else.
+
+// policyRequest is the document a policy evaluates. Passwords are never included.
+type policyRequest struct {
+	SchemaVersion int               `json:"schema_version"`
+	RequestID     string            `json:"request_id,omitempty"`
+	Target        string            `json:"target"`
+	Container     policyContainer   `json:"container"`
+	DB            string            `json:"db"`
+	User          string            `json:"user"`
+	Features      []string          `json:"features"`
+	Replication   bool              `json:"replication"`
+	Extensions    []string          `json:"extensions,omitempty"`
+	GrantSchemas  []string          `json:"grant_schemas,omitempty"`
+	SearchPath    []string          `json:"search_path,omitempty"`
+	RoleSettings  map[string]string `json:"role_settings,omitempty"`
+	Template      string            `json:"template,omitempty"`
+	Expires       string            `json:"expires,omitempty"`
+}
+
+type policyContainer struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	DisplayName    string            `json:"display_name"`
+	Image          string            `json:"image"`
+	ComposeProject string            `json:"compose_project,omitempty"`
+	ComposeService string            `json:"compose_service,omitempty"`
+	Labels         map[string]string `json:"labels"`
+}
+
+// policyDecision is what a policy answers. Fields of Mutate that are set replace the request's.
+type policyDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons"`
+	Mutate  struct {
+		Extensions   *[]string          `json:"extensions"`
+		GrantSchemas *[]string          `json:"grant_schemas"`
+		SearchPath   *[]string          `json:"search_path"`
+		RoleSettings *map[string]string `json:"role_settings"`
+		Replication  *bool              `json:"replication"`
+		Expires      *string            `json:"expires"`
+	} `json:"mutate"`
+}
+
+func newPolicyRequest(ctx context.Context, target string, r resource, spec provisionSpec) policyRequest {
+	labels := map[string]string{}
+	for k, v := range r.labels {
+		if !strings.HasSuffix(k, ".pass") {
+			labels[k] = redact(v)
+		}
+	}
+	req := policyRequest{
+		SchemaVersion: schemaVersion,
+		RequestID:     requestID(ctx),
+		Target:        target,
+		Container: policyContainer{
+			ID:             r.id,
+			Name:           r.name,
+			DisplayName:    r.displayName(),
+			Image:          r.image,
+			ComposeProject: r.project,
+			ComposeService: r.service,
+			Labels:         labels,
+		},
+		DB:           spec.DB,
+		User:         spec.User,
+		Features:     spec.features(),
+		Replication:  spec.Replication,
+		GrantSchemas: spec.GrantSchemas,
+		SearchPath:   spec.SearchPath,
+		Template:     spec.Template,
+	}
+	if req.Features == nil {
+		req.Features = []string{}
+	}
+	for _, e := range spec.Extensions {
+		name := e.Name
+		if e.Schema != "" {
+			name += "@" + e.Schema
+		}
+		req.Extensions = append(req.Extensions, name)
+	}
+	if len(spec.RoleSettings) > 0 {
+		req.RoleSettings = map[string]string{}
+		for _, rs := range spec.RoleSettings {
+			req.RoleSettings[rs.Name] = rs.Value
+		}
+	}
+	if spec.Expires != 0 {
+		req.Expires = spec.Expires.String()
+	}
+	return req
+}
+
+// evaluatePolicy asks target's policy about spec. It returns why the request is denied, or "" when it
+// is allowed, in which case spec carries the policy's mutations. An unreachable or broken policy denies,
+// unless AUTOPG_<TARGET>_POLICY_FAIL_OPEN=true.
+func evaluatePolicy(ctx context.Context, target string, r resource, spec *provisionSpec) (string, error) {
+	policy := targetSetting(target, "POLICY")
+	if policy == "" {
+		return "", nil
+	}
+	d, err := queryPolicy(ctx, policy, newPolicyRequest(ctx, target, r, *spec))
+	if err == nil {
+		err = applyPolicyMutations(spec, d)
+	}
+	if err != nil {
+		if targetSetting(target, "POLICY_FAIL_OPEN") == "true" {
+			logf(ctx, "warning: policy for target %s failed, allowing: %v", target, err)
+			return "", nil
+		}
+		return "", err
+	}
+	if !d.Allow {
+		reason := "denied by policy"
+		if len(d.Reasons) > 0 {
+			reason += ": " + strings.Join(d.Reasons, "; ")
+		}
+		return reason, nil
+	}
+	return "", nil
+}
+
+func queryPolicy(ctx context.Context, policy string, req policyRequest) (policyDecision, error) {
+	var d policyDecision
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	kind, arg, _ := strings.Cut(policy, ":")
+	switch kind {
+	case "opa":
+		body, err := json.Marshal(map[string]any{"input": req})
+		if err != nil {
+			return d, err
+		}
+		hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, arg, bytes.NewReader(body))
+		if err != nil {
+			return d, err
+		}
+		hreq.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(hreq)
+		if err != nil {
+			return d, fmt.Errorf("opa: %w", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return d, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return d, fmt.Errorf("opa: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+		}
+		var out struct {
+			Result *policyDecision `json:"result"`
+		}
+		if err := json.Unmarshal(b, &out); err != nil {
+			return d, fmt.Errorf("opa: invalid response: %w", err)
+		}
+		if out.Result == nil {
+			return d, fmt.Errorf("opa: no result at %s (undefined decision)", arg)
+		}
+		return *out.Result, nil
+	case "exec":
+		body, err := json.Marshal(req)
+		if err != nil {
+			return d, err
+		}
+		cmd := exec.CommandContext(ctx, "sh", "-c", arg)
+		cmd.Stdin = bytes.NewReader(body)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return d, fmt.Errorf("policy command: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		if err := json.Unmarshal(out, &d); err != nil {
+			return d, fmt.Errorf("policy command: invalid decision: %w", err)
+		}
+		return d, nil
+	default:
+		return d, fmt.Errorf("unknown policy %q; expected opa:<url> or exec:<command>", policy)
+	}
+}
+
+// applyPolicyMutations applies the mutations of an allowing decision to spec.
+func applyPolicyMutations(spec *provisionSpec, d policyDecision) error {
+	if !d.Allow {
+		return nil
+	}
+	m := d.Mutate
+	if m.Extensions != nil {
+		spec.Extensions = nil
+		for _, name := range *m.Extensions {
+			n, schema, _ := strings.Cut(name, "@")
+			spec.Extensions = append(spec.Extensions, extension{Name: n, Schema: schema})
+		}
+	}
+	if m.GrantSchemas != nil {
+		spec.GrantSchemas = *m.GrantSchemas
+	}
+	if m.SearchPath != nil {
+		spec.SearchPath = *m.SearchPath
+	}
+	if m.RoleSettings != nil {
+		spec.RoleSettings = nil
+		names := make([]string, 0, len(*m.RoleSettings))
+		for name := range *m.RoleSettings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !settingNameRe.MatchString(name) {
+				return fmt.Errorf("policy set invalid role setting %q", name)
+			}
+			spec.RoleSettings = append(spec.RoleSettings, roleSetting{Name: name, Value: (*m.RoleSettings)[name]})
+		}
+	}
+	if m.Replication != nil {
+		spec.Replication = *m.Replication
+	}
+	if m.Expires != nil {
+		spec.Expires = 0
+		if *m.Expires != "" {
+			d, err := time.ParseDuration(*m.Expires)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("policy set invalid expires %q", *m.Expires)
+			}
+			spec.Expires = d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// Post-provisioning actions in the app container: with autopg.<target>.post_exec=<command>, autopg runs
+// the command in the container (docker exec, through sh -c) once its database and role are ready, with
+// the connection info in the libpq PG* variables and DATABASE_URL, e.g. to run migrations.
+// autopg.<target>.post_exec_user runs it as another user of the container.
+//
+// The command runs once per compose or Swarm service (or container) and version of its autopg labels:
+// the label fingerprint of its last successful run is kept in the data directory (post_exec.json), so
+// replicas, restarts and rescans don't run it again; retriggered runs do. A failed run, or a container
+// that isn't running yet, is retried at the next provisioning. AUTOPG_<TARGET>_POST_EXEC_TIMEOUT bounds
+// a run (10m by default).
+//
+// autopg.<target>.post_signal=<signal> sends a signal (e.g. SIGHUP) to the container after its first
+// successful provisioning on the target, as found in the history, and post_signal=restart restarts it
+// instead, so an app that started before its database existed and kept the failed connection recovers.
+// Later runs, including the one that follows the restart, don't signal it again.
+
+var postExecs = struct {
+	sync.Mutex
+	m map[string]string // target/Docker host/service -> fingerprint of the labels of the last successful run
+}{}
+
+func postExecsPath() string {
+	return filepath.Join(dataDir(), "post_exec.json")
+}
+
+// postExecDone returns the label fingerprint of the last successful run for key, "" if none.
+func postExecDone(key string) string {
+	postExecs.Lock()
+	defer postExecs.Unlock()
+	if postExecs.m == nil {
+		postExecs.m = map[string]string{}
+		b, err := os.ReadFile(postExecsPath())
+		if err == nil {
+			err = json.Unmarshal(b, &postExecs.m)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logf(context.Background(), "warning: could not read %s: %v", postExecsPath(), err)
+		}
+	}
+	return postExecs.m[key]
+}
+
+// savePostExec records a successful run for key.
+func savePostExec(key, fingerprint string) error {
+	postExecDone(key) // loads the file
+	postExecs.Lock()
+	defer postExecs.Unlock()
+	postExecs.m[key] = fingerprint
+	b, err := json.Marshal(postExecs.m)
+	if err != nil {
+		return err
+	}
+	tmp := postExecsPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, postExecsPath())
+}
+
+func postExecTimeout(target string) time.Duration {
+	if d, err := time.ParseDuration(targetSetting(target, "POST_EXEC_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Minute
+}
+
+// runPostExec runs spec.PostExec in c, unless it already ran for c's service with the same labels.
+func runPostExec(ctx context.Context, cli *client.Client, c types.Container, target string, spec provisionSpec, exp exportedCredential, labels map[string]string) error {
+	key := target + "/" + dockerHostName(ctx) + "/" + exp.serviceName()
+	if exp.SwarmService != "" {
+		key = target + "/" + exp.SwarmService
+	}
+	fingerprint := serviceFingerprint(target, labels)
+	if !forced(ctx) && postExecDone(key) == fingerprint {
+		return nil
+	}
+	info, err := cli.ContainerInspect(ctx, c.ID)
+	if err != nil {
+		return fmt.Errorf("inspect failed: %w", err)
+	}
+	if info.State == nil || !info.State.Running || info.State.Paused {
+		return errors.New("the container is not running; retrying at its next provisioning")
+	}
+	env := []string{"PGHOST=" + exp.Host, "PGPORT=" + exp.Port, "PGDATABASE=" + exp.DB, "PGUSER=" + exp.User,
+		"PGPASSWORD=" + exp.Pass, "DATABASE_URL=" + exp.uri()}
+	xctx, cancel := context.WithTimeout(ctx, postExecTimeout(target))
+	defer cancel()
+	logf(ctx, "running post_exec in container %s", displayName(c))
+	code, _, stderr, err := containerExec(xctx, cli, c.ID, container.ExecOptions{
+		Cmd: []string{"sh", "-c", spec.PostExec}, Env: env, User: spec.PostExecUser,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		out := strings.TrimSpace(string(stderr))
+		if len(out) > 1024 {
+			out = "..." + out[len(out)-1024:]
+		}
+		return fmt.Errorf("%q exited with %d: %s", spec.PostExec, code, out)
+	}
+	logf(ctx, "post_exec done in container %s", displayName(c))
+	return savePostExec(key, fingerprint)
+}
+
+var signalRe = regexp.MustCompile(`^(SIG)?[A-Z0-9+-]+$`)
+
+// provisionedBefore reports whether the history has a successful provisioning of the container id on
+// target.
+func provisionedBefore(id, target string) bool {
+	recs, err := readHistory(time.Time{})
+	if err != nil {
+		logf(context.Background(), "warning: could not read history: %v", err)
+		return true
+	}
+	for _, r := range recs {
+		if r.Container == id && r.Target == target && r.Status == "ok" {
+			return true
+		}
+	}
+	return false
+}
+
+// sendPostSignal sends signal to c, or restarts it for "restart", if it is running.
+func sendPostSignal(ctx context.Context, cli *client.Client, c types.Container, signal string) error {
+	info, err := cli.ContainerInspect(ctx, c.ID)
+	if err != nil {
+		return fmt.Errorf("inspect failed: %w", err)
+	}
+	if info.State == nil || !info.State.Running || info.State.Paused {
+		// it will connect when it starts
+		return nil
+	}
+	if signal == "restart" {
+		logf(ctx, "restarting container %s", displayName(c))
+		return cli.ContainerRestart(ctx, c.ID, container.StopOptions{})
+	}
+	logf(ctx, "sending %s to container %s", signal, displayName(c))
+	return cli.ContainerKill(ctx, c.ID, signal)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A preset bundles the extensions a common stack needs with the follow-up grants that make them usable
+// by the provisioned (non-superuser) role.
+type preset struct {
+	Extensions []string
+	Setup      func(ctx context.Context, dbHost, dbPort, admin, adminPass string, spec provisionSpec) error
+}
+
+var presets = map[string]preset{
+	"postgis": {Extensions: []string{"postgis"}, Setup: setupPostGIS},
+}
+
+func presetNames() string {
+	names := make([]string, 0, len(presets))
+	for n := range presets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// setupPostGIS lets the role read the PostGIS metadata tables and views, which belong to the admin
+// that created the extension.
+func setupPostGIS(ctx context.Context, dbHost, dbPort, admin, adminPass string, spec provisionSpec) error {
+	db, err := openAdmin(ctx, dbHost, dbPort, admin, adminPass, spec.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var schema string
+	err = db.QueryRow(`SELECT n.nspname FROM pg_catalog.pg_extension e
+		JOIN pg_catalog.pg_namespace n ON n.oid = e.extnamespace WHERE e.extname = 'postgis';`).Scan(&schema)
+	if err != nil {
+		return fmt.Errorf("postgis preset: locate extension: %w", err)
+	}
+	s, user := pqQuoteIdent(schema), pqQuoteIdent(spec.User)
+	stmts := []string{
+		fmt.Sprintf("GRANT USAGE ON SCHEMA %s TO %s;", s, user),
+		fmt.Sprintf("GRANT SELECT ON %[1]s.spatial_ref_sys, %[1]s.geometry_columns, %[1]s.geography_columns TO %[2]s;", s, user),
+		// the role may register custom projections for its own data
+		fmt.Sprintf("GRANT INSERT, UPDATE, DELETE ON %s.spatial_ref_sys TO %s;", s, user),
+	}
+	for _, q := range stmts {
+		if _, err := db.Exec(q); err != nil {
+			return fmt.Errorf("postgis preset: grant failed: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protocol buffers wire format, limited to what the messages of proto/autopg.proto use: varints,
+// strings, nested messages and maps of strings. Enough to serve the gRPC API without generated code.
+
+// pbMessage is an encoded message being built.
+type pbMessage []byte
+
+func (m *pbMessage) tag(field, wireType int) {
+	*m = binary.AppendUvarint(*m, uint64(field<<3|wireType))
+}
+
+func (m *pbMessage) bytes(field int, b []byte) {
+	m.tag(field, 2)
+	*m = binary.AppendUvarint(*m, uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+// string encodes s, unless empty (the proto3 default).
+func (m *pbMessage) string(field int, s string) {
+	if s != "" {
+		m.bytes(field, []byte(s))
+	}
+}
+
+// int encodes v, unless 0.
+func (m *pbMessage) int(field int, v int64) {
+	if v != 0 {
+		m.tag(field, 0)
+		*m = binary.AppendUvarint(*m, uint64(v))
+	}
+}
+
+func (m *pbMessage) bool(field int, v bool) {
+	if v {
+		m.int(field, 1)
+	}
+}
+
+func (m *pbMessage) message(field int, sub pbMessage) {
+	m.bytes(field, sub)
+}
+
+// pbField is a decoded field: v for varints, b for length-delimited values.
+type pbField struct {
+	num int
+	v   uint64
+	b   []byte
+}
+
+// pbFields decodes the fields of message b, skipping fixed-size ones.
+func pbFields(b []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid field key")
+		}
+		b = b[n:]
+		f := pbField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if f.v, n = binary.Uvarint(b); n <= 0 {
+				return nil, fmt.Errorf("field %d: invalid varint", f.num)
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("field %d: truncated", f.num)
+			}
+			b = b[8:]
+			continue
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, fmt.Errorf("field %d: truncated", f.num)
+			}
+			f.b, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("field %d: truncated", f.num)
+			}
+			b = b[4:]
+			continue
+		default:
+			return nil, fmt.Errorf("field %d: unsupported wire type %d", f.num, key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// pbMapEntry decodes an entry of a map<string, string>.
+func pbMapEntry(b []byte) (key, value string, err error) {
+	fields, err := pbFields(b)
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			key = string(f.b)
+		case 2:
+			value = string(f.b)
+		}
+	}
+	return key, value, err
+}
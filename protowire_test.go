@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The encodings of the protocol buffers documentation.
+func TestPBMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(m *pbMessage)
+		want  string
+	}{
+		{"varint", func(m *pbMessage) { m.int(1, 150) }, "08 96 01"},
+		{"string", func(m *pbMessage) { m.string(2, "testing") }, "12 07 74 65 73 74 69 6e 67"},
+		{"message", func(m *pbMessage) {
+			var sub pbMessage
+			sub.int(1, 150)
+			m.message(3, sub)
+		}, "1a 03 08 96 01"},
+		{"bool", func(m *pbMessage) { m.bool(2, true) }, "10 01"},
+		{"field past 15", func(m *pbMessage) { m.string(16, "a") }, "82 01 01 61"},
+		// proto3 leaves the defaults out
+		{"defaults", func(m *pbMessage) {
+			m.int(1, 0)
+			m.string(2, "")
+			m.bool(3, false)
+		}, ""},
+	}
+	for _, tt := range tests {
+		var m pbMessage
+		tt.build(&m)
+		if want := unhex(t, tt.want); !bytes.Equal(m, want) {
+			t.Errorf("%s: % x, want % x", tt.name, []byte(m), want)
+		}
+	}
+}
+
+func TestPBFields(t *testing.T) {
+	// 150 in field 1, fixed64 and fixed32 fields to skip, "testing" in field 2, a nested message in 3
+	b := unhex(t, "08 96 01  11 0102030405060708  1d 01020304  12 07 74 65 73 74 69 6e 67  1a 03 08 96 01")
+	fields, err := pbFields(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 3 || fields[0].num != 1 || fields[0].v != 150 ||
+		fields[1].num != 2 || string(fields[1].b) != "testing" ||
+		fields[2].num != 3 || !bytes.Equal(fields[2].b, unhex(t, "08 96 01")) {
+		t.Errorf("pbFields = %+v", fields)
+	}
+
+	for _, bad := range []string{
+		"80",                    // truncated key
+		"08 96",                 // truncated varint
+		"12 07 74 65 73",        // string shorter than its length
+		"12 ffffffffffffffff01", // length past the end, and past int
+		"11 01020304",           // truncated fixed64
+		"1d 0102",               // truncated fixed32
+		"0b",                    // group start, unsupported
+	} {
+		if _, err := pbFields(unhex(t, bad)); err == nil {
+			t.Errorf("pbFields(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestPBMapEntry(t *testing.T) {
+	var entry pbMessage
+	entry.string(1, "extensions")
+	entry.string(2, "postgis")
+	if k, v, err := pbMapEntry(entry); err != nil || k != "extensions" || v != "postgis" {
+		t.Errorf("pbMapEntry = %q, %q, %v", k, v, err)
+	}
+	if _, _, err := pbMapEntry(unhex(t, "0a 05 61")); err == nil {
+		t.Error("pbMapEntry of a truncated entry succeeded")
+	}
+}
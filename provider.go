@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Providers: each source of provisioning requests is a provider. The daemon runs those listed in
+// AUTOPG_PROVIDERS (default "docker"): docker (containers and Swarm services of AUTOPG_DOCKER_HOSTS),
+// kubernetes (what `autopg operator` reconciles), nomad (allocations, as `autopg nomad`) and files (the
+// spec files of AUTOPG_FILES_DIR, as `autopg files`), plus webhook and grpc, the servers of requests
+// pushed to autopg rather than discovered, which run whenever AUTOPG_WEBHOOK_LISTEN or
+// AUTOPG_GRPC_LISTEN is set.
+//
+// Each provider translates what it finds into a resource (resource.go): an owner, and the
+// autopg.<target>.* labels equivalent to its native form (a container's labels, a PostgresDatabase's
+// spec, pod annotations, job meta, a spec file or request), which provision takes through the same
+// steps. reconcileResource provisions a resource on its targets, so a new provider only has to produce
+// resources; the Docker provider goes through processTarget instead, for what needs the container itself.
+
+// provider discovers provisioning requests and provisions them.
+type provider interface {
+	// run provisions what the provider finds until ctx is done. Errors are for a provider that cannot
+	// start; later failures are logged and retried.
+	run(ctx context.Context) error
+}
+
+// providers are the providers AUTOPG_PROVIDERS can list, by name. Their constructors check their
+// settings, so that the daemon fails at startup rather than later.
+var providers = map[string]func() (provider, error){
+	"docker":     newDockerProvider,
+	"kubernetes": newKubeProvider,
+	"nomad":      newNomadProvider,
+	"files": func() (provider, error) {
+		dir := os.Getenv("AUTOPG_FILES_DIR")
+		if dir == "" {
+			return nil, errors.New("AUTOPG_FILES_DIR is required")
+		}
+		return newFilesProvider(dir)
+	},
+	"webhook": newWebhookProvider,
+	"grpc":    newGRPCProvider,
+}
+
+// enabledProviders returns the providers of AUTOPG_PROVIDERS, and the webhook and grpc ones when their
+// listen address is set, with the Docker one apart since the control API acts on its hosts.
+func enabledProviders() ([]provider, *dockerProvider, error) {
+	names := splitList(os.Getenv("AUTOPG_PROVIDERS"))
+	if len(names) == 0 {
+		names = []string{"docker"}
+	}
+	if os.Getenv("AUTOPG_WEBHOOK_LISTEN") != "" {
+		names = append(names, "webhook")
+	}
+	if os.Getenv("AUTOPG_GRPC_LISTEN") != "" {
+		names = append(names, "grpc")
+	}
+	var list []provider
+	var docker *dockerProvider
+	seen := map[string]bool{}
+	for _, name := range names {
+		newProvider, ok := providers[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid AUTOPG_PROVIDERS %q; expected docker, kubernetes, nomad, files, webhook or grpc", name)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		p, err := newProvider()
+		if err != nil {
+			return nil, nil, fmt.Errorf("provider %s: %w", name, err)
+		}
+		if d, ok := p.(*dockerProvider); ok {
+			docker = d
+		}
+		list = append(list, p)
+	}
+	return list, docker, nil
+}
+
+// runProviders runs providers until ctx is done; a provider failing to start stops the daemon.
+func runProviders(ctx context.Context, providers []provider) {
+	var wg sync.WaitGroup
+	for _, p := range providers {
+		wg.Add(1)
+		go func(p provider) {
+			defer wg.Done()
+			if err := p.run(ctx); err != nil {
+				log.Fatal(err)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+// serveUntilDone runs serve, which serves srv, until ctx is done, then shuts srv down. A server that
+// stops by itself is an error, which stops the daemon as for a provider that cannot start.
+func serveUntilDone(ctx context.Context, srv *http.Server, name string, serve func() error) error {
+	errs := make(chan error, 1)
+	go func() { errs <- serve() }()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("%s: %w", name, err)
+	case <-ctx.Done():
+		sctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(sctx)
+	}
+}
+
+// resourceResult is the outcome of provisioning a resource on a target.
+type resourceResult struct {
+	target string
+	spec   provisionSpec
+	err    error
+}
+
+// errProvisioningPaused is returned by reconcileResource while provisioning is paused.
+var errProvisioningPaused = errors.New("provisioning is paused")
+
+// reconcileResource provisions r on each of its targets but those disabled by
+// autopg.<target>.enabled=false, and returns the outcome per target. Targets of other instances are
+// skipped and have no outcome. Failures are logged here; the caller only acts on them.
+func reconcileResource(ctx context.Context, r resource) ([]resourceResult, error) {
+	targets := r.targets
+	if targets == nil {
+		for target := range labelTargets(r.labels) {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	if provisioningPaused() {
+		logf(ctx, "provisioning paused; skipping %s %s (%d target(s))", r.kind, r.ref, len(targets))
+		return nil, errProvisioningPaused
+	}
+	queued := r
+	// labels as written, expanded here: only Docker containers have env: and file: values to resolve
+	labels, expandErr := expandConfigLabels(r.labels)
+	if expandErr == nil {
+		r.raw, r.labels, r.declared = r.labels, labels, labels
+	}
+	var results []resourceResult
+	var pending []string
+	var until time.Time
+	for _, target := range targets {
+		if enabled, err := r.enabled(target); err != nil || !enabled {
+			if err != nil {
+				logf(ctx, "%s %s: %v; skipping", r.kind, r.ref, err)
+			}
+			continue
+		}
+		res := resourceResult{target: target, err: expandErr}
+		for k, v := range labels {
+			if strings.HasPrefix(k, labelPrefix+target+".") && (strings.HasPrefix(v, "env:") || strings.HasPrefix(v, "file:")) {
+				res.err = fmt.Errorf("%s: env: and file: values are read from a Docker container", k)
+			}
+		}
+		if res.err == nil {
+			res.spec, _, res.err = provision(ctx, r, target)
+		}
+		if errors.Is(res.err, errNotOurTarget) {
+			logf(ctx, "no admin creds for target %s in this instance; skipping %s %s", target, r.kind, r.ref)
+			continue
+		}
+		var p pendingError
+		if errors.As(res.err, &p) {
+			pending = append(pending, target)
+			if p.until.After(until) {
+				until = p.until
+			}
+		}
+		if res.err != nil {
+			logf(ctx, "%s %s: %v", r.kind, r.ref, res.err)
+		} else {
+			logf(ctx, "provisioning done for %s target %s", r.displayName(), target)
+		}
+		results = append(results, res)
+	}
+	if len(pending) > 0 {
+		logf(ctx, "queueing %s %s until %s", r.kind, r.ref, until.Format(time.RFC3339))
+		scheduleRetry(queued, pending, until)
+	}
+	return results, nil
+}
+
+// provisionRequest provisions r, a request for a single target pushed to autopg by the webhook or the
+// gRPC API, and returns its spec.
+func provisionRequest(ctx context.Context, r resource) (provisionSpec, error) {
+	results, err := reconcileResource(ctx, r)
+	if err != nil {
+		return provisionSpec{}, err
+	}
+	if len(results) == 0 {
+		return provisionSpec{}, errNotOurTarget
+	}
+	return results[0].spec, results[0].err
+}
+
+// dockerProvider provisions the containers and Swarm services of the Docker hosts.
+type dockerProvider struct {
+	hosts     []dockerHost
+	behaviors map[string]string
+	resync    time.Duration
+}
+
+func newDockerProvider() (provider, error) {
+	p := &dockerProvider{}
+	var err error
+	if p.hosts, err = dockerHosts(); err != nil {
+		return nil, fmt.Errorf("docker client: %w", err)
+	}
+	if p.behaviors, err = eventBehaviors(); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("AUTOPG_RESYNC_INTERVAL"); v != "" {
+		if p.resync, err = time.ParseDuration(v); err != nil || p.resync <= 0 {
+			return nil, fmt.Errorf("invalid AUTOPG_RESYNC_INTERVAL %q", v)
+		}
+	}
+	for _, h := range p.hosts {
+		hctx, cli := h.context(context.Background()), h.cli
+		cli.NegotiateAPIVersion(hctx)
+		logf(hctx, "docker API %s negotiated with %s", cli.ClientVersion(), cli.DaemonHost())
+		if disabled := disabledDockerFeatures(cli); len(disabled) > 0 {
+			logf(hctx, "disabled on this Docker API version: %s", strings.Join(disabled, ", "))
+		}
+		if mode, err := dockerMode(hctx, cli); err == nil && mode != "rootful" {
+			logf(hctx, "docker runs in %s mode (%s)", mode, cli.DaemonHost())
+		}
+	}
+	return p, nil
+}
+
+// run scans the containers of every host, then follows its events.
+func (p *dockerProvider) run(ctx context.Context) error {
+	go watchPause(p.hosts, ctx)
+	if p.resync > 0 {
+		go resyncLoop(p.hosts, ctx, p.resync)
+	}
+	var wg sync.WaitGroup
+	for _, h := range p.hosts {
+		wg.Add(1)
+		go func(h dockerHost) {
+			defer wg.Done()
+			hctx := h.context(ctx)
+			go watchListing(h.cli, hctx)
+			// initial scan
+			listAndProcess(h.cli, hctx)
+			// monitor events
+			monitorEvents(h.cli, hctx, p.behaviors)
+		}(h)
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Provisioned state: what was provisioned successfully is kept in the data directory (provisioned.json),
+// per Docker host, container and target, with the label fingerprint (see serviceFingerprint) of the run.
+// A container whose entry matches its current labels is not provisioned again, across restarts of the
+// container and of autopg, unless retriggered or with AUTOPG_<TARGET>_REAPPLY=always. Containers with an
+// expires or deliver label are provisioned at every run, as their role validity or delivered file needs
+// renewing. Entries are removed with their container, on destroy events and at full scans.
+//
+// Docker can't add labels to an existing container, so the autopg.provisioned.<target>=true label is only
+// honoured when set on the container by its owner, as before.
+//
+// The store is a JSON file written atomically, like the other state in the data directory (credentials,
+// created roles, names, history), rather than BoltDB or SQLite: it holds one small entry per container and
+// target, is read once and rewritten on change, and SQLite would need cgo in a static binary.
+
+type provisionedEntry struct {
+	Fingerprint string    `json:"fingerprint"`
+	Time        time.Time `json:"time"`
+}
+
+var provisionedState = struct {
+	sync.Mutex
+	m map[string]provisionedEntry // Docker host/container ID/target -> last successful run
+}{}
+
+func provisionedStatePath() string {
+	return filepath.Join(dataDir(), "provisioned.json")
+}
+
+func provisionedKey(host, id, target string) string {
+	return host + "/" + id + "/" + target
+}
+
+// loadProvisioned reads the store on first use; the caller holds provisionedState.
+func loadProvisioned() {
+	if provisionedState.m != nil {
+		return
+	}
+	provisionedState.m = map[string]provisionedEntry{}
+	b, err := os.ReadFile(provisionedStatePath())
+	if err == nil {
+		err = json.Unmarshal(b, &provisionedState.m)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logf(context.Background(), "warning: could not read %s: %v", provisionedStatePath(), err)
+	}
+}
+
+// saveProvisionedLocked writes the store; the caller holds provisionedState.
+func saveProvisionedLocked() {
+	b, err := json.Marshal(provisionedState.m)
+	if err == nil {
+		tmp := provisionedStatePath() + ".tmp"
+		if err = os.WriteFile(tmp, b, 0o600); err == nil {
+			err = os.Rename(tmp, provisionedStatePath())
+		}
+	}
+	if err != nil {
+		logf(context.Background(), "warning: could not save provisioned state: %v", err)
+	}
+}
+
+// isProvisioned reports whether container id, on the Docker host of ctx, was provisioned on target
+// with labels as they are now.
+func isProvisioned(ctx context.Context, id, target string, labels map[string]string) bool {
+	if labels[provisionedLabelPrefix+target] == "true" {
+		return true
+	}
+	provisionedState.Lock()
+	defer provisionedState.Unlock()
+	loadProvisioned()
+	e, ok := provisionedState.m[provisionedKey(dockerHostName(ctx), id, target)]
+	return ok && e.Fingerprint == serviceFingerprint(target, labels)
+}
+
+// markProvisioned records that container id, on the Docker host of ctx, was provisioned on target with
+// labels.
+func markProvisioned(ctx context.Context, id, target string, labels map[string]string) {
+	provisionedState.Lock()
+	defer provisionedState.Unlock()
+	loadProvisioned()
+	provisionedState.m[provisionedKey(dockerHostName(ctx), id, target)] = provisionedEntry{
+		Fingerprint: serviceFingerprint(target, labels), Time: time.Now().UTC()}
+	saveProvisionedLocked()
+}
+
+// forgetProvisioned removes the entries of container id on host.
+func forgetProvisioned(host, id string) {
+	prefix := provisionedKey(host, id, "")
+	provisionedState.Lock()
+	defer provisionedState.Unlock()
+	loadProvisioned()
+	changed := false
+	for k := range provisionedState.m {
+		if strings.HasPrefix(k, prefix) {
+			delete(provisionedState.m, k)
+			changed = true
+		}
+	}
+	if changed {
+		saveProvisionedLocked()
+	}
+}
+
+// pruneProvisioned removes the entries of the containers of host missing from containers, a full
+// listing of the host.
+func pruneProvisioned(host string, containers []types.Container) {
+	present := map[string]bool{}
+	for _, c := range containers {
+		present[c.ID] = true
+	}
+	provisionedState.Lock()
+	defer provisionedState.Unlock()
+	loadProvisioned()
+	changed := false
+	for k := range provisionedState.m {
+		rest, ok := strings.CutPrefix(k, host+"/")
+		if !ok {
+			continue
+		}
+		id, _, _ := strings.Cut(rest, "/")
+		if !present[id] {
+			delete(provisionedState.m, k)
+			changed = true
+		}
+	}
+	if changed {
+		saveProvisionedLocked()
+	}
+}
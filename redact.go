@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redaction keeps secrets out of logs, the history and command output. Every secret autopg handles
+// (admin and app passwords, tokens, secret env vars) is registered and masked wherever it appears, and
+// DSN passwords, URL userinfo and bearer tokens are masked by pattern, which also covers lib/pq errors
+// quoting a connection string.
+//
+// Secrets are registered by source (a connection's user, a target's proxy, a token's issuer, ...), and a
+// new value from a source replaces the one before: a rotated password or renewed token stops being
+// matched once it is no longer used, so the set stays as large as the secrets in use.
+
+const redacted = "[REDACTED]"
+
+var (
+	secretsMu sync.RWMutex
+	secrets   = map[string]string{} // source -> secret
+)
+
+// redactPatterns mask secrets by shape, keeping the text around them.
+var redactPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)(password\s*=\s*)(?:'(?:[^'\\]|\\.)*'|\S+)`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)(\bpassword\s+)'(?:[^']|'')*'`), "${1}'" + redacted + "'"},
+	{regexp.MustCompile(`(?i)(\b[a-z][a-z0-9+.-]*://[^:/@\s]*:)[^@\s]+@`), "${1}" + redacted + "@"},
+	{regexp.MustCompile(`(?i)(bearer\s+)[a-z0-9._~+/=-]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)(x-amz-(?:signature|security-token)=)[^&\s]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)(\b(?:pass|secret|token)=)[^\s,;&]+`), "${1}" + redacted},
+}
+
+// secretEnvRe matches the names of environment variables holding secrets.
+var secretEnvRe = regexp.MustCompile(`(PASS|PASSWORD|SECRET|TOKEN|SECRET_ID|AGE_KEY|ACCESS_KEY|HMAC_KEY)$`)
+
+// registerSecret has s, the current secret of source, masked in everything autopg logs or prints from
+// now on, in place of the previous secret of source. Very short values are ignored, they would mask
+// unrelated text.
+func registerSecret(source, s string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if len(s) < 6 {
+		delete(secrets, source)
+		return
+	}
+	secrets[source] = s
+}
+
+// registerEnvSecrets registers the values of secret-looking environment variables.
+func registerEnvSecrets() {
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok && secretEnvRe.MatchString(name) {
+			registerSecret("env "+name, value)
+		}
+	}
+}
+
+// redact masks registered secrets and secret-shaped substrings in s.
+func redact(s string) string {
+	secretsMu.RLock()
+	known := make([]string, 0, len(secrets))
+	for _, v := range secrets {
+		if strings.Contains(s, v) {
+			known = append(known, v)
+		}
+	}
+	secretsMu.RUnlock()
+	// longest first, so a secret containing another is masked whole
+	sort.Slice(known, func(i, j int) bool { return len(known[i]) > len(known[j]) })
+	for _, v := range known {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+	for _, p := range redactPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// redactingWriter redacts each write before passing it on; log writes one line per call.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
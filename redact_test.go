@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	t.Cleanup(func() {
+		delete(secrets, "test admin")
+		delete(secrets, "test short")
+	})
+	registerSecret("test admin", "adm1n-s3cret")
+	registerSecret("test short", "abc") // too short to mask
+	tests := []struct {
+		in, want string
+	}{
+		{"login failed for adm1n-s3cret", "login failed for [REDACTED]"},
+		{"host=pg user=shop password='it\\'s x' dbname=shop", "host=pg user=shop password=[REDACTED] dbname=shop"},
+		{"host=pg password=hunter2 sslmode=require", "host=pg password=[REDACTED] sslmode=require"},
+		{"ALTER ROLE shop PASSWORD 'a''b'", "ALTER ROLE shop PASSWORD '[REDACTED]'"},
+		{"dial postgres://shop:hunter2@pg:5432/shop", "dial postgres://shop:[REDACTED]@pg:5432/shop"},
+		{"Authorization: Bearer eyJhbGciOi.x-y_z", "Authorization: Bearer [REDACTED]"},
+		{"GET /?X-Amz-Security-Token=abc&X-Amz-Signature=def", "GET /?X-Amz-Security-Token=[REDACTED]&X-Amz-Signature=[REDACTED]"},
+		{"deliver pass=hunter2, user=shop", "deliver pass=[REDACTED], user=shop"},
+		{"abc is kept", "abc is kept"},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// a rotated secret replaces the previous one of its source
+	registerSecret("test admin", "r0tated-s3cret")
+	if got := redact("adm1n-s3cret r0tated-s3cret"); got != "adm1n-s3cret [REDACTED]" {
+		t.Errorf("after rotation: %q", got)
+	}
+}
+
+func TestRedactLongestFirst(t *testing.T) {
+	t.Cleanup(func() {
+		delete(secrets, "test inner")
+		delete(secrets, "test outer")
+	})
+	registerSecret("test inner", "s3cret")
+	registerSecret("test outer", "s3cret-and-more")
+	if got := redact("got s3cret-and-more"); got != "got [REDACTED]" {
+		t.Errorf("redact = %q", got)
+	}
+}
+
+func TestRegisterEnvSecrets(t *testing.T) {
+	t.Cleanup(func() {
+		delete(secrets, "env AUTOPG_MAIN_ADMIN_PASS")
+		delete(secrets, "env AUTOPG_MAIN_HOST")
+	})
+	t.Setenv("AUTOPG_MAIN_ADMIN_PASS", "env-s3cret")
+	t.Setenv("AUTOPG_MAIN_HOST", "pg.internal")
+	registerEnvSecrets()
+	if got := redact("env-s3cret on pg.internal"); got != "[REDACTED] on pg.internal" {
+		t.Errorf("redact = %q", got)
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := redactingWriter{&buf}
+	line := "connect postgres://u:hunter2@h/db\n"
+	if n, err := w.Write([]byte(line)); err != nil || n != len(line) {
+		t.Errorf("Write = %d, %v, want %d", n, err, len(line))
+	}
+	if got := buf.String(); got != "connect postgres://u:[REDACTED]@h/db\n" {
+		t.Errorf("written %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// A request ID is assigned when an event (or scan entry) is taken in and follows the provisioning
+// through logs, the SQL application_name, history and hook metadata.
+type requestIDKey struct{}
+
+func newRequestID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "000000000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type dockerHostKey struct{}
+
+// withDockerHost tags ctx with the Docker host the container being handled runs on.
+func withDockerHost(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, dockerHostKey{}, name)
+}
+
+func dockerHostName(ctx context.Context) string {
+	name, _ := ctx.Value(dockerHostKey{}).(string)
+	return name
+}
+
+// logf logs like log.Printf, prefixed with the Docker host and request ID of ctx when there are.
+func logf(ctx context.Context, format string, args ...any) {
+	if id := requestID(ctx); id != "" {
+		format = "req=" + id + " " + format
+	}
+	if host := dockerHostName(ctx); host != "" {
+		format = "host=" + host + " " + format
+	}
+	log.Output(2, fmt.Sprintf(format, args...))
+}
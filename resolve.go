@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// Label values may point into the container instead of holding the value itself, so secrets stay in
+// the mechanisms teams already use rather than in labels visible to `docker inspect`:
+//   - env:NAME reads the container's environment variable NAME;
+//   - file:/path reads a file from the container's filesystem (e.g. a mounted Docker/Swarm secret),
+//     without its trailing newline.
+
+// resolveLabelValues returns labels with every autopg label value using a resolver prefix replaced by
+// the value it points to. The container is only inspected when a label needs it.
+func resolveLabelValues(ctx context.Context, cli *client.Client, containerID string, labels map[string]string) (map[string]string, error) {
+	var env map[string]string
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+		if !strings.HasPrefix(k, labelPrefix) {
+			continue
+		}
+		if name, ok := strings.CutPrefix(v, "env:"); ok {
+			if env == nil {
+				inspect, err := cli.ContainerInspect(ctx, containerID)
+				if err != nil {
+					return nil, fmt.Errorf("inspect container for %s: %w", k, err)
+				}
+				env = map[string]string{}
+				if inspect.Config != nil {
+					for _, kv := range inspect.Config.Env {
+						if name, value, ok := strings.Cut(kv, "="); ok {
+							env[name] = value
+						}
+					}
+				}
+			}
+			value, ok := env[name]
+			if !ok {
+				return nil, fmt.Errorf("%s: container has no environment variable %s", k, name)
+			}
+			out[k] = value
+		}
+		if path, ok := strings.CutPrefix(v, "file:"); ok {
+			value, err := readContainerFile(ctx, cli, containerID, path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = value
+		}
+	}
+	return out, nil
+}
+
+// maxLabelFileSize bounds what a file: label value may read; secrets are small.
+const maxLabelFileSize = 64 << 10
+
+// readContainerFile reads a regular file from the container through the archive API, which works on
+// stopped containers too and needs nothing installed in the image.
+func readContainerFile(ctx context.Context, cli *client.Client, containerID, path string) (string, error) {
+	rc, _, err := cli.CopyFromContainer(ctx, containerID, path)
+	if err != nil {
+		return "", fmt.Errorf("read %s from container: %w", path, err)
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		return "", fmt.Errorf("read %s from container: %w", path, err)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return "", fmt.Errorf("%s in container is not a regular file", path)
+	}
+	if hdr.Size > maxLabelFileSize {
+		return "", fmt.Errorf("%s in container is larger than %d bytes", path, maxLabelFileSize)
+	}
+	b, err := io.ReadAll(tr)
+	if err != nil {
+		return "", fmt.Errorf("read %s from container: %w", path, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// The reconciler: every provisioning request, whatever its provider (Docker containers, Kubernetes
+// PostgresDatabases and pods, Nomad allocations, spec files, webhook and gRPC requests; see provider.go),
+// is a resource, and provision takes it through the same steps on a target: signature, spec, naming,
+// policies, freeze windows, the SQL of ensureUserDB, history, audit and credential stores. What only a
+// provider can do is around it: Docker containers resolve env: and file: values beforehand and get
+// delivery, commands by exec, start gating and signals afterwards (processTarget); other resources can
+// hand their credentials to a credentialSink native to their platform.
+
+// resource is a provisioning request in the form every provider produces.
+type resource struct {
+	// kind and ref name the resource in logs, e.g. "pod" and "shop/web-5d8f9".
+	kind, ref string
+	// id is unique among the resources of its provider and name is its own name, e.g. a container's.
+	id, name string
+	// image is the container image, if any.
+	image string
+	// project and service are its owner, e.g. the compose project and service of a container.
+	project, service string
+	// labels are its autopg.<target>.* labels (and any others), with values resolved.
+	labels map[string]string
+	// raw are the labels as written, before autopg.config expansion, which signatures cover; declared
+	// are the labels before env: and file: values were resolved. Both default to labels.
+	raw, declared map[string]string
+	// targets are the targets to provision it on; nil for all its labels request.
+	targets []string
+	// sink returns where the credentials for target go besides the usual stores; nil for nowhere.
+	sink func(target string) (credentialSink, error)
+	// docker is the container a resource of the Docker provider is.
+	docker *dockerContainer
+	// retry provisions the resource again, as it is then, once a pending provisioning can run (e.g. after
+	// a freeze window); nil provisions it again as it was, e.g. a webhook request.
+	retry func(ctx context.Context)
+}
+
+// dockerContainer is the Docker container behind a resource.
+type dockerContainer struct {
+	cli *client.Client
+	c   types.Container
+}
+
+// containerResource returns the resource for c, whose labels are resolved; raw and declared are its labels
+// as written and before env: and file: values were resolved.
+func containerResource(cli *client.Client, c types.Container, raw, declared map[string]string) resource {
+	return resource{
+		kind: "container", ref: displayName(c),
+		id: c.ID, name: strings.TrimPrefix(firstName(c.Names), "/"), image: c.Image,
+		project: c.Labels["com.docker.compose.project"], service: c.Labels["com.docker.compose.service"],
+		labels: c.Labels, raw: raw, declared: declared,
+		docker: &dockerContainer{cli: cli, c: c},
+	}
+}
+
+// displayName is the human-meaningful name of r used in logs, history and comments: the owner's
+// project/service, else its name (see displayName for containers).
+func (r resource) displayName() string {
+	if r.docker != nil {
+		return displayName(r.docker.c)
+	}
+	if r.project != "" && r.service != "" {
+		return r.project + "/" + r.service
+	}
+	return r.name
+}
+
+// owner is who r's generated credentials belong to, e.g. "container shop/web": its provider's kind with
+// its project/service, so the replicas of a service share them, else its ref. A stored password is only
+// handed back to, and only set on a role created for, the same owner.
+func (r resource) owner() string {
+	if r.project != "" && r.service != "" {
+		return r.kind + " " + r.project + "/" + r.service
+	}
+	return r.kind + " " + r.ref
+}
+
+// passOwnerRefusal is why spec, asked for by owner, may not have its stored generated password, if it may not.
+func passOwnerRefusal(spec provisionSpec, owner string) string {
+	if spec.ManagedPass && !spec.NewPass && spec.PassOwner != "" && spec.PassOwner != owner {
+		return fmt.Sprintf("the generated password of user %s belongs to %s; refusing to hand it to %s", spec.User, spec.PassOwner, owner)
+	}
+	return ""
+}
+
+// enabled reports whether autopg.<target>.enabled leaves r to be provisioned on target.
+func (r resource) enabled(target string) (bool, error) {
+	v := r.labels[labelPrefix+target+".enabled"]
+	if v == "" {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid enabled %q for target %s", v, target)
+	}
+	return enabled, nil
+}
+
+// credentialSink is where the credentials of a resource are written besides the usual stores.
+type credentialSink interface {
+	// stored returns the user and password written before, if any, so a generated password survives
+	// the loss of autopg's data dir.
+	stored(ctx context.Context) (user, pass string, err error)
+	write(ctx context.Context, c exportedCredential) error
+}
+
+// pendingError is a provisioning that has to wait until a given time, e.g. the end of a freeze window.
+type pendingError struct {
+	msg   string
+	until time.Time
+}
+
+func (e pendingError) Error() string { return e.msg }
+
+// errNotOurTarget is returned for resources on a target this instance has no admin credentials for, so
+// that another instance can own them.
+var errNotOurTarget = errors.New("no admin creds for target in this instance")
+
+// provision provisions r on target and returns its spec and the credentials exported for it. Refusals
+// are errors, which the caller reports; a freeze window is a pendingError.
+func provision(ctx context.Context, r resource, target string) (provisionSpec, exportedCredential, error) {
+	var spec provisionSpec
+	var exp exportedCredential
+	name := r.displayName()
+	raw, declared := r.raw, r.declared
+	if raw == nil {
+		raw = r.labels
+	}
+	if declared == nil {
+		declared = r.labels
+	}
+	host, port, admin, adminPass, ok := getAdminCredsForTarget(target)
+	if !ok {
+		return spec, exp, errNotOurTarget
+	}
+	if err := verifyLabelSignature(target, raw, labelVars(r)); err != nil {
+		return spec, exp, err
+	}
+	// the sink is where a generated password survives when autopg's data dir does not
+	var sink credentialSink
+	var storedUser, storedPass string
+	if r.sink != nil {
+		var err error
+		if sink, err = r.sink(target); err != nil {
+			return spec, exp, err
+		}
+		if storedUser, storedPass, err = sink.stored(ctx); err != nil {
+			return spec, exp, err
+		}
+	}
+	spec, err := specFromLabels(r.labels, target, labelVars(r))
+	if err != nil {
+		return spec, exp, fmt.Errorf("invalid labels for target %s: %w", target, err)
+	}
+	registerSecret("password of "+target+"/"+spec.User, spec.Pass)
+	if spec.DerivedNames {
+		if err := resolveNameCollision(ctx, target, host, port, admin, adminPass, &spec); err != nil {
+			return spec, exp, fmt.Errorf("naming failed: %w", err)
+		}
+	}
+	// the sink only holds what was written for r, but it may name any user: setting its password is left to
+	// ensureUserDB, which only does so on a role autopg created for r's owner
+	if spec.NewPass && storedPass != "" && storedUser == spec.User {
+		spec.Pass = storedPass
+		registerSecret("password of "+target+"/"+spec.User, spec.Pass)
+	}
+	owner := r.owner()
+	if reason := passOwnerRefusal(spec, owner); reason != "" {
+		return spec, exp, errors.New(reason)
+	}
+	if reason, err := evaluatePolicy(ctx, target, r, &spec); err != nil || reason != "" {
+		if err != nil {
+			reason = fmt.Sprintf("policy evaluation failed (%v)", err)
+		}
+		return spec, exp, errors.New(reason)
+	}
+	if reason := policyRefusal(target, admin, r, spec); reason != "" {
+		return spec, exp, errors.New(reason)
+	}
+	// compose teardowns go by the project of the records of containers
+	project := ""
+	if r.docker != nil {
+		project = r.project
+	}
+	// refused records a refusal in the history, reason filed under the check that refused it
+	refused := func(check, reason string) {
+		recordHistory(historyRecord{SchemaVersion: schemaVersion, RequestID: requestID(ctx), DockerHost: dockerHostName(ctx), Time: time.Now().UTC(), Target: target,
+			Container: r.id, ContainerName: name, Project: project, DB: spec.DB, User: spec.User, Status: "error", Error: check + ": " + reason, Features: spec.features()})
+	}
+	if reason := plaintextPassRefusal(target, declared); reason != "" {
+		refused("plaintext pass", "label forbidden")
+		return spec, exp, errors.New(reason)
+	}
+	if !spec.ManagedPass && !spec.VaultCreds && !isSCRAMVerifier(spec.Pass) {
+		reason, err := passwordPolicyViolation(target, spec.User, spec.Pass)
+		if err != nil {
+			return spec, exp, fmt.Errorf("invalid password policy for target %s: %w", target, err)
+		}
+		if reason != "" {
+			refused("password policy", reason)
+			return spec, exp, fmt.Errorf("%s for user %s", reason, spec.User)
+		}
+	}
+	if spec.destructive(target) || spec.NewPass {
+		until, err := targetFrozenUntil(target, time.Now())
+		if err != nil {
+			return spec, exp, fmt.Errorf("invalid freeze windows for target %s: %w", target, err)
+		}
+		frozen := !until.IsZero()
+		if frozen && !spec.destructive(target) {
+			// a first provisioning creates the role with its new password; only an existing one is reset
+			if frozen, err = roleExists(ctx, target, host, port, admin, adminPass, spec.User); err != nil {
+				return spec, exp, err
+			}
+		}
+		if frozen {
+			return spec, exp, pendingError{fmt.Sprintf("target %s is frozen until %s", target, until.Format(time.RFC3339)), until}
+		}
+	}
+	logf(ctx, "provisioning target=%s host=%s %s %s db=%s user=%s", target, host, r.kind, name, spec.DB, spec.User)
+	meta := map[string]any{
+		"schema_version": schemaVersion,
+		"request_id":     requestID(ctx),
+		"target":         target,
+		"container_id":   r.id,
+		"container_name": r.name,
+		"display_name":   name,
+		"owner":          owner,
+		"features":       spec.features(),
+	}
+	if host := dockerHostName(ctx); host != "" {
+		meta["docker_host"] = host
+	}
+	pctx, audit := ctx, (*auditRecorder)(nil)
+	if auditDB(target) != "" {
+		pctx, audit = withAudit(ctx)
+	}
+	err = ensureUserDB(pctx, target, host, port, admin, adminPass, spec, meta)
+	rec := historyRecord{SchemaVersion: schemaVersion, RequestID: requestID(ctx), DockerHost: dockerHostName(ctx), Time: time.Now().UTC(), Target: target,
+		Container: r.id, ContainerName: name, Project: project, DB: spec.DB, User: spec.User, Status: "ok", Features: spec.features()}
+	if err != nil {
+		rec.Status, rec.Error = "error", err.Error()
+	}
+	recordHistory(rec)
+	if audit != nil {
+		if err := writeAudit(ctx, target, host, port, admin, adminPass, rec, audit.statements); err != nil {
+			logf(ctx, "warning: could not write audit record on target %s: %v", target, err)
+		}
+	}
+	if err != nil {
+		return spec, exp, fmt.Errorf("provision failed: %w", err)
+	}
+	exp = exportedCredential{Target: target, Host: host, Port: port, DB: spec.DB, User: spec.User, Pass: spec.Pass,
+		Container: name, Project: r.project, Service: r.service}
+	if r.docker != nil {
+		swarmCredential(r.docker.c, &exp)
+	}
+	if spec.NewPass || (spec.ManagedPass && spec.PassOwner == "") {
+		// passwords stored before owners were recorded go to the first resource using them
+		if err := saveCredential(storedCredential{Target: target, DB: spec.DB, User: spec.User, Pass: spec.Pass, Owner: owner}); err != nil {
+			logf(ctx, "warning: could not store generated password for %s: %v", spec.User, err)
+		}
+	}
+	if spec.NewPass {
+		if err := exportCredential(ctx, exp); err != nil {
+			logf(ctx, "warning: %v", err)
+		}
+	}
+	if !spec.VaultCreds {
+		if err := writeCredentialsFile(exp); err != nil {
+			logf(ctx, "warning: could not write credentials file for %s: %v", spec.User, err)
+		}
+		if sink != nil {
+			if err := sink.write(ctx, exp); err != nil {
+				return spec, exp, err
+			}
+		}
+	}
+	return spec, exp, nil
+}
+
+// swarmCredential names the credentials of a Swarm task's container after its stack and service rather
+// than the task's container.
+func swarmCredential(c types.Container, exp *exportedCredential) {
+	exp.SwarmService = c.Labels["com.docker.swarm.service.id"]
+	if exp.Service == "" && exp.SwarmService != "" {
+		exp.Project = c.Labels["com.docker.stack.namespace"]
+		exp.Service = strings.TrimPrefix(c.Labels["com.docker.swarm.service.name"], exp.Project+"_")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// A forced run re-evaluates a container even when it is marked provisioned.
+type forceKey struct{}
+
+func withForce(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceKey{}, true)
+}
+
+func forced(ctx context.Context) bool {
+	f, _ := ctx.Value(forceKey{}).(bool)
+	return f
+}
+
+// runRetrigger implements `autopg retrigger <container>...`: provisions the named containers again now,
+// without restarting them. Run it inside the autopg container (`docker exec`) so it sees the target
+// credentials and data directory.
+func runRetrigger(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: autopg retrigger <container>...")
+	}
+	ctx := context.Background()
+	hosts, err := dockerHosts()
+	if err != nil {
+		return fmt.Errorf("docker client: %w", err)
+	}
+	found := 0
+	for _, h := range hosts {
+		containers, err := h.cli.ContainerList(ctx, container.ListOptions{All: true})
+		if err != nil {
+			return fmt.Errorf("container list: %w", err)
+		}
+		discoverTargets(h.context(ctx), h.cli, containers)
+		for _, c := range containers {
+			if !matchesContainer(args, c) {
+				continue
+			}
+			found++
+			processContainer(h.cli, withForce(withRequestID(h.context(ctx), newRequestID())), c, nil)
+		}
+	}
+	if found == 0 {
+		return fmt.Errorf("no container matches %v", args)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Admin credential rotation: when the target rejects the admin's credentials, autopg re-reads them from
+// their files (<NAME>_FILE) and secret backends, bypassing caches, and retries with the new ones, so a
+// rotated admin password is picked up without restarting autopg.
+
+// isAuthError reports whether err is PostgreSQL rejecting the login (invalid_password or
+// invalid_authorization_specification).
+func isAuthError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "28P01" || pqErr.Code == "28000")
+}
+
+var (
+	credRefreshMu sync.Mutex
+	credRefreshed = map[string]time.Time{}
+)
+
+// refreshAdminCreds drops everything cached about the admin credentials of target and returns them
+// freshly read. Reloads happen at most every 10 seconds per target.
+func refreshAdminCreds(ctx context.Context, target string) (admin, adminPass string, ok bool) {
+	credRefreshMu.Lock()
+	if time.Since(credRefreshed[target]) > 10*time.Second {
+		credRefreshed[target] = time.Now()
+		if err := reloadFileEnv(); err != nil {
+			logf(ctx, "warning: reload secret files: %v", err)
+		}
+		forgetAdminCreds(target)
+	}
+	credRefreshMu.Unlock()
+	_, _, admin, adminPass, ok = getAdminCredsForTarget(target)
+	return admin, adminPass, ok
+}
+
+// forgetAdminCreds empties the caches of admin credentials and auth tokens.
+func forgetAdminCreds(target string) {
+	vaultCacheMu.Lock()
+	delete(vaultCache, target)
+	vaultCacheMu.Unlock()
+	awsSecretCacheMu.Lock()
+	clear(awsSecretCache)
+	awsSecretCacheMu.Unlock()
+	gcpSecretCacheMu.Lock()
+	clear(gcpSecretCache)
+	gcpSecretCacheMu.Unlock()
+	azureSecretCacheMu.Lock()
+	clear(azureSecretCache)
+	azureSecretCacheMu.Unlock()
+	rdsTokensMu.Lock()
+	clear(rdsTokens)
+	rdsTokensMu.Unlock()
+	krbTicketsMu.Lock()
+	for key := range krbTickets {
+		if strings.HasPrefix(key, target+" ") {
+			delete(krbTickets, key)
+		}
+	}
+	krbTicketsMu.Unlock()
+}
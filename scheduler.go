@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// The scheduler re-runs provisioning of a container or another resource at a later time, e.g. once a
+// target's freeze window is over. Jobs live in memory and are keyed by container or resource: queueing it
+// again replaces its pending run. A restart of autopg rescans every container and provider anyway.
+
+var (
+	schedulerMu sync.Mutex
+	scheduled   = map[string]*time.Timer{}
+)
+
+// scheduleRun calls run at the given time, replacing the pending run of key.
+func scheduleRun(key string, at time.Time, run func()) {
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+	if t, ok := scheduled[key]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(time.Until(at), func() {
+		schedulerMu.Lock()
+		if scheduled[key] == t {
+			delete(scheduled, key)
+		}
+		schedulerMu.Unlock()
+		run()
+	})
+	scheduled[key] = t
+}
+
+// scheduleReprocess re-processes containerID, on the Docker host of ctx, at the given time.
+func scheduleReprocess(cli *client.Client, ctx context.Context, containerID string, at time.Time) {
+	host := dockerHostName(ctx)
+	scheduleRun(containerID, at, func() {
+		ctx := withRequestID(withDockerHost(context.Background(), host), newRequestID())
+		cont, err := cli.ContainerInspect(ctx, containerID)
+		if err != nil {
+			logf(ctx, "scheduled run for container %s dropped: %v", containerID[:12], err)
+			return
+		}
+		processContainer(cli, ctx, containerFromInspect(cont), nil)
+	})
+}
+
+// scheduleRetry provisions r again at the given time, with r.retry when its provider set one, else as
+// it is on the targets given.
+func scheduleRetry(r resource, targets []string, at time.Time) {
+	scheduleRun(r.kind+"/"+r.id, at, func() {
+		ctx := withRequestID(context.Background(), newRequestID())
+		if r.retry != nil {
+			r.retry(ctx)
+			return
+		}
+		r.targets = targets
+		reconcileResource(ctx, r)
+	})
+}
+
+// resyncLoop rescans every container at a fixed interval, e.g. to renew role expiry (expires label)
+// for containers that run longer than their credentials are valid.
+func resyncLoop(hosts []dockerHost, ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			listAndProcessAll(hosts, ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// schemaVersion is the version of every JSON document autopg emits (history records, hook meta, ...).
+// Within a version, changes are additive only: fields may be added, never renamed, retyped or removed.
+// Anything else bumps the version, and the previous one stays printable with `autopg schema print`.
+const schemaVersion = 1
+
+const schemaIDPrefix = "https://github.com/journaudbe/autopg/schema/"
+
+// schemas holds the JSON Schema of each document type, keyed by name.
+var schemas = map[string]string{
+	"event": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "` + schemaIDPrefix + `v1/event.json",
+  "title": "autopg provisioning event",
+  "description": "One provisioning attempt, or a teardown, as written to history.jsonl.",
+  "type": "object",
+  "required": ["schema_version", "time", "target", "container", "db", "user", "status"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "request_id": {"type": "string", "description": "correlation ID shared by logs, application_name and hooks"},
+    "docker_host": {"type": "string", "description": "name of the Docker host, with AUTOPG_DOCKER_HOSTS"},
+    "time": {"type": "string", "format": "date-time"},
+    "target": {"type": "string"},
+    "container": {"type": "string", "description": "full container ID"},
+    "container_name": {"type": "string", "description": "compose project/service or container name"},
+    "project": {"type": "string", "description": "compose project of the container"},
+    "db": {"type": "string"},
+    "user": {"type": "string"},
+    "status": {"enum": ["ok", "error", "dropped"], "description": "dropped: removed after its compose project was torn down"},
+    "error": {"type": "string"},
+    "features": {"type": "array", "items": {"type": "string"}}
+  }
+}`,
+	"hook-meta": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "` + schemaIDPrefix + `v1/hook-meta.json",
+  "title": "autopg on_provision hook metadata",
+  "description": "The meta argument passed to autopg_registry.on_provision(db, role, meta).",
+  "type": "object",
+  "required": ["schema_version", "target", "container_id"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "request_id": {"type": "string"},
+    "target": {"type": "string"},
+    "container_id": {"type": "string"},
+    "container_name": {"type": "string"},
+    "display_name": {"type": "string", "description": "compose project/service or container name"},
+    "owner": {"type": "string", "description": "who the generated credentials belong to, e.g. container shop/web"},
+    "docker_host": {"type": "string", "description": "name of the Docker host, with AUTOPG_DOCKER_HOSTS"},
+    "features": {"type": "array", "items": {"type": "string"}}
+  }
+}`,
+	"policy-request": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "` + schemaIDPrefix + `v1/policy-request.json",
+  "title": "autopg policy request",
+  "description": "The provisioning request sent to the AUTOPG_<TARGET>_POLICY engine (OPA input or command stdin).",
+  "type": "object",
+  "required": ["schema_version", "target", "container", "db", "user", "features", "replication"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "request_id": {"type": "string"},
+    "target": {"type": "string"},
+    "container": {
+      "type": "object",
+      "required": ["id", "name", "display_name", "image", "labels"],
+      "properties": {
+        "id": {"type": "string"},
+        "name": {"type": "string"},
+        "display_name": {"type": "string"},
+        "image": {"type": "string"},
+        "compose_project": {"type": "string"},
+        "compose_service": {"type": "string"},
+        "labels": {"type": "object", "additionalProperties": {"type": "string"}, "description": "without pass labels"}
+      }
+    },
+    "db": {"type": "string"},
+    "user": {"type": "string"},
+    "features": {"type": "array", "items": {"type": "string"}},
+    "replication": {"type": "boolean"},
+    "extensions": {"type": "array", "items": {"type": "string"}, "description": "name or name@schema"},
+    "grant_schemas": {"type": "array", "items": {"type": "string"}},
+    "search_path": {"type": "array", "items": {"type": "string"}},
+    "role_settings": {"type": "object", "additionalProperties": {"type": "string"}},
+    "template": {"type": "string"},
+    "expires": {"type": "string", "description": "Go duration, e.g. 720h0m0s"}
+  }
+}`,
+	"policy-decision": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "` + schemaIDPrefix + `v1/policy-decision.json",
+  "title": "autopg policy decision",
+  "description": "What the policy engine answers (OPA result or command stdout). Set fields of mutate replace the request's.",
+  "type": "object",
+  "required": ["allow"],
+  "properties": {
+    "allow": {"type": "boolean"},
+    "reasons": {"type": "array", "items": {"type": "string"}},
+    "mutate": {
+      "type": "object",
+      "properties": {
+        "extensions": {"type": "array", "items": {"type": "string"}, "description": "name or name@schema"},
+        "grant_schemas": {"type": "array", "items": {"type": "string"}},
+        "search_path": {"type": "array", "items": {"type": "string"}},
+        "role_settings": {"type": "object", "additionalProperties": {"type": "string"}},
+        "replication": {"type": "boolean"},
+        "expires": {"type": "string", "description": "Go duration; empty removes the expiry"}
+      }
+    }
+  }
+}`,
+	"api-status": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "` + schemaIDPrefix + `v1/api-status.json",
+  "title": "autopg control API status",
+  "description": "Answer of GET /v1/status, POST /v1/pause and POST /v1/resume.",
+  "type": "object",
+  "required": ["schema_version", "time", "paused"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "time": {"type": "string", "format": "date-time"},
+    "paused": {"type": "boolean"}
+  }
+}`,
+	"api-retrigger": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "` + schemaIDPrefix + `v1/api-retrigger.json",
+  "title": "autopg control API retrigger",
+  "description": "Answer of POST /v1/retrigger: the matched containers and the request IDs of their runs, in the same order.",
+  "type": "object",
+  "required": ["schema_version", "containers", "request_ids"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "containers": {"type": "array", "items": {"type": "string"}},
+    "request_ids": {"type": "array", "items": {"type": "string"}}
+  }
+}`,
+	"webhook-provision": `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$id": "` + schemaIDPrefix + `v1/webhook-provision.json",
+  "title": "autopg webhook provisioning",
+  "description": "Answer of POST /v1/provision on the webhook: queued (202), or the outcome of the run with wait=true.",
+  "type": "object",
+  "required": ["schema_version", "request_id", "name", "target", "status"],
+  "properties": {
+    "schema_version": {"const": 1},
+    "request_id": {"type": "string"},
+    "name": {"type": "string"},
+    "target": {"type": "string"},
+    "status": {"enum": ["queued", "ok", "error"]},
+    "db": {"type": "string"},
+    "user": {"type": "string"},
+    "error": {"type": "string"}
+  }
+}`,
+}
+
+// runSchema implements `autopg schema print [name]`.
+func runSchema(args []string) error {
+	if len(args) == 0 || args[0] != "print" || len(args) > 2 {
+		return errors.New("usage: autopg schema print [name]")
+	}
+	names := make([]string, 0, len(schemas))
+	for n := range schemas {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if len(args) == 1 {
+		fmt.Printf("schema version %d; available: %s\n", schemaVersion, strings.Join(names, ", "))
+		return nil
+	}
+	s, ok := schemas[args[1]]
+	if !ok {
+		return fmt.Errorf("unknown schema %q; available: %s", args[1], strings.Join(names, ", "))
+	}
+	fmt.Println(s)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Admin credentials of a target come from env vars by default. AUTOPG_<TARGET>_ADMIN_SOURCE selects
+// another backend, which is asked each time the credentials are needed and is expected to cache.
+type adminSource func(ctx context.Context, target string) (user, pass string, err error)
+
+var adminSources = map[string]adminSource{
+	"vault": vaultAdminCreds,
+	"aws":   awsAdminCreds,
+	"gcp":   gcpAdminCreds,
+	"azure": azureAdminCreds,
+}
+
+// adminFromSource returns the admin credentials of target from the backend named source.
+func adminFromSource(target, source string) (string, string, error) {
+	fetch, ok := adminSources[source]
+	if !ok {
+		return "", "", fmt.Errorf("unknown admin credential source %q", source)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return fetch(ctx, target)
+}
+
+// exportedCredential is a generated app credential handed to the secret stores of
+// AUTOPG_<TARGET>_CREDENTIAL_STORES, in addition to the local credentials file.
+type exportedCredential struct {
+	Target, Host, Port, DB, User, Pass string
+	Container, Project, Service        string
+	SwarmService                       string // ID of the Swarm service running the container, if any
+}
+
+var safeNameRe = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// serviceName names c's container in file and secret names: <project>_<service> for compose services
+// and Swarm stacks, the service alone for other Swarm services, else the container name, limited to
+// letters, digits, '_', '.' and '-'.
+func (c exportedCredential) serviceName() string {
+	name := c.Container
+	if c.Project != "" && c.Service != "" {
+		name = c.Project + "_" + c.Service
+	} else if c.Service != "" {
+		name = c.Service
+	}
+	return safeNameRe.ReplaceAllString(name, "_")
+}
+
+// secretValue is the stored JSON document, in the layout RDS uses for its own secrets.
+func (c exportedCredential) secretValue() map[string]string {
+	return map[string]string{
+		"engine":   "postgres",
+		"host":     c.Host,
+		"port":     c.Port,
+		"dbname":   c.DB,
+		"username": c.User,
+		"password": c.Pass,
+	}
+}
+
+var credentialStores = map[string]func(ctx context.Context, c exportedCredential) error{
+	"aws":    awsStoreCredential,
+	"gcp":    gcpStoreCredential,
+	"azure":  azureStoreCredential,
+	"docker": dockerStoreCredential,
+}
+
+// exportCredential writes c to every secret store configured for its target.
+func exportCredential(ctx context.Context, c exportedCredential) error {
+	for _, name := range splitList(targetSetting(c.Target, "CREDENTIAL_STORES")) {
+		store, ok := credentialStores[name]
+		if !ok {
+			return fmt.Errorf("unknown credential store %q", name)
+		}
+		sctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := store(sctx, c)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("store credential in %s: %w", name, err)
+		}
+	}
+	return nil
+}
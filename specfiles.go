@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Spec files: `autopg files <dir>` provisions databases declared in a directory instead of watching
+// Docker, for what isn't a container (cron jobs on a host, external applications). Each .yaml, .yml or
+// .json file declares one database, with the fields of a PostgresDatabase's spec:
+//
+//	target: main
+//	db: reports
+//	user: reports
+//	options:
+//	  extensions: postgis
+//
+// A file goes through the same provisioning as a container with autopg.<target>.enable=true and the
+// equivalent labels, "files" standing in for the compose project and the file name (without extension)
+// for the service. The directory is polled every AUTOPG_FILES_INTERVAL (10s by default): new and changed
+// files are provisioned, failed ones retried every 5 minutes. Removing a file keeps its database and
+// role, like a removed container.
+
+// reservedOptions are label fields a spec file, webhook or gRPC request or PostgresDatabase cannot set in
+// options: they have fields of their own, act on a container or pod it does not have, or, for config,
+// would set the others.
+var reservedOptions = []string{"db", "user", "enable", "enabled", "config", "deliver", "deliver_format",
+	"deliver_template", "post_exec", "post_exec_user", "post_signal", "secret"}
+
+// specFile is the content of a spec file.
+type specFile struct {
+	Target, DB, User string
+	Options          map[string]string
+}
+
+// parseSpecFile parses the content of a spec file.
+func parseSpecFile(b []byte) (specFile, error) {
+	var f specFile
+	m, err := parseConfig(b)
+	if err != nil {
+		return f, err
+	}
+	for k, v := range m {
+		if k == "options" {
+			opts, ok := v.(map[string]any)
+			if !ok {
+				return f, errors.New("options must be a mapping")
+			}
+			f.Options = map[string]string{}
+			for key, ov := range opts {
+				if _, nested := ov.(map[string]any); nested {
+					return f, fmt.Errorf("options.%s must be a scalar", key)
+				}
+				f.Options[key] = fmt.Sprint(ov)
+			}
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return f, fmt.Errorf("%s must be a string", k)
+		}
+		switch k {
+		case "target":
+			f.Target = s
+		case "db":
+			f.DB = s
+		case "user":
+			f.User = s
+		default:
+			return f, fmt.Errorf("unknown field %q", k)
+		}
+	}
+	return f, nil
+}
+
+// resource returns the spec named name as a resource standing in for a service of project.
+func (f specFile) resource(project, name string) (resource, error) {
+	if f.Target == "" {
+		return resource{}, errors.New("target is required")
+	}
+	if strings.Contains(f.Target, ".") {
+		return resource{}, fmt.Errorf("invalid target %q", f.Target)
+	}
+	prefix := labelPrefix + f.Target + "."
+	labels := map[string]string{prefix + "enable": "true"}
+	if f.DB != "" {
+		labels[prefix+"db"] = f.DB
+	}
+	if f.User != "" {
+		labels[prefix+"user"] = f.User
+	}
+	for k, v := range f.Options {
+		if contains(reservedOptions, k) {
+			return resource{}, fmt.Errorf("options.%s cannot be set in a spec file", k)
+		}
+		labels[prefix+k] = v
+	}
+	return resource{
+		kind: "spec file", ref: name,
+		id: project + ":" + name, name: name,
+		project: project, service: name,
+		labels:  labels,
+		targets: []string{f.Target},
+	}, nil
+}
+
+// specFileState is what autopg knows of a spec file.
+type specFileState struct {
+	sum   [32]byte
+	ok    bool
+	tried time.Time
+}
+
+func filesInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("AUTOPG_FILES_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// runFiles implements `autopg files <dir>`: runs the files provider alone, on dir.
+func runFiles(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: autopg files <dir>")
+	}
+	p, err := newFilesProvider(args[0])
+	if err != nil {
+		return err
+	}
+	return p.run(context.Background())
+}
+
+// filesProvider provisions the spec files of a directory.
+type filesProvider struct {
+	dir string
+}
+
+func newFilesProvider(dir string) (provider, error) {
+	if _, err := os.ReadDir(dir); err != nil {
+		return nil, err
+	}
+	return &filesProvider{dir: dir}, nil
+}
+
+// run provisions the spec files of the directory, then polls it.
+func (p *filesProvider) run(ctx context.Context) error {
+	log.Printf("files: provisioning the spec files of %s", p.dir)
+	states := map[string]*specFileState{}
+	t := time.NewTicker(filesInterval())
+	defer t.Stop()
+	for {
+		if err := reconcileSpecFiles(ctx, p.dir, states); err != nil {
+			log.Printf("files: %v", err)
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// reconcileSpecFiles provisions the files of dir that are new, changed, or failed more than 5 minutes
+// ago, per states, which it updates.
+func reconcileSpecFiles(ctx context.Context, dir string, states map[string]*specFileState) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ext)
+		seen[name] = true
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			log.Printf("files: %v", err)
+			continue
+		}
+		sum := sha256.Sum256(b)
+		st := states[name]
+		if st != nil && st.sum == sum && (st.ok || time.Since(st.tried) < 5*time.Minute) {
+			continue
+		}
+		if st == nil {
+			st = &specFileState{}
+			states[name] = st
+		}
+		st.sum, st.tried = sum, time.Now()
+		st.ok = provisionSpecFile(withRequestID(ctx, newRequestID()), name, filepath.Join(dir, e.Name()), b)
+	}
+	removed := make([]string, 0)
+	for name := range states {
+		if !seen[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		delete(states, name)
+		log.Printf("files: %s was removed; keeping its database and role", name)
+	}
+	return nil
+}
+
+// provisionSpecFile provisions the spec file name, at path, with content b and reports whether it
+// succeeded.
+func provisionSpecFile(ctx context.Context, name, path string, b []byte) bool {
+	f, err := parseSpecFile(b)
+	var r resource
+	if err == nil {
+		r, err = f.resource("files", name)
+	}
+	if err != nil {
+		logf(ctx, "spec file %s: %v", name, err)
+		return false
+	}
+	r.retry = func(ctx context.Context) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			logf(ctx, "scheduled run for spec file %s dropped: %v", name, err)
+			return
+		}
+		provisionSpecFile(ctx, name, path, b)
+	}
+	results, err := reconcileResource(ctx, r)
+	if err != nil {
+		return false
+	}
+	// no result: another instance's target
+	return len(results) == 0 || results[0].err == nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSpecFile(t *testing.T) {
+	tests := []struct {
+		name, in, err string
+		want          specFile
+	}{
+		{"yaml", "target: main\ndb: reports\noptions:\n  extensions: postgis\n  conn_limit: 5\n", "",
+			specFile{Target: "main", DB: "reports", Options: map[string]string{"extensions": "postgis", "conn_limit": "5"}}},
+		{"json", `{"target": "main", "user": "reports"}`, "", specFile{Target: "main", User: "reports"}},
+		{"unknown field", "target: main\nowner: me\n", `unknown field "owner"`, specFile{}},
+		{"nested option", "target: main\noptions:\n  cron:\n    vacuum: x\n", "options.cron must be a scalar", specFile{}},
+		{"options not a mapping", "target: main\noptions: x\n", "options must be a mapping", specFile{}},
+	}
+	for _, tt := range tests {
+		got, err := parseSpecFile([]byte(tt.in))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: %v, want %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got.Target != tt.want.Target || got.DB != tt.want.DB || got.User != tt.want.User || len(got.Options) != len(tt.want.Options) {
+			t.Errorf("%s: %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+		for k, v := range tt.want.Options {
+			if got.Options[k] != v {
+				t.Errorf("%s: options %v, want %v", tt.name, got.Options, tt.want.Options)
+			}
+		}
+	}
+}
+
+func TestSpecFileResource(t *testing.T) {
+	f := specFile{Target: "main", DB: "reports", Options: map[string]string{"extensions": "postgis"}}
+	r, err := f.resource("files", "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.labels["autopg.main.enable"] != "true" || r.labels["autopg.main.db"] != "reports" ||
+		r.labels["autopg.main.extensions"] != "postgis" || len(r.labels) != 3 {
+		t.Errorf("labels %v", r.labels)
+	}
+	if r.project != "files" || r.service != "reports" || r.id != "files:reports" || strings.Join(r.targets, ",") != "main" {
+		t.Errorf("resource %+v", r)
+	}
+	if _, err := (specFile{}).resource("files", "reports"); err == nil {
+		t.Error("spec file without target accepted")
+	}
+	if _, err := (specFile{Target: "main.db"}).resource("files", "reports"); err == nil {
+		t.Error("spec file with a dotted target accepted")
+	}
+	for _, k := range reservedOptions {
+		f := specFile{Target: "main", Options: map[string]string{k: "x"}}
+		if _, err := f.resource("files", "reports"); err == nil || err.Error() != "options."+k+" cannot be set in a spec file" {
+			t.Errorf("options.%s: %v", k, err)
+		}
+	}
+}
+
+func TestReconcileSpecFiles(t *testing.T) {
+	useDataDir(t)
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// invalid specs fail before reaching a target
+	write("reports.yaml", "db: reports\n")
+	write("notes.txt", "target: main\n")
+	write(".hidden.yaml", "target: main\n")
+	states := map[string]*specFileState{}
+	if err := reconcileSpecFiles(t.Context(), dir, states); err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states["reports"] == nil || states["reports"].ok {
+		t.Fatalf("states after the first pass: %v", states)
+	}
+	tried := states["reports"].tried
+	if err := reconcileSpecFiles(t.Context(), dir, states); err != nil {
+		t.Fatal(err)
+	}
+	if !states["reports"].tried.Equal(tried) {
+		t.Error("unchanged failed file retried before 5 minutes")
+	}
+	write("reports.yaml", "db: reports2\n")
+	if err := reconcileSpecFiles(t.Context(), dir, states); err != nil {
+		t.Fatal(err)
+	}
+	if states["reports"].tried.Equal(tried) {
+		t.Error("changed file not tried again")
+	}
+	if err := os.Remove(filepath.Join(dir, "reports.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcileSpecFiles(t.Context(), dir, states); err != nil || len(states) != 0 {
+		t.Errorf("states after removal: %v, %v", states, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSH bastions: with AUTOPG_<TARGET>_SSH_HOST (host or host:port) set, every connection to the target is
+// tunneled through that jump host, so the host and port of the target are resolved and dialed from the
+// bastion. It runs the ssh CLI, which the image ships, with stdio forwarding (ssh -W) per connection,
+// multiplexed over one master connection per bastion.
+//   - AUTOPG_<TARGET>_SSH_USER is the login (default: ssh's default);
+//   - AUTOPG_<TARGET>_SSH_KEY is the private key file;
+//   - AUTOPG_<TARGET>_SSH_KNOWN_HOSTS is the known_hosts file the bastion's key is checked against
+//     (default ~/.ssh/known_hosts); unknown host keys are refused.
+
+// sshHost returns the bastion of target, or "" when it is reached directly.
+func sshHost(target string) string {
+	return targetSetting(target, "SSH_HOST")
+}
+
+// sshDialer dials through the bastion of target for lib/pq.
+type sshDialer struct {
+	target string
+}
+
+func (d sshDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d sshDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d sshDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("ssh tunnel of target %s: cannot forward %s connections", d.target, network)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	args, err := sshArgs(d.target)
+	if err != nil {
+		return nil, err
+	}
+	// the process lives as long as the connection, not ctx
+	cmd := exec.Command("ssh", append(args, "-W", address)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// an os.Pipe rather than StdoutPipe, which Wait closes: what the server sends last, such as an
+	// authentication error, must still be readable after ssh exited
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = w
+	c := &sshConn{target: d.target, address: address, cmd: cmd, stdin: stdin, stdout: r, exited: make(chan struct{})}
+	cmd.Stderr = &c.stderr
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("ssh tunnel of target %s: %w", d.target, err)
+	}
+	go func() {
+		c.waitErr = cmd.Wait()
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+// sshConn is a connection forwarded by an ssh process over its stdin and stdout.
+type sshConn struct {
+	target, address string
+	cmd             *exec.Cmd
+	stdin           io.WriteCloser
+	stdout          *os.File
+	stderr          sshStderr
+	exited          chan struct{}
+	waitErr         error
+	closeOnce       sync.Once
+}
+
+func (c *sshConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		<-c.exited
+		if c.waitErr != nil {
+			err = fmt.Errorf("ssh tunnel of target %s via %s: %v: %s", c.target, sshHost(c.target), c.waitErr, c.stderr.String())
+		}
+	}
+	return n, err
+}
+
+func (c *sshConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *sshConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		select {
+		case <-c.exited:
+		case <-time.After(2 * time.Second):
+			c.cmd.Process.Kill()
+			<-c.exited
+		}
+		c.stdout.Close()
+	})
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr  { return sshAddr("ssh") }
+func (c *sshConn) RemoteAddr() net.Addr { return sshAddr(c.address) }
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is not supported by the stdin pipe of exec; writes block at most until ssh exits.
+func (c *sshConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
+
+// sshArgs returns the ssh options for the bastion of target.
+func sshArgs(target string) ([]string, error) {
+	host := sshHost(target)
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=30",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPersist=60",
+		"-o", "ControlPath=" + filepath.Join(dataDir(), "ssh-%C"),
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		host = h
+		args = append(args, "-p", port)
+	}
+	if user := targetSetting(target, "SSH_USER"); user != "" {
+		args = append(args, "-l", user)
+	}
+	if kh := targetSetting(target, "SSH_KNOWN_HOSTS"); kh != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+kh)
+	}
+	if key := targetSetting(target, "SSH_KEY"); key != "" {
+		path, err := sshKeyFile(target, key)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-i", path, "-o", "IdentitiesOnly=yes")
+	}
+	return append(args, "--", host), nil
+}
+
+var (
+	sshKeysMu sync.Mutex
+	sshKeys   = map[string]string{}
+)
+
+// sshKeyFile returns a path ssh accepts for the key file: ssh refuses keys readable by others, which
+// secrets mounted by Docker are, so those are copied to the data dir with mode 0600 first.
+func sshKeyFile(target, key string) (string, error) {
+	fi, err := os.Stat(key)
+	if err != nil {
+		return "", fmt.Errorf("ssh key of target %s: %w", target, err)
+	}
+	if fi.Mode().Perm()&0o077 == 0 {
+		return key, nil
+	}
+	sshKeysMu.Lock()
+	defer sshKeysMu.Unlock()
+	if path, ok := sshKeys[key]; ok {
+		return path, nil
+	}
+	b, err := os.ReadFile(key)
+	if err != nil {
+		return "", fmt.Errorf("ssh key of target %s: %w", target, err)
+	}
+	path := filepath.Join(dataDir(), "ssh-key-"+slugify(target))
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		return "", err
+	}
+	sshKeys[key] = path
+	return path, nil
+}
+
+// sshStderr keeps the end of ssh's error output for error messages.
+type sshStderr struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (s *sshStderr) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf = append(s.buf, p...)
+	if len(s.buf) > 4096 {
+		s.buf = s.buf[len(s.buf)-4096:]
+	}
+	return len(p), nil
+}
+
+func (s *sshStderr) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.TrimSpace(string(s.buf))
+}
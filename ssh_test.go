@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSHArgs(t *testing.T) {
+	dir := useDataDir(t)
+	key := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(key, []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AUTOPG_MAIN_SSH_HOST", "bastion.example.com:2222")
+	t.Setenv("AUTOPG_MAIN_SSH_USER", "tunnel")
+	t.Setenv("AUTOPG_MAIN_SSH_KNOWN_HOSTS", "/etc/autopg/known_hosts")
+	t.Setenv("AUTOPG_MAIN_SSH_KEY", key)
+	args, err := sshArgs("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(args, " ")
+	want := "-o BatchMode=yes -o StrictHostKeyChecking=yes -o ExitOnForwardFailure=yes -o ServerAliveInterval=30 " +
+		"-o ControlMaster=auto -o ControlPersist=60 -o ControlPath=" + filepath.Join(dir, "ssh-%C") +
+		" -p 2222 -l tunnel -o UserKnownHostsFile=/etc/autopg/known_hosts -i " + key + " -o IdentitiesOnly=yes -- bastion.example.com"
+	if got != want {
+		t.Errorf("sshArgs =\n%s\nwant\n%s", got, want)
+	}
+
+	t.Setenv("AUTOPG_MAIN_SSH_KEY", filepath.Join(t.TempDir(), "missing"))
+	if _, err := sshArgs("main"); err == nil {
+		t.Error("sshArgs with a missing key succeeded")
+	}
+}
+
+func TestSSHKeyFile(t *testing.T) {
+	dir := useDataDir(t)
+	t.Cleanup(func() {
+		sshKeysMu.Lock()
+		defer sshKeysMu.Unlock()
+		clear(sshKeys)
+	})
+	key := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(key, []byte("private"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(key, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path, err := sshKeyFile("main", key)
+	if err != nil || path != filepath.Join(dir, "ssh-key-main") {
+		t.Fatalf("sshKeyFile = %q, %v", path, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("copied key %v, %v", fi, err)
+	}
+	if err := os.Chmod(key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if path, err := sshKeyFile("main", key); path != key || err != nil {
+		t.Errorf("sshKeyFile of a private key = %q, %v, want it unchanged", path, err)
+	}
+}
+
+// fakeSSH puts an ssh script running script on PATH.
+func fakeSSH(t *testing.T, script string) {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestSSHDialer(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_MAIN_SSH_HOST", "bastion")
+	fakeSSH(t, `for a; do last=$a; done; [ "$last" = pg.internal:5432 ] || exit 2; exec cat`)
+	conn, err := sshDialer{"main"}.DialTimeout("tcp", "pg.internal:5432", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("through the tunnel: %q, %v", buf, err)
+	}
+	if conn.RemoteAddr().String() != "pg.internal:5432" {
+		t.Errorf("remote address %s", conn.RemoteAddr())
+	}
+	conn.Close()
+
+	if _, err := (sshDialer{"main"}).Dial("unix", "/tmp/.s.PGSQL.5432"); err == nil {
+		t.Error("unix socket forwarded")
+	}
+}
+
+func TestSSHDialerError(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_MAIN_SSH_HOST", "bastion")
+	fakeSSH(t, `echo "Host key verification failed." >&2; exit 255`)
+	conn, err := sshDialer{"main"}.Dial("tcp", "pg.internal:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || !strings.Contains(err.Error(), "ssh tunnel of target main via bastion: exit status 255: Host key verification failed.") {
+		t.Errorf("Read = %v", err)
+	}
+}
+
+func TestSSHStderr(t *testing.T) {
+	var s sshStderr
+	s.Write([]byte(strings.Repeat("x", 5000)))
+	s.Write([]byte("end\n"))
+	if got := s.String(); len(got) != 4095 || !strings.HasSuffix(got, "xend") {
+		t.Errorf("kept %d bytes ending %q", len(got), got[len(got)-4:])
+	}
+}
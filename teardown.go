@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// Compose teardown: when the last container of a compose project with autopg labels is removed and none
+// comes back within AUTOPG_TEARDOWN_GRACE (1m by default), the project was taken down (`docker compose
+// down`) rather than restarted or recreated, which keep or replace its containers. With
+// AUTOPG_<TARGET>_TEARDOWN=drop, autopg then drops the databases and roles it provisioned for the
+// project on that target, as recorded in the history, and forgets their generated passwords. The default,
+// keep, only logs the teardown.
+//
+// Only a database and role autopg created are dropped (see created.go), the database only when
+// it was created for the project's role and that role still owns it, and neither while another project
+// or container was provisioned with it. Paused provisioning and freeze windows hold the drops.
+
+type teardownKey struct {
+	host, project string
+}
+
+var teardowns = struct {
+	sync.Mutex
+	timers map[teardownKey]*time.Timer
+}{timers: map[teardownKey]*time.Timer{}}
+
+func teardownGrace() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("AUTOPG_TEARDOWN_GRACE")); err == nil && d >= 0 {
+		return d
+	}
+	return time.Minute
+}
+
+// watchTeardown checks, after the grace period, whether the compose project of a removed container with
+// the given labels was torn down. Removals of the same project share the check.
+func watchTeardown(cli *client.Client, ctx context.Context, labels map[string]string) {
+	project := labels["com.docker.compose.project"]
+	if project == "" {
+		return
+	}
+	if expanded, err := expandConfigLabels(labels); err != nil || len(labelTargets(expanded)) == 0 {
+		return
+	}
+	key := teardownKey{dockerHostName(ctx), project}
+	teardowns.Lock()
+	defer teardowns.Unlock()
+	if t, ok := teardowns.timers[key]; ok {
+		t.Reset(teardownGrace())
+		return
+	}
+	teardowns.timers[key] = time.AfterFunc(teardownGrace(), func() {
+		teardowns.Lock()
+		delete(teardowns.timers, key)
+		teardowns.Unlock()
+		checkTeardown(cli, withRequestID(ctx, newRequestID()), project)
+	})
+}
+
+// checkTeardown deprovisions project if none of its containers is left.
+func checkTeardown(cli *client.Client, ctx context.Context, project string) {
+	left, err := cli.ContainerList(ctx, container.ListOptions{All: true,
+		Filters: filters.NewArgs(filters.Arg("label", "com.docker.compose.project="+project))})
+	if err != nil {
+		logf(ctx, "compose project %s: container list error: %v", project, err)
+		return
+	}
+	if len(left) > 0 {
+		return
+	}
+	logf(ctx, "compose project %s was torn down", project)
+	forgetProject(dockerHostName(ctx), project)
+	if provisioningPaused() {
+		logf(ctx, "provisioning paused; keeping the databases of compose project %s", project)
+		return
+	}
+	if err := deprovisionProject(ctx, project); err != nil {
+		logf(ctx, "compose project %s: %v", project, err)
+	}
+}
+
+// provisioned is a database and role provisioned on a target.
+type provisioned struct {
+	target, db, user string
+}
+
+// deprovisionProject drops what was provisioned for project, on the Docker host of ctx, on the targets
+// set to drop on teardown.
+func deprovisionProject(ctx context.Context, project string) error {
+	recs, err := readHistory(time.Time{})
+	if err != nil {
+		return fmt.Errorf("read history: %w", err)
+	}
+	host := dockerHostName(ctx)
+	// the last record of each database and role, per project
+	type owner struct {
+		provisioned
+		host, project string
+	}
+	last := map[owner]string{}
+	for _, r := range recs {
+		if r.Status == "error" {
+			continue
+		}
+		proj := r.Project
+		if proj == "" {
+			// older records only have the compose project in the display name
+			proj, _, _ = strings.Cut(r.ContainerName, "/")
+		}
+		last[owner{provisioned{r.Target, r.DB, r.User}, r.DockerHost, proj}] = r.Status
+	}
+	var drops []provisioned
+	for o, status := range last {
+		if o.host == host && o.project == project && status == "ok" {
+			drops = append(drops, o.provisioned)
+		}
+	}
+	for _, p := range drops {
+		if targetSetting(p.target, "TEARDOWN") != "drop" {
+			logf(ctx, "keeping database %s and role %s of compose project %s on target %s", p.db, p.user, project, p.target)
+			continue
+		}
+		shared := false
+		for o, status := range last {
+			if status == "ok" && o.target == p.target && (o.db == p.db || o.user == p.user) && (o.host != host || o.project != project) {
+				shared = true
+			}
+		}
+		if shared {
+			logf(ctx, "database %s or role %s on target %s is also used outside compose project %s; keeping them", p.db, p.user, p.target, project)
+			continue
+		}
+		if until, err := targetFrozenUntil(p.target, time.Now()); err != nil || !until.IsZero() {
+			logf(ctx, "target %s is frozen; keeping database %s and role %s of compose project %s", p.target, p.db, p.user, project)
+			continue
+		}
+		if err := dropProvisioned(ctx, p); errors.Is(err, errNotCreated) {
+			logf(ctx, "database %s and role %s on target %s were not created by autopg; keeping them", p.db, p.user, p.target)
+			continue
+		} else if err != nil {
+			logf(ctx, "drop database %s and role %s on target %s: %v", p.db, p.user, p.target, err)
+			continue
+		}
+		if err := deleteCredential(p.target, p.user); err != nil {
+			logf(ctx, "warning: could not forget the password of %s: %v", p.user, err)
+		}
+		recordHistory(historyRecord{SchemaVersion: schemaVersion, RequestID: requestID(ctx), DockerHost: host, Time: time.Now().UTC(), Target: p.target,
+			Project: project, DB: p.db, User: p.user, Status: "dropped"})
+		logf(ctx, "dropped database %s and role %s of compose project %s on target %s", p.db, p.user, project, p.target)
+	}
+	return nil
+}
+
+// errNotCreated is returned by dropProvisioned when autopg created neither the database nor the role.
+var errNotCreated = errors.New("not created by autopg")
+
+// dropProvisioned drops p's database, when autopg created it for p's role and the role still owns it,
+// then the role, when autopg created it. Others are kept, with a log line.
+func dropProvisioned(ctx context.Context, p provisioned) error {
+	dbCreated := databaseCreatedFor(p.target, p.db, p.user)
+	_, roleCreated := createdObject(p.target, "role", p.user)
+	if !dbCreated && !roleCreated {
+		return errNotCreated
+	}
+	host, port, admin, adminPass, ok := getAdminCredsForTarget(p.target)
+	if !ok {
+		return fmt.Errorf("no admin creds for target %s", p.target)
+	}
+	db, err := openAdmin(withTarget(ctx, p.target), host, port, admin, adminPass, "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var dbOwner string
+	err = db.QueryRowContext(ctx, "SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = $1", p.db).Scan(&dbOwner)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("read owner of database %s: %w", p.db, err)
+	}
+	switch {
+	case !dbCreated:
+		logf(ctx, "database %s on target %s was not created by autopg for role %s; keeping it", p.db, p.target, p.user)
+	case dbOwner != "" && dbOwner != p.user:
+		logf(ctx, "database %s on target %s is now owned by %s; keeping it", p.db, p.target, dbOwner)
+	default:
+		num, err := serverVersionNum(db)
+		if err != nil {
+			return err
+		}
+		q := "DROP DATABASE IF EXISTS " + pqQuoteIdent(p.db)
+		if num >= 130000 {
+			// the application is gone; end what is left of its sessions
+			q += " WITH (FORCE)"
+		}
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return err
+		}
+		if err := forgetCreated(p.target, "database", p.db); err != nil {
+			return err
+		}
+	}
+	if !roleCreated {
+		logf(ctx, "role %s on target %s was not created by autopg; keeping it", p.user, p.target)
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "DROP ROLE IF EXISTS "+pqQuoteIdent(p.user)); err != nil {
+		return err
+	}
+	return forgetCreated(p.target, "role", p.user)
+}
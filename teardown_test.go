@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog returns the buffer the standard logger writes to until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestDeprovisionProjectKeeps(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_MAIN_TEARDOWN", "drop")
+	t.Setenv("AUTOPG_FROZEN_TEARDOWN", "drop")
+	t.Setenv("AUTOPG_FROZEN_FREEZE", "* 00:00-00:00")
+	now := time.Now().UTC()
+	for _, rec := range []historyRecord{
+		{Target: "main", Project: "shop", DB: "shop", User: "shop", Status: "ok"},
+		{Target: "main", Project: "shop", DB: "shared", User: "shop_ro", Status: "ok"},
+		{Target: "main", Project: "blog", DB: "shared", User: "blog", Status: "ok"},
+		{Target: "main", Project: "shop", DB: "failed", User: "failed", Status: "error"},
+		{Target: "main", Project: "shop", DB: "gone", User: "gone", Status: "ok"},
+		{Target: "main", Project: "shop", DB: "gone", User: "gone", Status: "dropped"},
+		{Target: "keep", ContainerName: "shop/web-1", DB: "legacy", User: "legacy", Status: "ok"},
+		{Target: "frozen", Project: "shop", DB: "shop", User: "shop", Status: "ok"},
+		{Target: "main", DockerHost: "remote", Project: "shop", DB: "remote", User: "remote", Status: "ok"},
+	} {
+		rec.Time = now
+		recordHistory(rec)
+	}
+	if err := saveCredential(storedCredential{Target: "main", DB: "shop", User: "shop", Pass: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLog(t)
+	if err := deprovisionProject(context.Background(), "shop"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"database shop and role shop on target main were not created by autopg; keeping them",
+		"database shared or role shop_ro on target main is also used outside compose project shop; keeping them",
+		"keeping database legacy and role legacy of compose project shop on target keep",
+		"target frozen is frozen; keeping database shop and role shop of compose project shop",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, logs)
+		}
+	}
+	for _, unexpected := range []string{"failed", "gone", "remote", "dropped"} {
+		if strings.Contains(logs.String(), unexpected) {
+			t.Errorf("log mentions %q:\n%s", unexpected, logs)
+		}
+	}
+	if _, ok, _ := lookupCredential("main", "shop"); !ok {
+		t.Error("password of a kept role forgotten")
+	}
+}
+
+func TestWatchTeardown(t *testing.T) {
+	t.Setenv("AUTOPG_TEARDOWN_GRACE", "1h")
+	t.Cleanup(func() {
+		teardowns.Lock()
+		defer teardowns.Unlock()
+		for k, timer := range teardowns.timers {
+			timer.Stop()
+			delete(teardowns.timers, k)
+		}
+	})
+	ctx := context.Background()
+	watchTeardown(nil, ctx, map[string]string{"com.docker.compose.project": "shop", "autopg.main.db": "shop"})
+	watchTeardown(nil, ctx, map[string]string{"com.docker.compose.project": "shop", "autopg.main.config": `{"db":"shop"}`})
+	watchTeardown(nil, ctx, map[string]string{"com.docker.compose.project": "blog"}) // no autopg labels
+	watchTeardown(nil, ctx, map[string]string{"autopg.main.db": "solo"})             // not compose
+	teardowns.Lock()
+	defer teardowns.Unlock()
+	if len(teardowns.timers) != 1 || teardowns.timers[teardownKey{"", "shop"}] == nil {
+		t.Errorf("teardown checks %v, want one for shop", teardowns.timers)
+	}
+}
+
+func TestTeardownGrace(t *testing.T) {
+	for in, want := range map[string]time.Duration{"": time.Minute, "30s": 30 * time.Second, "0s": 0, "-1s": time.Minute, "soon": time.Minute} {
+		t.Setenv("AUTOPG_TEARDOWN_GRACE", in)
+		if got := teardownGrace(); got != want {
+			t.Errorf("teardownGrace with %q = %s, want %s", in, got, want)
+		}
+	}
+}
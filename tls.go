@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tlsParams returns the libpq TLS parameters of target: AUTOPG_<TARGET>_SSLMODE, the CA bundle and,
+// for admin connections, the client certificate _SSLCERT and _SSLKEY, each falling back to the global
+// AUTOPG_<FIELD>. The mode defaults to verify-full when a CA bundle is configured and to disable
+// otherwise; with AUTOPG_<TARGET>_REQUIRE_VERIFY_FULL=true any other mode is refused.
+func tlsParams(target string, admin bool) (string, error) {
+	ca, err := caBundle(target)
+	if err != nil {
+		return "", err
+	}
+	mode := sslMode(target)
+	if targetSetting(target, "REQUIRE_VERIFY_FULL") == "true" && mode != "verify-full" {
+		return "", fmt.Errorf("target %s requires sslmode=verify-full, configured %s", target, mode)
+	}
+	params := "sslmode=" + dsnQuote(mode)
+	if ca != "" {
+		params += " sslrootcert=" + dsnQuote(ca)
+	}
+	if admin {
+		for _, f := range []string{"SSLCERT", "SSLKEY"} {
+			if v := tlsSetting(target, f); v != "" {
+				params += " " + strings.ToLower(f) + "=" + dsnQuote(v)
+			}
+		}
+	}
+	return params, nil
+}
+
+// sslMode is the effective sslmode of target.
+func sslMode(target string) string {
+	if mode := tlsSetting(target, "SSLMODE"); mode != "" {
+		return mode
+	}
+	if tlsSetting(target, "SSLROOTCERT") != "" || targetSetting(target, "SSLROOTCERT_PEM") != "" {
+		return "verify-full"
+	}
+	return "disable"
+}
+
+// tlsSetting is the TLS setting field of target, falling back to its connection service (see pgpass.go).
+func tlsSetting(target, field string) string {
+	if v := targetSetting(target, field); v != "" {
+		return v
+	}
+	return serviceSetting(target, field)
+}
+
+// adminAuth is how autopg authenticates as the admin of target: "password" (default), "cert", a client
+// certificate (AUTOPG_<TARGET>_SSLCERT/_SSLKEY) without password, "rds-iam", an RDS IAM auth token,
+// "gcp-iam", Cloud SQL IAM database authentication, "azure-ad", a Microsoft Entra ID access token, or
+// "gss", Kerberos with a keytab (see kerberos.go).
+func adminAuth(target string) string {
+	if v := targetSetting(target, "ADMIN_AUTH"); v != "" {
+		return v
+	}
+	return "password"
+}
+
+var (
+	caBundlesMu sync.Mutex
+	caBundles   = map[string]string{}
+)
+
+// caBundle returns the CA file libpq verifies target's server with. AUTOPG_<TARGET>_SSLROOTCERT is a
+// file, or a directory whose *.pem and *.crt files are combined; AUTOPG_<TARGET>_SSLROOTCERT_PEM holds
+// PEM certificates directly. Combined bundles are written once to the data dir.
+func caBundle(target string) (string, error) {
+	root, inline := tlsSetting(target, "SSLROOTCERT"), targetSetting(target, "SSLROOTCERT_PEM")
+	if inline == "" {
+		if fi, err := os.Stat(root); root == "" || err != nil || !fi.IsDir() {
+			return root, nil // a plain file (or nothing); libpq reports problems with it
+		}
+	}
+	caBundlesMu.Lock()
+	defer caBundlesMu.Unlock()
+	if path, ok := caBundles[target]; ok {
+		return path, nil
+	}
+	var pemData bytes.Buffer
+	if root != "" {
+		files, err := filepath.Glob(filepath.Join(root, "*"))
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(files)
+		for _, f := range files {
+			if ext := filepath.Ext(f); ext != ".pem" && ext != ".crt" {
+				continue
+			}
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return "", err
+			}
+			pemData.Write(b)
+			pemData.WriteByte('\n')
+		}
+	}
+	pemData.WriteString(inline)
+	if n, err := countCerts(pemData.Bytes()); err != nil {
+		return "", fmt.Errorf("CA bundle of target %s: %w", target, err)
+	} else if n == 0 {
+		return "", fmt.Errorf("CA bundle of target %s has no certificates", target)
+	}
+	path := filepath.Join(dataDir(), "ca-"+slugify(target)+".pem")
+	if err := os.WriteFile(path, pemData.Bytes(), 0o600); err != nil {
+		return "", err
+	}
+	caBundles[target] = path
+	return path, nil
+}
+
+// countCerts validates PEM data and counts its certificates.
+func countCerts(b []byte) (int, error) {
+	n := 0
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return n, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTLSParams(t *testing.T) {
+	useDataDir(t)
+	ca := t.TempDir() + "/ca.pem"
+	tests := []struct {
+		name      string
+		env       map[string]string
+		admin     bool
+		want, err string
+	}{
+		{"nothing", nil, false, "sslmode='disable'", ""},
+		{"CA file", map[string]string{"AUTOPG_MAIN_SSLROOTCERT": ca}, false, "sslmode='verify-full' sslrootcert='" + ca + "'", ""},
+		{"global mode", map[string]string{"AUTOPG_SSLMODE": "require"}, false, "sslmode='require'", ""},
+		{"client certificate", map[string]string{"AUTOPG_MAIN_SSLMODE": "verify-ca", "AUTOPG_MAIN_SSLCERT": "/c.pem", "AUTOPG_MAIN_SSLKEY": "/k.pem"},
+			true, "sslmode='verify-ca' sslcert='/c.pem' sslkey='/k.pem'", ""},
+		{"client certificate not for apps", map[string]string{"AUTOPG_MAIN_SSLCERT": "/c.pem"}, false, "sslmode='disable'", ""},
+		{"verify-full required", map[string]string{"AUTOPG_MAIN_SSLMODE": "require", "AUTOPG_MAIN_REQUIRE_VERIFY_FULL": "true"},
+			false, "", "target main requires sslmode=verify-full, configured require"},
+		{"verify-full by default", map[string]string{"AUTOPG_MAIN_SSLROOTCERT": ca, "AUTOPG_MAIN_REQUIRE_VERIFY_FULL": "true"},
+			false, "sslmode='verify-full' sslrootcert='" + ca + "'", ""},
+	}
+	for _, tt := range tests {
+		for _, k := range []string{"AUTOPG_SSLMODE", "AUTOPG_MAIN_SSLMODE", "AUTOPG_MAIN_SSLROOTCERT", "AUTOPG_MAIN_SSLCERT",
+			"AUTOPG_MAIN_SSLKEY", "AUTOPG_MAIN_REQUIRE_VERIFY_FULL"} {
+			t.Setenv(k, tt.env[k])
+		}
+		got, err := tlsParams("main", tt.admin)
+		if got != tt.want || (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: tlsParams = %q, %v, want %q %s", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestCABundle(t *testing.T) {
+	dir := useDataDir(t)
+	t.Cleanup(func() {
+		caBundlesMu.Lock()
+		defer caBundlesMu.Unlock()
+		clear(caBundles)
+	})
+	certPEM := func(cn string) string {
+		c, _ := testCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: cn}, IsCA: true, BasicConstraintsValid: true}, nil, nil)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}))
+	}
+	cas := t.TempDir()
+	for name, content := range map[string]string{"a.pem": certPEM("a"), "b.crt": certPEM("b"), "README": "not a certificate"} {
+		if err := os.WriteFile(filepath.Join(cas, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("AUTOPG_DIR_SSLROOTCERT", cas)
+	t.Setenv("AUTOPG_DIR_SSLROOTCERT_PEM", certPEM("inline"))
+	path, err := caBundle("dir")
+	if err != nil || path != filepath.Join(dir, "ca-dir.pem") {
+		t.Fatalf("caBundle = %q, %v", path, err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := countCerts(b); n != 3 || err != nil {
+		t.Errorf("bundle has %d certificates, %v, want 3", n, err)
+	}
+
+	t.Setenv("AUTOPG_FILE_SSLROOTCERT", "/etc/ssl/rds.pem")
+	if path, err := caBundle("file"); path != "/etc/ssl/rds.pem" || err != nil {
+		t.Errorf("caBundle of a file = %q, %v", path, err)
+	}
+	t.Setenv("AUTOPG_EMPTY_SSLROOTCERT_PEM", "no certificate here")
+	if _, err := caBundle("empty"); err == nil || !strings.Contains(err.Error(), "has no certificates") {
+		t.Errorf("caBundle without certificates = %v", err)
+	}
+	t.Setenv("AUTOPG_BAD_SSLROOTCERT_PEM", "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n")
+	if _, err := caBundle("bad"); err == nil {
+		t.Error("caBundle with an invalid certificate succeeded")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	if got := adminAuth("main"); got != "password" {
+		t.Errorf("default admin auth %q", got)
+	}
+	t.Setenv("AUTOPG_MAIN_ADMIN_AUTH", "cert")
+	if got := adminAuth("main"); got != "cert" {
+		t.Errorf("admin auth %q, want cert", got)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vault client for admin credentials. The server is VAULT_ADDR (and VAULT_NAMESPACE if set); autopg
+// authenticates with VAULT_TOKEN or, when AUTOPG_VAULT_ROLE_ID and AUTOPG_VAULT_SECRET_ID are set, with
+// AppRole. Tokens are renewed before they expire and AppRole logins are redone when renewal fails.
+//
+// AUTOPG_<TARGET>_VAULT_PATH is the API path to read, e.g. "secret/data/pg/main" for a KV v2 secret or
+// "database/creds/pg-admin" for the database secrets engine. Usernames and passwords are read from the
+// keys "username" and "password", overridable with AUTOPG_<TARGET>_VAULT_USER_KEY / _VAULT_PASS_KEY.
+
+type vaultClient struct {
+	mu          sync.Mutex
+	addr        string
+	token       string
+	tokenExpiry time.Time // zero for tokens that don't expire
+	http        *http.Client
+}
+
+var vault = sync.OnceValue(func() *vaultClient {
+	return &vaultClient{
+		addr:  strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		token: os.Getenv("VAULT_TOKEN"),
+		http:  &http.Client{Timeout: 20 * time.Second},
+	}
+})
+
+// vaultResponse is the envelope of Vault API responses.
+type vaultResponse struct {
+	LeaseID       string         `json:"lease_id"`
+	LeaseDuration int            `json:"lease_duration"`
+	Renewable     bool           `json:"renewable"`
+	Data          map[string]any `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func (v *vaultClient) do(ctx context.Context, method, path, token string, body any) (*vaultResponse, error) {
+	if v.addr == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+strings.TrimLeft(path, "/"), rd)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	var out vaultResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("vault %s %s: decode response: %w", method, path, err)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("vault %s %s: %s %s", method, path, resp.Status, strings.Join(out.Errors, "; "))
+	}
+	return &out, nil
+}
+
+// authToken returns a valid token, logging in with AppRole or renewing the current token as needed.
+func (v *vaultClient) authToken(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token != "" && (v.tokenExpiry.IsZero() || time.Until(v.tokenExpiry) > time.Minute) {
+		return v.token, nil
+	}
+	if v.token != "" {
+		if resp, err := v.do(ctx, http.MethodPost, "auth/token/renew-self", v.token, nil); err == nil && resp.Auth != nil {
+			v.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration)
+			return v.token, nil
+		}
+	}
+	roleID, secretID := os.Getenv("AUTOPG_VAULT_ROLE_ID"), os.Getenv("AUTOPG_VAULT_SECRET_ID")
+	if roleID == "" || secretID == "" {
+		if v.token == "" {
+			return "", errors.New("no Vault credentials: set VAULT_TOKEN or AUTOPG_VAULT_ROLE_ID and AUTOPG_VAULT_SECRET_ID")
+		}
+		return v.token, nil
+	}
+	resp, err := v.do(ctx, http.MethodPost, "auth/approle/login", "", map[string]string{"role_id": roleID, "secret_id": secretID})
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth == nil {
+		return "", errors.New("vault approle login returned no token")
+	}
+	v.setToken(resp.Auth.ClientToken, resp.Auth.LeaseDuration)
+	return v.token, nil
+}
+
+func (v *vaultClient) setToken(token string, ttl int) {
+	registerSecret("vault token "+v.addr, token)
+	v.token = token
+	v.tokenExpiry = time.Time{}
+	if ttl > 0 {
+		v.tokenExpiry = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+}
+
+// read reads path; for KV v2 secrets the inner data is returned.
+func (v *vaultClient) read(ctx context.Context, path string) (*vaultResponse, error) {
+	token, err := v.authToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.do(ctx, http.MethodGet, path, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	if inner, ok := resp.Data["data"].(map[string]any); ok && resp.Data["metadata"] != nil {
+		resp.Data = inner
+	}
+	return resp, nil
+}
+
+// write writes body to path.
+func (v *vaultClient) write(ctx context.Context, path string, body any) error {
+	token, err := v.authToken(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = v.do(ctx, http.MethodPost, path, token, body)
+	return err
+}
+
+// renewLease extends a dynamic secret's lease, returning its new duration.
+func (v *vaultClient) renewLease(ctx context.Context, leaseID string) (time.Duration, error) {
+	token, err := v.authToken(ctx)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := v.do(ctx, http.MethodPut, "sys/leases/renew", token, map[string]string{"lease_id": leaseID})
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.LeaseDuration) * time.Second, nil
+}
+
+// vaultCred is a cached credential; refreshAt is when it is renewed or read again.
+type vaultCred struct {
+	user, pass string
+	leaseID    string
+	renewable  bool
+	refreshAt  time.Time
+}
+
+var (
+	vaultCacheMu sync.Mutex
+	vaultCache   = map[string]*vaultCred{}
+)
+
+// vaultRefresh is how long static (KV) secrets are cached before being read again.
+const vaultRefresh = 5 * time.Minute
+
+// vaultAdminCreds returns the admin credentials of target from Vault. Static secrets are re-read every
+// few minutes; leased (dynamic) ones are renewed at two thirds of their lease and read anew once they
+// can't be renewed any more.
+func vaultAdminCreds(ctx context.Context, target string) (string, string, error) {
+	path := os.Getenv(toEnvKey(target, "VAULT_PATH"))
+	if path == "" {
+		return "", "", fmt.Errorf("%s is not set", toEnvKey(target, "VAULT_PATH"))
+	}
+	vaultCacheMu.Lock()
+	defer vaultCacheMu.Unlock()
+	if c := vaultCache[target]; c != nil {
+		if time.Now().Before(c.refreshAt) {
+			return c.user, c.pass, nil
+		}
+		if c.leaseID != "" && c.renewable {
+			if d, err := vault().renewLease(ctx, c.leaseID); err == nil && d > 0 {
+				c.refreshAt = time.Now().Add(d * 2 / 3)
+				return c.user, c.pass, nil
+			}
+		}
+	}
+	resp, err := vault().read(ctx, path)
+	if err != nil {
+		return "", "", err
+	}
+	userKey, passKey := os.Getenv(toEnvKey(target, "VAULT_USER_KEY")), os.Getenv(toEnvKey(target, "VAULT_PASS_KEY"))
+	if userKey == "" {
+		userKey = "username"
+	}
+	if passKey == "" {
+		passKey = "password"
+	}
+	user, _ := resp.Data[userKey].(string)
+	pass, _ := resp.Data[passKey].(string)
+	if user == "" || pass == "" {
+		return "", "", fmt.Errorf("vault secret %s has no %q/%q keys", path, userKey, passKey)
+	}
+	c := &vaultCred{user: user, pass: pass, leaseID: resp.LeaseID, renewable: resp.Renewable, refreshAt: time.Now().Add(vaultRefresh)}
+	if resp.LeaseID != "" && resp.LeaseDuration > 0 {
+		c.refreshAt = time.Now().Add(time.Duration(resp.LeaseDuration) * time.Second * 2 / 3)
+	}
+	vaultCache[target] = c
+	return user, pass, nil
+}
+
+// vaultDBRoleName is the Vault database role issuing logins for the parent role user on target.
+func vaultDBRoleName(target, user string) string {
+	return strings.ToLower(target) + "-" + user
+}
+
+// configureVaultDBRole creates or updates the Vault database secrets engine role whose dynamic logins
+// are members of spec.User and act as it, so objects they create belong to the parent role. The
+// connection (AUTOPG_<TARGET>_VAULT_DB_CONNECTION) is configured by the operator in Vault and must allow
+// the role name; the engine is mounted at AUTOPG_<TARGET>_VAULT_DB_MOUNT (default "database").
+func configureVaultDBRole(ctx context.Context, target string, spec provisionSpec) error {
+	conn := os.Getenv(toEnvKey(target, "VAULT_DB_CONNECTION"))
+	if conn == "" {
+		return fmt.Errorf("credentials=vault needs %s", toEnvKey(target, "VAULT_DB_CONNECTION"))
+	}
+	mount := os.Getenv(toEnvKey(target, "VAULT_DB_MOUNT"))
+	if mount == "" {
+		mount = "database"
+	}
+	ttl, maxTTL := os.Getenv(toEnvKey(target, "VAULT_DB_TTL")), os.Getenv(toEnvKey(target, "VAULT_DB_MAX_TTL"))
+	if ttl == "" {
+		ttl = "1h"
+	}
+	if maxTTL == "" {
+		maxTTL = "24h"
+	}
+	parent := pqQuoteIdent(spec.User)
+	role := vaultDBRoleName(target, spec.User)
+	body := map[string]any{
+		"db_name": conn,
+		"creation_statements": []string{
+			`CREATE ROLE "{{name}}" WITH LOGIN PASSWORD '{{password}}' VALID UNTIL '{{expiration}}' IN ROLE ` + parent + ";",
+			`ALTER ROLE "{{name}}" SET role = ` + pqQuote(spec.User) + ";",
+		},
+		"revocation_statements": []string{`DROP ROLE IF EXISTS "{{name}}";`},
+		"default_ttl":           ttl,
+		"max_ttl":               maxTTL,
+	}
+	if err := vault().write(ctx, strings.Trim(mount, "/")+"/roles/"+role, body); err != nil {
+		return fmt.Errorf("configure vault role %s failed: %w", role, err)
+	}
+	logf(ctx, "vault role %s configured; apps read credentials from %s/creds/%s", role, strings.Trim(mount, "/"), role)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeVault is a Vault server answering each "METHOD path" from responses, recording the requests.
+type fakeVault struct {
+	responses map[string]string
+	requests  []string
+	tokens    []string
+	bodies    map[string]string
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v1/")
+	f.requests = append(f.requests, key)
+	f.tokens = append(f.tokens, r.Header.Get("X-Vault-Token"))
+	b, _ := io.ReadAll(r.Body)
+	if f.bodies == nil {
+		f.bodies = map[string]string{}
+	}
+	f.bodies[key] = string(b)
+	resp, ok := f.responses[key]
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		resp = `{"errors":["permission denied"]}`
+	}
+	io.WriteString(w, resp)
+}
+
+func newFakeVault(t *testing.T, responses map[string]string) (*fakeVault, *vaultClient) {
+	f := &fakeVault{responses: responses}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, &vaultClient{addr: srv.URL, http: srv.Client()}
+}
+
+func TestVaultRead(t *testing.T) {
+	_, v := newFakeVault(t, map[string]string{
+		"GET secret/data/pg/main": `{"data":{"data":{"username":"postgres","password":"kv2"},"metadata":{"version":3}}}`,
+		"GET kv/pg/main":          `{"data":{"username":"postgres","password":"kv1"}}`,
+		"GET database/creds/admin": `{"lease_id":"database/creds/admin/abc","lease_duration":3600,"renewable":true,
+			"data":{"username":"v-admin","password":"dyn"}}`,
+	})
+	v.token = "root"
+	tests := []struct {
+		path, pass, lease string
+	}{
+		{"secret/data/pg/main", "kv2", ""}, // KV v2: the secret is inside data.data
+		{"kv/pg/main", "kv1", ""},
+		{"database/creds/admin", "dyn", "database/creds/admin/abc"},
+	}
+	for _, tt := range tests {
+		resp, err := v.read(t.Context(), tt.path)
+		if err != nil {
+			t.Errorf("read %s: %v", tt.path, err)
+			continue
+		}
+		if resp.Data["password"] != tt.pass || resp.LeaseID != tt.lease {
+			t.Errorf("read %s = %+v", tt.path, resp)
+		}
+	}
+	if _, err := v.read(t.Context(), "secret/data/other"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("read of a forbidden path: %v", err)
+	}
+}
+
+func TestVaultAuthToken(t *testing.T) {
+	t.Setenv("AUTOPG_VAULT_ROLE_ID", "role")
+	t.Setenv("AUTOPG_VAULT_SECRET_ID", "secret")
+	login := `{"auth":{"client_token":"from-approle","lease_duration":3600,"renewable":true}}`
+
+	f, v := newFakeVault(t, map[string]string{"POST auth/approle/login": login})
+	if tok, err := v.authToken(t.Context()); err != nil || tok != "from-approle" {
+		t.Fatalf("authToken = %q, %v", tok, err)
+	}
+	if tok, _ := v.authToken(t.Context()); tok != "from-approle" || len(f.requests) != 1 {
+		t.Errorf("token not reused: %q after %v", tok, f.requests)
+	}
+	if !strings.Contains(f.bodies["POST auth/approle/login"], `"secret_id":"secret"`) {
+		t.Errorf("login body %s", f.bodies["POST auth/approle/login"])
+	}
+
+	// a token about to expire is renewed
+	f, v = newFakeVault(t, map[string]string{"POST auth/token/renew-self": `{"auth":{"client_token":"renewed","lease_duration":3600}}`})
+	v.token, v.tokenExpiry = "old", time.Now().Add(30*time.Second)
+	if tok, err := v.authToken(t.Context()); err != nil || tok != "renewed" || f.tokens[0] != "old" {
+		t.Errorf("authToken = %q, %v after %v", tok, err, f.requests)
+	}
+
+	// and when it can't be, AppRole logs in again
+	f, v = newFakeVault(t, map[string]string{"POST auth/approle/login": login})
+	v.token, v.tokenExpiry = "old", time.Now().Add(30*time.Second)
+	if tok, err := v.authToken(t.Context()); err != nil || tok != "from-approle" ||
+		strings.Join(f.requests, ",") != "POST auth/token/renew-self,POST auth/approle/login" {
+		t.Errorf("authToken = %q, %v after %v", tok, err, f.requests)
+	}
+}
+
+func TestVaultNoCredentials(t *testing.T) {
+	t.Setenv("AUTOPG_VAULT_ROLE_ID", "")
+	_, v := newFakeVault(t, nil)
+	if _, err := v.authToken(t.Context()); err == nil {
+		t.Error("authToken without a token nor AppRole succeeded")
+	}
+}
+
+// vault() is set up once per process, so this is the only test using it.
+func TestVaultAdminCredsAndDBRole(t *testing.T) {
+	f := &fakeVault{responses: map[string]string{
+		"GET database/creds/admin": `{"lease_id":"lease-1","lease_duration":3,"renewable":true,"data":{"user":"v-admin","pass":"dyn"}}`,
+		"PUT sys/leases/renew":     `{"lease_id":"lease-1","lease_duration":3600}`,
+		"POST db/roles/main-app":   ``,
+	}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "root")
+	t.Setenv("AUTOPG_VAULT_ROLE_ID", "")
+	t.Setenv("AUTOPG_MAIN_VAULT_PATH", "database/creds/admin")
+	t.Setenv("AUTOPG_MAIN_VAULT_USER_KEY", "user")
+	t.Setenv("AUTOPG_MAIN_VAULT_PASS_KEY", "pass")
+	t.Setenv("AUTOPG_MAIN_VAULT_DB_CONNECTION", "pg-main")
+	t.Setenv("AUTOPG_MAIN_VAULT_DB_MOUNT", "/db/")
+
+	if user, pass, err := vaultAdminCreds(t.Context(), "main"); err != nil || user != "v-admin" || pass != "dyn" {
+		t.Fatalf("vaultAdminCreds = %q, %q, %v", user, pass, err)
+	}
+	// past two thirds of its lease, the credential is renewed rather than read again
+	vaultCache["main"].refreshAt = time.Now().Add(-time.Second)
+	if _, _, err := vaultAdminCreds(t.Context(), "main"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(f.requests, ","); got != "GET database/creds/admin,PUT sys/leases/renew" {
+		t.Errorf("requests %s", got)
+	}
+	if until := time.Until(vaultCache["main"].refreshAt); until < 39*time.Minute || until > 40*time.Minute {
+		t.Errorf("renewed credential refreshed in %v, want two thirds of an hour", until)
+	}
+
+	if err := configureVaultDBRole(t.Context(), "main", provisionSpec{User: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	var role struct {
+		DBName     string   `json:"db_name"`
+		Creation   []string `json:"creation_statements"`
+		DefaultTTL string   `json:"default_ttl"`
+	}
+	if err := json.Unmarshal([]byte(f.bodies["POST db/roles/main-app"]), &role); err != nil {
+		t.Fatal(err)
+	}
+	if role.DBName != "pg-main" || role.DefaultTTL != "1h" || len(role.Creation) != 2 ||
+		!strings.HasSuffix(role.Creation[0], ` IN ROLE "app";`) || role.Creation[1] != `ALTER ROLE "{{name}}" SET role = 'app';` {
+		t.Errorf("role %+v", role)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Webhook: with AUTOPG_WEBHOOK_LISTEN (e.g. ":8444") set, autopg also accepts provisioning requests over
+// HTTPS, for CI systems creating preview databases without a container. POST /v1/provision?name=<name>
+// takes the JSON form of a spec file (target, db, user, options; see specfiles.go) and provisions it like
+// a container carrying the equivalent labels, "webhook" standing in for the compose project and name for
+// the service. Requests authenticate with a bearer token from AUTOPG_WEBHOOK_TOKENS (comma-separated,
+// usually given as AUTOPG_WEBHOOK_TOKENS_FILE); AUTOPG_WEBHOOK_TLS_CERT and AUTOPG_WEBHOOK_TLS_KEY are the
+// server's certificate and key. There is no plaintext mode.
+
+// webhookProvision is the "webhook-provision" document answered by POST /v1/provision.
+type webhookProvision struct {
+	SchemaVersion int    `json:"schema_version"`
+	RequestID     string `json:"request_id"`
+	Name          string `json:"name"`
+	Target        string `json:"target"`
+	Status        string `json:"status"` // "queued", "ok" or "error"
+	DB            string `json:"db,omitempty"`
+	User          string `json:"user,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+var webhookNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// webhookAuthorized reports whether r carries one of AUTOPG_WEBHOOK_TOKENS as bearer token.
+func webhookAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	for _, t := range splitList(os.Getenv("AUTOPG_WEBHOOK_TOKENS")) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookProvider serves the webhook.
+type webhookProvider struct {
+	addr, certFile, keyFile string
+}
+
+func newWebhookProvider() (provider, error) {
+	p := &webhookProvider{addr: os.Getenv("AUTOPG_WEBHOOK_LISTEN"),
+		certFile: os.Getenv("AUTOPG_WEBHOOK_TLS_CERT"), keyFile: os.Getenv("AUTOPG_WEBHOOK_TLS_KEY")}
+	if p.addr == "" || p.certFile == "" || p.keyFile == "" || len(splitList(os.Getenv("AUTOPG_WEBHOOK_TOKENS"))) == 0 {
+		return nil, errors.New("the webhook needs AUTOPG_WEBHOOK_LISTEN, AUTOPG_WEBHOOK_TLS_CERT, AUTOPG_WEBHOOK_TLS_KEY and AUTOPG_WEBHOOK_TOKENS")
+	}
+	return p, nil
+}
+
+// run serves the webhook until ctx is done.
+func (p *webhookProvider) run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              p.addr,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler:           webhookHandler(ctx),
+	}
+	return serveUntilDone(ctx, srv, "webhook", func() error {
+		log.Printf("webhook listening on %s", p.addr)
+		return srv.ListenAndServeTLS(p.certFile, p.keyFile)
+	})
+}
+
+// webhookHandler serves the webhook's requests, provisioning until ctx is done.
+func webhookHandler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/provision", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if !webhookNameRe.MatchString(name) {
+			http.Error(w, "name parameter required: letters, digits, '_', '.' and '-'", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if t := strings.TrimSpace(string(body)); !strings.HasPrefix(t, "{") {
+			http.Error(w, "expected a JSON object", http.StatusBadRequest)
+			return
+		}
+		f, err := parseSpecFile(body)
+		if err == nil {
+			_, err = f.resource("webhook", name)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, _, _, _, ok := getAdminCredsForTarget(f.Target); !ok {
+			http.Error(w, "no admin creds for target "+f.Target+" in this instance", http.StatusNotFound)
+			return
+		}
+		if provisioningPaused() {
+			http.Error(w, "provisioning is paused", http.StatusServiceUnavailable)
+			return
+		}
+		resp := webhookProvision{SchemaVersion: schemaVersion, RequestID: newRequestID(), Name: name, Target: f.Target, Status: "queued"}
+		rctx := withRequestID(ctx, resp.RequestID)
+		if r.URL.Query().Get("wait") != "true" {
+			go provisionWebhook(rctx, f, name)
+			writeJSON(w, http.StatusAccepted, resp)
+			return
+		}
+		resp.Status = "ok"
+		resp.DB, resp.User, err = provisionWebhook(rctx, f, name)
+		if err != nil {
+			resp.Status, resp.Error = "error", redact(err.Error())
+			writeJSON(w, http.StatusUnprocessableEntity, resp)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !webhookAuthorized(r) {
+			log.Printf("webhook: unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("webhook: %s %s from %s", r.Method, r.URL.RequestURI(), r.RemoteAddr)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// provisionWebhook provisions the webhook request f named name and returns the database and role.
+func provisionWebhook(ctx context.Context, f specFile, name string) (string, string, error) {
+	r, err := f.resource("webhook", name)
+	if err != nil {
+		return "", "", err
+	}
+	r.kind = "webhook request"
+	spec, err := provisionRequest(ctx, r)
+	return spec.DB, spec.User, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookAuthorized(t *testing.T) {
+	t.Setenv("AUTOPG_WEBHOOK_TOKENS", "ci-token, deploy-token")
+	for header, want := range map[string]bool{
+		"Bearer ci-token":     true,
+		"Bearer deploy-token": true,
+		"Bearer other":        false,
+		"Bearer ":             false,
+		"ci-token":            false,
+		"":                    false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/provision", nil)
+		r.Header.Set("Authorization", header)
+		if got := webhookAuthorized(r); got != want {
+			t.Errorf("webhookAuthorized(%q) = %v, want %v", header, got, want)
+		}
+	}
+	t.Setenv("AUTOPG_WEBHOOK_TOKENS", "")
+	r := httptest.NewRequest(http.MethodPost, "/v1/provision", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	if webhookAuthorized(r) {
+		t.Error("authorized without tokens")
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_WEBHOOK_TOKENS", "ci-token")
+	t.Setenv("AUTOPG_MAIN_HOST", "pg.invalid")
+	t.Setenv("AUTOPG_MAIN_ADMIN", "postgres")
+	t.Setenv("AUTOPG_MAIN_ADMIN_PASS", "admin")
+	h := webhookHandler(t.Context())
+	tests := []struct {
+		name, method, url, token, body string
+		status                         int
+		contains                       string
+	}{
+		{"no token", "POST", "/v1/provision?name=pr-1", "", `{"target":"main"}`, 401, "unauthorized"},
+		{"GET", "GET", "/v1/provision?name=pr-1", "ci-token", "", 405, "method not allowed"},
+		{"no name", "POST", "/v1/provision", "ci-token", `{"target":"main"}`, 400, "name parameter required"},
+		{"bad name", "POST", "/v1/provision?name=../x", "ci-token", `{"target":"main"}`, 400, "name parameter required"},
+		{"YAML", "POST", "/v1/provision?name=pr-1", "ci-token", "target: main\n", 400, "expected a JSON object"},
+		{"no target", "POST", "/v1/provision?name=pr-1", "ci-token", `{"db":"pr_1"}`, 400, "target is required"},
+		{"reserved option", "POST", "/v1/provision?name=pr-1", "ci-token", `{"target":"main","options":{"post_exec":"x"}}`, 400,
+			"options.post_exec cannot be set"},
+		{"unknown target", "POST", "/v1/provision?name=pr-1", "ci-token", `{"target":"other"}`, 404, "no admin creds for target other"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s: %d %s, want %d with %q", tt.name, w.Code, w.Body, tt.status, tt.contains)
+		}
+	}
+
+	if err := setPaused(true); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/v1/provision?name=pr-1", strings.NewReader(`{"target":"main"}`))
+	r.Header.Set("Authorization", "Bearer ci-token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("paused: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestWebhookRefusalResponse(t *testing.T) {
+	useDataDir(t)
+	t.Setenv("AUTOPG_WEBHOOK_TOKENS", "ci-token")
+	t.Setenv("AUTOPG_MAIN_HOST", "pg.invalid")
+	t.Setenv("AUTOPG_MAIN_ADMIN", "postgres")
+	t.Setenv("AUTOPG_MAIN_ADMIN_PASS", "admin")
+	t.Setenv("AUTOPG_MAIN_FORBID_PLAINTEXT_PASS", "true")
+	r := httptest.NewRequest("POST", "/v1/provision?name=pr-1&wait=true",
+		strings.NewReader(`{"target":"main","db":"pr_1","user":"pr_1","options":{"pass":"Correct-Horse-42"}}`))
+	r.Header.Set("Authorization", "Bearer ci-token")
+	w := httptest.NewRecorder()
+	webhookHandler(t.Context()).ServeHTTP(w, r)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want 422", w.Code)
+	}
+	var resp webhookProvision
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "pr-1" || resp.Target != "main" || resp.Status != "error" || resp.RequestID == "" ||
+		!strings.Contains(resp.Error, "plaintext autopg.main.pass is forbidden") || strings.Contains(resp.Error, "Correct-Horse-42") {
+		t.Errorf("response %+v", resp)
+	}
+}